@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	config "github.com/q191201771/lalmax/conf"
+	"github.com/q191201771/naza/pkg/nazalog"
+)
+
+// 鉴权方式
+const (
+	MethodSecret = "secret" // url参数token需要在配置的pub_secrets或者sub_secrets中
+	MethodSign   = "sign"   // 签名url，见 Sign
+	MethodHttp   = "http"   // 回调业务服务器，返回200表示通过
+)
+
+const (
+	ActionPub = "pub"
+	ActionSub = "sub"
+)
+
+// lalmax自己实现的协议，lal的协议走lal的鉴权流程
+const (
+	ProtocolSrt       = "SRT"
+	ProtocolWhip      = "WHIP"
+	ProtocolWhep      = "WHEP"
+	ProtocolJessibuca = "JESSIBUCA"
+	ProtocolHttpFmp4  = "HTTP-FMP4"
+	ProtocolHls       = "HLS"
+)
+
+const (
+	ParamToken = "token"
+
+	// http回调鉴权通过后缓存一段时间，避免hls每个切片请求都回调
+	httpAuthCacheDuration = 30 * time.Second
+)
+
+var (
+	ErrTokenInvalid = errors.New("lalmax.auth: token invalid")
+	ErrHttpReject   = errors.New("lalmax.auth: rejected by http callback")
+)
+
+type AuthInfo struct {
+	Protocol   string     `json:"protocol"`
+	Action     string     `json:"action"`
+	StreamName string     `json:"stream_name"`
+	RemoteAddr string     `json:"remote_addr"`
+	ClientIp   string     `json:"client_ip"`
+	Query      url.Values `json:"query"`
+}
+
+// IAuthenticator 返回nil表示鉴权通过
+type IAuthenticator interface {
+	Authenticate(info AuthInfo) error
+}
+
+// NewHttpAuthInfo 根据http请求生成鉴权信息，clientIp由调用方解析(例如经过代理时)
+func NewHttpAuthInfo(protocol, action, streamName string, r *http.Request, clientIp string) AuthInfo {
+	return AuthInfo{
+		Protocol:   protocol,
+		Action:     action,
+		StreamName: streamName,
+		RemoteAddr: r.RemoteAddr,
+		ClientIp:   clientIp,
+		Query:      r.URL.Query(),
+	}
+}
+
+// NewAuthenticator 根据配置创建鉴权器，推流和拉流可以使用不同的鉴权方式，都没有配置时返回nil
+//
+// conf需要已经通过 config.Config.SetDefaults 填充默认值
+func NewAuthenticator(conf config.AuthConfig) IAuthenticator {
+	if conf.PubMethod == "" && conf.SubMethod == "" {
+		return nil
+	}
+
+	a := &authenticator{
+		conf: conf,
+		client: &http.Client{
+			Timeout: time.Duration(conf.HttpTimeoutMs) * time.Millisecond,
+		},
+	}
+	nazalog.Infof("auth enabled, pubMethod:%s, subMethod:%s", conf.PubMethod, conf.SubMethod)
+	return a
+}
+
+type authenticator struct {
+	conf   config.AuthConfig
+	client *http.Client
+	cache  sync.Map // 缓存key -> 过期时间
+}
+
+func (a *authenticator) Authenticate(info AuthInfo) error {
+	method := a.conf.SubMethod
+	if info.Action == ActionPub {
+		method = a.conf.PubMethod
+	}
+
+	var err error
+	switch method {
+	case "":
+	case MethodSecret:
+		secrets := a.conf.SubSecrets
+		if info.Action == ActionPub {
+			secrets = a.conf.PubSecrets
+		}
+		if !contains(secrets, info.Query.Get(ParamToken)) {
+			err = ErrTokenInvalid
+		}
+	case MethodSign:
+		err = Verify(a.conf.SignSecret, info.Action, info.StreamName, info.Query, info.ClientIp)
+	case MethodHttp:
+		err = a.httpAuthenticate(info)
+	default:
+		err = fmt.Errorf("lalmax.auth: unknown method %s", method)
+	}
+
+	if err != nil {
+		nazalog.Warnf("auth failed, protocol:%s, action:%s, streamName:%s, remoteAddr:%s, err:%+v",
+			info.Protocol, info.Action, info.StreamName, info.RemoteAddr, err)
+	}
+	return err
+}
+
+func (a *authenticator) httpAuthenticate(info AuthInfo) error {
+	key := info.Protocol + "|" + info.Action + "|" + info.StreamName + "|" + info.ClientIp + "|" + info.Query.Encode()
+	if value, ok := a.cache.Load(key); ok && time.Now().Before(value.(time.Time)) {
+		return nil
+	}
+
+	body, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Post(a.conf.HttpCallback, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ErrHttpReject
+	}
+
+	a.cache.Store(key, time.Now().Add(httpAuthCacheDuration))
+	a.cleanCache()
+	return nil
+}
+
+// cleanCache 删除过期的缓存
+func (a *authenticator) cleanCache() {
+	now := time.Now()
+	a.cache.Range(func(k, v interface{}) bool {
+		if now.After(v.(time.Time)) {
+			a.cache.Delete(k)
+		}
+		return true
+	})
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
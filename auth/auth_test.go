@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	config "github.com/q191201771/lalmax/conf"
+)
+
+func TestSecretSeparatesPubAndSub(t *testing.T) {
+	a := NewAuthenticator(config.AuthConfig{
+		PubMethod:  MethodSecret,
+		SubMethod:  MethodSecret,
+		PubSecrets: []string{"pubtoken"},
+		SubSecrets: []string{"subtoken"},
+	})
+
+	testCases := []struct {
+		name   string
+		action string
+		token  string
+		ok     bool
+	}{
+		{"pub with pub token", ActionPub, "pubtoken", true},
+		{"pub with sub token", ActionPub, "subtoken", false},
+		{"sub with sub token", ActionSub, "subtoken", true},
+		{"sub with pub token", ActionSub, "pubtoken", false},
+		{"pub without token", ActionPub, "", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := a.Authenticate(AuthInfo{
+				Protocol:   ProtocolSrt,
+				Action:     tc.action,
+				StreamName: "test110",
+				Query:      url.Values{ParamToken: []string{tc.token}},
+			})
+			if (err == nil) != tc.ok {
+				t.Fatalf("expect ok:%v, got err:%v", tc.ok, err)
+			}
+		})
+	}
+}
+
+func TestSignBindsAction(t *testing.T) {
+	const secret = "lalmaxsignsecret"
+	a := NewAuthenticator(config.AuthConfig{
+		PubMethod:  MethodSign,
+		SubMethod:  MethodSign,
+		SignSecret: secret,
+	})
+	expire := time.Now().Unix() + 60
+
+	testCases := []struct {
+		name       string
+		signAction string
+		action     string
+		streamName string
+		ip         string
+		clientIp   string
+		expire     int64
+		err        error
+	}{
+		{"sub sign for sub", ActionSub, ActionSub, "test110", "", "1.2.3.4", expire, nil},
+		{"pub sign for pub", ActionPub, ActionPub, "test110", "", "1.2.3.4", expire, nil},
+		{"sub sign for pub", ActionSub, ActionPub, "test110", "", "1.2.3.4", expire, ErrSignInvalid},
+		{"pub sign for sub", ActionPub, ActionSub, "test110", "", "1.2.3.4", expire, ErrSignInvalid},
+		{"other stream", ActionSub, ActionSub, "test111", "", "1.2.3.4", expire, ErrSignInvalid},
+		{"ip bound", ActionSub, ActionSub, "test110", "1.2.3.4", "1.2.3.4", expire, nil},
+		{"ip mismatch", ActionSub, ActionSub, "test110", "1.2.3.4", "5.6.7.8", expire, ErrSignIpMismatch},
+		{"expired", ActionSub, ActionSub, "test110", "", "1.2.3.4", time.Now().Unix() - 1, ErrSignExpired},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query := SignQuery(secret, tc.signAction, "test110", tc.expire, tc.ip)
+			err := a.Authenticate(AuthInfo{
+				Protocol:   ProtocolWhip,
+				Action:     tc.action,
+				StreamName: tc.streamName,
+				ClientIp:   tc.clientIp,
+				Query:      query,
+			})
+			if err != tc.err {
+				t.Fatalf("expect err:%v, got:%v", tc.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// 签名url的参数名，格式为 ?expire={过期时间戳}&sign={签名}[&ip={客户端ip}]
+const (
+	ParamExpire = "expire"
+	ParamSign   = "sign"
+	ParamIp     = "ip"
+)
+
+var (
+	ErrSignMissing    = errors.New("lalmax.auth: sign missing")
+	ErrSignExpired    = errors.New("lalmax.auth: sign expired")
+	ErrSignIpMismatch = errors.New("lalmax.auth: client ip mismatch")
+	ErrSignInvalid    = errors.New("lalmax.auth: sign invalid")
+)
+
+// Sign 计算签名，sign = hex(hmac_sha256(secret, "{action}:{streamName}:{expire}:{ip}"))，ip为空时不绑定客户端
+//
+// action为 ActionPub 或者 ActionSub，拉流的签名不能用于推流
+func Sign(secret, action, streamName string, expire int64, ip string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(action + ":" + streamName + ":" + strconv.FormatInt(expire, 10) + ":" + ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignQuery 生成签名url参数
+func SignQuery(secret, action, streamName string, expire int64, ip string) url.Values {
+	query := url.Values{}
+	query.Set(ParamExpire, strconv.FormatInt(expire, 10))
+	if ip != "" {
+		query.Set(ParamIp, ip)
+	}
+	query.Set(ParamSign, Sign(secret, action, streamName, expire, ip))
+	return query
+}
+
+// Verify 校验url参数中的签名
+func Verify(secret, action, streamName string, query url.Values, clientIp string) error {
+	sign := query.Get(ParamSign)
+	expire, err := strconv.ParseInt(query.Get(ParamExpire), 10, 64)
+	if sign == "" || err != nil {
+		return ErrSignMissing
+	}
+	if time.Now().Unix() > expire {
+		return ErrSignExpired
+	}
+	ip := query.Get(ParamIp)
+	if ip != "" && ip != clientIp {
+		return ErrSignIpMismatch
+	}
+	if !hmac.Equal([]byte(sign), []byte(Sign(secret, action, streamName, expire, ip))) {
+		return ErrSignInvalid
+	}
+	return nil
+}
+
+// Resign 使用同样的过期时间和客户端ip为另一路流重新签名，其他参数保持不变，用于ABR主播放列表中的各个码率
+func Resign(secret, action, streamName string, query url.Values) url.Values {
+	out := url.Values{}
+	for k, v := range query {
+		out[k] = append([]string(nil), v...)
+	}
+	if expire, err := strconv.ParseInt(query.Get(ParamExpire), 10, 64); err == nil {
+		out.Set(ParamSign, Sign(secret, action, streamName, expire, query.Get(ParamIp)))
+	}
+	return out
+}
@@ -1,8 +1,11 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"os"
 )
 
 var defaultConfig Config
@@ -20,11 +23,18 @@ type Config struct {
 	LalSvrConfigPath string           `json:"lal_config_path"` // lal配置目录
 	HookConfig       HookConfig       `json:"hook_config"`     // gop cache配置
 	RoomConfig       RoomConfig       `json:"room_config"`     // room配置
+	AuthConfig       AuthConfig       `json:"auth_config"`     // lalmax协议推拉流鉴权配置
+	MetricsConfig    MetricsConfig    `json:"metrics_config"`  // prometheus指标配置
+
+	ShutdownTimeoutSec int `json:"shutdown_timeout_sec"` // 收到SIGINT/SIGTERM后等待各个模块关闭的最长时间,默认15s
 }
 
 type SrtConfig struct {
-	Enable bool   `json:"enable"` // srt服务使能配置
-	Addr   string `json:"addr"`   // srt服务监听地址
+	Enable      bool   `json:"enable"`       // srt服务使能配置
+	Addr        string `json:"addr"`         // srt服务监听地址
+	Latency     int    `json:"latency"`      // 延迟,单位毫秒,默认300ms
+	RecvLatency int    `json:"recv_latency"` // 接收端延迟,单位毫秒,默认和latency相同
+	PeerLatency int    `json:"peer_latency"` // 对端延迟,单位毫秒,默认和latency相同
 }
 
 type RtcConfig struct {
@@ -42,12 +52,13 @@ type HttpConfig struct {
 	HttpsCertFile     string            `json:"https_cert_file"`   // https cert 文件
 	HttpsKeyFile      string            `json:"https_key_file"`    // https key 文件
 	CtrlAuthWhitelist CtrlAuthWhitelist `json:"ctrl_auth_whitelist"`
+	TrustedProxies    []string          `json:"trusted_proxies"` // 信任的反向代理ip或者网段，只有来自这些地址的请求才使用X-Forwarded-For作为客户端ip，默认不信任
 }
 
 // CtrlAuthWhitelist 控制类接口鉴权
 type CtrlAuthWhitelist struct {
-	IPs     []string // 允许访问的远程 IP，零值时不生效
-	Secrets []string // 认证信息，零值时不生效
+	IPs     []string `json:"ips"`     // 允许访问的远程 IP，零值时不生效
+	Secrets []string `json:"secrets"` // 认证信息，零值时不生效
 }
 
 type HttpFmp4Config struct {
@@ -60,20 +71,100 @@ type HlsConfig struct {
 	SegmentDuration int  `json:"segment_duration"` // hls分片时长,默认1s
 	PartDuration    int  `json:"part_duration"`    // llhls part时长,默认200ms
 	LowLatency      bool `json:"low_latency"`      // 是否开启llhls
+	EnableTs        bool `json:"enable_ts"`        // 是否开启mpegts封装的hls,通过 /live/hls-ts/ 拉流
+
+	AbrGroups    map[string][]string `json:"abr_groups"`     // ABR分组，分组名对应多个码率的流名
+	AbrAutoGroup bool                `json:"abr_auto_group"` // 是否按照 {分组名}_{后缀} 的命名约定自动分组
+
+	Dvr HlsDvrConfig `json:"dvr"` // DVR回看配置
+
+	ViewerTimeoutSec int `json:"viewer_timeout_sec"` // 观看者超过该时长没有请求则认为观看结束,默认30s
+
+	OnDemand       bool `json:"on_demand"`        // 按需模式,第一次请求时才创建muxer
+	IdleTimeoutSec int  `json:"idle_timeout_sec"` // 按需模式下超过该时长没有请求则销毁muxer,默认60s
+}
+
+type HlsDvrConfig struct {
+	Enable          bool   `json:"enable"`           // DVR使能标志
+	Dir             string `json:"dir"`              // 切片存放目录,默认./dvr
+	WindowMinutes   int    `json:"window_minutes"`   // 回看窗口时长,单位分钟,默认10分钟
+	SegmentDuration int    `json:"segment_duration"` // 切片时长,单位秒,默认4s
 }
 
 type GB28181Config struct {
-	Enable            bool               `json:"enable"`             // gb28181使能标志
-	ListenAddr        string             `json:"listen_addr"`        // gb28181监听地址
-	SipIP             string             `json:"sip_ip"`             // sip 服务器公网IP
-	SipPort           uint16             `json:"sip_port"`           // sip 服务器端口，默认 5060
-	Serial            string             `json:"serial"`             // sip 服务器 id, 默认 34020000002000000001
-	Realm             string             `json:"realm"`              // sip 服务器域，默认 3402000000
-	Username          string             `json:"username"`           // sip 服务器账号
-	Password          string             `json:"password"`           // sip 服务器密码
-	KeepaliveInterval int                `json:"keepalive_interval"` // 心跳包时长
-	QuickLogin        bool               `json:"quick_login"`        // 快速登陆,有keepalive就认为在线
-	MediaConfig       GB28181MediaConfig `json:"media_config"`       // 媒体服务器配置
+	Enable            bool                   `json:"enable"`             // gb28181使能标志
+	ListenAddr        string                 `json:"listen_addr"`        // gb28181监听地址
+	SipIP             string                 `json:"sip_ip"`             // sip 服务器公网IP
+	SipPort           uint16                 `json:"sip_port"`           // sip 服务器端口，默认 5060
+	Serial            string                 `json:"serial"`             // sip 服务器 id, 默认 34020000002000000001
+	Realm             string                 `json:"realm"`              // sip 服务器域，默认 3402000000
+	Username          string                 `json:"username"`           // sip 服务器账号
+	Password          string                 `json:"password"`           // sip 服务器密码
+	KeepaliveInterval int                    `json:"keepalive_interval"` // 心跳包时长
+	QuickLogin        bool                   `json:"quick_login"`        // 快速登陆,有keepalive就认为在线
+	MediaConfig       GB28181MediaConfig     `json:"media_config"`       // 媒体服务器配置
+	DownloadDir       string                 `json:"download_dir"`       // 录像下载文件保存目录，默认 ./download
+	DownloadSpeed     int                    `json:"download_speed"`     // 录像下载倍速，默认 4
+	Cascades          []GB28181CascadeConfig `json:"cascades"`           // 级联的上级平台
+	Store             GB28181StoreConfig     `json:"store"`              // 设备和通道持久化
+	Register          GB28181RegisterConfig  `json:"register"`           // 设备注册的鉴权和准入策略
+	Alarm             GB28181AlarmConfig     `json:"alarm"`              // 设备报警
+	Subscribe         GB28181SubscribeConfig `json:"subscribe"`          // 目录和移动位置订阅
+}
+
+// GB28181SubscribeConfig 目录和移动位置订阅，订阅到期前自动刷新，设备离线时取消订阅，恢复上线后重新订阅
+type GB28181SubscribeConfig struct {
+	Catalog             bool `json:"catalog"`               // 设备注册后是否自动订阅目录
+	CatalogExpires      int  `json:"catalog_expires"`       // 目录订阅有效期，单位秒，默认 3600
+	Position            bool `json:"position"`              // 设备注册后是否自动订阅移动位置
+	PositionExpires     int  `json:"position_expires"`      // 移动位置订阅有效期，单位秒，默认 3600
+	PositionInterval    int  `json:"position_interval"`     // 设备上报移动位置的间隔，单位秒，默认 5
+	PositionHistorySize int  `json:"position_history_size"` // 每个通道在内存中保存的历史位置条数，默认 1000
+}
+
+// GB28181AlarmConfig 设备报警的订阅和历史记录
+type GB28181AlarmConfig struct {
+	Subscribe   bool `json:"subscribe"`    // 设备注册后是否自动订阅报警
+	Expires     int  `json:"expires"`      // 报警订阅有效期，单位秒，默认 3600，到期前自动刷新
+	HistorySize int  `json:"history_size"` // 内存中保存的报警条数，默认 1000
+}
+
+// GB28181RegisterConfig 设备注册的鉴权和准入策略
+// 设备密码的优先级为 passwords > password_callback > password，都没有配置时不鉴权
+type GB28181RegisterConfig struct {
+	Expires           int               `json:"expires"`             // 注册有效期，单位秒，默认 3600，设备请求的有效期更短时使用设备的
+	Passwords         map[string]string `json:"passwords"`           // 每个设备单独的密码，key为设备id
+	PasswordCallback  string            `json:"password_callback"`   // 通过http回调获取设备密码
+	CallbackTimeoutMs int               `json:"callback_timeout_ms"` // http回调超时时间，默认 3000ms
+	AllowPrefixes     []string          `json:"allow_prefixes"`      // 允许注册的设备id前缀，为空时不限制
+	DenyPrefixes      []string          `json:"deny_prefixes"`       // 禁止注册的设备id前缀
+	AllowCivilCodes   []string          `json:"allow_civil_codes"`   // 允许注册的行政区划(设备id前2/4/6/8位)，为空时不限制
+	DenyCivilCodes    []string          `json:"deny_civil_codes"`    // 禁止注册的行政区划
+	MaxAuthFailures   int               `json:"max_auth_failures"`   // 连续鉴权失败多少次后封禁，默认 3
+	BanSec            int               `json:"ban_sec"`             // 封禁时长，单位秒，默认 600
+}
+
+// GB28181StoreConfig 设备和通道的持久化，重启后恢复设备列表
+type GB28181StoreConfig struct {
+	Enable          bool   `json:"enable"`            // 是否持久化设备和通道
+	Path            string `json:"path"`              // 保存的文件路径，默认 ./gb28181_devices.json
+	SaveIntervalSec int    `json:"save_interval_sec"` // 检查变化并保存的间隔，单位秒，默认 10
+}
+
+// GB28181CascadeConfig 向上级平台注册，作为上级平台的下级节点
+type GB28181CascadeConfig struct {
+	Enable            bool   `json:"enable"`             // 是否启用该上级平台
+	ServerId          string `json:"server_id"`          // 上级平台sip id
+	ServerRealm       string `json:"server_realm"`       // 上级平台sip域，默认为server_id前10位
+	ServerIp          string `json:"server_ip"`          // 上级平台sip地址
+	ServerPort        uint16 `json:"server_port"`        // 上级平台sip端口，默认 5060
+	Transport         string `json:"transport"`          // 信令传输方式 udp/tcp，默认 udp
+	LocalId           string `json:"local_id"`           // 本平台在上级平台中的id，默认使用serial
+	Username          string `json:"username"`           // 注册账号，默认使用local_id
+	Password          string `json:"password"`           // 注册密码
+	RegisterExpires   int    `json:"register_expires"`   // 注册有效期，单位秒，默认 3600
+	KeepaliveInterval int    `json:"keepalive_interval"` // 心跳间隔，单位秒，默认 60
+	ShareStreams      bool   `json:"share_streams"`      // 是否把lal中的流作为虚拟通道共享给上级平台
 }
 
 type GB28181MediaConfig struct {
@@ -99,11 +190,39 @@ type HttpNotifyConfig struct {
 	OnRelayPullStop   string `json:"on_relay_pull_stop"`
 	OnRtmpConnect     string `json:"on_rtmp_connect"`
 	OnHlsMakeTs       string `json:"on_hls_make_ts"`
+	OnGbAlarm         string `json:"on_gb_alarm"` // 国标设备报警
+
+	MaxRetries        int    `json:"max_retries"`         // 回调失败后的重试次数,默认3次,小于0时不重试
+	RetryIntervalMs   int    `json:"retry_interval_ms"`   // 第一次重试的间隔,之后每次翻倍,默认1000ms
+	SpoolDir          string `json:"spool_dir"`           // 未发送成功的事件落盘目录,重启后继续发送,为空时不落盘
+	SignSecret        string `json:"sign_secret"`         // 请求头X-Lalmax-Signature的hmac签名秘钥,为空时不签名
+	ConcurrencyPerUrl int    `json:"concurrency_per_url"` // 每个回调地址的并发数,默认1,为1时同一个地址的事件按顺序发送
+
+	SyncEvents     []string `json:"sync_events"`      // 同步回调的事件: on_pub_start、on_sub_start、on_rtmp_connect,返回非2xx或者{"allow": false}时拒绝
+	SyncTimeoutMs  int      `json:"sync_timeout_ms"`  // 同步回调超时时间,默认3000ms
+	SyncFailPolicy string   `json:"sync_fail_policy"` // 同步回调失败或者超时时的策略: open允许、closed拒绝,默认open
 }
 
 type HookConfig struct {
-	GopCacheNum          int `json:"gop_cache_num"`
-	SingleGopMaxFrameNum int `json:"single_gop_max_frame_num"`
+	GopCacheNum          int    `json:"gop_cache_num"`
+	SingleGopMaxFrameNum int    `json:"single_gop_max_frame_num"`
+	RepublishPolicy      string `json:"republish_policy"` // srt、whip同名流重复推流的处理策略: reject、kick_old、takeover
+}
+
+// AuthConfig srt、whip、whep、jessibuca、http-fmp4、hls的推拉流鉴权，鉴权方式为空时不鉴权
+type AuthConfig struct {
+	PubMethod     string   `json:"pub_method"`      // 推流鉴权方式: secret、sign、http
+	SubMethod     string   `json:"sub_method"`      // 拉流鉴权方式: secret、sign、http
+	PubSecrets    []string `json:"pub_secrets"`     // secret方式下推流时url参数token允许的值
+	SubSecrets    []string `json:"sub_secrets"`     // secret方式下拉流时url参数token允许的值
+	SignSecret    string   `json:"sign_secret"`     // sign方式下的hmac签名秘钥,签名中包含推拉流动作
+	HttpCallback  string   `json:"http_callback"`   // http方式下的回调地址
+	HttpTimeoutMs int      `json:"http_timeout_ms"` // http回调超时时间,默认3000ms
+}
+
+// MetricsConfig 开启后通过 /metrics 提供prometheus指标，鉴权和 /api/stat 相同，使用 ctrl_auth_whitelist
+type MetricsConfig struct {
+	Enable bool `json:"enable"` // prometheus指标使能标志
 }
 
 type RoomConfig struct {
@@ -112,17 +231,48 @@ type RoomConfig struct {
 	APISecret string `json:"api_secret"` // livekit api secret
 }
 
+var configPath string
+
+// Open 加载配置文件，之后可以通过 Reload 重新加载同一个文件
 func Open(filepath string) error {
-	data, err := ioutil.ReadFile(filepath)
+	conf, err := Load(filepath)
 	if err != nil {
 		return err
 	}
+	configPath = filepath
+	defaultConfig = *conf
+	return nil
+}
 
-	err = json.Unmarshal(data, &defaultConfig)
+// Load 读取配置文件，未知的字段会报错，然后使用环境变量覆盖、填充默认值并检查配置
+func Load(filepath string) (*Config, error) {
+	data, err := os.ReadFile(filepath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+
+	var conf Config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&conf); err != nil {
+		return nil, fmt.Errorf("parse %s failed: %w", filepath, err)
+	}
+	if err = conf.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	conf.SetDefaults()
+	if err = conf.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s:\n%w", filepath, err)
+	}
+	return &conf, nil
+}
+
+// Reload 重新加载 Open 打开的配置文件，返回新的配置，不会修改 GetConfig 返回的配置
+func Reload() (*Config, error) {
+	if configPath == "" {
+		return nil, errors.New("config file not opened")
+	}
+	return Load(configPath)
 }
 
 func GetConfig() *Config {
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func validConfig() Config {
+	var c Config
+	c.SetDefaults()
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(c *Config)
+		errs   []string // 期望错误信息中包含的配置项，为空表示合法
+	}{
+		{"defaults", func(c *Config) {}, nil},
+		{"invalid listen addr", func(c *Config) { c.HttpConfig.ListenAddr = "1290" }, []string{"http_config.http_listen_addr"}},
+		{"invalid trusted proxy", func(c *Config) { c.HttpConfig.TrustedProxies = []string{"10.0.0.0/8", "proxy"} }, []string{"http_config.trusted_proxies"}},
+		{"negative hls timeout", func(c *Config) { c.HlsConfig.ViewerTimeoutSec = -1 }, []string{"hls_config.viewer_timeout_sec"}},
+		{"invalid republish policy", func(c *Config) { c.HookConfig.RepublishPolicy = "replace" }, []string{"hook_config.republish_policy"}},
+		{"secret without secrets", func(c *Config) {
+			c.AuthConfig.PubMethod = "secret"
+			c.AuthConfig.SubMethod = "secret"
+			c.AuthConfig.SubSecrets = []string{"subtoken"}
+		}, []string{"auth_config.pub_method"}},
+		{"sign without secret", func(c *Config) { c.AuthConfig.SubMethod = "sign" }, []string{"auth_config.sub_method"}},
+		{"multiple errors", func(c *Config) {
+			c.SrtConfig.Latency = -1
+			c.ShutdownTimeoutSec = -1
+		}, []string{"srt_config.latency", "shutdown_timeout_sec"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := validConfig()
+			tc.modify(&c)
+			err := c.Validate()
+			if len(tc.errs) == 0 {
+				if err != nil {
+					t.Fatalf("expect valid, got:%v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expect errors %v, got nil", tc.errs)
+			}
+			for _, name := range tc.errs {
+				if !strings.Contains(err.Error(), name+":") {
+					t.Fatalf("expect error of %s, got:%v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"LALMAX_SERVER_ID":                                 "2",
+		"LALMAX_HTTP_CONFIG__HTTP_LISTEN_ADDR":             ":8080",
+		"LALMAX_HTTP_CONFIG__CTRL_AUTH_WHITELIST__SECRETS": "token1, token2,",
+		"LALMAX_HLS_CONFIG__ENABLE":                        "true",
+		"LALMAX_HLS_CONFIG__DVR__WINDOW_MINUTES":           "30",
+		"LALMAX_GB28181_CONFIG__SIP_PORT":                  "5061",
+	}
+	var c Config
+	err := c.applyEnv(func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.ServerId != "2" {
+		t.Fatalf("server_id:%s", c.ServerId)
+	}
+	if c.HttpConfig.ListenAddr != ":8080" {
+		t.Fatalf("http_listen_addr:%s", c.HttpConfig.ListenAddr)
+	}
+	if secrets := c.HttpConfig.CtrlAuthWhitelist.Secrets; !reflect.DeepEqual(secrets, []string{"token1", "token2"}) {
+		t.Fatalf("secrets:%v", secrets)
+	}
+	if !c.HlsConfig.Enable || c.HlsConfig.Dvr.WindowMinutes != 30 {
+		t.Fatalf("hls_config:%+v", c.HlsConfig)
+	}
+	if c.GB28181Config.SipPort != 5061 {
+		t.Fatalf("sip_port:%d", c.GB28181Config.SipPort)
+	}
+}
+
+func TestApplyEnvError(t *testing.T) {
+	testCases := []struct {
+		name  string
+		key   string
+		value string
+	}{
+		{"invalid bool", "LALMAX_HLS_CONFIG__ENABLE", "yes please"},
+		{"invalid int", "LALMAX_SRT_CONFIG__LATENCY", "300ms"},
+		{"uint overflow", "LALMAX_GB28181_CONFIG__SIP_PORT", "70000"},
+		{"map unsupported", "LALMAX_HLS_CONFIG__ABR_GROUPS", "live=a,b"},
+		{"struct slice unsupported", "LALMAX_GB28181_CONFIG__CASCADES", "x"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var c Config
+			err := c.applyEnv(func(name string) (string, bool) {
+				if name == tc.key {
+					return tc.value, true
+				}
+				return "", false
+			})
+			if err == nil || !strings.Contains(err.Error(), tc.key) {
+				t.Fatalf("expect error of %s, got:%v", tc.key, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package config
+
+// 配置的默认值，配置文件中没有设置或者设置为0时使用
+const (
+	DefaultHttpListenAddr = ":1290"
+
+	DefaultSrtAddr          = ":6001"
+	DefaultSrtLatencyMs     = 300
+	DefaultRtcWriteChanSize = 1024
+
+	DefaultHlsSegmentDuration    = 1   // 秒
+	DefaultHlsPartDuration       = 200 // 毫秒
+	DefaultHlsViewerTimeoutSec   = 30
+	DefaultHlsIdleTimeoutSec     = 60
+	DefaultHlsDvrDir             = "./dvr"
+	DefaultHlsDvrWindowMinutes   = 10
+	DefaultHlsDvrSegmentDuration = 4 // 秒
+
+	DefaultGB28181ListenAddr            = "0.0.0.0"
+	DefaultGB28181SipPort               = 5060
+	DefaultGB28181Serial                = "34020000002000000001"
+	DefaultGB28181Realm                 = "3402000000"
+	DefaultGB28181KeepaliveInterval     = 60
+	DefaultGB28181MediaIp               = "0.0.0.0"
+	DefaultGB28181MediaListenPort       = 30000
+	DefaultGB28181MultiPortMaxIncrement = 3000
+	DefaultGB28181DownloadDir           = "./download"
+	DefaultGB28181DownloadSpeed         = 4
+	DefaultGB28181CascadeTransport      = "udp"
+	DefaultGB28181CascadeExpires        = 3600
+	DefaultGB28181StorePath             = "./gb28181_devices.json"
+	DefaultGB28181StoreSaveInterval     = 10
+	DefaultGB28181RegisterExpires       = 3600
+	DefaultGB28181CallbackTimeoutMs     = 3000
+	DefaultGB28181MaxAuthFailures       = 3
+	DefaultGB28181BanSec                = 600
+	DefaultGB28181AlarmExpires          = 3600
+	DefaultGB28181AlarmHistorySize      = 1000
+	DefaultGB28181SubscribeExpires      = 3600
+	DefaultGB28181PositionInterval      = 5
+	DefaultGB28181PositionHistorySize   = 1000
+
+	DefaultRepublishPolicy = "reject"
+
+	DefaultAuthHttpTimeoutMs = 3000
+
+	DefaultNotifyMaxRetries      = 3
+	DefaultNotifyRetryIntervalMs = 1000
+	DefaultNotifyConcurrency     = 1
+	DefaultNotifySyncTimeoutMs   = 3000
+	DefaultNotifySyncFailPolicy  = "open"
+
+	DefaultShutdownTimeoutSec = 15
+)
+
+// SetDefaults 填充没有设置的配置项
+func (c *Config) SetDefaults() {
+	if c.HttpConfig.ListenAddr == "" {
+		c.HttpConfig.ListenAddr = DefaultHttpListenAddr
+	}
+
+	if c.SrtConfig.Addr == "" {
+		c.SrtConfig.Addr = DefaultSrtAddr
+	}
+	if c.SrtConfig.Latency == 0 {
+		c.SrtConfig.Latency = DefaultSrtLatencyMs
+	}
+	if c.SrtConfig.RecvLatency == 0 {
+		c.SrtConfig.RecvLatency = c.SrtConfig.Latency
+	}
+	if c.SrtConfig.PeerLatency == 0 {
+		c.SrtConfig.PeerLatency = c.SrtConfig.Latency
+	}
+
+	if c.RtcConfig.WriteChanSize == 0 {
+		c.RtcConfig.WriteChanSize = DefaultRtcWriteChanSize
+	}
+
+	hls := &c.HlsConfig
+	if hls.SegmentDuration == 0 {
+		hls.SegmentDuration = DefaultHlsSegmentDuration
+	}
+	if hls.PartDuration == 0 {
+		hls.PartDuration = DefaultHlsPartDuration
+	}
+	if hls.ViewerTimeoutSec == 0 {
+		hls.ViewerTimeoutSec = DefaultHlsViewerTimeoutSec
+	}
+	if hls.IdleTimeoutSec == 0 {
+		hls.IdleTimeoutSec = DefaultHlsIdleTimeoutSec
+	}
+	if hls.Dvr.Dir == "" {
+		hls.Dvr.Dir = DefaultHlsDvrDir
+	}
+	if hls.Dvr.WindowMinutes == 0 {
+		hls.Dvr.WindowMinutes = DefaultHlsDvrWindowMinutes
+	}
+	if hls.Dvr.SegmentDuration == 0 {
+		hls.Dvr.SegmentDuration = DefaultHlsDvrSegmentDuration
+	}
+
+	gb := &c.GB28181Config
+	if gb.ListenAddr == "" {
+		gb.ListenAddr = DefaultGB28181ListenAddr
+	}
+	if gb.SipPort == 0 {
+		gb.SipPort = DefaultGB28181SipPort
+	}
+	if gb.Serial == "" {
+		gb.Serial = DefaultGB28181Serial
+	}
+	if gb.Realm == "" {
+		gb.Realm = DefaultGB28181Realm
+	}
+	if gb.KeepaliveInterval == 0 {
+		gb.KeepaliveInterval = DefaultGB28181KeepaliveInterval
+	}
+	if gb.MediaConfig.MediaIp == "" {
+		gb.MediaConfig.MediaIp = DefaultGB28181MediaIp
+	}
+	if gb.MediaConfig.ListenPort == 0 {
+		gb.MediaConfig.ListenPort = DefaultGB28181MediaListenPort
+	}
+	if gb.MediaConfig.MultiPortMaxIncrement == 0 {
+		gb.MediaConfig.MultiPortMaxIncrement = DefaultGB28181MultiPortMaxIncrement
+	}
+	if gb.DownloadDir == "" {
+		gb.DownloadDir = DefaultGB28181DownloadDir
+	}
+	if gb.DownloadSpeed == 0 {
+		gb.DownloadSpeed = DefaultGB28181DownloadSpeed
+	}
+	if gb.Store.Path == "" {
+		gb.Store.Path = DefaultGB28181StorePath
+	}
+	if gb.Store.SaveIntervalSec == 0 {
+		gb.Store.SaveIntervalSec = DefaultGB28181StoreSaveInterval
+	}
+	gb.Register.SetDefaults()
+	gb.Alarm.SetDefaults()
+	gb.Subscribe.SetDefaults()
+	for i := range gb.Cascades {
+		gb.Cascades[i].SetDefaults(gb)
+	}
+
+	if c.HookConfig.RepublishPolicy == "" {
+		c.HookConfig.RepublishPolicy = DefaultRepublishPolicy
+	}
+
+	if c.AuthConfig.HttpTimeoutMs == 0 {
+		c.AuthConfig.HttpTimeoutMs = DefaultAuthHttpTimeoutMs
+	}
+
+	notify := &c.HttpNotifyConfig
+	if notify.MaxRetries == 0 {
+		notify.MaxRetries = DefaultNotifyMaxRetries
+	}
+	if notify.RetryIntervalMs == 0 {
+		notify.RetryIntervalMs = DefaultNotifyRetryIntervalMs
+	}
+	if notify.ConcurrencyPerUrl == 0 {
+		notify.ConcurrencyPerUrl = DefaultNotifyConcurrency
+	}
+	if notify.SyncTimeoutMs == 0 {
+		notify.SyncTimeoutMs = DefaultNotifySyncTimeoutMs
+	}
+	if notify.SyncFailPolicy == "" {
+		notify.SyncFailPolicy = DefaultNotifySyncFailPolicy
+	}
+
+	if c.ShutdownTimeoutSec == 0 {
+		c.ShutdownTimeoutSec = DefaultShutdownTimeoutSec
+	}
+}
+
+// SetDefaults 填充级联配置的默认值，本平台id默认使用gb28181的serial
+func (c *GB28181CascadeConfig) SetDefaults(gb *GB28181Config) {
+	if c.ServerRealm == "" && len(c.ServerId) >= 10 {
+		c.ServerRealm = c.ServerId[:10]
+	}
+	if c.ServerPort == 0 {
+		c.ServerPort = DefaultGB28181SipPort
+	}
+	if c.Transport == "" {
+		c.Transport = DefaultGB28181CascadeTransport
+	}
+	if c.LocalId == "" {
+		c.LocalId = gb.Serial
+	}
+	if c.Username == "" {
+		c.Username = c.LocalId
+	}
+	if c.RegisterExpires == 0 {
+		c.RegisterExpires = DefaultGB28181CascadeExpires
+	}
+	if c.KeepaliveInterval == 0 {
+		c.KeepaliveInterval = DefaultGB28181KeepaliveInterval
+	}
+}
+
+// SetDefaults 设置注册策略的默认值
+func (r *GB28181RegisterConfig) SetDefaults() {
+	if r.Expires == 0 {
+		r.Expires = DefaultGB28181RegisterExpires
+	}
+	if r.CallbackTimeoutMs == 0 {
+		r.CallbackTimeoutMs = DefaultGB28181CallbackTimeoutMs
+	}
+	if r.MaxAuthFailures == 0 {
+		r.MaxAuthFailures = DefaultGB28181MaxAuthFailures
+	}
+	if r.BanSec == 0 {
+		r.BanSec = DefaultGB28181BanSec
+	}
+}
+
+// SetDefaults 设置报警配置的默认值
+func (a *GB28181AlarmConfig) SetDefaults() {
+	if a.Expires == 0 {
+		a.Expires = DefaultGB28181AlarmExpires
+	}
+	if a.HistorySize == 0 {
+		a.HistorySize = DefaultGB28181AlarmHistorySize
+	}
+}
+
+// SetDefaults 设置目录和移动位置订阅的默认值
+func (c *GB28181SubscribeConfig) SetDefaults() {
+	if c.CatalogExpires == 0 {
+		c.CatalogExpires = DefaultGB28181SubscribeExpires
+	}
+	if c.PositionExpires == 0 {
+		c.PositionExpires = DefaultGB28181SubscribeExpires
+	}
+	if c.PositionInterval == 0 {
+		c.PositionInterval = DefaultGB28181PositionInterval
+	}
+	if c.PositionHistorySize == 0 {
+		c.PositionHistorySize = DefaultGB28181PositionHistorySize
+	}
+}
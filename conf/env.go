@@ -0,0 +1,91 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix 环境变量覆盖配置文件，变量名为 LALMAX_ 加上json字段路径，层级之间用两个下划线分隔，例如:
+//
+//	LALMAX_HTTP_NOTIFY__ON_PUB_START=http://127.0.0.1:10101/on_pub_start
+//	LALMAX_HTTP_CONFIG__CTRL_AUTH_WHITELIST__SECRETS=token1,token2
+//
+// 支持string、bool、整数和string数组(逗号分隔)类型的字段。map类型(例如 hls_config.abr_groups、
+// gb28181_config.register.passwords)和结构体数组(例如 gb28181_config.cascades)不支持，设置时报错，只能在配置文件中修改
+const EnvPrefix = "LALMAX_"
+
+const envSeparator = "__"
+
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+	walkEnv(reflect.ValueOf(c).Elem(), EnvPrefix, lookup, &errs)
+	return errors.Join(errs...)
+}
+
+func walkEnv(v reflect.Value, prefix string, lookup func(string) (string, bool), errs *[]error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if !field.IsExported() || tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(tag)
+		fv := v.Field(i)
+
+		if fv.Kind() == reflect.Struct {
+			walkEnv(fv, name+envSeparator, lookup, errs)
+			continue
+		}
+
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := setEnvValue(fv, value); err != nil {
+			*errs = append(*errs, fmt.Errorf("env %s: %w", name, err))
+		}
+	}
+}
+
+func setEnvValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+)
+
+// Validate 检查配置，返回所有不合法的配置项
+func (c *Config) Validate() error {
+	var v validator
+
+	v.addr("http_config.http_listen_addr", c.HttpConfig.ListenAddr)
+	if c.HttpConfig.EnableHttps {
+		v.addr("http_config.https_listen_addr", c.HttpConfig.HttpsListenAddr)
+		v.file("http_config.https_cert_file", c.HttpConfig.HttpsCertFile)
+		v.file("http_config.https_key_file", c.HttpConfig.HttpsKeyFile)
+	}
+	for _, proxy := range c.HttpConfig.TrustedProxies {
+		v.ipOrCidr("http_config.trusted_proxies", proxy)
+	}
+
+	if c.SrtConfig.Enable {
+		v.addr("srt_config.addr", c.SrtConfig.Addr)
+	}
+	v.nonNegative("srt_config.latency", c.SrtConfig.Latency)
+	v.nonNegative("srt_config.recv_latency", c.SrtConfig.RecvLatency)
+	v.nonNegative("srt_config.peer_latency", c.SrtConfig.PeerLatency)
+
+	if c.RtcConfig.Enable {
+		for _, ip := range c.RtcConfig.ICEHostNATToIPs {
+			if net.ParseIP(ip) == nil {
+				v.errorf("rtc_config.ice_host_nat_to_ips", "invalid ip %q", ip)
+			}
+		}
+		v.port("rtc_config.ice_udp_mux_port", c.RtcConfig.ICEUDPMuxPort)
+		v.port("rtc_config.ice_tcp_mux_port", c.RtcConfig.ICETCPMuxPort)
+	}
+	v.nonNegative("rtc_config.write_chan_size", c.RtcConfig.WriteChanSize)
+
+	hls := c.HlsConfig
+	v.nonNegative("hls_config.segment_count", hls.SegmentCount)
+	v.nonNegative("hls_config.segment_duration", hls.SegmentDuration)
+	v.nonNegative("hls_config.part_duration", hls.PartDuration)
+	v.nonNegative("hls_config.viewer_timeout_sec", hls.ViewerTimeoutSec)
+	v.nonNegative("hls_config.idle_timeout_sec", hls.IdleTimeoutSec)
+	v.nonNegative("hls_config.dvr.window_minutes", hls.Dvr.WindowMinutes)
+	v.nonNegative("hls_config.dvr.segment_duration", hls.Dvr.SegmentDuration)
+
+	if c.GB28181Config.Enable {
+		gb := c.GB28181Config
+		if len(gb.Serial) != 20 {
+			v.errorf("gb28181_config.serial", "must be 20 digits, got %q", gb.Serial)
+		}
+		if len(gb.Realm) != 10 {
+			v.errorf("gb28181_config.realm", "must be 10 digits, got %q", gb.Realm)
+		}
+		if gb.MediaConfig.ListenPort != 0 && int(gb.MediaConfig.ListenPort)+int(gb.MediaConfig.MultiPortMaxIncrement) > 65535 {
+			v.errorf("gb28181_config.media_config.multi_port_max_increment", "port range %d+%d exceeds 65535", gb.MediaConfig.ListenPort, gb.MediaConfig.MultiPortMaxIncrement)
+		}
+		v.nonNegative("gb28181_config.keepalive_interval", gb.KeepaliveInterval)
+		v.nonNegative("gb28181_config.download_speed", gb.DownloadSpeed)
+		v.nonNegative("gb28181_config.store.save_interval_sec", gb.Store.SaveIntervalSec)
+		reg := gb.Register
+		v.nonNegative("gb28181_config.register.expires", reg.Expires)
+		v.url("gb28181_config.register.password_callback", reg.PasswordCallback, false)
+		v.nonNegative("gb28181_config.register.callback_timeout_ms", reg.CallbackTimeoutMs)
+		v.nonNegative("gb28181_config.register.max_auth_failures", reg.MaxAuthFailures)
+		v.nonNegative("gb28181_config.register.ban_sec", reg.BanSec)
+		v.nonNegative("gb28181_config.alarm.expires", gb.Alarm.Expires)
+		v.nonNegative("gb28181_config.alarm.history_size", gb.Alarm.HistorySize)
+		v.nonNegative("gb28181_config.subscribe.catalog_expires", gb.Subscribe.CatalogExpires)
+		v.nonNegative("gb28181_config.subscribe.position_expires", gb.Subscribe.PositionExpires)
+		v.nonNegative("gb28181_config.subscribe.position_interval", gb.Subscribe.PositionInterval)
+		v.nonNegative("gb28181_config.subscribe.position_history_size", gb.Subscribe.PositionHistorySize)
+		for _, codes := range []struct {
+			name  string
+			codes []string
+		}{
+			{"gb28181_config.register.allow_civil_codes", reg.AllowCivilCodes},
+			{"gb28181_config.register.deny_civil_codes", reg.DenyCivilCodes},
+		} {
+			for _, code := range codes.codes {
+				if l := len(code); l == 0 || l > 8 || l%2 != 0 {
+					v.errorf(codes.name, "civil code must be 2/4/6/8 digits, got %q", code)
+				}
+			}
+		}
+		for i, cascade := range gb.Cascades {
+			if !cascade.Enable {
+				continue
+			}
+			prefix := fmt.Sprintf("gb28181_config.cascades[%d]", i)
+			if len(cascade.ServerId) != 20 {
+				v.errorf(prefix+".server_id", "must be 20 digits, got %q", cascade.ServerId)
+			}
+			if cascade.ServerIp == "" {
+				v.errorf(prefix+".server_ip", "is required")
+			}
+			if cascade.LocalId != "" && len(cascade.LocalId) != 20 {
+				v.errorf(prefix+".local_id", "must be 20 digits, got %q", cascade.LocalId)
+			}
+			v.oneOf(prefix+".transport", cascade.Transport, "", "udp", "tcp")
+			v.nonNegative(prefix+".register_expires", cascade.RegisterExpires)
+			v.nonNegative(prefix+".keepalive_interval", cascade.KeepaliveInterval)
+		}
+	}
+
+	v.nonNegative("hook_config.gop_cache_num", c.HookConfig.GopCacheNum)
+	v.nonNegative("hook_config.single_gop_max_frame_num", c.HookConfig.SingleGopMaxFrameNum)
+	v.oneOf("hook_config.republish_policy", c.HookConfig.RepublishPolicy, "", "reject", "kick_old", "takeover")
+
+	auth := c.AuthConfig
+	for _, m := range []struct {
+		name, method, secretsName string
+		secrets                   []string
+	}{
+		{"auth_config.pub_method", auth.PubMethod, "auth_config.pub_secrets", auth.PubSecrets},
+		{"auth_config.sub_method", auth.SubMethod, "auth_config.sub_secrets", auth.SubSecrets},
+	} {
+		name, method := m.name, m.method
+		v.oneOf(name, method, "", "secret", "sign", "http")
+		switch method {
+		case "secret":
+			if len(m.secrets) == 0 {
+				v.errorf(name, "secret method requires %s", m.secretsName)
+			}
+		case "sign":
+			if auth.SignSecret == "" {
+				v.errorf(name, "sign method requires auth_config.sign_secret")
+			}
+		case "http":
+			v.url("auth_config.http_callback", auth.HttpCallback, true)
+		}
+	}
+	v.nonNegative("auth_config.http_timeout_ms", auth.HttpTimeoutMs)
+
+	notify := c.HttpNotifyConfig
+	if notify.Enable {
+		for _, u := range []struct{ name, url string }{
+			{"http_notify.on_server_start", notify.OnServerStart},
+			{"http_notify.on_update", notify.OnUpdate},
+			{"http_notify.on_pub_start", notify.OnPubStart},
+			{"http_notify.on_pub_stop", notify.OnPubStop},
+			{"http_notify.on_sub_start", notify.OnSubStart},
+			{"http_notify.on_sub_stop", notify.OnSubStop},
+			{"http_notify.on_relay_pull_start", notify.OnRelayPullStart},
+			{"http_notify.on_relay_pull_stop", notify.OnRelayPullStop},
+			{"http_notify.on_rtmp_connect", notify.OnRtmpConnect},
+			{"http_notify.on_hls_make_ts", notify.OnHlsMakeTs},
+			{"http_notify.on_gb_alarm", notify.OnGbAlarm},
+		} {
+			v.url(u.name, u.url, false)
+		}
+		for _, event := range notify.SyncEvents {
+			v.oneOf("http_notify.sync_events", event, "on_pub_start", "on_sub_start", "on_rtmp_connect")
+		}
+		v.oneOf("http_notify.sync_fail_policy", notify.SyncFailPolicy, "", "open", "closed")
+		v.nonNegative("http_notify.retry_interval_ms", notify.RetryIntervalMs)
+		v.nonNegative("http_notify.concurrency_per_url", notify.ConcurrencyPerUrl)
+		v.nonNegative("http_notify.sync_timeout_ms", notify.SyncTimeoutMs)
+	}
+
+	if c.LalSvrConfigPath != "" {
+		v.file("lal_config_path", c.LalSvrConfigPath)
+	}
+	v.nonNegative("shutdown_timeout_sec", c.ShutdownTimeoutSec)
+
+	return errors.Join(v.errs...)
+}
+
+type validator struct {
+	errs []error
+}
+
+func (v *validator) errorf(name, format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) addr(name, addr string) {
+	if addr == "" {
+		v.errorf(name, "is required")
+		return
+	}
+	if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+		v.errorf(name, "invalid address %q, expect host:port or :port", addr)
+	}
+}
+
+func (v *validator) ipOrCidr(name, s string) {
+	if net.ParseIP(s) != nil {
+		return
+	}
+	if _, _, err := net.ParseCIDR(s); err != nil {
+		v.errorf(name, "invalid ip or cidr %q", s)
+	}
+}
+
+func (v *validator) port(name string, port int) {
+	if port < 0 || port > 65535 {
+		v.errorf(name, "invalid port %d", port)
+	}
+}
+
+func (v *validator) file(name, path string) {
+	if path == "" {
+		v.errorf(name, "is required")
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		v.errorf(name, "%v", err)
+	}
+}
+
+func (v *validator) nonNegative(name string, n int) {
+	if n < 0 {
+		v.errorf(name, "must not be negative, got %d", n)
+	}
+}
+
+func (v *validator) oneOf(name, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.errorf(name, "invalid value %q, expect one of %q", value, allowed)
+}
+
+func (v *validator) url(name, u string, required bool) {
+	if u == "" {
+		if required {
+			v.errorf(name, "is required")
+		}
+		return
+	}
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		v.errorf(name, "invalid http url %q", u)
+	}
+}
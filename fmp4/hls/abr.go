@@ -0,0 +1,212 @@
+package hls
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/gohlslib"
+	"github.com/bluenviron/gohlslib/pkg/codecparams"
+	"github.com/bluenviron/gohlslib/pkg/codecs"
+	"github.com/bluenviron/gohlslib/pkg/playlist"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+	"github.com/gin-gonic/gin"
+	"github.com/q191201771/naza/pkg/nazalog"
+)
+
+// MasterPlaylistName ABR多码率主播放列表的文件名，请求地址为 /live/hls/{分组名}/master.m3u8，mpegts为 /live/hls-ts/{分组名}/master.m3u8
+const MasterPlaylistName = "master.m3u8"
+
+const (
+	bitrateWindow      = 5 * time.Second
+	bitrateWindowCount = 6
+
+	// 还没有统计到码率时，按照分辨率估算，单位bit/pixel
+	estimateBitsPerPixel = 2
+	estimateAudioBitrate = 128000
+)
+
+// SetAbrGroup 设置ABR分组，streamNames的顺序就是主播放列表中各个码率的顺序
+func (s *HlsServer) SetAbrGroup(groupName string, streamNames []string) {
+	nazalog.Infof("set hls abr group, groupName:%s, streamNames:%v", groupName, streamNames)
+	s.abrGroups.Store(groupName, append([]string(nil), streamNames...))
+}
+
+func (s *HlsServer) DelAbrGroup(groupName string) {
+	nazalog.Infof("del hls abr group, groupName:%s", groupName)
+	s.abrGroups.Delete(groupName)
+}
+
+func (s *HlsServer) handleMasterPlaylist(ctx *gin.Context, groupName string, ts bool) {
+	var streamNames []string
+	var autoGroup bool
+
+	if value, ok := s.abrGroups.Load(groupName); ok {
+		streamNames = value.([]string)
+	} else if s.conf.AbrAutoGroup {
+		autoGroup = true
+		streamNames = s.autoGroupStreams(groupName, ts)
+	}
+	if s.conf.OnDemand {
+		s.waitVariants(streamNames, ts)
+	}
+
+	var variants []*playlist.MultivariantVariant
+	for _, streamName := range streamNames {
+		v := s.loadVariant(streamName, ts)
+		if v == nil {
+			continue
+		}
+		if query := s.variantQuery(ctx, streamName, !autoGroup); len(query) != 0 {
+			v.URI += "?" + query.Encode()
+		}
+		variants = append(variants, v)
+	}
+
+	if len(variants) == 0 {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	if autoGroup {
+		sort.Slice(variants, func(i, j int) bool {
+			return variants[i].Bandwidth > variants[j].Bandwidth
+		})
+	}
+
+	version := 9
+	if ts {
+		version = 3
+	}
+	pl := &playlist.Multivariant{
+		Version:             version,
+		IndependentSegments: true,
+		Variants:            variants,
+	}
+	buf, err := pl.Marshal()
+	if err != nil {
+		nazalog.Error("marshal hls master playlist failed, err:", err)
+		ctx.Status(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Header("Cache-Control", "max-age=30")
+	ctx.Data(http.StatusOK, "application/vnd.apple.mpegurl", buf)
+}
+
+// autoGroupStreams 按照命名约定分组，{分组名}_{后缀} 的流都属于该分组
+//
+// 按需模式下muxer还没有创建，从数据来源中查找存在的流
+func (s *HlsServer) autoGroupStreams(groupName string, ts bool) (streamNames []string) {
+	prefix := groupName + "_"
+	if s.conf.OnDemand && s.source != nil {
+		for _, streamName := range s.source.StreamNames() {
+			if strings.HasPrefix(streamName, prefix) {
+				streamNames = append(streamNames, streamName)
+			}
+		}
+		return
+	}
+	s.sessionMap(ts).Range(func(k, _ interface{}) bool {
+		if streamName := k.(string); strings.HasPrefix(streamName, prefix) {
+			streamNames = append(streamNames, streamName)
+		}
+		return true
+	})
+	return
+}
+
+func (s *HlsServer) loadVariant(streamName string, ts bool) *playlist.MultivariantVariant {
+	value, ok := s.sessionMap(ts).Load(streamName)
+	if !ok {
+		return nil
+	}
+	v := value.(*HlsSession).getVariant()
+	if v == nil {
+		return nil
+	}
+	v.URI = "../" + streamName + "/stream.m3u8"
+	return v
+}
+
+// newVariant 根据音视频轨道的序列头生成主播放列表中的码率信息，BANDWIDTH在请求时根据实际码率填充
+func newVariant(videoTrack, audioTrack *gohlslib.Track) *playlist.MultivariantVariant {
+	v := &playlist.MultivariantVariant{}
+
+	if videoTrack != nil {
+		v.Codecs = append(v.Codecs, codecparams.Marshal(videoTrack.Codec))
+
+		var width, height int
+		var fps float64
+		switch codec := videoTrack.Codec.(type) {
+		case *codecs.H264:
+			var sps h264.SPS
+			if err := sps.Unmarshal(codec.SPS); err == nil {
+				width, height, fps = sps.Width(), sps.Height(), sps.FPS()
+			}
+		case *codecs.H265:
+			var sps h265.SPS
+			if err := sps.Unmarshal(codec.SPS); err == nil {
+				width, height, fps = sps.Width(), sps.Height(), sps.FPS()
+			}
+		}
+		if width != 0 && height != 0 {
+			v.Resolution = strconv.Itoa(width) + "x" + strconv.Itoa(height)
+			v.Bandwidth = width * height * estimateBitsPerPixel
+		}
+		if fps != 0 {
+			v.FrameRate = &fps
+		}
+	}
+
+	if audioTrack != nil {
+		v.Codecs = append(v.Codecs, codecparams.Marshal(audioTrack.Codec))
+		v.Bandwidth += estimateAudioBitrate
+	}
+
+	return v
+}
+
+// bitrateCounter 统计最近一段时间的峰值码率，单位bit/s
+type bitrateCounter struct {
+	mutex       sync.Mutex
+	windowStart time.Time
+	windowBytes int
+	windows     []int
+}
+
+func (c *bitrateCounter) add(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if c.windowStart.IsZero() {
+		c.windowStart = now
+	}
+	if elapsed := now.Sub(c.windowStart); elapsed >= bitrateWindow {
+		c.windows = append(c.windows, int(int64(c.windowBytes)*8*int64(time.Second)/int64(elapsed)))
+		if len(c.windows) > bitrateWindowCount {
+			c.windows = c.windows[1:]
+		}
+		c.windowStart = now
+		c.windowBytes = 0
+	}
+	c.windowBytes += n
+}
+
+func (c *bitrateCounter) peak() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var peak int
+	for _, v := range c.windows {
+		if v > peak {
+			peak = v
+		}
+	}
+	return peak
+}
@@ -0,0 +1,434 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/q191201771/lal/pkg/base"
+	config "github.com/q191201771/lalmax/conf"
+	"github.com/q191201771/naza/pkg/nazalog"
+	codec "github.com/yapingcat/gomedia/go-codec"
+	flv "github.com/yapingcat/gomedia/go-flv"
+	ts "github.com/yapingcat/gomedia/go-mpeg2"
+)
+
+// DVR回看的播放列表文件名，请求地址为 /live/hls/{流名}/dvr.m3u8，流结束或者服务重启后依然可以回看
+const (
+	DvrPlaylistName = "dvr.m3u8"
+	dvrIndexName    = "dvr.json"
+	dvrSegmentPre   = "dvr_"
+)
+
+const (
+	// dvrMaxTimestampJumpMs 相邻两帧时间戳跳变超过该值时切片并插入EXT-X-DISCONTINUITY
+	dvrMaxTimestampJumpMs = 10000
+	dvrGcInterval         = time.Minute
+)
+
+type dvrSegment struct {
+	Sequence      uint64    `json:"sequence"`
+	Duration      float64   `json:"duration"` // 单位秒
+	DateTime      time.Time `json:"date_time"`
+	Discontinuity bool      `json:"discontinuity"`
+}
+
+// dvrIndex 落盘的切片索引，服务重启后从这里恢复
+type dvrIndex struct {
+	NextSequence          uint64       `json:"next_sequence"`
+	DiscontinuitySequence uint64       `json:"discontinuity_sequence"`
+	Segments              []dvrSegment `json:"segments"`
+}
+
+// dvrDirName 流名对应的切片目录名，流名中的路径分隔符等字符会被转义，不会访问到dvr目录之外
+func dvrDirName(streamName string) string {
+	name := url.PathEscape(streamName)
+	if strings.HasPrefix(name, ".") {
+		// "." 和 ".." 不能作为目录名
+		name = "%2E" + name[1:]
+	}
+	return name
+}
+
+// dvrStreamName 切片目录名对应的流名
+func dvrStreamName(dirName string) string {
+	if streamName, err := url.PathUnescape(dirName); err == nil {
+		return streamName
+	}
+	return dirName
+}
+
+func segmentName(sequence uint64) string {
+	return fmt.Sprintf("%s%d.ts", dvrSegmentPre, sequence)
+}
+
+func loadDvrIndex(dir string) (*dvrIndex, error) {
+	b, err := os.ReadFile(filepath.Join(dir, dvrIndexName))
+	if err != nil {
+		return nil, err
+	}
+	var index dvrIndex
+	if err = json.Unmarshal(b, &index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+func (index *dvrIndex) save(dir string) error {
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, dvrIndexName+".tmp")
+	if err = os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, dvrIndexName))
+}
+
+// prune 删除超出回看窗口的切片，返回是否有切片被删除
+func (index *dvrIndex) prune(dir string, window time.Duration, now time.Time) bool {
+	var n int
+	for n < len(index.Segments) && now.Sub(index.Segments[n].DateTime) > window {
+		seg := index.Segments[n]
+		if seg.Discontinuity {
+			index.DiscontinuitySequence++
+		}
+		if err := os.Remove(filepath.Join(dir, segmentName(seg.Sequence))); err != nil && !os.IsNotExist(err) {
+			nazalog.Warnf("remove dvr segment failed, err:%+v", err)
+		}
+		n++
+	}
+	index.Segments = index.Segments[n:]
+	return n > 0
+}
+
+// playlist 生成滑动窗口的播放列表，ended为true时表示流已经结束
+//
+// 超出回看窗口的切片会被删除，所以不能使用EVENT类型(EVENT只允许追加切片)
+func (index *dvrIndex) playlist(ended bool) []byte {
+	var targetDuration float64
+	for _, seg := range index.Segments {
+		targetDuration = math.Max(targetDuration, seg.Duration)
+	}
+
+	var mediaSequence uint64
+	if len(index.Segments) > 0 {
+		mediaSequence = index.Segments[0].Sequence
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&buf, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration)))
+	fmt.Fprintf(&buf, "#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSequence)
+	fmt.Fprintf(&buf, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", index.DiscontinuitySequence)
+	for _, seg := range index.Segments {
+		if seg.Discontinuity {
+			buf.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&buf, "#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.DateTime.Format("2006-01-02T15:04:05.000Z07:00"))
+		fmt.Fprintf(&buf, "#EXTINF:%.3f,\n", seg.Duration)
+		buf.WriteString(segmentName(seg.Sequence) + "\n")
+	}
+	if ended {
+		buf.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return buf.Bytes()
+}
+
+// dvrSession 将一路流切成TS切片写到磁盘上，只保留最近 window 时长的切片
+type dvrSession struct {
+	streamName      string
+	dir             string
+	window          time.Duration
+	segmentDuration int64 // 单位毫秒
+
+	mutex sync.Mutex
+	index *dvrIndex
+
+	videoDemuxer flv.VideoTagDemuxer
+	audioDemuxer flv.AudioTagDemuxer
+	videoCid     ts.TS_STREAM_TYPE
+	dts          uint32
+
+	muxer         *ts.TSMuxer
+	file          *os.File
+	videoPid      uint16
+	audioPid      uint16
+	current       dvrSegment
+	startDts      int64
+	lastDts       int64
+	discontinuity bool
+}
+
+func newDvrSession(streamName string, conf config.HlsDvrConfig) *dvrSession {
+	d := &dvrSession{
+		streamName:      streamName,
+		dir:             filepath.Join(conf.Dir, dvrDirName(streamName)),
+		window:          time.Duration(conf.WindowMinutes) * time.Minute,
+		segmentDuration: int64(conf.SegmentDuration) * 1000,
+		index:           &dvrIndex{},
+	}
+
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		nazalog.Errorf("create dvr dir failed, streamName:%s, err:%+v", streamName, err)
+	}
+
+	if index, err := loadDvrIndex(d.dir); err == nil {
+		d.index = index
+		d.index.prune(d.dir, d.window, time.Now())
+		// 与上一次推流的切片之间不连续
+		d.discontinuity = len(d.index.Segments) > 0
+	}
+
+	nazalog.Infof("new dvr session, streamName:%s, dir:%s, segments:%d", streamName, d.dir, len(d.index.Segments))
+	return d
+}
+
+func (d *dvrSession) OnMsg(msg base.RtmpMsg) {
+	switch msg.Header.MsgTypeId {
+	case base.RtmpTypeIdVideo:
+		if len(msg.Payload) < 5 {
+			return
+		}
+		if msg.IsVideoKeySeqHeader() {
+			if msg.IsAvcKeySeqHeader() {
+				d.videoDemuxer = flv.CreateFlvVideoTagHandle(flv.FLV_AVC)
+				d.videoCid = ts.TS_STREAM_H264
+			} else if msg.IsHevcKeySeqHeader() {
+				d.videoDemuxer = flv.CreateFlvVideoTagHandle(flv.FLV_HEVC)
+				d.videoCid = ts.TS_STREAM_H265
+			} else {
+				return
+			}
+			d.videoDemuxer.OnFrame(d.onVideoFrame)
+			d.decodeVideo(msg)
+			return
+		}
+		if d.videoDemuxer == nil {
+			return
+		}
+		if msg.IsAvcKeyNalu() || msg.IsHevcKeyNalu() {
+			d.cutIfNeeded(int64(msg.Dts()))
+		}
+		if d.muxer == nil {
+			return
+		}
+		d.decodeVideo(msg)
+	case base.RtmpTypeIdAudio:
+		if msg.AudioCodecId() != base.RtmpSoundFormatAac || len(msg.Payload) < 2 {
+			return
+		}
+		if msg.IsAacSeqHeader() {
+			d.audioDemuxer = flv.CreateAudioTagDemuxer(flv.FLV_AAC)
+			d.audioDemuxer.OnFrame(d.onAudioFrame)
+			_ = d.audioDemuxer.Decode(msg.Payload)
+			return
+		}
+		if d.audioDemuxer == nil {
+			return
+		}
+		if d.videoDemuxer == nil {
+			// 纯音频流
+			d.cutIfNeeded(int64(msg.Dts()))
+		}
+		if d.muxer == nil {
+			return
+		}
+		d.dts = msg.Dts()
+		d.lastDts = int64(d.dts)
+		if err := d.audioDemuxer.Decode(msg.Payload); err != nil {
+			nazalog.Error(err)
+		}
+	}
+}
+
+func (d *dvrSession) decodeVideo(msg base.RtmpMsg) {
+	d.dts = msg.Dts()
+	if d.muxer != nil {
+		d.lastDts = int64(d.dts)
+	}
+	// gomedia会原地修改数据，这里需要拷贝一份，避免影响其他订阅者
+	if err := d.videoDemuxer.Decode(append([]byte(nil), msg.Payload...)); err != nil {
+		nazalog.Error(err)
+	}
+}
+
+func (d *dvrSession) onVideoFrame(_ codec.CodecID, frame []byte, cts int) {
+	if d.muxer != nil {
+		_ = d.muxer.Write(d.videoPid, frame, uint64(d.dts)+uint64(cts), uint64(d.dts))
+	}
+}
+
+func (d *dvrSession) onAudioFrame(_ codec.CodecID, frame []byte) {
+	if d.muxer != nil {
+		_ = d.muxer.Write(d.audioPid, frame, uint64(d.dts), uint64(d.dts))
+	}
+}
+
+func (d *dvrSession) cutIfNeeded(dts int64) {
+	if d.muxer != nil {
+		elapsed := dts - d.startDts
+		if elapsed >= 0 && elapsed < d.segmentDuration {
+			return
+		}
+		if elapsed < 0 || elapsed > d.segmentDuration+dvrMaxTimestampJumpMs {
+			// 时间戳回退或者跳变，按上一帧结束当前切片
+			d.closeSegment(d.lastDts)
+			d.discontinuity = true
+		} else {
+			d.closeSegment(dts)
+		}
+	}
+	d.openSegment(dts)
+}
+
+func (d *dvrSession) openSegment(dts int64) {
+	d.mutex.Lock()
+	sequence := d.index.NextSequence
+	d.index.NextSequence++
+	d.mutex.Unlock()
+
+	file, err := os.Create(filepath.Join(d.dir, segmentName(sequence)))
+	if err != nil {
+		nazalog.Errorf("create dvr segment failed, streamName:%s, err:%+v", d.streamName, err)
+		return
+	}
+
+	// 每个切片使用新的muxer，保证切片以PAT/PMT开头，可以单独解码
+	d.file = file
+	d.muxer = ts.NewTSMuxer()
+	d.muxer.OnPacket = func(pkg []byte) {
+		if _, err := d.file.Write(pkg); err != nil {
+			nazalog.Errorf("write dvr segment failed, streamName:%s, err:%+v", d.streamName, err)
+		}
+	}
+	if d.videoDemuxer != nil {
+		d.videoPid = d.muxer.AddStream(d.videoCid)
+	}
+	if d.audioDemuxer != nil {
+		d.audioPid = d.muxer.AddStream(ts.TS_STREAM_AAC)
+	}
+
+	d.current = dvrSegment{
+		Sequence:      sequence,
+		DateTime:      time.Now(),
+		Discontinuity: d.discontinuity,
+	}
+	d.discontinuity = false
+	d.startDts = dts
+	d.lastDts = dts
+}
+
+func (d *dvrSession) closeSegment(endDts int64) {
+	if d.muxer == nil {
+		return
+	}
+	d.muxer = nil
+	_ = d.file.Close()
+
+	duration := endDts - d.startDts
+	if duration <= 0 {
+		_ = os.Remove(d.file.Name())
+		return
+	}
+	d.current.Duration = float64(duration) / 1000
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.index.Segments = append(d.index.Segments, d.current)
+	d.index.prune(d.dir, d.window, time.Now())
+	if err := d.index.save(d.dir); err != nil {
+		nazalog.Errorf("save dvr index failed, streamName:%s, err:%+v", d.streamName, err)
+	}
+}
+
+func (d *dvrSession) OnStop() {
+	nazalog.Infof("dvr session stop, streamName:%s", d.streamName)
+	d.closeSegment(d.lastDts)
+}
+
+func (d *dvrSession) playlist() []byte {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.index.playlist(false)
+}
+
+// handleDvrRequest 处理DVR播放列表和切片的请求，流不在线时从磁盘读取
+func (s *HlsServer) handleDvrRequest(ctx *gin.Context, streamName, name string) {
+	dir := filepath.Join(s.conf.Dvr.Dir, dvrDirName(streamName))
+
+	if name == DvrPlaylistName {
+		var buf []byte
+		if value, ok := s.dvrSessions.Load(streamName); ok {
+			buf = value.(*dvrSession).playlist()
+		} else {
+			index, err := loadDvrIndex(dir)
+			if err != nil || len(index.Segments) == 0 {
+				ctx.Status(http.StatusNotFound)
+				return
+			}
+			buf = index.playlist(true)
+		}
+		ctx.Header("Cache-Control", "no-cache")
+		ctx.Data(http.StatusOK, "application/vnd.apple.mpegurl", appendPlaylistQuery(buf, childQuery(ctx)))
+		return
+	}
+
+	ctx.Header("Content-Type", "video/mp2t")
+	http.ServeFile(ctx.Writer, ctx.Request, filepath.Join(dir, filepath.Base(name)))
+}
+
+func isDvrRequest(name string) bool {
+	return name == DvrPlaylistName || (strings.HasPrefix(name, dvrSegmentPre) && strings.HasSuffix(name, ".ts"))
+}
+
+// cleanDvr 定时清理已经不在线的流的过期切片
+func (s *HlsServer) cleanDvr() {
+	ticker := time.NewTicker(dvrGcInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		entries, err := os.ReadDir(s.conf.Dvr.Dir)
+		if err != nil {
+			continue
+		}
+
+		window := time.Duration(s.conf.Dvr.WindowMinutes) * time.Minute
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			streamName := dvrStreamName(entry.Name())
+			if _, ok := s.dvrSessions.Load(streamName); ok {
+				continue
+			}
+
+			dir := filepath.Join(s.conf.Dvr.Dir, entry.Name())
+			index, err := loadDvrIndex(dir)
+			if err != nil {
+				continue
+			}
+			if !index.prune(dir, window, time.Now()) {
+				continue
+			}
+			if len(index.Segments) == 0 {
+				nazalog.Info("clean dvr dir, streamName:", streamName)
+				_ = os.RemoveAll(dir)
+				continue
+			}
+			_ = index.save(dir)
+		}
+	}
+}
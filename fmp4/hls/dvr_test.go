@@ -0,0 +1,64 @@
+package hls
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDvrDirName(t *testing.T) {
+	testCases := []struct {
+		streamName string
+		expect     string
+	}{
+		{"test110", "test110"},
+		{"live/test110", "live%2Ftest110"},
+		{"..", "%2E."},
+		{"../etc", "%2E.%2Fetc"},
+		{".hidden", "%2Ehidden"},
+		{`a\b`, `a%5Cb`},
+	}
+	root := "dvr"
+	for _, tc := range testCases {
+		name := dvrDirName(tc.streamName)
+		if name != tc.expect {
+			t.Fatalf("streamName:%s, expect:%s, got:%s", tc.streamName, tc.expect, name)
+		}
+		if dir := filepath.Join(root, name); filepath.Dir(dir) != root {
+			t.Fatalf("streamName:%s, dir out of root:%s", tc.streamName, dir)
+		}
+		if out := dvrStreamName(name); out != tc.streamName {
+			t.Fatalf("expect stream name:%s, got:%s", tc.streamName, out)
+		}
+	}
+}
+
+func TestDvrPlaylist(t *testing.T) {
+	now := time.Now()
+	index := &dvrIndex{
+		NextSequence: 3,
+		Segments: []dvrSegment{
+			{Sequence: 1, Duration: 4, DateTime: now.Add(-time.Hour)},
+			{Sequence: 2, Duration: 4.5, DateTime: now, Discontinuity: true},
+		},
+	}
+	index.prune(t.TempDir(), 10*time.Minute, now)
+
+	pl := string(index.playlist(false))
+	// 切片会被删除，不能是EVENT类型
+	if strings.Contains(pl, "EXT-X-PLAYLIST-TYPE") {
+		t.Fatalf("unexpected playlist type:\n%s", pl)
+	}
+	for _, line := range []string{"#EXT-X-MEDIA-SEQUENCE:2", "#EXT-X-TARGETDURATION:5", "#EXT-X-DISCONTINUITY\n", "dvr_2.ts"} {
+		if !strings.Contains(pl, line) {
+			t.Fatalf("expect %q in playlist:\n%s", line, pl)
+		}
+	}
+	if strings.Contains(pl, "dvr_1.ts") || strings.Contains(pl, "#EXT-X-ENDLIST") {
+		t.Fatalf("unexpected playlist:\n%s", pl)
+	}
+	if !strings.HasSuffix(string(index.playlist(true)), "#EXT-X-ENDLIST\n") {
+		t.Fatal("expect endlist when ended")
+	}
+}
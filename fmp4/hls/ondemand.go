@@ -0,0 +1,128 @@
+package hls
+
+import (
+	"sync"
+	"time"
+
+	"github.com/q191201771/lal/pkg/base"
+	"github.com/q191201771/naza/pkg/nazalog"
+)
+
+const (
+	idleCheckInterval = 5 * time.Second
+
+	// 请求时等待muxer启动的最长时间
+	muxerStartTimeout = 5 * time.Second
+
+	// 按需模式下请求主播放列表时，等待各个码率的muxer启动的最长时间
+	onDemandVariantWait = 5 * time.Second
+)
+
+// IStreamSubscriber 按需模式下hls muxer作为流的订阅者接收数据
+type IStreamSubscriber interface {
+	OnMsg(msg base.RtmpMsg)
+	OnStop()
+}
+
+// IStreamSource 按需模式下hls muxer的数据来源，订阅时需要先下发gop缓存
+type IStreamSource interface {
+	AddConsumer(streamName, consumerId string, subscriber IStreamSubscriber) bool
+	RemoveConsumer(streamName, consumerId string)
+	// StreamNames 当前存在的所有流，按需模式下用于ABR自动分组
+	StreamNames() []string
+}
+
+// SetStreamSource 开启按需模式时必须设置
+func (s *HlsServer) SetStreamSource(source IStreamSource) {
+	s.source = source
+}
+
+// onDemandConsumer 按需创建的muxer通过它从hook session订阅数据
+type onDemandConsumer struct {
+	session *HlsSession
+}
+
+func (c *onDemandConsumer) OnMsg(msg base.RtmpMsg) {
+	c.session.OnMsg(msg)
+}
+
+func (c *onDemandConsumer) OnStop() {
+	// 流结束时由 HlsServer.OnStop 清理
+}
+
+// loadOrStartSession 获取流对应的hls session，按需模式下没有时创建
+func (s *HlsServer) loadOrStartSession(streamName string, ts bool) (*HlsSession, bool) {
+	sessions := s.sessionMap(ts)
+	if value, ok := sessions.Load(streamName); ok {
+		return value.(*HlsSession), true
+	}
+	if !s.conf.OnDemand || s.source == nil {
+		return nil, false
+	}
+
+	session := NewHlsSession(streamName, s.getConf(), ts)
+	session.touch()
+	value, loaded := sessions.LoadOrStore(streamName, session)
+	if loaded {
+		return value.(*HlsSession), true
+	}
+
+	if !s.source.AddConsumer(streamName, session.SessionId, &onDemandConsumer{session: session}) {
+		sessions.Delete(streamName)
+		return nil, false
+	}
+
+	nazalog.Info("start on demand hls session, streamName:", streamName, " sessionId:", session.SessionId)
+	return session, true
+}
+
+// cleanIdleSession 按需模式下，超过一段时间没有请求的muxer会被销毁
+func (s *HlsServer) cleanIdleSession() {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		timeout := time.Duration(s.getConf().IdleTimeoutSec) * time.Second
+		for _, sessions := range []*sync.Map{&s.sessions, &s.tsSessions} {
+			sessions.Range(func(k, v interface{}) bool {
+				streamName := k.(string)
+				session := v.(*HlsSession)
+				if !session.idle(timeout) {
+					return true
+				}
+
+				nazalog.Info("stop idle hls session, streamName:", streamName, " sessionId:", session.SessionId)
+				s.source.RemoveConsumer(streamName, session.SessionId)
+				sessions.Delete(streamName)
+				// 与OnStop一样延迟关闭，避免与正在进行的写入和请求冲突
+				s.invalidSessions.Store(session.SessionId, session)
+				return true
+			})
+		}
+	}
+}
+
+// waitVariants 按需模式下等待muxer启动，直到所有流都能生成码率信息或者超时
+func (s *HlsServer) waitVariants(streamNames []string, ts bool) {
+	deadline := time.Now().Add(onDemandVariantWait)
+	for time.Now().Before(deadline) {
+		ready := true
+		for _, streamName := range streamNames {
+			session, ok := s.loadOrStartSession(streamName, ts)
+			if ok && session.getVariant() == nil {
+				ready = false
+			}
+		}
+		if ready {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (session *HlsSession) touch() {
+	session.lastRequestTime.Store(time.Now().UnixNano())
+}
+
+func (session *HlsSession) idle(timeout time.Duration) bool {
+	return time.Since(time.Unix(0, session.lastRequestTime.Load())) > timeout
+}
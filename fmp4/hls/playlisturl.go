@@ -0,0 +1,103 @@
+package hls
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/q191201771/lalmax/auth"
+)
+
+var uriAttrRegexp = regexp.MustCompile(`URI="([^"]*)"`)
+
+// SetSignSecret 开启签名url后设置，配置的ABR分组中的各个码率需要使用各自的流名重新签名
+func (s *HlsServer) SetSignSecret(secret string) {
+	s.signSecret = secret
+}
+
+// childQuery 播放列表中的子地址需要继承的url参数，例如签名和会话id，去掉llhls的阻塞请求参数
+func childQuery(ctx *gin.Context) url.Values {
+	query := ctx.Request.URL.Query()
+	for k := range query {
+		if strings.HasPrefix(k, "_HLS_") {
+			delete(query, k)
+		}
+	}
+	return query
+}
+
+// variantQuery 主播放列表中某个码率的url参数
+//
+// 只有配置的分组才使用分组的签名为各个码率重新签名。自动分组的成员由流名决定，
+// 如果也重新签名，任何 {分组名} 的签名都可以换到所有 {分组名}_* 流的签名，所以自动分组的码率需要各自的签名
+func (s *HlsServer) variantQuery(ctx *gin.Context, streamName string, resign bool) url.Values {
+	query := childQuery(ctx)
+	if resign && s.signSecret != "" && query.Get(auth.ParamSign) != "" {
+		return auth.Resign(s.signSecret, auth.ActionSub, streamName, query)
+	}
+	return query
+}
+
+// appendPlaylistQuery 给播放列表中的所有地址加上url参数，播放器请求切片时就能带上播放列表的签名
+func appendPlaylistQuery(playlist []byte, query url.Values) []byte {
+	if len(query) == 0 {
+		return playlist
+	}
+	rawQuery := query.Encode()
+	appendTo := func(uri string) string {
+		if strings.Contains(uri, "?") {
+			return uri + "&" + rawQuery
+		}
+		return uri + "?" + rawQuery
+	}
+
+	lines := bytes.Split(playlist, []byte("\n"))
+	for i, line := range lines {
+		l := string(bytes.TrimRight(line, "\r"))
+		switch {
+		case l == "":
+		case strings.HasPrefix(l, "#"):
+			l = uriAttrRegexp.ReplaceAllStringFunc(l, func(attr string) string {
+				return `URI="` + appendTo(attr[len(`URI="`):len(attr)-1]) + `"`
+			})
+			lines[i] = []byte(l)
+		default:
+			lines[i] = []byte(appendTo(l))
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// playlistWriter 缓存muxer生成的播放列表，修改地址后再返回给播放器
+type playlistWriter struct {
+	gin.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (w *playlistWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *playlistWriter) Write(data []byte) (int, error) {
+	return w.buf.Write(data)
+}
+
+func (w *playlistWriter) WriteString(s string) (int, error) {
+	return w.buf.WriteString(s)
+}
+
+func (w *playlistWriter) flush(query url.Values) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	body := w.buf.Bytes()
+	if w.status == http.StatusOK {
+		body = appendPlaylistQuery(body, query)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
@@ -1,9 +1,11 @@
 package hls
 
 import (
+	"net/http"
 	"sync"
 	"time"
 
+	"github.com/q191201771/lalmax/auth"
 	config "github.com/q191201771/lalmax/conf"
 
 	"github.com/gin-gonic/gin"
@@ -12,32 +14,78 @@ import (
 )
 
 type HlsServer struct {
-	sessions        sync.Map
+	sessions        sync.Map // fmp4/llhls
+	tsSessions      sync.Map // mpegts
+	confMutex       sync.RWMutex
 	conf            config.HlsConfig
 	invalidSessions sync.Map
+	abrGroups       sync.Map
+	dvrSessions     sync.Map
+	viewers         sync.Map
+	viewerMutex     sync.Mutex
+	viewerCounts    map[string]int // 每路流的观看者个数，由viewerMutex保护
+	notify          INotifyHandler
+	source          IStreamSource
+	signSecret      string
+	auth            auth.IAuthenticator
 }
 
+// NewHlsServer conf需要已经通过 config.Config.SetDefaults 填充默认值
 func NewHlsServer(conf config.HlsConfig) *HlsServer {
 	svr := &HlsServer{
-		conf: conf,
+		conf:         conf,
+		viewerCounts: make(map[string]int),
+	}
+
+	for groupName, streamNames := range conf.AbrGroups {
+		svr.SetAbrGroup(groupName, streamNames)
 	}
 
 	go svr.cleanInvalidSession()
+	go svr.cleanViewers()
+
+	if conf.Dvr.Enable {
+		go svr.cleanDvr()
+	}
+
+	if conf.OnDemand {
+		go svr.cleanIdleSession()
+	}
 
 	return svr
 }
 
 func (s *HlsServer) NewHlsSession(streamName string) {
-	nazalog.Info("new hls session, streamName:", streamName)
-	session := NewHlsSession(streamName, s.conf)
-	s.sessions.Store(streamName, session)
+	// 按需模式下muxer在第一次请求时创建
+	if !s.conf.OnDemand {
+		nazalog.Info("new hls session, streamName:", streamName)
+		conf := s.getConf()
+		s.sessions.Store(streamName, NewHlsSession(streamName, conf, false))
+		if s.conf.EnableTs {
+			s.tsSessions.Store(streamName, NewHlsSession(streamName, conf, true))
+		}
+	}
+
+	if s.conf.Dvr.Enable {
+		s.dvrSessions.Store(streamName, newDvrSession(streamName, s.conf.Dvr))
+	}
 }
 
 func (s *HlsServer) OnMsg(streamName string, msg base.RtmpMsg) {
-	value, ok := s.sessions.Load(streamName)
-	if ok {
-		session := value.(*HlsSession)
-		session.OnMsg(msg)
+	// 按需模式下muxer通过hook session的订阅接收数据
+	if !s.conf.OnDemand {
+		value, ok := s.sessions.Load(streamName)
+		if ok {
+			session := value.(*HlsSession)
+			session.OnMsg(msg)
+		}
+		if value, ok := s.tsSessions.Load(streamName); ok {
+			value.(*HlsSession).OnMsg(msg)
+		}
+	}
+
+	if value, ok := s.dvrSessions.Load(streamName); ok {
+		value.(*dvrSession).OnMsg(msg)
 	}
 }
 
@@ -48,15 +96,96 @@ func (s *HlsServer) OnStop(streamName string) {
 		s.invalidSessions.Store(session.SessionId, session)
 		s.sessions.Delete(streamName)
 	}
+	if value, ok := s.tsSessions.LoadAndDelete(streamName); ok {
+		session := value.(*HlsSession)
+		s.invalidSessions.Store(session.SessionId, session)
+	}
+
+	if value, ok := s.dvrSessions.LoadAndDelete(streamName); ok {
+		value.(*dvrSession).OnStop()
+	}
 }
 
+// HandleRequest 处理fmp4/llhls的请求
 func (s *HlsServer) HandleRequest(ctx *gin.Context) {
+	s.handleRequest(ctx, false)
+}
+
+// HandleTsRequest 处理mpegts的请求
+func (s *HlsServer) HandleTsRequest(ctx *gin.Context) {
+	if !s.conf.EnableTs {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+	s.handleRequest(ctx, true)
+}
+
+func (s *HlsServer) handleRequest(ctx *gin.Context, ts bool) {
 	streamName := ctx.Param("streamid")
-	value, ok := s.sessions.Load(streamName)
+	name := ctx.Param("type")
+	if s.auth != nil {
+		// 主播放列表的streamid为ABR分组名
+		err := s.auth.Authenticate(auth.NewHttpAuthInfo(auth.ProtocolHls, auth.ActionSub, streamName, ctx.Request, ctx.ClientIP()))
+		if err != nil {
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+	}
+
+	if name == MasterPlaylistName {
+		s.handleMasterPlaylist(ctx, streamName, ts)
+		return
+	}
+	if s.conf.Dvr.Enable && isDvrRequest(name) {
+		s.serveViewer(ctx, streamName, func() {
+			s.handleDvrRequest(ctx, streamName, name)
+		})
+		return
+	}
+
+	session, ok := s.loadOrStartSession(streamName, ts)
 	if ok {
-		session := value.(*HlsSession)
-		session.HandleRequest(ctx)
+		session.touch()
+		s.serveViewer(ctx, streamName, func() {
+			session.HandleRequest(ctx)
+		})
+	}
+}
+
+// UpdateConfig 热更新分片参数和超时时间，分片参数对之后创建的muxer生效
+func (s *HlsServer) UpdateConfig(conf config.HlsConfig) {
+	s.confMutex.Lock()
+	defer s.confMutex.Unlock()
+	s.conf.SegmentCount = conf.SegmentCount
+	s.conf.SegmentDuration = conf.SegmentDuration
+	s.conf.PartDuration = conf.PartDuration
+	s.conf.ViewerTimeoutSec = conf.ViewerTimeoutSec
+	s.conf.IdleTimeoutSec = conf.IdleTimeoutSec
+}
+
+func (s *HlsServer) getConf() config.HlsConfig {
+	s.confMutex.RLock()
+	defer s.confMutex.RUnlock()
+	return s.conf
+}
+
+func (s *HlsServer) SetAuthenticator(authenticator auth.IAuthenticator) {
+	s.auth = authenticator
+}
+
+func (s *HlsServer) sessionMap(ts bool) *sync.Map {
+	if ts {
+		return &s.tsSessions
+	}
+	return &s.sessions
+}
+
+func (s *HlsServer) hasSession(streamName string) bool {
+	_, ok := s.sessions.Load(streamName)
+	if !ok {
+		_, ok = s.tsSessions.Load(streamName)
 	}
+	return ok
 }
 
 func (s *HlsServer) cleanInvalidSession() {
@@ -1,12 +1,17 @@
 package hls
 
 import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	config "github.com/q191201771/lalmax/conf"
 
 	"github.com/bluenviron/gohlslib"
 	"github.com/bluenviron/gohlslib/pkg/codecs"
+	"github.com/bluenviron/gohlslib/pkg/playlist"
 	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
 	"github.com/gin-gonic/gin"
 	"github.com/q191201771/lal/pkg/avc"
@@ -33,11 +38,22 @@ type HlsSession struct {
 	audioStartPTSFilled bool
 	videoStartPTSFilled bool
 	SessionId           string
+	unsupported         bool // 没有可以封装的音视频轨道，不再尝试启动muxer
+
+	bitrate      bitrateCounter
+	variantMutex sync.Mutex
+	variant      *playlist.MultivariantVariant
+
+	lastRequestTime atomic.Int64 // 按需模式下用于判断是否空闲，单位纳秒
+	startedChan     chan struct{}
 }
 
-func NewHlsSession(streamName string, conf config.HlsConfig) *HlsSession {
+// NewHlsSession ts为true时使用mpegts封装，否则根据配置使用fmp4或者llhls
+func NewHlsSession(streamName string, conf config.HlsConfig, ts bool) *HlsSession {
 	variant := gohlslib.MuxerVariantFMP4
-	if conf.LowLatency {
+	if ts {
+		variant = gohlslib.MuxerVariantMPEGTS
+	} else if conf.LowLatency {
 		variant = gohlslib.MuxerVariantLowLatency
 	}
 
@@ -53,17 +69,18 @@ func NewHlsSession(streamName string, conf config.HlsConfig) *HlsSession {
 		data:         make([]Frame, 10)[0:0],
 		streamName:   streamName,
 		SessionId:    u.String(),
+		startedChan:  make(chan struct{}),
 	}
 
 	uid, _ := uuid.NewV4()
 	session.SessionId = uid.String()
 
-	if !conf.LowLatency && conf.SegmentCount > 0 {
-		// fmp4模式下可以设置分片个数
+	if variant != gohlslib.MuxerVariantLowLatency && conf.SegmentCount > 0 {
+		// fmp4和mpegts模式下可以设置分片个数
 		session.muxer.SegmentCount = conf.SegmentCount
 	}
 
-	if conf.LowLatency && conf.PartDuration > 0 {
+	if variant == gohlslib.MuxerVariantLowLatency && conf.PartDuration > 0 {
 		// llhls设置part duration
 		session.muxer.PartDuration = time.Millisecond * time.Duration(conf.PartDuration)
 	}
@@ -76,6 +93,11 @@ func NewHlsSession(streamName string, conf config.HlsConfig) *HlsSession {
 }
 
 func (session *HlsSession) OnMsg(msg base.RtmpMsg) {
+	session.bitrate.add(len(msg.Payload))
+	if session.unsupported {
+		return
+	}
+
 	if session.done {
 		if msg.Header.MsgTypeId == base.RtmpTypeIdVideo {
 			if msg.IsVideoKeySeqHeader() {
@@ -90,6 +112,9 @@ func (session *HlsSession) OnMsg(msg base.RtmpMsg) {
 					session.vps, session.sps, session.pps, _ = hevc.ParseVpsSpsPpsFromSeqHeaderWithoutMalloc(msg.Payload)
 				}
 			} else {
+				if session.muxer.VideoTrack == nil {
+					return
+				}
 				nals, err := avc.SplitNaluAvcc(msg.Payload[5:])
 				if err != nil {
 					nazalog.Error(err)
@@ -116,7 +141,7 @@ func (session *HlsSession) OnMsg(msg base.RtmpMsg) {
 				}
 			}
 
-		} else {
+		} else if session.muxer.AudioTrack != nil {
 			if session.audioCodecId == int(base.RtmpSoundFormatAac) {
 				pts := time.Millisecond*time.Duration(msg.Dts()) - session.startAudioPts
 				err := session.muxer.WriteMPEG4Audio(time.Now(), pts, [][]byte{msg.Payload[2:]})
@@ -278,19 +303,49 @@ func (session *HlsSession) drain() {
 		}
 	}
 
+	if session.muxer.Variant == gohlslib.MuxerVariantMPEGTS {
+		// gohlslib的mpegts封装只支持h264和aac
+		if session.muxer.VideoTrack != nil {
+			if _, ok := session.muxer.VideoTrack.Codec.(*codecs.H264); !ok {
+				nazalog.Warn("hls-ts only support h264, drop video, streamName:", session.streamName)
+				session.muxer.VideoTrack = nil
+			}
+		}
+		if session.muxer.AudioTrack != nil {
+			if _, ok := session.muxer.AudioTrack.Codec.(*codecs.MPEG4Audio); !ok {
+				nazalog.Warn("hls-ts only support aac, drop audio, streamName:", session.streamName)
+				session.muxer.AudioTrack = nil
+			}
+		}
+		if session.muxer.VideoTrack == nil && session.muxer.AudioTrack == nil {
+			// 例如只有h265和opus的流，只提示一次，之后的消息直接丢弃
+			nazalog.Warn("hls-ts no supported track, streamName:", session.streamName)
+			session.unsupported = true
+			session.data = nil
+			return
+		}
+	}
+
 	if err := session.muxer.Start(); err != nil {
 		nazalog.Error(err)
 		return
 	}
 
+	session.variantMutex.Lock()
+	session.variant = newVariant(session.muxer.VideoTrack, session.muxer.AudioTrack)
+	session.variantMutex.Unlock()
+
 	for _, data := range session.data {
-		if (data.codecType == base.RtmpCodecIdAvc || data.codecType == base.RtmpCodecIdHevc) && session.videoCodecId != -1 {
+		if data.codecType == base.RtmpCodecIdAvc || data.codecType == base.RtmpCodecIdHevc {
+			if session.muxer.VideoTrack == nil {
+				continue
+			}
 			err := session.muxer.WriteH26x(data.ntp, data.pts, data.au)
 			if err != nil {
 				nazalog.Error("hls-fmp4 WriteH26x failed, err:", err)
 				continue
 			}
-		} else if session.audioCodecId != -1 {
+		} else if session.muxer.AudioTrack != nil {
 			if data.codecType == base.RtmpSoundFormatAac {
 				err := session.muxer.WriteMPEG4Audio(data.ntp, data.pts, data.au)
 				if err != nil {
@@ -311,6 +366,7 @@ func (session *HlsSession) drain() {
 	}
 
 	session.done = true
+	close(session.startedChan)
 }
 
 func (session *HlsSession) OnStop() {
@@ -319,9 +375,41 @@ func (session *HlsSession) OnStop() {
 	}
 }
 
+// getVariant 返回该流在ABR主播放列表中的码率信息，muxer还没有启动时返回nil
+func (session *HlsSession) getVariant() *playlist.MultivariantVariant {
+	session.variantMutex.Lock()
+	defer session.variantMutex.Unlock()
+
+	if session.variant == nil {
+		return nil
+	}
+	v := *session.variant
+	if peak := session.bitrate.peak(); peak > 0 {
+		v.Bandwidth = peak
+	}
+	return &v
+}
+
 func (session *HlsSession) HandleRequest(ctx *gin.Context) {
 	nazalog.Info("handle hls request, streamName:", session.streamName, " path:", ctx.Request.URL.Path)
-	session.muxer.Handle(ctx.Writer, ctx.Request)
+
+	// muxer启动前不能处理请求，按需模式下第一次请求需要等待muxer启动
+	select {
+	case <-session.startedChan:
+	case <-time.After(muxerStartTimeout):
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	query := childQuery(ctx)
+	if len(query) == 0 || !strings.HasSuffix(ctx.Request.URL.Path, ".m3u8") {
+		session.muxer.Handle(ctx.Writer, ctx.Request)
+		return
+	}
+
+	w := &playlistWriter{ResponseWriter: ctx.Writer}
+	session.muxer.Handle(w, ctx.Request)
+	w.flush(query)
 }
 
 type Frame struct {
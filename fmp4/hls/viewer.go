@@ -0,0 +1,271 @@
+package hls
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/q191201771/lal/pkg/base"
+	"github.com/q191201771/naza/pkg/nazalog"
+)
+
+const (
+	// 播放器可以通过url参数携带会话id，不携带时通过cookie下发
+	viewerSessionParam  = "session_id"
+	viewerSessionCookie = "lalmax_hls_session"
+
+	viewerCheckInterval = 5 * time.Second
+
+	// 每路流最多统计的观看者个数，避免大量不带cookie的请求占用内存
+	maxViewersPerStream = 10000
+)
+
+var errTooManyViewers = errors.New("lalmax.hls: too many viewers")
+
+// INotifyHandler hls观看者的开始、结束事件通知
+type INotifyHandler interface {
+	OnSubStart(info base.SubStartInfo)
+	OnSubStop(info base.SubStopInfo)
+}
+
+// IStartChecker 可选，INotifyHandler同时实现时，新的观看者开始前同步检查，返回非nil时拒绝
+type IStartChecker interface {
+	CheckSubStart(info base.SubStartInfo) error
+}
+
+// hlsViewer hls是短连接，同一个会话id的多次请求认为是同一个观看者，超过一段时间没有请求则认为观看结束
+type hlsViewer struct {
+	mutex      sync.Mutex
+	key        string // 流名/会话id
+	stat       base.StatSub
+	streamName string
+	url        string
+	rawQuery   string
+	lastActive time.Time
+	lastBytes  uint64
+}
+
+func (v *hlsViewer) addBytes(n int) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.lastActive = time.Now()
+	if n > 0 {
+		v.stat.WroteBytesSum += uint64(n)
+	}
+}
+
+func (v *hlsViewer) getStat() base.StatSub {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	return v.stat
+}
+
+func (v *hlsViewer) eventInfo() base.SessionEventCommonInfo {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	return base.SessionEventCommonInfo{
+		SessionId:     v.stat.SessionId,
+		Protocol:      v.stat.Protocol,
+		BaseType:      v.stat.BaseType,
+		RemoteAddr:    v.stat.RemoteAddr,
+		Url:           v.url,
+		AppName:       "live",
+		StreamName:    v.streamName,
+		UrlParam:      v.rawQuery,
+		HasOutSession: true,
+		WroteBytesSum: v.stat.WroteBytesSum,
+	}
+}
+
+func (s *HlsServer) SetNotifyHandler(notify INotifyHandler) {
+	s.notify = notify
+}
+
+// GetAllViewers 获取某路流当前所有的hls观看者
+func (s *HlsServer) GetAllViewers(streamName string) (out []base.StatSub) {
+	s.viewers.Range(func(_, value interface{}) bool {
+		v := value.(*hlsViewer)
+		if v.streamName == streamName {
+			out = append(out, v.getStat())
+		}
+		return true
+	})
+	return
+}
+
+// serveViewer 统计请求对应的观看者，新的观看者在播放列表请求成功后才开始统计
+//
+// 新的观看者被同步回调拒绝或者超过个数上限时不处理请求，直接返回错误
+func (s *HlsServer) serveViewer(ctx *gin.Context, streamName string, serve func()) {
+	v, registered, err := s.touchViewer(ctx, streamName)
+	if err != nil {
+		ctx.Status(viewerErrorStatus(err))
+		return
+	}
+	serve()
+	if !registered {
+		if !strings.HasSuffix(ctx.Request.URL.Path, ".m3u8") || ctx.Writer.Status() != http.StatusOK {
+			return
+		}
+		if v = s.registerViewer(v); v == nil {
+			return
+		}
+	}
+	v.addBytes(ctx.Writer.Size())
+}
+
+// touchViewer 根据请求找到观看者，registered为false时是还没有统计的新观看者，已经通过同步回调的检查
+//
+// 不带会话id和cookie的请求(部分播放器、curl、CDN回源)使用客户端ip和User-Agent生成会话id，
+// 同一个出口ip下User-Agent相同的多个播放器会被统计为一个观看者
+func (s *HlsServer) touchViewer(ctx *gin.Context, streamName string) (v *hlsViewer, registered bool, err error) {
+	id := ctx.Query(viewerSessionParam)
+	if id == "" {
+		id, _ = ctx.Cookie(viewerSessionCookie)
+	}
+	if id == "" {
+		sum := sha1.Sum([]byte(ctx.ClientIP() + "|" + ctx.Request.UserAgent()))
+		id = hex.EncodeToString(sum[:])
+	}
+	ctx.SetCookie(viewerSessionCookie, id, 0, path.Dir(ctx.Request.URL.Path), "", false, true)
+
+	key := streamName + "/" + id
+	if value, ok := s.viewers.Load(key); ok {
+		return value.(*hlsViewer), true, nil
+	}
+
+	v = &hlsViewer{
+		key:        key,
+		streamName: streamName,
+		url:        ctx.Request.URL.String(),
+		rawQuery:   removeQueryParam(ctx.Request.URL.RawQuery, viewerSessionParam),
+	}
+	v.stat.SessionId = id
+	v.stat.Protocol = base.SessionProtocolHlsStr
+	v.stat.BaseType = base.SessionBaseTypeSubStr
+	// 经过反向代理时使用trusted_proxies配置解析出的客户端地址
+	v.stat.RemoteAddr = ctx.ClientIP()
+
+	if s.viewerCount(streamName) >= maxViewersPerStream {
+		nazalog.Warnf("hls too many viewers, streamName:%s, sessionId:%s", streamName, id)
+		return nil, false, errTooManyViewers
+	}
+
+	if checker, ok := s.notify.(IStartChecker); ok {
+		info := base.SubStartInfo{SessionEventCommonInfo: v.eventInfo()}
+		info.HasInSession = s.hasSession(streamName)
+		if err = checker.CheckSubStart(info); err != nil {
+			nazalog.Warnf("hls viewer rejected, streamName:%s, sessionId:%s, err:%+v", streamName, id, err)
+			return nil, false, err
+		}
+	}
+	return v, false, nil
+}
+
+// registerViewer 开始统计新的观看者，并发请求时返回已经统计的观看者，超过个数上限时返回nil
+func (s *HlsServer) registerViewer(v *hlsViewer) *hlsViewer {
+	s.viewerMutex.Lock()
+	if value, ok := s.viewers.Load(v.key); ok {
+		s.viewerMutex.Unlock()
+		return value.(*hlsViewer)
+	}
+	if s.viewerCounts[v.streamName] >= maxViewersPerStream {
+		s.viewerMutex.Unlock()
+		return nil
+	}
+	v.lastActive = time.Now()
+	v.stat.StartTime = v.lastActive.Format("2006-01-02 15:04:05.999")
+	s.viewers.Store(v.key, v)
+	s.viewerCounts[v.streamName]++
+	s.viewerMutex.Unlock()
+
+	nazalog.Infof("hls viewer start, streamName:%s, sessionId:%s, remoteAddr:%s", v.streamName, v.stat.SessionId, v.stat.RemoteAddr)
+	if s.notify != nil {
+		info := base.SubStartInfo{SessionEventCommonInfo: v.eventInfo()}
+		info.HasInSession = s.hasSession(v.streamName)
+		s.notify.OnSubStart(info)
+	}
+	return v
+}
+
+// unregisterViewer 结束统计，流没有观看者时删除计数
+func (s *HlsServer) unregisterViewer(v *hlsViewer) {
+	s.viewerMutex.Lock()
+	defer s.viewerMutex.Unlock()
+
+	s.viewers.Delete(v.key)
+	if s.viewerCounts[v.streamName]--; s.viewerCounts[v.streamName] <= 0 {
+		delete(s.viewerCounts, v.streamName)
+	}
+}
+
+// cleanViewers 定时清理超时的观看者，并计算码率
+func (s *HlsServer) cleanViewers() {
+	ticker := time.NewTicker(viewerCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		timeout := time.Duration(s.getConf().ViewerTimeoutSec) * time.Second
+		now := time.Now()
+		s.viewers.Range(func(_, value interface{}) bool {
+			v := value.(*hlsViewer)
+
+			v.mutex.Lock()
+			expired := now.Sub(v.lastActive) > timeout
+			kbits := int((v.stat.WroteBytesSum - v.lastBytes) * 8 / 1000 / uint64(viewerCheckInterval/time.Second))
+			v.stat.BitrateKbits = kbits
+			v.stat.WriteBitrateKbits = kbits
+			v.lastBytes = v.stat.WroteBytesSum
+			v.mutex.Unlock()
+
+			if !expired {
+				return true
+			}
+
+			s.unregisterViewer(v)
+			nazalog.Infof("hls viewer stop, streamName:%s, sessionId:%s", v.streamName, v.stat.SessionId)
+			if s.notify != nil {
+				info := base.SubStopInfo{SessionEventCommonInfo: v.eventInfo()}
+				info.HasInSession = s.hasSession(v.streamName)
+				s.notify.OnSubStop(info)
+			}
+			return true
+		})
+	}
+}
+
+// viewerCount 某路流当前的观看者个数
+func (s *HlsServer) viewerCount(streamName string) int {
+	s.viewerMutex.Lock()
+	defer s.viewerMutex.Unlock()
+	return s.viewerCounts[streamName]
+}
+
+func viewerErrorStatus(err error) int {
+	if err == errTooManyViewers {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusForbidden
+}
+
+func removeQueryParam(rawQuery, name string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	var items []string
+	for _, item := range strings.Split(rawQuery, "&") {
+		if item == name || strings.HasPrefix(item, name+"=") {
+			continue
+		}
+		items = append(items, item)
+	}
+	return strings.Join(items, "&")
+}
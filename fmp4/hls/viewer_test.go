@@ -0,0 +1,64 @@
+package hls
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newViewerContext(path string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, path, nil)
+	ctx.Request.RemoteAddr = "192.0.2.10:50000"
+	return ctx, w
+}
+
+func TestServeViewer(t *testing.T) {
+	s := &HlsServer{viewerCounts: make(map[string]int)}
+
+	testCases := []struct {
+		name   string
+		path   string
+		status int
+		expect int
+	}{
+		// 切片请求和失败的播放列表请求不统计
+		{"segment", "/live/hls/test/seg0.mp4?session_id=a", http.StatusOK, 0},
+		{"playlist not found", "/live/hls/test/stream.m3u8?session_id=a", http.StatusNotFound, 0},
+		{"playlist", "/live/hls/test/stream.m3u8?session_id=a", http.StatusOK, 1},
+		{"same viewer", "/live/hls/test/seg1.mp4?session_id=a", http.StatusOK, 1},
+		{"other viewer", "/live/hls/test/stream.m3u8?session_id=b", http.StatusOK, 2},
+	}
+	for _, tc := range testCases {
+		ctx, _ := newViewerContext(tc.path)
+		s.serveViewer(ctx, "test", func() {
+			ctx.String(tc.status, "data")
+		})
+		if n := s.viewerCount("test"); n != tc.expect {
+			t.Fatalf("%s: expect viewers:%d, got:%d", tc.name, tc.expect, n)
+		}
+	}
+
+	stats := s.GetAllViewers("test")
+	if len(stats) != 2 || stats[0].RemoteAddr != "192.0.2.10" {
+		t.Fatalf("unexpected viewers:%+v", stats)
+	}
+
+	// 全部结束后删除计数
+	s.viewers.Range(func(_, value interface{}) bool {
+		v := value.(*hlsViewer)
+		if v.stat.SessionId == "a" && v.stat.WroteBytesSum != 8 {
+			t.Fatalf("expect 8 bytes, got:%d", v.stat.WroteBytesSum)
+		}
+		v.lastActive = time.Time{}
+		s.unregisterViewer(v)
+		return true
+	})
+	if _, ok := s.viewerCounts["test"]; ok {
+		t.Fatal("expect viewer count deleted")
+	}
+}
@@ -1,10 +1,14 @@
 package httpfmp4
 
 import (
+	"net/http"
+
 	"github.com/gin-gonic/gin"
+	"github.com/q191201771/lalmax/auth"
 )
 
 type HttpFmp4Server struct {
+	auth auth.IAuthenticator
 }
 
 func NewHttpFmp4Server() *HttpFmp4Server {
@@ -13,9 +17,20 @@ func NewHttpFmp4Server() *HttpFmp4Server {
 	return svr
 }
 
+func (s *HttpFmp4Server) SetAuthenticator(authenticator auth.IAuthenticator) {
+	s.auth = authenticator
+}
+
 func (s *HttpFmp4Server) HandleRequest(c *gin.Context) {
 	streamid := c.Param("streamid")
 
+	if s.auth != nil {
+		if err := s.auth.Authenticate(auth.NewHttpAuthInfo(auth.ProtocolHttpFmp4, auth.ActionSub, streamid, c.Request, c.ClientIP())); err != nil {
+			c.Status(http.StatusForbidden)
+			return
+		}
+	}
+
 	session := NewHttpFmp4Session(streamid)
 	session.handleSession(c)
 }
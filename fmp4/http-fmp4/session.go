@@ -6,6 +6,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/q191201771/lalmax/auth"
 	"github.com/q191201771/lalmax/hook"
 
 	"github.com/gofrs/uuid"
@@ -193,6 +194,18 @@ func (session *HttpFmp4Session) handleSession(c *gin.Context) {
 		return
 	}
 
+	// 同步回调需要在应答之前检查，拒绝时返回403
+	info := hook.SessionInfo{
+		Protocol:   auth.ProtocolHttpFmp4,
+		RemoteAddr: c.Request.RemoteAddr,
+		Url:        c.Request.URL.String(),
+		RawQuery:   c.Request.URL.RawQuery,
+	}
+	if err := hooksession.CheckConsumer(session.subscriberId, info); err != nil {
+		c.Status(http.StatusForbidden)
+		return
+	}
+
 	c.Header("Content-Type", "video/mp4")
 	c.Header("Connection", "close")
 	c.Header("Expires", "-1")
@@ -218,7 +231,7 @@ func (session *HttpFmp4Session) handleSession(c *gin.Context) {
 		nazalog.Errorf("session writeHttpHeader. err=%+v", err)
 		return
 	}
-	session.hooks.AddConsumer(session.subscriberId, session)
+	session.hooks.AddCheckedConsumer(session.subscriberId, session, info)
 	session.initSegment.Encode(session.conn)
 
 	readBuf := make([]byte, 1024)
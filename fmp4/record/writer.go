@@ -0,0 +1,434 @@
+package record
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/q191201771/lal/pkg/aac"
+	"github.com/q191201771/lal/pkg/avc"
+	"github.com/q191201771/lal/pkg/base"
+	"github.com/q191201771/lal/pkg/hevc"
+	"github.com/q191201771/naza/pkg/nazalog"
+)
+
+var ErrNoTrack = errors.New("no audio or video track")
+
+const (
+	// 每个分片最多包含的帧数，视频在关键帧处也会切分片
+	maxFragmentSamples = 100
+
+	// 写入init segment前等待音视频两路header的最长时间(按照时间戳计算)和最多缓存的帧数，
+	// 超过后只写入已经收到header的轨道
+	maxInitWaitMs    = 2000
+	maxInitCacheMsgs = 512
+)
+
+// Fmp4FileWriter 把rtmp消息写入fmp4文件，可以作为hook session的消费者使用
+type Fmp4FileWriter struct {
+	mutex sync.Mutex
+
+	filename string
+	file     *os.File
+	bw       *bufio.Writer
+	w        *countWriter
+
+	videoHeader *base.RtmpMsg
+	audioHeader *base.RtmpMsg // G.711没有sequence header，使用第一帧
+	cache       []base.RtmpMsg
+	initWritten bool
+	closed      bool
+
+	videoTrack *fragmentTrack
+	audioTrack *fragmentTrack
+	seqNumber  uint32
+
+	firstDts int64
+	lastDts  int64
+}
+
+// fragmentTrack 缓存一帧，下一帧到来时才能计算出这一帧的时长
+type fragmentTrack struct {
+	trackId  uint32
+	fragment *mp4.Fragment
+	pending  *mp4.FullSample
+	lastDur  uint32
+}
+
+func NewFmp4FileWriter(filename string) (*Fmp4FileWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriterSize(file, 256*1024)
+	return &Fmp4FileWriter{
+		filename: filename,
+		file:     file,
+		bw:       bw,
+		w:        &countWriter{w: bw},
+		firstDts: -1,
+	}, nil
+}
+
+func (fw *Fmp4FileWriter) Filename() string {
+	return fw.filename
+}
+
+// Duration 已经写入的媒体时长，单位毫秒
+func (fw *Fmp4FileWriter) Duration() int64 {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+
+	if fw.firstDts < 0 {
+		return 0
+	}
+	return fw.lastDts - fw.firstDts
+}
+
+// Size 已经写入的字节数
+func (fw *Fmp4FileWriter) Size() int64 {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+
+	return fw.w.n
+}
+
+func (fw *Fmp4FileWriter) OnMsg(msg base.RtmpMsg) {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+
+	if fw.closed || len(msg.Payload) == 0 {
+		return
+	}
+	if fw.initWritten {
+		fw.feed(msg)
+		return
+	}
+
+	// init segment写入前记录header并缓存数据帧，等两路header都收到后再写入
+	switch msg.Header.MsgTypeId {
+	case base.RtmpTypeIdVideo:
+		if msg.IsVideoKeySeqHeader() {
+			m := msg.Clone()
+			fw.videoHeader = &m
+			return
+		}
+	case base.RtmpTypeIdAudio:
+		if msg.IsAacSeqHeader() {
+			m := msg.Clone()
+			fw.audioHeader = &m
+			return
+		}
+		if isG711(msg) && fw.audioHeader == nil {
+			m := msg.Clone()
+			fw.audioHeader = &m
+		}
+	default:
+		return
+	}
+
+	fw.cache = append(fw.cache, msg.Clone())
+	if fw.readyToInit() {
+		fw.flushCache()
+	}
+}
+
+// readyToInit 两路header都已经收到，或者等待超时
+func (fw *Fmp4FileWriter) readyToInit() bool {
+	if fw.videoHeader != nil && fw.audioHeader != nil {
+		return true
+	}
+	if len(fw.cache) >= maxInitCacheMsgs {
+		return true
+	}
+	first, last := fw.cache[0].Dts(), fw.cache[len(fw.cache)-1].Dts()
+	return last > first && last-first >= maxInitWaitMs
+}
+
+// flushCache 写入init segment和缓存的数据帧，一路header都没有时丢弃缓存继续等待
+func (fw *Fmp4FileWriter) flushCache() {
+	cache := fw.cache
+	fw.cache = nil
+	if !fw.writeInit() {
+		return
+	}
+	for _, msg := range cache {
+		fw.feed(msg)
+	}
+}
+
+func (fw *Fmp4FileWriter) feed(msg base.RtmpMsg) {
+	switch msg.Header.MsgTypeId {
+	case base.RtmpTypeIdVideo:
+		if msg.IsVideoKeySeqHeader() {
+			return
+		}
+		fw.feedVideo(msg)
+	case base.RtmpTypeIdAudio:
+		if msg.IsAacSeqHeader() {
+			return
+		}
+		fw.feedAudio(msg)
+	}
+}
+
+func (fw *Fmp4FileWriter) OnStop() {
+	fw.Close()
+}
+
+// Close 写入缓存的分片并关闭文件
+func (fw *Fmp4FileWriter) Close() error {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+
+	if fw.closed {
+		return nil
+	}
+	// 流很短，等待header期间就结束了
+	if !fw.initWritten && len(fw.cache) > 0 {
+		fw.flushCache()
+	}
+	fw.closed = true
+
+	for _, t := range []*fragmentTrack{fw.videoTrack, fw.audioTrack} {
+		if t != nil {
+			fw.flush(t, true)
+		}
+	}
+	if err := fw.bw.Flush(); err != nil {
+		fw.file.Close()
+		return err
+	}
+	return fw.file.Close()
+}
+
+// writeInit 根据收到的header写入init segment
+func (fw *Fmp4FileWriter) writeInit() bool {
+	if fw.initWritten {
+		return true
+	}
+	if fw.videoHeader == nil && fw.audioHeader == nil {
+		return false
+	}
+
+	init := mp4.CreateEmptyInit()
+	moov := init.Moov
+	moov.Mvhd.NextTrackID = 1
+
+	if fw.videoHeader != nil {
+		trak := mp4.CreateEmptyTrak(moov.Mvhd.NextTrackID, 1000, "video", "und")
+		if err := setVideoDescriptor(trak, fw.videoHeader); err != nil {
+			nazalog.Error("set video descriptor failed, file:", fw.filename, " err:", err)
+		} else {
+			fw.videoTrack = &fragmentTrack{trackId: moov.Mvhd.NextTrackID}
+			moov.AddChild(trak)
+			moov.Mvex.AddChild(mp4.CreateTrex(fw.videoTrack.trackId))
+			moov.Mvhd.NextTrackID++
+		}
+	}
+	if fw.audioHeader != nil {
+		trak := mp4.CreateEmptyTrak(moov.Mvhd.NextTrackID, 1000, "audio", "und")
+		if err := setAudioDescriptor(trak, fw.audioHeader); err != nil {
+			nazalog.Error("set audio descriptor failed, file:", fw.filename, " err:", err)
+		} else {
+			fw.audioTrack = &fragmentTrack{trackId: moov.Mvhd.NextTrackID}
+			moov.AddChild(trak)
+			moov.Mvex.AddChild(mp4.CreateTrex(fw.audioTrack.trackId))
+			moov.Mvhd.NextTrackID++
+		}
+	}
+	if fw.videoTrack == nil && fw.audioTrack == nil {
+		nazalog.Error(ErrNoTrack, ", file:", fw.filename)
+		fw.closed = true
+		return false
+	}
+
+	fw.encode(init)
+	fw.initWritten = true
+	return true
+}
+
+func (fw *Fmp4FileWriter) feedVideo(msg base.RtmpMsg) {
+	t := fw.videoTrack
+	if t == nil || (msg.VideoCodecId() != base.RtmpCodecIdAvc && msg.VideoCodecId() != base.RtmpCodecIdHevc) {
+		return
+	}
+
+	index := 5
+	if msg.IsEnhanced() {
+		index = msg.GetEnchanedHevcNaluIndex()
+	}
+	if len(msg.Payload) <= index {
+		return
+	}
+
+	flags := mp4.NonSyncSampleFlags
+	if msg.IsVideoKeyNalu() {
+		flags = mp4.SyncSampleFlags
+	}
+
+	data := make([]byte, len(msg.Payload)-index)
+	copy(data, msg.Payload[index:])
+	// 关键帧处切分片，方便播放器拖动
+	fw.addSample(t, msg.Dts(), msg.IsVideoKeyNalu(), mp4.FullSample{
+		Data:       data,
+		DecodeTime: uint64(msg.Dts()),
+		Sample: mp4.Sample{
+			Flags:                 flags,
+			Size:                  uint32(len(data)),
+			CompositionTimeOffset: int32(msg.Cts()),
+		},
+	})
+}
+
+func (fw *Fmp4FileWriter) feedAudio(msg base.RtmpMsg) {
+	t := fw.audioTrack
+	if t == nil || msg.AudioCodecId() != fw.audioHeader.AudioCodecId() {
+		return
+	}
+
+	// aac有1字节的AACPacketType，G.711只有1字节的音频tag头
+	index := 1
+	if msg.AudioCodecId() == base.RtmpSoundFormatAac {
+		index = 2
+	}
+	if len(msg.Payload) <= index {
+		return
+	}
+
+	data := make([]byte, len(msg.Payload)-index)
+	copy(data, msg.Payload[index:])
+	fw.addSample(t, msg.Dts(), false, mp4.FullSample{
+		Data:       data,
+		DecodeTime: uint64(msg.Dts()),
+		Sample: mp4.Sample{
+			Flags: mp4.NonSyncSampleFlags,
+			Size:  uint32(len(data)),
+		},
+	})
+}
+
+func (fw *Fmp4FileWriter) addSample(t *fragmentTrack, dts uint32, cut bool, sample mp4.FullSample) {
+	if fw.firstDts < 0 {
+		fw.firstDts = int64(dts)
+	}
+	if int64(dts) > fw.lastDts {
+		fw.lastDts = int64(dts)
+	}
+
+	if t.pending != nil {
+		if sample.DecodeTime > t.pending.DecodeTime {
+			t.lastDur = uint32(sample.DecodeTime - t.pending.DecodeTime)
+		}
+		fw.appendPending(t)
+	}
+	if cut || (t.fragment != nil && len(t.fragment.Moof.Traf.Trun.Samples) >= maxFragmentSamples) {
+		fw.flush(t, false)
+	}
+	t.pending = &sample
+}
+
+func (fw *Fmp4FileWriter) appendPending(t *fragmentTrack) {
+	t.pending.Dur = t.lastDur
+	if t.fragment == nil {
+		fw.seqNumber++
+		t.fragment, _ = mp4.CreateFragment(fw.seqNumber, t.trackId)
+	}
+	t.fragment.AddFullSample(*t.pending)
+	t.pending = nil
+}
+
+// flush 写入当前分片，last为true时把缓存的最后一帧也写入
+func (fw *Fmp4FileWriter) flush(t *fragmentTrack, last bool) {
+	if last && t.pending != nil {
+		fw.appendPending(t)
+	}
+	if t.fragment == nil || len(t.fragment.Moof.Traf.Trun.Samples) == 0 {
+		return
+	}
+	fw.encode(t.fragment)
+	t.fragment = nil
+}
+
+func (fw *Fmp4FileWriter) encode(box interface {
+	Encode(w io.Writer) error
+}) {
+	if err := box.Encode(fw.w); err != nil {
+		nazalog.Error("write fmp4 failed, file:", fw.filename, " err:", err)
+	}
+}
+
+// countWriter 统计写入的字节数
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func setVideoDescriptor(trak *mp4.TrakBox, header *base.RtmpMsg) error {
+	switch header.VideoCodecId() {
+	case base.RtmpCodecIdAvc:
+		sps, pps, err := avc.ParseSpsPpsFromSeqHeader(header.Payload)
+		if err != nil {
+			return err
+		}
+		return trak.SetAVCDescriptor("avc1", [][]byte{sps}, [][]byte{pps}, true)
+	case base.RtmpCodecIdHevc:
+		var vps, sps, pps []byte
+		var err error
+		if header.IsEnhanced() {
+			vps, sps, pps, err = hevc.ParseVpsSpsPpsFromEnhancedSeqHeader(header.Payload)
+		} else {
+			vps, sps, pps, err = hevc.ParseVpsSpsPpsFromSeqHeader(header.Payload)
+		}
+		if err != nil {
+			return err
+		}
+		return trak.SetHEVCDescriptor("hvc1", [][]byte{vps}, [][]byte{sps}, [][]byte{pps}, nil, true)
+	}
+	return errors.New("unsupported video codec")
+}
+
+func setAudioDescriptor(trak *mp4.TrakBox, header *base.RtmpMsg) error {
+	switch header.AudioCodecId() {
+	case base.RtmpSoundFormatG711A:
+		// 国标设备的G.711固定为8000Hz单声道
+		trak.Mdia.Minf.Stbl.Stsd.AddChild(mp4.CreateAudioSampleEntryBox("alaw", 1, 16, 8000, nil))
+		return nil
+	case base.RtmpSoundFormatG711U:
+		trak.Mdia.Minf.Stbl.Stsd.AddChild(mp4.CreateAudioSampleEntryBox("ulaw", 1, 16, 8000, nil))
+		return nil
+	}
+	if header.AudioCodecId() != base.RtmpSoundFormatAac || len(header.Payload) <= 2 {
+		return errors.New("unsupported audio codec")
+	}
+	ascCtx, err := aac.NewAscContext(header.Payload[2:])
+	if err != nil {
+		return err
+	}
+	samplerate, _ := ascCtx.GetSamplingFrequency()
+	switch ascCtx.AudioObjectType {
+	case 5, 29:
+		// HE-AAC v1/v2
+		return trak.SetAACDescriptor(ascCtx.AudioObjectType, samplerate)
+	default:
+		return trak.SetAACDescriptor(2, samplerate)
+	}
+}
+
+func isG711(msg base.RtmpMsg) bool {
+	codecId := msg.AudioCodecId()
+	return codecId == base.RtmpSoundFormatG711A || codecId == base.RtmpSoundFormatG711U
+}
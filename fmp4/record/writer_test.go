@@ -0,0 +1,147 @@
+package record
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/q191201771/lal/pkg/avc"
+	"github.com/q191201771/lal/pkg/base"
+)
+
+var (
+	testSps = []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60}
+	testPps = []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+)
+
+func rtmpMsg(typeId uint8, dts uint32, payload []byte) base.RtmpMsg {
+	var msg base.RtmpMsg
+	msg.Header.MsgTypeId = typeId
+	msg.Header.TimestampAbs = dts
+	msg.Header.MsgLen = uint32(len(payload))
+	msg.Payload = payload
+	return msg
+}
+
+func videoHeader(t *testing.T) base.RtmpMsg {
+	payload, err := avc.BuildSeqHeaderFromSpsPps(testSps, testPps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rtmpMsg(base.RtmpTypeIdVideo, 0, payload)
+}
+
+func videoFrame(dts uint32, key bool) base.RtmpMsg {
+	nalu := []byte{0x41, 0x9a, 0x00, 0x01}
+	first := byte(0x27)
+	if key {
+		nalu[0] = 0x65
+		first = 0x17
+	}
+	payload := []byte{first, base.RtmpAvcPacketTypeNalu, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(payload[5:], uint32(len(nalu)))
+	return rtmpMsg(base.RtmpTypeIdVideo, dts, append(payload, nalu...))
+}
+
+func aacHeader() base.RtmpMsg {
+	return rtmpMsg(base.RtmpTypeIdAudio, 0, []byte{0xaf, base.RtmpAacPacketTypeSeqHeader, 0x12, 0x10})
+}
+
+func aacFrame(dts uint32) base.RtmpMsg {
+	return rtmpMsg(base.RtmpTypeIdAudio, dts, []byte{0xaf, base.RtmpAacPacketTypeRaw, 0x21, 0x00, 0x49})
+}
+
+func g711aFrame(dts uint32) base.RtmpMsg {
+	return rtmpMsg(base.RtmpTypeIdAudio, dts, append([]byte{0x72}, make([]byte, 160)...))
+}
+
+func TestFmp4FileWriter(t *testing.T) {
+	testCases := []struct {
+		name         string
+		msgs         func(t *testing.T) []base.RtmpMsg
+		expectTracks []string // 期望的sample entry类型
+		expectSample int
+	}{
+		{
+			name: "audio header after video frames",
+			msgs: func(t *testing.T) []base.RtmpMsg {
+				return []base.RtmpMsg{
+					videoHeader(t), videoFrame(0, true), videoFrame(40, false), videoFrame(80, false),
+					aacHeader(), aacFrame(90), videoFrame(120, false), aacFrame(113),
+				}
+			},
+			expectTracks: []string{"avc1", "mp4a"},
+			expectSample: 6,
+		},
+		{
+			name: "g711a",
+			msgs: func(t *testing.T) []base.RtmpMsg {
+				return []base.RtmpMsg{
+					videoHeader(t), videoFrame(0, true), g711aFrame(0), videoFrame(40, false), g711aFrame(20), g711aFrame(40),
+				}
+			},
+			expectTracks: []string{"avc1", "alaw"},
+			expectSample: 5,
+		},
+		{
+			name: "video only wait timeout",
+			msgs: func(t *testing.T) []base.RtmpMsg {
+				msgs := []base.RtmpMsg{videoHeader(t)}
+				for i := uint32(0); i < 100; i++ {
+					msgs = append(msgs, videoFrame(i*40, i%25 == 0))
+				}
+				// 超时后收到的音频header不再生效
+				return append(msgs, aacHeader(), aacFrame(4000))
+			},
+			expectTracks: []string{"avc1"},
+			expectSample: 100,
+		},
+		{
+			name: "short stream without audio",
+			msgs: func(t *testing.T) []base.RtmpMsg {
+				return []base.RtmpMsg{videoHeader(t), videoFrame(0, true), videoFrame(40, false)}
+			},
+			expectTracks: []string{"avc1"},
+			expectSample: 2,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "test.mp4")
+			fw, err := NewFmp4FileWriter(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range tc.msgs(t) {
+				fw.OnMsg(msg)
+			}
+			if err = fw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := mp4.ReadMP4File(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Init == nil || len(f.Init.Moov.Traks) != len(tc.expectTracks) {
+				t.Fatalf("expect tracks:%v, got init:%+v", tc.expectTracks, f.Init)
+			}
+			for i, trak := range f.Init.Moov.Traks {
+				if typ := trak.Mdia.Minf.Stbl.Stsd.Children[0].Type(); typ != tc.expectTracks[i] {
+					t.Fatalf("expect tracks:%v, got track %d:%s", tc.expectTracks, i, typ)
+				}
+			}
+
+			samples := 0
+			for _, seg := range f.Segments {
+				for _, frag := range seg.Fragments {
+					samples += int(frag.Moof.Traf.Trun.SampleCount())
+				}
+			}
+			if samples != tc.expectSample {
+				t.Fatalf("expect samples:%d, got:%d", tc.expectSample, samples)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package gb28181
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/q191201771/naza/pkg/nazalog"
+	"golang.org/x/net/html/charset"
+)
+
+// INotifyHandler 国标事件通知，由lalmax转发为http回调
+type INotifyHandler interface {
+	OnGbAlarm(info AlarmInfo)
+}
+
+// AlarmInfo 设备上报的报警
+type AlarmInfo struct {
+	ServerId    string `json:"server_id,omitempty"`
+	DeviceId    string `json:"device_id"`    // 上报报警的设备
+	ChannelId   string `json:"channel_id"`   // 报警源，报警消息中的DeviceID，可能是设备本身或者报警输入通道
+	Priority    string `json:"priority"`     // 报警级别 1:一级警情 2:二级警情 3:三级警情 4:四级警情
+	Method      string `json:"method"`       // 报警方式 1:电话 2:设备 3:短信 4:GPS 5:视频 6:设备故障 7:其他
+	Type        string `json:"type"`         // 报警类型，含义和报警方式有关，例如视频报警中2为运动目标检测，6为区域入侵
+	EventType   string `json:"event_type"`   // 报警类型扩展参数，区域入侵时 1:进入区域 2:离开区域
+	Time        string `json:"time"`         // 设备上报的报警时间
+	Description string `json:"description"`  // 报警描述
+	Longitude   string `json:"longitude"`    // 经度
+	Latitude    string `json:"latitude"`     // 纬度
+	ReceiveTime int64  `json:"receive_time"` // 收到报警的时间，unix毫秒时间戳
+}
+
+// alarmMessage 报警通知的消息体，设备通过MESSAGE主动上报，或者订阅后通过NOTIFY上报
+type alarmMessage struct {
+	XMLName          xml.Name
+	CmdType          string
+	SN               int
+	DeviceID         string
+	AlarmPriority    string
+	AlarmMethod      string
+	AlarmTime        string
+	AlarmDescription string
+	Longitude        string
+	Latitude         string
+	AlarmType        string `xml:"Info>AlarmType"`
+	EventType        string `xml:"Info>AlarmTypeParam>EventType"`
+}
+
+// alarmHistory 内存中保存最近的报警，超过size条时丢弃最早的
+type alarmHistory struct {
+	mutex  sync.Mutex
+	size   int
+	alarms []*AlarmInfo
+}
+
+func (h *alarmHistory) add(info *AlarmInfo) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.alarms = append(h.alarms, info)
+	if len(h.alarms) > h.size {
+		h.alarms = append(h.alarms[:0], h.alarms[len(h.alarms)-h.size:]...)
+	}
+}
+
+// query 按条件查询报警，结果按收到时间倒序
+func (h *alarmHistory) query(req *ReqAlarms) []*AlarmInfo {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	infos := make([]*AlarmInfo, 0)
+	for i := len(h.alarms) - 1; i >= 0; i-- {
+		a := h.alarms[i]
+		if req.DeviceId != "" && a.DeviceId != req.DeviceId {
+			continue
+		}
+		if req.ChannelId != "" && a.ChannelId != req.ChannelId {
+			continue
+		}
+		if req.Priority != "" && a.Priority != req.Priority {
+			continue
+		}
+		if req.Method != "" && a.Method != req.Method {
+			continue
+		}
+		if req.StartTime > 0 && a.ReceiveTime < req.StartTime*1000 {
+			continue
+		}
+		if req.EndTime > 0 && a.ReceiveTime >= req.EndTime*1000 {
+			continue
+		}
+		infos = append(infos, a)
+		if req.Limit > 0 && len(infos) >= req.Limit {
+			break
+		}
+	}
+	return infos
+}
+
+// SetNotifyHandler 设置国标事件通知，需要在Start之前调用
+func (s *GB28181Server) SetNotifyHandler(notify INotifyHandler) {
+	s.notify = notify
+}
+
+// onAlarm 处理设备上报的报警，记录到历史中并通知
+func (s *GB28181Server) onAlarm(d *Device, body string) {
+	msg := &alarmMessage{}
+	decoder := xml.NewDecoder(bytes.NewReader([]byte(body)))
+	decoder.CharsetReader = charset.NewReaderLabel
+	if err := decoder.Decode(msg); err != nil {
+		if err = DecodeGbk(msg, []byte(body)); err != nil {
+			nazalog.Error("decode alarm failed, err:", err)
+			return
+		}
+	}
+	info := &AlarmInfo{
+		DeviceId:    d.ID,
+		ChannelId:   msg.DeviceID,
+		Priority:    msg.AlarmPriority,
+		Method:      msg.AlarmMethod,
+		Type:        msg.AlarmType,
+		EventType:   msg.EventType,
+		Time:        msg.AlarmTime,
+		Description: msg.AlarmDescription,
+		Longitude:   msg.Longitude,
+		Latitude:    msg.Latitude,
+		ReceiveTime: time.Now().UnixMilli(),
+	}
+	if info.ChannelId == "" {
+		info.ChannelId = d.ID
+	}
+	d.Status = DeviceAlarmedStatus
+	nazalog.Info("gb28181 alarm, deviceId:", info.DeviceId, " channelId:", info.ChannelId, " priority:", info.Priority,
+		" method:", info.Method, " type:", info.Type, " time:", info.Time, " description:", info.Description)
+
+	s.alarms.add(info)
+	if s.notify != nil {
+		s.notify.OnGbAlarm(*info)
+	}
+}
+
+// Alarms 查询报警历史
+func (s *GB28181Server) Alarms(req *ReqAlarms) []*AlarmInfo {
+	return s.alarms.query(req)
+}
+
+// SubscribeAlarm 向设备订阅报警，expires为0时取消订阅
+func (s *GB28181Server) SubscribeAlarm(deviceId string, expires int) error {
+	d := s.FindDevice(deviceId)
+	if d == nil || d.Status == DeviceOfflineStatus {
+		return ErrDeviceNotOnline
+	}
+	if expires == 0 {
+		return d.stopSubscription("Alarm")
+	}
+	return d.SubscribeAlarm(expires)
+}
+
+// AlarmSubscriptions 查询设备的报警订阅，deviceId为空时返回所有设备的
+func (s *GB28181Server) AlarmSubscriptions(deviceId string) []*SubscriptionInfo {
+	return s.Subscriptions(deviceId, "Alarm")
+}
+
+// ResetAlarm 报警复位，channelId为空时复位设备本身的报警
+func (s *GB28181Server) ResetAlarm(deviceId, channelId, alarmMethod, alarmType string) error {
+	d := s.FindDevice(deviceId)
+	if d == nil || d.Status == DeviceOfflineStatus {
+		return ErrDeviceNotOnline
+	}
+	if channelId == "" {
+		channelId = d.ID
+	}
+	request := d.CreateRequest(sip.MESSAGE, d.conf)
+	contentType := sip.ContentType("Application/MANSCDP+xml")
+	request.AppendHeader(&contentType)
+	request.SetBody(BuildAlarmResetXML(d.sn, channelId, alarmMethod, alarmType), true)
+	resp, err := d.SipRequestForResponse(request)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("reset alarm response code:%d", resp.StatusCode())
+	}
+	if d.Status == DeviceAlarmedStatus {
+		d.Status = DeviceOnlineStatus
+	}
+	nazalog.Info("gb28181 reset alarm, deviceId:", deviceId, " channelId:", channelId)
+	return nil
+}
+
+// SubscribeAlarm 订阅设备的报警，到期前自动刷新
+func (d *Device) SubscribeAlarm(expires int) error {
+	return d.startSubscription(&subscription{
+		cmdType: "Alarm",
+		event:   "presence",
+		expires: expires,
+		body: func(sn int) string {
+			return BuildAlarmSubscribeXML(sn, d.ID)
+		},
+	})
+}
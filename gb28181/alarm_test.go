@@ -0,0 +1,81 @@
+package gb28181
+
+import (
+	"testing"
+)
+
+func TestAlarmHistoryQuery(t *testing.T) {
+	h := &alarmHistory{size: 4}
+	alarms := []*AlarmInfo{
+		{DeviceId: "d1", ChannelId: "c1", Priority: "1", Method: "2", ReceiveTime: 1000},
+		{DeviceId: "d1", ChannelId: "c2", Priority: "2", Method: "5", ReceiveTime: 2000},
+		{DeviceId: "d2", ChannelId: "c3", Priority: "1", Method: "5", ReceiveTime: 3000},
+		{DeviceId: "d1", ChannelId: "c1", Priority: "3", Method: "2", ReceiveTime: 4000},
+		{DeviceId: "d2", ChannelId: "c4", Priority: "1", Method: "2", ReceiveTime: 5000},
+	}
+	for _, a := range alarms {
+		h.add(a)
+	}
+
+	testCases := []struct {
+		req    ReqAlarms
+		expect []int64
+	}{
+		// 超过size时丢弃最早的，结果按收到时间倒序
+		{ReqAlarms{}, []int64{5000, 4000, 3000, 2000}},
+		{ReqAlarms{DeviceId: "d1"}, []int64{4000, 2000}},
+		{ReqAlarms{ChannelId: "c1"}, []int64{4000}},
+		{ReqAlarms{Priority: "1"}, []int64{5000, 3000}},
+		{ReqAlarms{Method: "5"}, []int64{3000, 2000}},
+		{ReqAlarms{StartTime: 3, EndTime: 5}, []int64{4000, 3000}},
+		{ReqAlarms{Limit: 1}, []int64{5000}},
+		{ReqAlarms{DeviceId: "d3"}, []int64{}},
+	}
+	for _, tc := range testCases {
+		out := h.query(&tc.req)
+		if len(out) != len(tc.expect) {
+			t.Fatalf("req:%+v, expect:%v, got len:%d", tc.req, tc.expect, len(out))
+		}
+		for i := range out {
+			if out[i].ReceiveTime != tc.expect[i] {
+				t.Fatalf("req:%+v, expect:%v, got:%d at %d", tc.req, tc.expect, out[i].ReceiveTime, i)
+			}
+		}
+	}
+}
+
+func TestOnAlarm(t *testing.T) {
+	s := &GB28181Server{alarms: &alarmHistory{size: 10}}
+	d := &Device{ID: "34020000001110000001", Status: DeviceOnlineStatus}
+
+	// 解码失败的报警不记录，也不改变设备状态
+	s.onAlarm(d, "<Notify><CmdType>Alarm")
+	if out := s.Alarms(&ReqAlarms{}); len(out) != 0 {
+		t.Fatalf("expect invalid alarm dropped, got:%d", len(out))
+	}
+	if d.Status != DeviceOnlineStatus {
+		t.Fatalf("expect status unchanged, got:%s", d.Status)
+	}
+
+	s.onAlarm(d, `<?xml version="1.0" encoding="UTF-8"?>
+<Notify>
+<CmdType>Alarm</CmdType>
+<SN>1</SN>
+<DeviceID>34020000001340000001</DeviceID>
+<AlarmPriority>1</AlarmPriority>
+<AlarmMethod>5</AlarmMethod>
+<AlarmTime>2024-01-02T03:04:05</AlarmTime>
+<Info><AlarmType>2</AlarmType></Info>
+</Notify>`)
+	out := s.Alarms(&ReqAlarms{})
+	if len(out) != 1 {
+		t.Fatalf("expect 1 alarm, got:%d", len(out))
+	}
+	a := out[0]
+	if a.DeviceId != d.ID || a.ChannelId != "34020000001340000001" || a.Priority != "1" || a.Method != "5" || a.Type != "2" {
+		t.Fatalf("unexpected alarm:%+v", a)
+	}
+	if d.Status != DeviceAlarmedStatus {
+		t.Fatalf("expect alarmed status, got:%s", d.Status)
+	}
+}
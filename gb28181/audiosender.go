@@ -0,0 +1,261 @@
+package gb28181
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/q191201771/lal/pkg/base"
+	"github.com/q191201771/lalmax/gb28181/mpegps"
+	"github.com/q191201771/naza/pkg/nazalog"
+)
+
+const (
+	// 每个rtp包携带20ms的G.711数据
+	g711SamplesPerPacket = 160
+	// ps muxer中SCR为dts减去3600(40ms)，ps的时间戳从40ms开始避免下溢
+	psPtsOffset = 40
+)
+
+// ErrUnsupportedAudioCodec 不做opus/aac到G.711的转码，浏览器whip推流时需要带上audio_codec=g711
+var ErrUnsupportedAudioCodec = errors.New("unsupported audio codec, only G.711 is supported")
+
+// audioSdp 设备语音广播invite中的sdp信息
+type audioSdp struct {
+	ip          string
+	port        int
+	tcp         bool
+	setup       string // tcp时设备的连接方式 active/passive
+	payloadType uint8
+	ps          bool  // 是否使用ps封装
+	codec       uint8 // base.RtmpSoundFormatG711A/G711U
+	ssrc        string
+}
+
+// parseAudioSdp 解析设备的sdp，按m行中的顺序选择第一个支持的负载类型(PS/PCMA/PCMU)
+func parseAudioSdp(body string) (*audioSdp, error) {
+	m, err := parseSdpMedia(body, "audio")
+	if err != nil {
+		return nil, err
+	}
+	sdp := &audioSdp{
+		ip:    m.ip,
+		port:  m.port,
+		tcp:   m.tcp,
+		setup: m.setup,
+		ssrc:  m.ssrc,
+	}
+	for _, pt := range m.payloadTypes {
+		name, ok := m.rtpmap[pt]
+		if !ok {
+			// 静态负载类型可以不带rtpmap
+			switch pt {
+			case "0":
+				name = "PCMU"
+			case "8":
+				name = "PCMA"
+			}
+		}
+		n, err := strconv.Atoi(pt)
+		if err != nil {
+			continue
+		}
+		switch name {
+		case "PS":
+			// ps封装时按照国标的习惯使用G.711A
+			sdp.ps = true
+			sdp.codec = base.RtmpSoundFormatG711A
+		case "PCMA":
+			sdp.codec = base.RtmpSoundFormatG711A
+		case "PCMU":
+			sdp.codec = base.RtmpSoundFormatG711U
+		default:
+			continue
+		}
+		sdp.payloadType = uint8(n)
+		return sdp, nil
+	}
+	return nil, fmt.Errorf("no supported audio payload type, payload types:%v", m.payloadTypes)
+}
+
+// payloadName 负载类型对应的名称，rtpmap中使用
+func (sdp *audioSdp) payloadName() string {
+	if sdp.ps {
+		return "PS/90000"
+	}
+	if sdp.codec == base.RtmpSoundFormatG711U {
+		return "PCMU/8000"
+	}
+	return "PCMA/8000"
+}
+
+// audioSender 把lal流中的G.711音频按照rtp发送给设备，ps封装或者直接发送G.711
+type audioSender struct {
+	*rtpSender
+
+	mutex sync.Mutex
+	sdp   *audioSdp
+
+	psMuxer *mpegps.PsMuxer
+	psSid   uint8
+
+	samples uint64 // 已经发送的采样数，用于计算时间戳
+	buf     []byte
+}
+
+// newAudioSender 准备好本地端口，本地端口需要在应答invite时带给设备
+func newAudioSender(s *GB28181Server, sdp *audioSdp) (*audioSender, error) {
+	var ssrc uint32
+	if v, err := strconv.ParseUint(sdp.ssrc, 10, 32); err == nil {
+		ssrc = uint32(v)
+	}
+	rtpSender, err := newRtpSender(s, sdp.ip, sdp.port, sdp.tcp, sdp.setup, sdp.payloadType, ssrc)
+	if err != nil {
+		return nil, err
+	}
+	sender := &audioSender{rtpSender: rtpSender, sdp: sdp}
+	if sdp.ps {
+		sender.psMuxer = mpegps.NewPsMuxer()
+		sender.psSid = sender.psMuxer.AddStream(mpegps.PsStreamG711A)
+		sender.psMuxer.OnPacket = sender.onPsPacket
+	}
+	return sender, nil
+}
+
+// write 发送一帧rtmp音频消息
+func (sender *audioSender) write(msg base.RtmpMsg) error {
+	if msg.Header.MsgTypeId != base.RtmpTypeIdAudio || len(msg.Payload) <= 1 {
+		return nil
+	}
+	codec := msg.AudioCodecId()
+	if codec != base.RtmpSoundFormatG711A && codec != base.RtmpSoundFormatG711U {
+		return ErrUnsupportedAudioCodec
+	}
+	if !sender.ready() {
+		return nil
+	}
+
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+
+	data := msg.Payload[1:]
+	if codec != sender.sdp.codec {
+		data = convertG711(data, codec == base.RtmpSoundFormatG711A)
+	}
+	sender.buf = append(sender.buf, data...)
+	for len(sender.buf) >= g711SamplesPerPacket {
+		if err := sender.sendFrame(sender.buf[:g711SamplesPerPacket]); err != nil {
+			return err
+		}
+		sender.buf = sender.buf[g711SamplesPerPacket:]
+	}
+	return nil
+}
+
+func (sender *audioSender) sendFrame(frame []byte) error {
+	defer func() {
+		sender.samples += uint64(len(frame))
+	}()
+	if sender.psMuxer != nil {
+		// ps的时间戳单位为ms，由muxer转换为90000
+		pts := sender.samples/8 + psPtsOffset
+		return sender.psMuxer.Write(sender.psSid, frame, pts, pts)
+	}
+	return sender.sendRtp(frame, uint32(sender.samples), true)
+}
+
+// onPsPacket ps muxer输出的ps包
+func (sender *audioSender) onPsPacket(pkg []byte, pts uint64) {
+	if err := sender.sendPs(pkg, pts); err != nil {
+		nazalog.Warn("send ps rtp failed, err:", err)
+	}
+}
+
+// convertG711 G.711A和G.711U互相转换
+func convertG711(in []byte, alawToUlaw bool) []byte {
+	out := make([]byte, len(in))
+	for i, b := range in {
+		if alawToUlaw {
+			out[i] = linearToUlaw(alawToLinear(b))
+		} else {
+			out[i] = linearToAlaw(ulawToLinear(b))
+		}
+	}
+	return out
+}
+
+func alawToLinear(a byte) int16 {
+	a ^= 0x55
+	t := int16(a&0x0f) << 4
+	seg := (a & 0x70) >> 4
+	switch seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+	if a&0x80 != 0 {
+		return t
+	}
+	return -t
+}
+
+func ulawToLinear(u byte) int16 {
+	u = ^u
+	t := (int16(u&0x0f) << 3) + 0x84
+	t <<= (u & 0x70) >> 4
+	if u&0x80 != 0 {
+		return 0x84 - t
+	}
+	return t - 0x84
+}
+
+func linearToAlaw(pcm int16) byte {
+	mask := byte(0xd5)
+	v := int(pcm) >> 3
+	if v < 0 {
+		mask = 0x55
+		v = -v - 1
+	}
+	seg := 0
+	for end := 0x1f; seg < 8 && v > end; end = end<<1 | 1 {
+		seg++
+	}
+	if seg >= 8 {
+		return 0x7f ^ mask
+	}
+	aval := byte(seg << 4)
+	if seg < 2 {
+		aval |= byte(v>>1) & 0x0f
+	} else {
+		aval |= byte(v>>seg) & 0x0f
+	}
+	return aval ^ mask
+}
+
+func linearToUlaw(pcm int16) byte {
+	const bias = 0x84
+	const clip = 8159
+	mask := byte(0xff)
+	v := int(pcm) >> 2
+	if v < 0 {
+		v = -v
+		mask = 0x7f
+	}
+	if v > clip {
+		v = clip
+	}
+	v += bias >> 2
+	seg := 0
+	for end := 0x3f; seg < 8 && v > end; end = end<<1 | 1 {
+		seg++
+	}
+	if seg >= 8 {
+		return 0x7f ^ mask
+	}
+	return byte(seg<<4|(v>>(seg+1))&0x0f) ^ mask
+}
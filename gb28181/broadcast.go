@@ -0,0 +1,469 @@
+package gb28181
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/q191201771/lal/pkg/base"
+	"github.com/q191201771/lalmax/hook"
+	"github.com/q191201771/naza/pkg/nazalog"
+)
+
+// 从发送广播通知到开始发送音频的最长时间
+const broadcastTimeout = 15 * time.Second
+
+type BroadcastStatus string
+
+const (
+	BroadcastStatusNotifying  BroadcastStatus = "notifying"  // 已发送广播通知，等待设备invite
+	BroadcastStatusConnecting BroadcastStatus = "connecting" // 已应答设备invite，等待ack和建立连接
+	BroadcastStatusTalking    BroadcastStatus = "talking"    // 正在发送音频
+	BroadcastStatusStopped    BroadcastStatus = "stopped"    // 已结束
+)
+
+// Broadcasts 语音广播会话，key为设备id和通道id
+var Broadcasts sync.Map
+
+var (
+	ErrBroadcastExist   = errors.New("broadcast already exists")
+	ErrStreamNotFound   = errors.New("stream not found")
+	ErrDeviceNotOnline  = errors.New("device not online")
+	ErrBroadcastTimeout = errors.New("broadcast timeout")
+)
+
+// BroadcastSession 语音广播会话
+// 流程: 发送Broadcast通知 -> 设备发送invite(m=audio) -> 应答sendonly的sdp -> 收到ack后把lal流中的音频通过rtp发送给设备
+type BroadcastSession struct {
+	mutex sync.Mutex
+
+	id         string
+	s          *GB28181Server
+	device     *Device
+	channelId  string
+	streamName string
+
+	status     BroadcastStatus
+	errMsg     string
+	inviteReq  sip.Request  // 设备发送的invite
+	inviteResp sip.Response // 我们的200应答，结束时用来构造BYE
+	sender     *audioSender
+	consumerId string
+	createTime time.Time
+}
+
+func broadcastKey(deviceId, channelId string) string {
+	return deviceId + "_" + channelId
+}
+
+// StartBroadcast 向设备的语音输出通道发送广播通知，音频来源为lal中的streamName流，只支持G.711音频
+// channelId为空时使用设备id作为语音输出设备id
+func (s *GB28181Server) StartBroadcast(deviceId, channelId, streamName string) (*BroadcastSession, error) {
+	v, ok := Devices.Load(deviceId)
+	if !ok {
+		return nil, ErrDeviceNotOnline
+	}
+	d := v.(*Device)
+	if d.Status == DeviceOfflineStatus {
+		return nil, ErrDeviceNotOnline
+	}
+	if channelId == "" {
+		channelId = deviceId
+	}
+	if ok, _ := hook.GetHookSessionManagerInstance().GetHookSession(streamName); !ok {
+		return nil, ErrStreamNotFound
+	}
+
+	bs := &BroadcastSession{
+		id:         broadcastKey(deviceId, channelId),
+		s:          s,
+		device:     d,
+		channelId:  channelId,
+		streamName: streamName,
+		status:     BroadcastStatusNotifying,
+		consumerId: fmt.Sprintf("broadcast_%s_%s", deviceId, channelId),
+		createTime: time.Now(),
+	}
+	if _, loaded := Broadcasts.LoadOrStore(bs.id, bs); loaded {
+		return nil, ErrBroadcastExist
+	}
+
+	request := d.CreateRequest(sip.MESSAGE, s.conf)
+	contentType := sip.ContentType("Application/MANSCDP+xml")
+	request.AppendHeader(&contentType)
+	request.SetBody(BuildBroadcastXML(d.sn, s.conf.Serial, channelId), true)
+	nazalog.Info("SIP->Broadcast, deviceId:", deviceId, " channelId:", channelId, " streamName:", streamName)
+
+	resp, err := d.SipRequestForResponse(request)
+	if err == nil && resp.StatusCode() != http.StatusOK {
+		err = fmt.Errorf("sip message broadcast fail,code:%d", resp.StatusCode())
+	}
+	if err != nil {
+		Broadcasts.Delete(bs.id)
+		return nil, err
+	}
+
+	time.AfterFunc(broadcastTimeout, func() {
+		if bs.Status() != BroadcastStatusTalking {
+			bs.stop(true, ErrBroadcastTimeout.Error())
+		}
+	})
+	return bs, nil
+}
+
+// GetBroadcast 查询语音广播
+func GetBroadcast(deviceId, channelId string) (*BroadcastSession, bool) {
+	if channelId == "" {
+		channelId = deviceId
+	}
+	if v, ok := Broadcasts.Load(broadcastKey(deviceId, channelId)); ok {
+		return v.(*BroadcastSession), true
+	}
+	return nil, false
+}
+
+// findBroadcastByInvite 设备invite的From一般为语音输出通道id，也有设备使用设备id
+func findBroadcastByInvite(fromId string) (bs *BroadcastSession) {
+	Broadcasts.Range(func(_, value any) bool {
+		v := value.(*BroadcastSession)
+		if v.Status() != BroadcastStatusNotifying {
+			return true
+		}
+		if v.channelId == fromId {
+			bs = v
+			return false
+		}
+		if v.device.ID == fromId && bs == nil {
+			bs = v
+		}
+		return true
+	})
+	return
+}
+
+func findBroadcastByCallId(callId string) (bs *BroadcastSession) {
+	Broadcasts.Range(func(_, value any) bool {
+		v := value.(*BroadcastSession)
+		if v.callId() == callId {
+			bs = v
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// OnInvite 设备收到广播通知后发起的音频invite，或者上级平台的点播
+func (s *GB28181Server) OnInvite(req sip.Request, tx sip.ServerTransaction) {
+	from, _ := req.From()
+	id := from.Address.User().String()
+	if c := s.findCascade(id); c != nil {
+		if c.checkSource(req, tx) {
+			c.onInvite(req, tx)
+		}
+		return
+	}
+	nazalog.Info("SIP<-OnInvite, id:", id, " source:", req.Source(), " req:", req.String())
+
+	bs := findBroadcastByInvite(id)
+	if bs == nil {
+		nazalog.Warn("invite not match any broadcast, id:", id)
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusNotFound, "broadcast not found", ""))
+		return
+	}
+
+	sdp, err := parseAudioSdp(req.Body())
+	if err != nil {
+		nazalog.Error("parse broadcast sdp failed, id:", bs.id, " err:", err)
+		tx.Respond(sip.NewResponseFromRequest("", req, 488, "Not Acceptable Here", ""))
+		bs.stop(false, err.Error())
+		return
+	}
+	sender, err := newAudioSender(s, sdp)
+	if err != nil {
+		nazalog.Error("create audio sender failed, id:", bs.id, " err:", err)
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusInternalServerError, "", ""))
+		bs.stop(false, err.Error())
+		return
+	}
+
+	port := sip.Port(s.conf.SipPort)
+	contact := sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: s.conf.Serial}, FHost: bs.device.sipIP, FPort: &port}}
+	resp := newInviteOkResponse(req, bs.answerSdp(sdp, sender.localPort), contact)
+
+	bs.mutex.Lock()
+	if bs.status != BroadcastStatusNotifying {
+		bs.mutex.Unlock()
+		sender.close()
+		tx.Respond(sip.NewResponseFromRequest("", req, 487, "Request Terminated", ""))
+		return
+	}
+	bs.status = BroadcastStatusConnecting
+	bs.inviteReq = req
+	bs.inviteResp = resp
+	bs.sender = sender
+	bs.mutex.Unlock()
+
+	if err = tx.Respond(resp); err != nil {
+		nazalog.Error("respond broadcast invite failed, id:", bs.id, " err:", err)
+		bs.stop(false, err.Error())
+	}
+}
+
+// OnAck 收到ack后开始发送音频或者向上级平台推流
+func (s *GB28181Server) OnAck(req sip.Request, tx sip.ServerTransaction) {
+	callId, ok := req.CallID()
+	if !ok {
+		return
+	}
+	if cs := s.findCascadeSession(callId.Value()); cs != nil {
+		if cs.cascade.fromServer(req) {
+			go cs.start()
+		}
+		return
+	}
+	if bs := findBroadcastByCallId(callId.Value()); bs != nil {
+		go bs.start()
+	}
+}
+
+// answerSdp 应答设备的sdp，我们只发送音频
+func (bs *BroadcastSession) answerSdp(sdp *audioSdp, localPort uint16) string {
+	mediaIP := bs.device.mediaIP
+	protocol := ""
+	if sdp.tcp {
+		protocol = "TCP/"
+	}
+	sdpInfo := []string{
+		"v=0",
+		fmt.Sprintf("o=%s 0 0 IN IP4 %s", bs.s.conf.Serial, mediaIP),
+		"s=Play",
+		"c=IN IP4 " + mediaIP,
+		"t=0 0",
+		fmt.Sprintf("m=audio %d %sRTP/AVP %d", localPort, protocol, sdp.payloadType),
+		"a=sendonly",
+		fmt.Sprintf("a=rtpmap:%d %s", sdp.payloadType, sdp.payloadName()),
+	}
+	if sdp.tcp {
+		if sdp.setup == "active" {
+			sdpInfo = append(sdpInfo, "a=setup:passive")
+		} else {
+			sdpInfo = append(sdpInfo, "a=setup:active")
+		}
+		sdpInfo = append(sdpInfo, "a=connection:new")
+	}
+	sdpInfo = append(sdpInfo, "y="+sdp.ssrc, "f=v/////a/1/8/1")
+	return strings.Join(sdpInfo, "\r\n") + "\r\n"
+}
+
+func (bs *BroadcastSession) start() {
+	bs.mutex.Lock()
+	if bs.status != BroadcastStatusConnecting {
+		bs.mutex.Unlock()
+		return
+	}
+	sender := bs.sender
+	bs.mutex.Unlock()
+
+	if err := sender.connect(); err != nil {
+		bs.stop(true, "connect device failed, err:"+err.Error())
+		return
+	}
+	ok, session := hook.GetHookSessionManagerInstance().GetHookSession(bs.streamName)
+	if !ok {
+		bs.stop(true, ErrStreamNotFound.Error())
+		return
+	}
+
+	bs.mutex.Lock()
+	if bs.status != BroadcastStatusConnecting {
+		bs.mutex.Unlock()
+		return
+	}
+	bs.status = BroadcastStatusTalking
+	bs.mutex.Unlock()
+
+	nazalog.Info("broadcast start talking, id:", bs.id, " streamName:", bs.streamName, " payloadType:", sender.sdp.payloadType, " tcp:", sender.sdp.tcp)
+	session.AddInnerConsumer(bs.consumerId, bs)
+}
+
+// OnMsg 作为hook session的消费者接收音频
+func (bs *BroadcastSession) OnMsg(msg base.RtmpMsg) {
+	if err := bs.sender.write(msg); err != nil {
+		nazalog.Error("broadcast send audio failed, id:", bs.id, " err:", err)
+		// 先关闭sender避免重复报错，在hook的回调中不同步移除消费者
+		bs.sender.close()
+		go bs.stop(true, err.Error())
+	}
+}
+
+// OnStop 音频来源的流结束
+func (bs *BroadcastSession) OnStop() {
+	go bs.stop(true, "source stream stopped")
+}
+
+// Stop 结束语音广播
+func (bs *BroadcastSession) Stop() {
+	bs.stop(true, "")
+}
+
+// stop 结束会话，bye为false时表示设备已经发送了BYE或者会话还没有建立
+func (bs *BroadcastSession) stop(bye bool, errMsg string) {
+	bs.mutex.Lock()
+	if bs.status == BroadcastStatusStopped {
+		bs.mutex.Unlock()
+		return
+	}
+	talking := bs.status == BroadcastStatusTalking
+	bs.status = BroadcastStatusStopped
+	bs.errMsg = errMsg
+	sender := bs.sender
+	bs.mutex.Unlock()
+
+	Broadcasts.Delete(bs.id)
+	if talking {
+		if ok, session := hook.GetHookSessionManagerInstance().GetHookSession(bs.streamName); ok {
+			session.RemoveConsumer(bs.consumerId)
+		}
+	}
+	if sender != nil {
+		sender.close()
+		if bye {
+			bs.sendBye()
+		}
+	}
+	nazalog.Info("broadcast stop, id:", bs.id, " err:", errMsg)
+}
+
+// sendBye 我们是会话的被叫方，From和To需要和invite中的对调
+func (bs *BroadcastSession) sendBye() {
+	d := bs.device
+	d.sn++
+	bye := newByeRequest(bs.inviteReq, bs.inviteResp, uint32(d.sn))
+	// 通过事务发送，Via由事务层添加
+	go func() {
+		if _, err := d.SipRequestForResponse(bye); err != nil {
+			nazalog.Error("send broadcast bye failed, id:", bs.id, " err:", err)
+		}
+	}()
+}
+
+// newInviteOkResponse 作为被叫方应答invite，带上To tag和Contact
+func newInviteOkResponse(req sip.Request, sdp string, contact sip.Address) sip.Response {
+	resp := sip.NewResponseFromRequest("", req, http.StatusOK, "OK", sdp)
+	if to, ok := resp.To(); ok {
+		if to.Params == nil {
+			to.Params = sip.NewParams()
+		}
+		if !to.Params.Has("tag") {
+			to.Params.Add("tag", sip.String{Str: RandNumString(9)})
+		}
+	}
+	contentType := sip.ContentType("application/sdp")
+	resp.AppendHeader(&contentType)
+	resp.AppendHeader(contact.AsContactHeader())
+	return resp
+}
+
+// newByeRequest 被叫方结束会话的BYE，From和To和invite中的对调，发往invite的Contact
+func newByeRequest(req sip.Request, resp sip.Response, seq uint32) sip.Request {
+	from, _ := req.From()
+	to, _ := resp.To()
+	callId, _ := req.CallID()
+
+	recipient := from.Address
+	if contact, ok := req.Contact(); ok {
+		recipient = contact.Address
+	}
+	cseq := sip.CSeq{SeqNo: seq, MethodName: sip.BYE}
+	maxForwards := sip.MaxForwards(70)
+	userAgent := sip.UserAgentHeader("LALMax")
+	bye := sip.NewRequest(
+		"",
+		sip.BYE,
+		recipient,
+		"SIP/2.0",
+		[]sip.Header{
+			&sip.FromHeader{DisplayName: to.DisplayName, Address: to.Address, Params: to.Params},
+			&sip.ToHeader{DisplayName: from.DisplayName, Address: from.Address, Params: from.Params},
+			callId,
+			&userAgent,
+			&cseq,
+			&maxForwards,
+		},
+		"",
+		nil,
+	)
+	bye.SetTransport(req.Transport())
+	bye.SetDestination(req.Source())
+	return bye
+}
+
+// onBroadcastResult 设备对广播通知的应答，Result不为OK时结束会话
+func (d *Device) onBroadcastResult(targetId string, result string) {
+	bs, ok := GetBroadcast(d.ID, targetId)
+	if !ok {
+		return
+	}
+	if result != "OK" {
+		bs.stop(false, "device response broadcast result:"+result)
+	}
+}
+
+func (bs *BroadcastSession) Status() BroadcastStatus {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	return bs.status
+}
+
+func (bs *BroadcastSession) callId() string {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	if bs.inviteReq == nil {
+		return ""
+	}
+	if callId, ok := bs.inviteReq.CallID(); ok {
+		return callId.Value()
+	}
+	return ""
+}
+
+// Info 语音广播的状态
+func (bs *BroadcastSession) Info() *BroadcastInfo {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	info := &BroadcastInfo{
+		DeviceId:   bs.device.ID,
+		ChannelId:  bs.channelId,
+		StreamName: bs.streamName,
+		Status:     bs.status,
+		Error:      bs.errMsg,
+		CreateTime: bs.createTime.Unix(),
+	}
+	if bs.sender != nil {
+		sdp := bs.sender.sdp
+		info.NetWork = "udp"
+		if sdp.tcp {
+			info.NetWork = "tcp"
+		}
+		info.Payload = strings.Split(sdp.payloadName(), "/")[0]
+		info.RemoteAddr = fmt.Sprintf("%s:%d", sdp.ip, sdp.port)
+		info.SentPackets = bs.sender.sentPackets()
+	}
+	return info
+}
+
+// stopAllBroadcasts 服务退出时结束所有语音广播
+func stopAllBroadcasts() {
+	Broadcasts.Range(func(_, value any) bool {
+		value.(*BroadcastSession).Stop()
+		return true
+	})
+}
@@ -0,0 +1,646 @@
+package gb28181
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/q191201771/lal/pkg/base"
+	config "github.com/q191201771/lalmax/conf"
+	"github.com/q191201771/lalmax/hook"
+	"github.com/q191201771/lalmax/metrics"
+	"github.com/q191201771/naza/pkg/nazalog"
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	// 注册失败或者和上级平台断开后的重试间隔
+	cascadeRetryInterval = 10 * time.Second
+	// 连续心跳失败超过该次数认为和上级平台断开，需要重新注册
+	cascadeMaxKeepaliveFail = 3
+	// 向上级平台发送请求的超时时间
+	cascadeRequestTimeout = 10 * time.Second
+	// 目录应答每条消息携带的最大通道数，避免udp报文过大
+	catalogItemsPerMessage = 20
+)
+
+type CascadeStatus string
+
+const (
+	CascadeStatusRegistering CascadeStatus = "registering" // 正在注册
+	CascadeStatusRegistered  CascadeStatus = "registered"  // 已注册，正常心跳
+	CascadeStatusFailed      CascadeStatus = "failed"      // 注册或心跳失败，等待重试
+	CascadeStatusStopped     CascadeStatus = "stopped"     // 已注销
+)
+
+var ErrChannelNotFound = errors.New("channel not found")
+
+// Cascade 级联的上级平台，lalmax作为下级平台向上级注册，共享设备通道和lal中的流
+// 流程: 注册(鉴权) -> 定时心跳，注册有效期过半时刷新注册 -> 应答上级的目录/设备信息查询 -> 上级invite时把流封装为ps通过rtp推给上级
+type Cascade struct {
+	mutex sync.Mutex
+
+	s         *GB28181Server
+	conf      config.GB28181CascadeConfig
+	sipSvr    gosip.Server
+	localIp   string   // 本平台访问上级平台使用的ip，用于Contact和sdp
+	serverIps []string // 上级平台server_ip解析出的ip，只接受来自这些地址的请求
+
+	status        CascadeStatus
+	errMsg        string
+	registerTime  time.Time
+	keepaliveTime time.Time
+
+	sn      uint32
+	callId  sip.CallID // 刷新注册和注销时使用同一个Call-ID
+	fromTag string
+
+	sessions  sync.Map // 上级平台的点播会话，key为Call-ID
+	closeChan chan struct{}
+	closeOnce sync.Once
+	doneChan  chan struct{}
+}
+
+func newCascade(s *GB28181Server, conf config.GB28181CascadeConfig) *Cascade {
+	c := &Cascade{
+		s:         s,
+		conf:      conf,
+		status:    CascadeStatusRegistering,
+		callId:    sip.CallID(RandNumString(10)),
+		fromTag:   RandNumString(9),
+		closeChan: make(chan struct{}),
+		doneChan:  make(chan struct{}),
+	}
+	if conf.Transport == "tcp" {
+		c.sipSvr = s.sipTcpSvr
+	} else {
+		c.sipSvr = s.sipUdpSvr
+	}
+	c.localIp = s.conf.SipIP
+	if c.localIp == "" {
+		c.localIp = localIpTo(conf.ServerIp, conf.ServerPort)
+	}
+	c.serverIps = []string{conf.ServerIp}
+	if net.ParseIP(conf.ServerIp) == nil {
+		if ips, err := net.LookupHost(conf.ServerIp); err == nil {
+			c.serverIps = ips
+		} else {
+			nazalog.Warn("lookup cascade server ip failed, serverIp:", conf.ServerIp, " err:", err)
+		}
+	}
+	return c
+}
+
+// fromServer 请求的来源地址是否为上级平台，From中的平台ID可以伪造，所以还要校验来源ip
+func (c *Cascade) fromServer(req sip.Request) bool {
+	host, _, err := net.SplitHostPort(req.Source())
+	if err != nil {
+		host = req.Source()
+	}
+	for _, ip := range c.serverIps {
+		if ip == host {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSource 来源不是上级平台时应答403，返回false
+func (c *Cascade) checkSource(req sip.Request, tx sip.ServerTransaction) bool {
+	if c.fromServer(req) {
+		return true
+	}
+	nazalog.Warn("reject cascade request from unexpected source, serverId:", c.conf.ServerId, " serverIp:", c.conf.ServerIp, " source:", req.Source())
+	tx.Respond(sip.NewResponseFromRequest("", req, http.StatusForbidden, "Forbidden", ""))
+	return false
+}
+
+// localIpTo 没有配置sip_ip时，使用访问上级平台的路由对应的本地ip
+func localIpTo(ip string, port uint16) string {
+	conn, err := net.Dial("udp", net.JoinHostPort(ip, strconv.Itoa(int(port))))
+	if err != nil {
+		nazalog.Warn("get local ip failed, err:", err)
+		return ""
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+func (c *Cascade) mediaIp() string {
+	if ip := c.s.conf.MediaConfig.MediaIp; ip != "" && ip != "0.0.0.0" {
+		return ip
+	}
+	return c.localIp
+}
+
+func (c *Cascade) run() {
+	defer close(c.doneChan)
+	for {
+		err := c.register(c.conf.RegisterExpires)
+		if err == nil {
+			nazalog.Info("cascade register success, serverId:", c.conf.ServerId, " localId:", c.conf.LocalId)
+			c.setStatus(CascadeStatusRegistered, "")
+			err = c.keepaliveLoop()
+		}
+		if c.isClosed() {
+			return
+		}
+		if err != nil {
+			nazalog.Error("cascade failed, serverId:", c.conf.ServerId, " err:", err)
+			c.setStatus(CascadeStatusFailed, err.Error())
+			select {
+			case <-c.closeChan:
+				return
+			case <-time.After(cascadeRetryInterval):
+			}
+		}
+	}
+}
+
+// keepaliveLoop 定时心跳，返回nil时表示需要刷新注册或者已经关闭
+func (c *Cascade) keepaliveLoop() error {
+	refresh := time.NewTimer(time.Duration(c.conf.RegisterExpires) * time.Second / 2)
+	defer refresh.Stop()
+	ticker := time.NewTicker(time.Duration(c.conf.KeepaliveInterval) * time.Second)
+	defer ticker.Stop()
+
+	fails := 0
+	keepalive := func() error {
+		if err := c.sendMessage(BuildKeepaliveXML(int(c.nextSn()), c.conf.LocalId)); err != nil {
+			fails++
+			nazalog.Warn("cascade keepalive failed, serverId:", c.conf.ServerId, " fails:", fails, " err:", err)
+			if fails >= cascadeMaxKeepaliveFail {
+				return err
+			}
+			return nil
+		}
+		fails = 0
+		c.mutex.Lock()
+		c.keepaliveTime = time.Now()
+		c.mutex.Unlock()
+		return nil
+	}
+
+	// 注册成功后立即发送一次心跳，部分平台收到心跳后才认为下级在线
+	if err := keepalive(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-c.closeChan:
+			return nil
+		case <-refresh.C:
+			return nil
+		case <-ticker.C:
+			if err := keepalive(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// register 注册，expires为0时注销
+func (c *Cascade) register(expires int) error {
+	req := c.createRequest(sip.REGISTER, c.callId, c.fromTag)
+	expiresHeader := sip.Expires(expires)
+	req.AppendHeader(&expiresHeader)
+
+	resp, err := c.request(req)
+	// 经过鉴权时CSeq会增加，后续的注册需要继续递增
+	if cseq, ok := req.CSeq(); ok {
+		c.mutex.Lock()
+		if cseq.SeqNo > c.sn {
+			c.sn = cseq.SeqNo
+		}
+		c.mutex.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("register fail, code:%d", resp.StatusCode())
+	}
+	if expires > 0 {
+		c.mutex.Lock()
+		c.registerTime = time.Now()
+		c.mutex.Unlock()
+	}
+	return nil
+}
+
+func (c *Cascade) nextSn() uint32 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.sn++
+	return c.sn
+}
+
+// createRequest 向上级平台发送的请求，From为本平台id，To为上级平台id，注册时To和From相同
+func (c *Cascade) createRequest(method sip.RequestMethod, callId sip.CallID, fromTag string) sip.Request {
+	userAgent := sip.UserAgentHeader("LALMax")
+	maxForwards := sip.MaxForwards(70)
+	cseq := sip.CSeq{
+		SeqNo:      c.nextSn(),
+		MethodName: method,
+	}
+	localPort := sip.Port(c.s.conf.SipPort)
+	serverPort := sip.Port(c.conf.ServerPort)
+	from := sip.Address{
+		Uri:    &sip.SipUri{FUser: sip.String{Str: c.conf.LocalId}, FHost: c.conf.ServerRealm},
+		Params: sip.NewParams().Add("tag", sip.String{Str: fromTag}),
+	}
+	to := sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: c.conf.ServerId}, FHost: c.conf.ServerRealm}}
+	if method == sip.REGISTER {
+		to.Uri = &sip.SipUri{FUser: sip.String{Str: c.conf.LocalId}, FHost: c.conf.ServerRealm}
+	}
+	contact := sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: c.conf.LocalId}, FHost: c.localIp, FPort: &localPort}}
+	req := sip.NewRequest(
+		"",
+		method,
+		&sip.SipUri{FUser: sip.String{Str: c.conf.ServerId}, FHost: c.conf.ServerIp, FPort: &serverPort},
+		"SIP/2.0",
+		[]sip.Header{
+			from.AsFromHeader(),
+			to.AsToHeader(),
+			&callId,
+			&userAgent,
+			&cseq,
+			&maxForwards,
+			contact.AsContactHeader(),
+		},
+		"",
+		nil,
+	)
+	req.SetTransport(c.conf.Transport)
+	req.SetDestination(net.JoinHostPort(c.conf.ServerIp, strconv.Itoa(int(c.conf.ServerPort))))
+	return req
+}
+
+// request 发送请求，上级平台返回401时使用配置的账号密码鉴权后重发
+func (c *Cascade) request(req sip.Request) (sip.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cascadeRequestTimeout)
+	defer cancel()
+
+	var options []gosip.RequestWithContextOption
+	if c.conf.Password != "" {
+		options = append(options, gosip.WithAuthorizer(&sip.DefaultAuthorizer{
+			User:     sip.String{Str: c.conf.Username},
+			Password: sip.String{Str: c.conf.Password},
+		}))
+	}
+	resp, err := c.sipSvr.RequestWithContext(ctx, req, options...)
+	result := metrics.ResultOk
+	if err != nil || resp == nil || resp.StatusCode() >= 300 {
+		result = metrics.ResultError
+	}
+	metrics.SipRequestsSent.WithLabelValues(string(req.Method()), result).Inc()
+	return resp, err
+}
+
+func (c *Cascade) sendMessage(body string) error {
+	req := c.createRequest(sip.MESSAGE, sip.CallID(RandNumString(10)), RandNumString(9))
+	contentType := sip.ContentType("Application/MANSCDP+xml")
+	req.AppendHeader(&contentType)
+	req.SetBody(body, true)
+
+	resp, err := c.request(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("sip message fail, code:%d", resp.StatusCode())
+	}
+	return nil
+}
+
+// onMessage 上级平台的查询
+func (c *Cascade) onMessage(req sip.Request, tx sip.ServerTransaction) {
+	nazalog.Info("SIP<-Cascade OnMessage, serverId:", c.conf.ServerId, " source:", req.Source(), " req:", req.String())
+	temp := &struct {
+		XMLName  xml.Name
+		CmdType  string
+		SN       int
+		DeviceID string
+	}{}
+	decoder := xml.NewDecoder(bytes.NewReader([]byte(req.Body())))
+	decoder.CharsetReader = charset.NewReaderLabel
+	if err := decoder.Decode(temp); err != nil {
+		if err = DecodeGbk(temp, []byte(req.Body())); err != nil {
+			nazalog.Error("decode cascade message err:", err)
+		}
+	}
+
+	var body string
+	switch temp.CmdType {
+	case "Catalog":
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", ""))
+		go c.sendCatalog(temp.SN)
+		return
+	case "DeviceInfo":
+		body = BuildDeviceInfoResponseXML(temp.SN, c.conf.LocalId, base.LalVersion, len(c.catalogItems()))
+	case "DeviceStatus":
+		body = BuildDeviceStatusResponseXML(temp.SN, c.conf.LocalId)
+	default:
+		nazalog.Warn("Not supported cascade CmdType, CmdType:", temp.CmdType, " body:", req.Body())
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusBadRequest, "", ""))
+		return
+	}
+	tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", ""))
+	go func() {
+		if err := c.sendMessage(body); err != nil {
+			nazalog.Error("cascade response ", temp.CmdType, " failed, serverId:", c.conf.ServerId, " err:", err)
+		}
+	}()
+}
+
+// catalogItem 目录应答中的通道
+type catalogItem struct {
+	DeviceID     string
+	Name         string
+	Manufacturer string
+	Model        string
+	Owner        string
+	CivilCode    string
+	Address      string
+	Parental     int
+	ParentID     string
+	SafetyWay    int
+	RegisterWay  int
+	Secrecy      int
+	Status       string
+	Longitude    string `xml:",omitempty"`
+	Latitude     string `xml:",omitempty"`
+}
+
+type catalogResponse struct {
+	XMLName    xml.Name `xml:"Response"`
+	CmdType    string
+	SN         int
+	DeviceID   string
+	SumNum     int
+	DeviceList struct {
+		Num   int            `xml:"Num,attr"`
+		Items []*catalogItem `xml:"Item"`
+	}
+}
+
+// catalogItems 共享给上级平台的通道，设备的通道统一挂在本平台下，share_streams时lal中的流作为虚拟通道
+func (c *Cascade) catalogItems() []*catalogItem {
+	items := make([]*catalogItem, 0)
+	civilCode := c.conf.LocalId[:6]
+	Devices.Range(func(_, value any) bool {
+		d := value.(*Device)
+		d.channelMap.Range(func(_, value any) bool {
+			ch := value.(*Channel)
+			// 目录节点不共享，只共享视频通道
+			if ch.Parental != 0 {
+				return true
+			}
+			item := &catalogItem{
+				DeviceID:     ch.ChannelId,
+				Name:         ch.Name,
+				Manufacturer: ch.Manufacturer,
+				Model:        ch.Model,
+				Owner:        ch.Owner,
+				CivilCode:    ch.CivilCode,
+				Address:      ch.Address,
+				ParentID:     c.conf.LocalId,
+				RegisterWay:  1,
+				Secrecy:      ch.Secrecy,
+				Status:       string(ch.Status),
+				Longitude:    ch.Longitude,
+				Latitude:     ch.Latitude,
+			}
+			if item.CivilCode == "" {
+				item.CivilCode = civilCode
+			}
+			if item.Status == "" {
+				item.Status = ChannelOnStatus
+			}
+			if d.Status == DeviceOfflineStatus {
+				item.Status = ChannelOffStatus
+			}
+			items = append(items, item)
+			return true
+		})
+		return true
+	})
+	for channelId, streamName := range c.virtualChannels() {
+		items = append(items, &catalogItem{
+			DeviceID:     channelId,
+			Name:         streamName,
+			Manufacturer: "LALMax",
+			Model:        "LALMax",
+			Owner:        "LALMax",
+			CivilCode:    civilCode,
+			Address:      streamName,
+			ParentID:     c.conf.LocalId,
+			RegisterWay:  1,
+			Status:       ChannelOnStatus,
+		})
+	}
+	return items
+}
+
+// virtualChannels lal中的流对应的虚拟通道，key为通道id，value为流名，下级设备推上来的流不重复共享
+func (c *Cascade) virtualChannels() map[string]string {
+	channels := make(map[string]string)
+	if !c.conf.ShareStreams || c.s.lalServer == nil {
+		return channels
+	}
+	gbStreams := make(map[string]bool)
+	Devices.Range(func(_, value any) bool {
+		value.(*Device).channelMap.Range(func(_, value any) bool {
+			for _, streamName := range value.(*Channel).streamNames() {
+				gbStreams[streamName] = true
+			}
+			return true
+		})
+		return true
+	})
+	for _, group := range c.s.lalServer.StatAllGroup() {
+		if gbStreams[group.StreamName] {
+			continue
+		}
+		if ok, _ := hook.GetHookSessionManagerInstance().GetHookSession(group.StreamName); !ok {
+			continue
+		}
+		channels[virtualChannelId(c.conf.LocalId, group.StreamName)] = group.StreamName
+	}
+	return channels
+}
+
+// virtualChannelId 虚拟通道id，前10位使用本平台id的前10位，类型编码为131(摄像机)，后7位由流名计算
+func virtualChannelId(localId, streamName string) string {
+	return fmt.Sprintf("%s131%07d", localId[:10], crc32.ChecksumIEEE([]byte(streamName))%10000000)
+}
+
+// sendCatalog 目录应答，通道较多时分多条消息发送，SumNum为通道总数
+func (c *Cascade) sendCatalog(sn int) {
+	items := c.catalogItems()
+	sum := len(items)
+	for i := 0; i == 0 || i < sum; i += catalogItemsPerMessage {
+		end := min(i+catalogItemsPerMessage, sum)
+		resp := &catalogResponse{
+			CmdType:  "Catalog",
+			SN:       sn,
+			DeviceID: c.conf.LocalId,
+			SumNum:   sum,
+		}
+		resp.DeviceList.Num = end - i
+		resp.DeviceList.Items = items[i:end]
+		body, err := XmlEncode(resp)
+		if err != nil {
+			nazalog.Error("encode catalog response failed, err:", err)
+			return
+		}
+		if err = c.sendMessage(body); err != nil {
+			nazalog.Error("cascade response catalog failed, serverId:", c.conf.ServerId, " err:", err)
+			return
+		}
+	}
+	nazalog.Info("cascade response catalog, serverId:", c.conf.ServerId, " sumNum:", sum)
+}
+
+// findChannelById 在所有设备中查找通道
+func findChannelById(channelId string) (ch *Channel) {
+	Devices.Range(func(_, value any) bool {
+		if v, ok := value.(*Device).channelMap.Load(channelId); ok {
+			ch = v.(*Channel)
+			return false
+		}
+		return true
+	})
+	return
+}
+
+func (c *Cascade) setStatus(status CascadeStatus, errMsg string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.status = status
+	c.errMsg = errMsg
+}
+
+func (c *Cascade) isClosed() bool {
+	select {
+	case <-c.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop 结束上级平台的点播并注销
+func (c *Cascade) stop() {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+	})
+	<-c.doneChan
+
+	c.sessions.Range(func(_, value any) bool {
+		value.(*cascadeSession).stop(true, "server dispose")
+		return true
+	})
+	c.mutex.Lock()
+	registered := c.status == CascadeStatusRegistered
+	c.mutex.Unlock()
+	if registered {
+		if err := c.register(0); err != nil {
+			nazalog.Warn("cascade unregister failed, serverId:", c.conf.ServerId, " err:", err)
+		}
+	}
+	c.setStatus(CascadeStatusStopped, "")
+	nazalog.Info("cascade stopped, serverId:", c.conf.ServerId)
+}
+
+// Info 级联状态
+func (c *Cascade) Info() *CascadeInfo {
+	c.mutex.Lock()
+	info := &CascadeInfo{
+		ServerId:   c.conf.ServerId,
+		ServerAddr: net.JoinHostPort(c.conf.ServerIp, strconv.Itoa(int(c.conf.ServerPort))),
+		Transport:  c.conf.Transport,
+		LocalId:    c.conf.LocalId,
+		Status:     c.status,
+		Error:      c.errMsg,
+		Sessions:   make([]*CascadeSessionInfo, 0),
+	}
+	if !c.registerTime.IsZero() {
+		info.RegisterTime = c.registerTime.Unix()
+	}
+	if !c.keepaliveTime.IsZero() {
+		info.KeepaliveTime = c.keepaliveTime.Unix()
+	}
+	c.mutex.Unlock()
+
+	c.sessions.Range(func(_, value any) bool {
+		info.Sessions = append(info.Sessions, value.(*cascadeSession).Info())
+		return true
+	})
+	return info
+}
+
+// startCascades 向配置的上级平台注册
+func (s *GB28181Server) startCascades() {
+	for _, conf := range s.conf.Cascades {
+		if !conf.Enable {
+			continue
+		}
+		c := newCascade(s, conf)
+		s.cascades = append(s.cascades, c)
+		nazalog.Info("start cascade, serverId:", conf.ServerId, " server:", conf.ServerIp, ":", conf.ServerPort, " transport:", conf.Transport, " localId:", conf.LocalId)
+		go c.run()
+	}
+}
+
+func (s *GB28181Server) stopCascades() {
+	var wg sync.WaitGroup
+	for _, c := range s.cascades {
+		wg.Add(1)
+		go func(c *Cascade) {
+			defer wg.Done()
+			c.stop()
+		}(c)
+	}
+	wg.Wait()
+}
+
+// findCascade 根据请求的From判断是否为上级平台的请求，还需要通过 checkSource 校验来源地址
+func (s *GB28181Server) findCascade(serverId string) *Cascade {
+	for _, c := range s.cascades {
+		if c.conf.ServerId == serverId {
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *GB28181Server) findCascadeSession(callId string) *cascadeSession {
+	for _, c := range s.cascades {
+		if v, ok := c.sessions.Load(callId); ok {
+			return v.(*cascadeSession)
+		}
+	}
+	return nil
+}
+
+// Cascades 所有上级平台的状态
+func (s *GB28181Server) Cascades() []*CascadeInfo {
+	infos := make([]*CascadeInfo, 0, len(s.cascades))
+	for _, c := range s.cascades {
+		infos = append(infos, c.Info())
+	}
+	return infos
+}
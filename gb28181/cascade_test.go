@@ -0,0 +1,82 @@
+package gb28181
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+func newTestRequest(method sip.RequestMethod, source string) sip.Request {
+	req := sip.NewRequest("", method, &sip.SipUri{FUser: sip.String{Str: "34020000002000000001"}, FHost: "127.0.0.1"}, "SIP/2.0", nil, "", nil)
+	req.SetSource(source)
+	return req
+}
+
+func TestCascadeFromServer(t *testing.T) {
+	c := &Cascade{serverIps: []string{"192.168.1.10", "fd00::10"}}
+	testCases := []struct {
+		source string
+		expect bool
+	}{
+		{"192.168.1.10:5060", true},
+		{"[fd00::10]:5060", true},
+		{"192.168.1.10", true},
+		{"192.168.1.11:5060", false},
+		{"10.0.0.1:5060", false},
+		{"", false},
+	}
+	for _, tc := range testCases {
+		if out := c.fromServer(newTestRequest(sip.MESSAGE, tc.source)); out != tc.expect {
+			t.Fatalf("source:%s, expect:%v, got:%v", tc.source, tc.expect, out)
+		}
+	}
+}
+
+func TestNewByeRequest(t *testing.T) {
+	callId := sip.CallID("call-1")
+	from := &sip.FromHeader{
+		Address: &sip.SipUri{FUser: sip.String{Str: "34020000002000000001"}, FHost: "3402000000"},
+		Params:  sip.NewParams().Add("tag", sip.String{Str: "from-tag"}),
+	}
+	to := &sip.ToHeader{
+		Address: &sip.SipUri{FUser: sip.String{Str: "34020000001320000001"}, FHost: "3402000000"},
+		Params:  sip.NewParams(),
+	}
+	port := sip.Port(5061)
+	contact := &sip.ContactHeader{Address: &sip.SipUri{FUser: sip.String{Str: "34020000002000000001"}, FHost: "192.168.1.10", FPort: &port}}
+	cseq := &sip.CSeq{SeqNo: 1, MethodName: sip.INVITE}
+	invite := sip.NewRequest("", sip.INVITE, to.Address, "SIP/2.0", []sip.Header{from, to, &callId, cseq, contact}, "", nil)
+	invite.SetSource("192.168.1.10:5060")
+	invite.SetTransport("UDP")
+
+	resp := sip.NewResponseFromRequest("", invite, http.StatusOK, "OK", "")
+	respTo, _ := resp.To()
+	respTo.Params.Add("tag", sip.String{Str: "to-tag"})
+
+	bye := newByeRequest(invite, resp, 2)
+	if bye.Method() != sip.BYE || bye.Recipient().String() != contact.Address.String() {
+		t.Fatalf("unexpected bye:%s %s", bye.Method(), bye.Recipient())
+	}
+	// 被叫方发起的BYE，From为invite应答的To，To为invite的From
+	byeFrom, _ := bye.From()
+	byeTo, _ := bye.To()
+	if byeFrom.Address.User().String() != "34020000001320000001" || byeTo.Address.User().String() != "34020000002000000001" {
+		t.Fatalf("expect from/to swapped, from:%s to:%s", byeFrom, byeTo)
+	}
+	if tag, _ := byeFrom.Params.Get("tag"); tag == nil || tag.String() != "to-tag" {
+		t.Fatalf("expect from tag to-tag, got:%v", tag)
+	}
+	if tag, _ := byeTo.Params.Get("tag"); tag == nil || tag.String() != "from-tag" {
+		t.Fatalf("expect to tag from-tag, got:%v", tag)
+	}
+	if id, _ := bye.CallID(); id.Value() != "call-1" {
+		t.Fatalf("expect same call id, got:%s", id.Value())
+	}
+	if seq, _ := bye.CSeq(); seq.SeqNo != 2 || seq.MethodName != sip.BYE {
+		t.Fatalf("unexpected cseq:%s", seq)
+	}
+	if bye.Destination() != "192.168.1.10:5060" || bye.Transport() != "UDP" {
+		t.Fatalf("unexpected destination:%s transport:%s", bye.Destination(), bye.Transport())
+	}
+}
@@ -0,0 +1,488 @@
+package gb28181
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/q191201771/lal/pkg/aac"
+	"github.com/q191201771/lal/pkg/avc"
+	"github.com/q191201771/lal/pkg/base"
+	"github.com/q191201771/lal/pkg/hevc"
+	"github.com/q191201771/lalmax/gb28181/mpegps"
+	"github.com/q191201771/lalmax/hook"
+	"github.com/q191201771/naza/pkg/nazalog"
+)
+
+// 上级平台点播下级设备通道时，等待设备推流的最长时间
+const cascadeStreamWaitTimeout = 10 * time.Second
+
+// cascadeSession 上级平台的点播会话
+// 流程: 上级invite(m=video, PS) -> 找到通道对应的流(必要时向下级设备点播) -> 应答sendonly的sdp -> 收到ack后把lal流封装为ps通过rtp推给上级
+type cascadeSession struct {
+	mutex sync.Mutex
+
+	cascade    *Cascade
+	callId     string
+	channelId  string
+	streamName string
+	channel    *Channel // 为该会话向下级设备点播的通道，会话结束时挂断
+
+	inviteReq  sip.Request  // 上级平台发送的invite
+	inviteResp sip.Response // 我们的200应答，结束时用来构造BYE
+	sender     *rtpSender
+	consumerId string
+	started    bool
+	stopped    bool
+	createTime time.Time
+
+	// 以下字段只在hook的回调中使用
+	psMuxer     *mpegps.PsMuxer
+	videoSid    uint8
+	audioSid    uint8
+	hasVideo    bool
+	hasAudio    bool
+	videoHeader []byte // annexb格式的参数集，在关键帧前插入
+	ascCtx      *aac.AscContext
+	gotKeyFrame bool
+	sendErr     error
+}
+
+// onInvite 上级平台点播通道，只支持实时流
+func (c *Cascade) onInvite(req sip.Request, tx sip.ServerTransaction) {
+	channelId := ""
+	if to, ok := req.To(); ok && to.Address != nil && to.Address.User() != nil {
+		channelId = to.Address.User().String()
+	}
+	callId := ""
+	if v, ok := req.CallID(); ok {
+		callId = v.Value()
+	}
+	nazalog.Info("SIP<-Cascade OnInvite, serverId:", c.conf.ServerId, " channelId:", channelId, " req:", req.String())
+
+	sdp, err := parseSdpMedia(req.Body(), "video")
+	if err == nil && sdp.sessionName != "" && sdp.sessionName != "Play" {
+		err = fmt.Errorf("not supported session:%s, only Play is supported", sdp.sessionName)
+	}
+	var payloadType int
+	if err == nil {
+		payloadType = -1
+		for _, pt := range sdp.payloadTypes {
+			if sdp.rtpmap[pt] == "PS" {
+				payloadType, _ = strconv.Atoi(pt)
+				break
+			}
+		}
+		if payloadType < 0 {
+			err = fmt.Errorf("no PS payload type, payload types:%v", sdp.payloadTypes)
+		}
+	}
+	if err != nil {
+		nazalog.Error("parse cascade invite sdp failed, channelId:", channelId, " err:", err)
+		tx.Respond(sip.NewResponseFromRequest("", req, 488, "Not Acceptable Here", ""))
+		return
+	}
+
+	streamName, channel, err := c.findStream(channelId)
+	if err != nil {
+		nazalog.Error("cascade invite find stream failed, channelId:", channelId, " err:", err)
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusNotFound, err.Error(), ""))
+		return
+	}
+
+	cs := &cascadeSession{
+		cascade:    c,
+		callId:     callId,
+		channelId:  channelId,
+		streamName: streamName,
+		channel:    channel,
+		inviteReq:  req,
+		consumerId: fmt.Sprintf("cascade_%s_%s", c.conf.ServerId, callId),
+		createTime: time.Now(),
+	}
+	var ssrc uint32
+	if v, err := strconv.ParseUint(sdp.ssrc, 10, 32); err == nil {
+		ssrc = uint32(v)
+	}
+	cs.sender, err = newRtpSender(c.s, sdp.ip, sdp.port, sdp.tcp, sdp.setup, uint8(payloadType), ssrc)
+	if err != nil {
+		nazalog.Error("create cascade rtp sender failed, channelId:", channelId, " err:", err)
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusInternalServerError, "", ""))
+		cs.releaseChannel()
+		return
+	}
+
+	port := sip.Port(c.s.conf.SipPort)
+	contact := sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: c.conf.LocalId}, FHost: c.localIp, FPort: &port}}
+	cs.inviteResp = newInviteOkResponse(req, cs.answerSdp(sdp, uint8(payloadType)), contact)
+	c.sessions.Store(callId, cs)
+	if err = tx.Respond(cs.inviteResp); err != nil {
+		nazalog.Error("respond cascade invite failed, channelId:", channelId, " err:", err)
+		cs.stop(false, err.Error())
+	}
+}
+
+// findStream 通道对应的lal流，虚拟通道直接使用对应的流，设备通道没有在推流时先向设备点播
+//
+// 同一个通道的点播串行进行，多个上级同时点播时只向设备发送一次invite
+func (c *Cascade) findStream(channelId string) (streamName string, invited *Channel, err error) {
+	if streamName, ok := c.virtualChannels()[channelId]; ok {
+		return streamName, nil, nil
+	}
+	ch := findChannelById(channelId)
+	if ch == nil {
+		return "", nil, ErrChannelNotFound
+	}
+	ch.cascadeMutex.Lock()
+	defer ch.cascadeMutex.Unlock()
+
+	if streamName = ch.LiveStreamName(); streamName != "" {
+		// 通道是其他上级会话点播的，由最后结束的会话挂断
+		if ch.isCascadeInvited(streamName) {
+			invited = ch
+		}
+	} else {
+		streamName = ch.ChannelId
+		code, err := ch.Invite(&InviteOptions{}, streamName, &PlayInfo{NetWork: "udp", StreamName: streamName})
+		if err == nil && code != http.StatusOK {
+			err = fmt.Errorf("invite channel fail, code:%d", code)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		ch.setCascadeInvited(streamName)
+		invited = ch
+	}
+
+	for start := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		if ok, _ := hook.GetHookSessionManagerInstance().GetHookSession(streamName); ok {
+			return streamName, invited, nil
+		}
+		if time.Since(start) > cascadeStreamWaitTimeout {
+			if invited != nil {
+				invited.Bye(streamName)
+			}
+			return "", nil, ErrStreamNotFound
+		}
+	}
+}
+
+// answerSdp 应答上级平台的sdp，我们只发送ps流
+func (cs *cascadeSession) answerSdp(sdp *sdpMedia, payloadType uint8) string {
+	mediaIp := cs.cascade.mediaIp()
+	protocol := ""
+	if sdp.tcp {
+		protocol = "TCP/"
+	}
+	sdpInfo := []string{
+		"v=0",
+		fmt.Sprintf("o=%s 0 0 IN IP4 %s", cs.channelId, mediaIp),
+		"s=Play",
+		"c=IN IP4 " + mediaIp,
+		"t=0 0",
+		fmt.Sprintf("m=video %d %sRTP/AVP %d", cs.sender.localPort, protocol, payloadType),
+		"a=sendonly",
+		fmt.Sprintf("a=rtpmap:%d PS/90000", payloadType),
+	}
+	if sdp.tcp {
+		if sdp.setup == "active" {
+			sdpInfo = append(sdpInfo, "a=setup:passive")
+		} else {
+			sdpInfo = append(sdpInfo, "a=setup:active")
+		}
+		sdpInfo = append(sdpInfo, "a=connection:new")
+	}
+	sdpInfo = append(sdpInfo, "y="+sdp.ssrc)
+	return strings.Join(sdpInfo, "\r\n") + "\r\n"
+}
+
+// start 收到ack后建立连接并开始推流
+func (cs *cascadeSession) start() {
+	cs.mutex.Lock()
+	if cs.started || cs.stopped {
+		cs.mutex.Unlock()
+		return
+	}
+	cs.started = true
+	cs.mutex.Unlock()
+
+	if err := cs.sender.connect(); err != nil {
+		cs.stop(true, "connect superior failed, err:"+err.Error())
+		return
+	}
+	ok, session := hook.GetHookSessionManagerInstance().GetHookSession(cs.streamName)
+	if !ok {
+		cs.stop(true, ErrStreamNotFound.Error())
+		return
+	}
+
+	cs.psMuxer = mpegps.NewPsMuxer()
+	cs.psMuxer.OnPacket = cs.onPsPacket
+	// G.711没有序列头，先根据lal的统计信息添加音频流，保证第一个ps包的psm中带有音频
+	if lal := cs.cascade.s.lalServer; lal != nil {
+		if group := lal.StatGroup(cs.streamName); group != nil {
+			switch group.AudioCodec {
+			case base.AudioCodecG711A:
+				cs.addAudioStream(mpegps.PsStreamG711A)
+			case base.AudioCodecG711U:
+				cs.addAudioStream(mpegps.PsStreamG711U)
+			}
+		}
+	}
+
+	cs.mutex.Lock()
+	if cs.stopped {
+		cs.mutex.Unlock()
+		return
+	}
+	cs.mutex.Unlock()
+
+	nazalog.Info("cascade start push, serverId:", cs.cascade.conf.ServerId, " channelId:", cs.channelId, " streamName:", cs.streamName, " tcp:", cs.sender.tcp)
+	session.AddInnerConsumer(cs.consumerId, cs)
+}
+
+// OnMsg 作为hook session的消费者接收音视频，hook保证先收到序列头，视频从关键帧开始
+func (cs *cascadeSession) OnMsg(msg base.RtmpMsg) {
+	if cs.sendErr != nil {
+		return
+	}
+	var err error
+	switch msg.Header.MsgTypeId {
+	case base.RtmpTypeIdVideo:
+		err = cs.writeVideo(msg)
+	case base.RtmpTypeIdAudio:
+		err = cs.writeAudio(msg)
+	}
+	if err == nil {
+		err = cs.sendErr
+	}
+	if err != nil {
+		cs.sendErr = err
+		nazalog.Error("cascade send media failed, channelId:", cs.channelId, " err:", err)
+		// 先关闭sender避免重复报错，在hook的回调中不同步移除消费者
+		cs.sender.close()
+		go cs.stop(true, err.Error())
+	}
+}
+
+func (cs *cascadeSession) writeVideo(msg base.RtmpMsg) error {
+	if len(msg.Payload) < 5 || msg.IsEnhanced() {
+		return nil
+	}
+	if msg.IsVideoKeySeqHeader() {
+		var streamType mpegps.PsStreamType
+		var header []byte
+		var err error
+		switch msg.VideoCodecId() {
+		case base.RtmpCodecIdAvc:
+			streamType = mpegps.PsStreamH264
+			header, err = avc.SpsPpsSeqHeader2Annexb(msg.Payload)
+		case base.RtmpCodecIdHevc:
+			streamType = mpegps.PsStreamH265
+			header, err = hevc.VpsSpsPpsSeqHeader2Annexb(msg.Payload)
+		default:
+			return nil
+		}
+		if err != nil {
+			nazalog.Warn("parse video seq header failed, streamName:", cs.streamName, " err:", err)
+			return nil
+		}
+		cs.videoHeader = header
+		if !cs.hasVideo {
+			cs.videoSid = cs.psMuxer.AddStream(streamType)
+			cs.hasVideo = true
+		}
+		return nil
+	}
+	if !cs.hasVideo || msg.Payload[1] != base.RtmpAvcPacketTypeNalu {
+		return nil
+	}
+
+	key := msg.IsVideoKeyNalu()
+	if !cs.gotKeyFrame {
+		if !key {
+			return nil
+		}
+		cs.gotKeyFrame = true
+	}
+	frame, err := avc.Avcc2Annexb(msg.Payload[5:])
+	if err != nil {
+		nazalog.Warn("convert video frame failed, streamName:", cs.streamName, " err:", err)
+		return nil
+	}
+	if key {
+		frame = append(append([]byte{}, cs.videoHeader...), frame...)
+	}
+	return cs.psMuxer.Write(cs.videoSid, frame, uint64(msg.Pts())+psPtsOffset, uint64(msg.Dts())+psPtsOffset)
+}
+
+func (cs *cascadeSession) writeAudio(msg base.RtmpMsg) error {
+	if len(msg.Payload) < 2 {
+		return nil
+	}
+	var frame []byte
+	switch msg.AudioCodecId() {
+	case base.RtmpSoundFormatAac:
+		if msg.IsAacSeqHeader() {
+			ascCtx, err := aac.NewAscContext(msg.Payload[2:])
+			if err != nil {
+				nazalog.Warn("parse aac seq header failed, streamName:", cs.streamName, " err:", err)
+				return nil
+			}
+			cs.ascCtx = ascCtx
+			cs.addAudioStream(mpegps.PsStreamAac)
+			return nil
+		}
+		if cs.ascCtx == nil || len(msg.Payload) <= 2 {
+			return nil
+		}
+		raw := msg.Payload[2:]
+		frame = append(cs.ascCtx.PackAdtsHeader(len(raw)), raw...)
+	case base.RtmpSoundFormatG711A:
+		cs.addAudioStream(mpegps.PsStreamG711A)
+		frame = msg.Payload[1:]
+	case base.RtmpSoundFormatG711U:
+		cs.addAudioStream(mpegps.PsStreamG711U)
+		frame = msg.Payload[1:]
+	default:
+		return nil
+	}
+	// 有视频时从第一个关键帧开始发送
+	if cs.hasVideo && !cs.gotKeyFrame {
+		return nil
+	}
+	pts := uint64(msg.Dts()) + psPtsOffset
+	return cs.psMuxer.Write(cs.audioSid, frame, pts, pts)
+}
+
+// addAudioStream ps中只添加一路音频
+func (cs *cascadeSession) addAudioStream(streamType mpegps.PsStreamType) {
+	if cs.hasAudio {
+		return
+	}
+	cs.audioSid = cs.psMuxer.AddStream(streamType)
+	cs.hasAudio = true
+}
+
+func (cs *cascadeSession) onPsPacket(pkg []byte, pts uint64) {
+	if cs.sendErr == nil {
+		cs.sendErr = cs.sender.sendPs(pkg, pts)
+	}
+}
+
+// OnStop 流结束
+func (cs *cascadeSession) OnStop() {
+	go cs.stop(true, "source stream stopped")
+}
+
+// stop 结束会话，bye为false时表示上级平台已经发送了BYE或者会话还没有建立
+func (cs *cascadeSession) stop(bye bool, errMsg string) {
+	cs.mutex.Lock()
+	if cs.stopped {
+		cs.mutex.Unlock()
+		return
+	}
+	cs.stopped = true
+	started := cs.started
+	cs.mutex.Unlock()
+
+	cs.cascade.sessions.Delete(cs.callId)
+	if started {
+		if ok, session := hook.GetHookSessionManagerInstance().GetHookSession(cs.streamName); ok {
+			session.RemoveConsumer(cs.consumerId)
+		}
+	}
+	cs.sender.close()
+	if bye {
+		bye := newByeRequest(cs.inviteReq, cs.inviteResp, cs.cascade.nextSn())
+		if _, err := cs.cascade.request(bye); err != nil {
+			nazalog.Error("send cascade bye failed, channelId:", cs.channelId, " err:", err)
+		}
+	}
+	cs.releaseChannel()
+	nazalog.Info("cascade session stop, serverId:", cs.cascade.conf.ServerId, " channelId:", cs.channelId, " err:", errMsg)
+}
+
+// releaseChannel 为上级点播的通道在没有其他上级会话使用，并且流没有其他观看者时挂断
+//
+// 有其他观看者时不挂断，之后需要通过 /api/gb/stop_play 挂断
+func (cs *cascadeSession) releaseChannel() {
+	ch := cs.channel
+	if ch == nil {
+		return
+	}
+	ch.cascadeMutex.Lock()
+	defer ch.cascadeMutex.Unlock()
+
+	if !ch.isCascadeInvited(cs.streamName) || cs.cascade.s.channelInCascade(ch) {
+		return
+	}
+	if n := cs.cascade.s.streamViewers(cs.streamName); n > 0 {
+		nazalog.Info("cascade keep channel, stream still has viewers, channelId:", ch.ChannelId, " streamName:", cs.streamName, " viewers:", n)
+		return
+	}
+	nazalog.Info("cascade bye channel, channelId:", ch.ChannelId, " streamName:", cs.streamName)
+	ch.Bye(cs.streamName)
+}
+
+// streamViewers 流当前的观看者个数，包括hook session的消费者和lal自己的拉流会话
+func (s *GB28181Server) streamViewers(streamName string) (n int) {
+	if ok, session := hook.GetHookSessionManagerInstance().GetHookSession(streamName); ok {
+		n += session.ConsumerCount()
+	}
+	if s.lalServer != nil {
+		if group := s.lalServer.StatGroup(streamName); group != nil {
+			n += len(group.StatSubs)
+		}
+	}
+	return
+}
+
+func (channel *Channel) isCascadeInvited(streamName string) bool {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+	sess := channel.sessions[streamName]
+	return sess != nil && sess.cascadeInvited
+}
+
+func (channel *Channel) setCascadeInvited(streamName string) {
+	channel.mutex.Lock()
+	if sess := channel.sessions[streamName]; sess != nil {
+		sess.cascadeInvited = true
+	}
+	channel.mutex.Unlock()
+}
+
+// channelInCascade 通道是否正在被上级会话使用
+func (s *GB28181Server) channelInCascade(ch *Channel) (inUse bool) {
+	for _, c := range s.cascades {
+		c.sessions.Range(func(_, value any) bool {
+			if value.(*cascadeSession).channel == ch {
+				inUse = true
+				return false
+			}
+			return true
+		})
+	}
+	return
+}
+
+// Info 点播会话的状态
+func (cs *cascadeSession) Info() *CascadeSessionInfo {
+	info := &CascadeSessionInfo{
+		ChannelId:   cs.channelId,
+		StreamName:  cs.streamName,
+		NetWork:     "udp",
+		RemoteAddr:  fmt.Sprintf("%s:%d", cs.sender.remoteIp, cs.sender.remotePort),
+		SentPackets: cs.sender.sentPackets(),
+		CreateTime:  cs.createTime.Unix(),
+	}
+	if cs.sender.tcp {
+		info.NetWork = "tcp"
+	}
+	return info
+}
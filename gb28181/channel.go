@@ -3,9 +3,11 @@ package gb28181
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/q191201771/naza/pkg/nazaatomic"
@@ -17,15 +19,26 @@ import (
 	"github.com/q191201771/naza/pkg/nazalog"
 )
 
+// ErrChannelBusy 通道离线、不支持点播，或者实时流、同名的回放/下载已经在进行
+var ErrChannelBusy = errors.New("channel is busy or can not invite")
+
+// ErrInviteCanceled 等待invite应答期间会话已经被停止
+var ErrInviteCanceled = errors.New("invite canceled")
+
 type Channel struct {
 	device *Device // 所属设备
 	//status  atomic.Int32 // 通道状态,0:空闲,1:正在invite,2:正在播放
 	GpsTime time.Time // gps时间
 	number  uint16
-	ackReq  sip.Request
 
 	observer IMediaOpObserver
-	playInfo *PlayInfo
+
+	// cascadeMutex 串行化上级平台对该通道的点播和挂断，避免同时向设备发送多次invite
+	cascadeMutex sync.Mutex
+
+	// mutex 保护invite建立的会话，http接口、cascade和设备消息会在不同的协程中访问
+	mutex    sync.Mutex
+	sessions map[string]*inviteSession // key为流名
 
 	ChannelInfo
 	conf config.GB28181Config
@@ -51,8 +64,7 @@ type ChannelInfo struct {
 	Latitude     string        `xml:"Latitude"`     // 纬度
 	StreamName   string        `xml:"-"`
 	serial       string
-	mediaserver.MediaInfo
-	sn nazaatomic.Uint32
+	sn           nazaatomic.Uint32
 }
 
 type ChannelStatus string
@@ -67,12 +79,24 @@ func (channel *Channel) WithMediaServer(observer IMediaOpObserver) {
 }
 
 func (channel *Channel) TryAutoInvite(opt *InviteOptions, streamName string, playInfo *PlayInfo) {
-	if channel.CanInvite(streamName) {
-		go channel.Invite(opt, streamName, playInfo)
+	if _, err := channel.reserve(streamName, *opt); err == nil {
+		go channel.startInvite(opt, streamName, playInfo)
 	}
 }
 
+// CanInvite 是否可以点播实时流，只用于提前判断，Invite 时会再次原子地检查
 func (channel *Channel) CanInvite(streamName string) bool {
+	if !channel.canInvite() {
+		return false
+	}
+
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+	return channel.liveSessionLocked() == nil
+}
+
+// canInvite 通道在线并且是支持点播的类型
+func (channel *Channel) canInvite() bool {
 	if len(channel.ChannelId) != 20 || channel.Status == ChannelOffStatus {
 		nazalog.Info("return false,  channel.DeviceID:", len(channel.ChannelId), " channel.Status:", channel.Status)
 		return false
@@ -81,10 +105,6 @@ func (channel *Channel) CanInvite(streamName string) bool {
 		return false
 	}
 
-	if channel.MediaInfo.IsInvite {
-		return false
-	}
-
 	// 11～13位是设备类型编码
 	typeID := channel.ChannelId[10:13]
 	if typeID == "132" || typeID == "131" {
@@ -143,11 +163,26 @@ f字段中视、音频参数段之间不需空格分割。
 可使用f字段中的分辨率参数标识同一设备不同分辨率的码流。
 */
 
+// Invite 先在通道上预留会话再发送invite，通道被占用时返回 ErrChannelBusy，失败时释放会话
 func (channel *Channel) Invite(opt *InviteOptions, streamName string, playInfo *PlayInfo) (code int, err error) {
+	if _, err = channel.reserve(streamName, *opt); err != nil {
+		return http.StatusConflict, err
+	}
+	return channel.startInvite(opt, streamName, playInfo)
+}
+
+// startInvite 在已经预留的会话上发送invite
+func (channel *Channel) startInvite(opt *InviteOptions, streamName string, playInfo *PlayInfo) (code int, err error) {
 	d := channel.device
 	s := "Play"
+	if opt.Download {
+		s = "Download"
+	} else if !opt.IsLive() {
+		s = "Playback"
+	}
 
 	//然后按顺序生成，一个channel最大999 方便排查问题,也能保证唯一性
+	channel.mutex.Lock()
 	channel.number++
 	if channel.number > 999 {
 		channel.number = 1
@@ -155,38 +190,54 @@ func (channel *Channel) Invite(opt *InviteOptions, streamName string, playInfo *
 	if len(channel.serial) == 0 {
 		channel.serial = RandNumString(6)
 	}
-	opt.CreateSSRC(channel.serial, channel.number)
+	opt.CreateSSRC(channel.serial, channel.number, opt.IsLive())
+	channel.mutex.Unlock()
 
-	var mediaserver *mediaserver.GB28181MediaServer
+	var mediaServer *mediaserver.GB28181MediaServer
 	if channel.observer != nil {
-		mediaserver = channel.observer.OnStartMediaServer(playInfo.NetWork, playInfo.SinglePort, channel.device.ID, channel.ChannelId)
+		mediaServer = channel.observer.OnStartMediaServer(playInfo.NetWork, playInfo.SinglePort, channel.device.ID, channel.ChannelId, streamName)
 	}
-	if mediaserver == nil {
+	if mediaServer == nil {
+		channel.release(streamName)
 		return http.StatusNotFound, err
 	}
 
 	protocol := ""
 	if playInfo.NetWork == "tcp" {
-		opt.MediaPort = mediaserver.GetListenerPort()
+		opt.MediaPort = mediaServer.GetListenerPort()
 		protocol = "TCP/"
 	} else {
-		opt.MediaPort = mediaserver.GetListenerPort()
+		opt.MediaPort = mediaServer.GetListenerPort()
 	}
 
 	sdpInfo := []string{
 		"v=0",
 		fmt.Sprintf("o=%s 0 0 IN IP4 %s", channel.ChannelId, d.mediaIP),
 		"s=" + s,
-		"c=IN IP4 " + d.mediaIP,
+	}
+	if !opt.IsLive() {
+		// 回放时u字段为通道id
+		sdpInfo = append(sdpInfo, fmt.Sprintf("u=%s:0", channel.ChannelId))
+	}
+	sdpInfo = append(sdpInfo,
+		"c=IN IP4 "+d.mediaIP,
 		opt.String(),
 		fmt.Sprintf("m=video %d %sRTP/AVP 96", opt.MediaPort, protocol),
 		"a=recvonly",
 		"a=rtpmap:96 PS/90000",
-		"y=" + opt.ssrc,
+		"y="+opt.ssrc,
+	)
+	if opt.Download && opt.DownloadSpeed > 0 {
+		sdpInfo = append(sdpInfo, fmt.Sprintf("a=downloadspeed:%d", opt.DownloadSpeed))
 	}
 
 	if playInfo.NetWork == "tcp" {
-		sdpInfo = append(sdpInfo, "a=setup:passive", "a=connection:new")
+		if playInfo.TcpMode == TcpModeActive {
+			// tcp主动模式，由我们连接设备的媒体端口
+			sdpInfo = append(sdpInfo, "a=setup:active", "a=connection:new")
+		} else {
+			sdpInfo = append(sdpInfo, "a=setup:passive", "a=connection:new")
+		}
 	}
 
 	invite := channel.CreateRequst(sip.INVITE, channel.conf)
@@ -207,12 +258,8 @@ func (channel *Channel) Invite(opt *InviteOptions, streamName string, playInfo *
 		nazalog.Error("invite failed, err:", err, " invite msg:", invite.String())
 
 		//jay 在media端口监听成功后，但是sip发送失败时
-		if channel.observer != nil {
-			if err = channel.observer.OnStopMediaServer(playInfo.NetWork, playInfo.SinglePort, channel.device.ID, channel.ChannelId, ""); err != nil {
-				nazalog.Errorf("gb28181 MediaServer stop err:%s", err.Error())
-			}
-		}
-
+		channel.release(streamName)
+		channel.stopMediaServer(playInfo, streamName)
 		return http.StatusInternalServerError, err
 	}
 	code = int(inviteRes.StatusCode())
@@ -237,65 +284,142 @@ func (channel *Channel) Invite(opt *InviteOptions, streamName string, playInfo *
 				}
 			}
 		}
-		channel.MediaInfo.IsInvite = true
-		channel.MediaInfo.Ssrc = opt.SSRC
-		channel.MediaInfo.StreamName = streamName
-		channel.MediaInfo.MediaKey = fmt.Sprintf("%s%d", playInfo.NetWork, mediaserver.GetListenerPort())
-
 		ackReq := sip.NewAckRequest("", invite, inviteRes, "", nil)
-		//保存一下播放信息
-		channel.ackReq = ackReq
-		channel.playInfo = playInfo
+		//保存一下播放信息，等待应答期间会话可能已经被停止
+		channel.mutex.Lock()
+		sess, ok := channel.sessions[streamName]
+		if ok {
+			sess.ackReq = ackReq
+			sess.playInfo = playInfo
+			sess.opt = *opt
+			sess.mediaInfo = mediaserver.MediaInfo{
+				IsInvite:   true,
+				Ssrc:       opt.SSRC,
+				StreamName: streamName,
+				MediaKey:   fmt.Sprintf("%s%d", playInfo.NetWork, mediaServer.GetListenerPort()),
+			}
+			if opt.IsLive() {
+				channel.StreamName = streamName
+			}
+		}
+		channel.mutex.Unlock()
 
 		err = channel.device.sipSvr.Send(ackReq)
-	} else {
+		if !ok {
+			nazalog.Warn("invite session stopped before answer, bye it, channelId:", channel.ChannelId, " streamName:", streamName)
+			channel.sendBye(ackReq, 1)
+			channel.stopMediaServer(playInfo, streamName)
+			return http.StatusRequestTimeout, ErrInviteCanceled
+		}
 
-		if channel.observer != nil {
-			if err = channel.observer.OnStopMediaServer(playInfo.NetWork, playInfo.SinglePort, channel.device.ID, channel.ChannelId, ""); err != nil {
-				nazalog.Errorf("gb28181 MediaServer stop err:%s", err.Error())
+		if playInfo.NetWork == "tcp" && playInfo.TcpMode == TcpModeActive {
+			if err = channel.dialMedia(mediaServer, inviteRes.Body()); err != nil {
+				nazalog.Error("gb28181 tcp active connect failed, channelId:", channel.ChannelId, " err:", err)
+				channel.Bye(streamName)
+				return http.StatusInternalServerError, err
 			}
 		}
-
+	} else {
+		channel.release(streamName)
+		channel.stopMediaServer(playInfo, streamName)
 	}
 	return
 }
-func (channel *Channel) GetCallId() string {
-	if channel.ackReq != nil {
-		if callId, ok := channel.ackReq.CallID(); ok {
-			return callId.Value()
-		}
+
+// dialMedia tcp主动模式，根据设备应答sdp中的地址连接设备，连接交给媒体服务处理
+func (channel *Channel) dialMedia(mediasvr *mediaserver.GB28181MediaServer, body string) error {
+	m, err := parseSdpMedia(body, "video")
+	if err != nil {
+		return err
+	}
+	if m.setup == "active" {
+		// 设备不支持被动模式，仍然由设备连接我们
+		nazalog.Warn("gb28181 device answer setup:active, wait for device connect, channelId:", channel.ChannelId)
+		return nil
+	}
+	addr := mediaDialAddr(m, channel.device.NetAddr)
+	conn, err := net.DialTimeout("tcp", addr, rtpConnectTimeout)
+	if err != nil {
+		return err
 	}
-	return ""
+	nazalog.Info("gb28181 tcp active connected, channelId:", channel.ChannelId, " remote:", addr)
+	mediasvr.ServeConn(conn)
+	return nil
 }
-func (channel *Channel) stopMediaServer() (err error) {
-	if channel.playInfo != nil {
-		if channel.observer != nil {
-			if err = channel.observer.OnStopMediaServer(channel.playInfo.NetWork, channel.playInfo.SinglePort, channel.device.ID, channel.ChannelId, channel.playInfo.StreamName); err != nil {
-				nazalog.Errorf("gb28181 MediaServer stop err:%s", err.Error())
-			}
+
+// mediaDialAddr tcp主动模式连接的地址，netAddr为设备信令的来源地址
+func mediaDialAddr(m *sdpMedia, netAddr string) string {
+	ip := m.ip
+	if host, _, err := net.SplitHostPort(netAddr); err == nil {
+		// 设备在nat后面时sdp中一般是内网地址，使用设备信令的来源地址
+		if sdpIp, devIp := net.ParseIP(ip), net.ParseIP(host); sdpIp == nil || sdpIp.IsUnspecified() ||
+			(sdpIp.IsPrivate() && devIp != nil && !devIp.IsPrivate() && !devIp.IsLoopback()) {
+			ip = host
 		}
 	}
-	return
+	return net.JoinHostPort(ip, strconv.Itoa(m.port))
 }
-func (channel *Channel) byeClear() (err error) {
-	err = channel.stopMediaServer()
-	channel.ackReq = nil
-	channel.MediaInfo.Clear()
-	return
+
+func (channel *Channel) stopMediaServer(playInfo *PlayInfo, streamName string) {
+	if playInfo == nil || channel.observer == nil {
+		return
+	}
+	if err := channel.observer.OnStopMediaServer(playInfo.NetWork, playInfo.SinglePort, channel.device.ID, channel.ChannelId, streamName); err != nil {
+		nazalog.Errorf("gb28181 MediaServer stop err:%s", err.Error())
+	}
 }
+
+// onDeviceBye 设备主动挂断，只清理会话，不再发送BYE
+func (channel *Channel) onDeviceBye(streamName string) {
+	if sess := channel.release(streamName); sess != nil {
+		channel.stopMediaServer(sess.playInfo, streamName)
+	}
+}
+
+// Bye 挂断流名对应的会话，正在invite还没有应答的会话在收到应答后挂断
 func (channel *Channel) Bye(streamName string) (err error) {
-	if channel.ackReq != nil {
-		byeReq := channel.ackReq
-		channel.ackReq = nil
-		byeReq.SetMethod(sip.BYE)
-		seq, _ := byeReq.CSeq()
-		seq.SeqNo += 1
-		channel.device.sipSvr.Send(byeReq)
-	} else {
-		err = errors.New("channel has been closed")
+	channel.mutex.Lock()
+	sess := channel.sessions[streamName]
+	delete(channel.sessions, streamName)
+	var seq uint32
+	if sess != nil && sess.ackReq != nil {
+		seq = sess.nextDialogSeq()
+	}
+	channel.mutex.Unlock()
+
+	if sess == nil || sess.ackReq == nil {
+		return errors.New("channel has been closed")
+	}
+	channel.sendBye(sess.ackReq, seq)
+	channel.stopMediaServer(sess.playInfo, streamName)
+	return nil
+}
+
+// byeAll 挂断通道上所有的会话
+func (channel *Channel) byeAll() {
+	channel.mutex.Lock()
+	names := make([]string, 0, len(channel.sessions))
+	for name := range channel.sessions {
+		names = append(names, name)
+	}
+	channel.mutex.Unlock()
+
+	for _, name := range names {
+		nazalog.Info("gb28181 bye channel:", channel.ChannelId, " streamName:", name)
+		channel.Bye(name)
+	}
+}
+
+// sendBye 根据会话的ACK构造BYE，dialogSeq为会话内已经发送的请求数
+func (channel *Channel) sendBye(ackReq sip.Request, dialogSeq uint32) {
+	byeReq := ackReq.Clone().(sip.Request)
+	byeReq.SetMethod(sip.BYE)
+	byeReq.RemoveHeader("Via")
+	if seq, ok := byeReq.CSeq(); ok {
+		seq.SeqNo += dialogSeq
+		seq.MethodName = sip.BYE
 	}
-	channel.stopMediaServer()
-	return err
+	channel.device.sipSvr.Send(byeReq)
 }
 func (channel *Channel) CreateRequst(Method sip.RequestMethod, conf config.GB28181Config) (req sip.Request) {
 	d := channel.device
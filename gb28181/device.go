@@ -9,6 +9,7 @@ import (
 	"time"
 
 	config "github.com/q191201771/lalmax/conf"
+	"github.com/q191201771/lalmax/metrics"
 
 	"github.com/ghettovoice/gosip/sip"
 	"github.com/q191201771/naza/pkg/nazalog"
@@ -17,9 +18,8 @@ import (
 const TIME_LAYOUT = "2006-01-02T15:04:05"
 
 var (
-	Devices             sync.Map
-	DeviceNonce         sync.Map //保存nonce防止设备伪造
-	DeviceRegisterCount sync.Map //设备注册次数
+	Devices     sync.Map
+	DeviceNonce sync.Map //保存nonce防止设备伪造
 )
 
 type DeviceStatus string
@@ -48,20 +48,20 @@ type Device struct {
 	mediaIP         string //设备对应网卡的服务器ip
 	NetAddr         string
 	channelMap      sync.Map
-	subscriber      struct {
-		CallID  string
-		Timeout time.Time
-	}
-	lastSyncTime time.Time
-	GpsTime      time.Time //gps时间
-	Longitude    string    //经度
-	Latitude     string    //纬度
+	lastSyncTime    time.Time
+	GpsTime         time.Time //gps时间
+	Longitude       string    //经度
+	Latitude        string    //纬度
 
 	observer IMediaOpObserver
 	conf     config.GB28181Config
 
 	network string
 	sipSvr  gosip.Server
+
+	recordQueries sync.Map // 正在进行的录像查询，key为通道id和SN
+	subscriptions sync.Map // 向设备发起的事件订阅，key为订阅的CmdType
+	positions     sync.Map // 上报的移动位置，key为通道id，value为*positionTrack
 }
 
 func (d *Device) WithMediaServer(observer IMediaOpObserver) {
@@ -77,7 +77,6 @@ func (d *Device) syncChannels() {
 	if time.Since(d.lastSyncTime) > 2*time.Second {
 		d.lastSyncTime = time.Now()
 		d.Catalog(d.conf)
-		//d.Subscribe(conf)
 		//d.QueryDeviceInfo(conf)
 	}
 }
@@ -108,6 +107,8 @@ func (d *Device) UpdateChannels(list ...ChannelInfo) {
 func (d *Device) addOrUpdateChannel(info ChannelInfo) (c *Channel) {
 	if old, ok := d.channelMap.Load(info.ChannelId); ok {
 		c = old.(*Channel)
+		// 目录更新不影响绑定的流名
+		info.StreamName = c.StreamName
 		c.ChannelInfo = info
 	} else {
 		c = &Channel{
@@ -124,7 +125,6 @@ func (d *Device) addOrUpdateChannel(info ChannelInfo) (c *Channel) {
 func (d *Device) Catalog(conf config.GB28181Config) int {
 	request := d.CreateRequest(sip.MESSAGE, conf)
 	expires := sip.Expires(3600)
-	d.subscriber.Timeout = time.Now().Add(time.Second * time.Duration(expires))
 	contentType := sip.ContentType("Application/MANSCDP+xml")
 
 	request.AppendHeader(&contentType)
@@ -185,33 +185,6 @@ func (d *Device) CreateRequest(Method sip.RequestMethod, conf config.GB28181Conf
 	return
 }
 
-func (d *Device) Subscribe(conf config.GB28181Config) int {
-	request := d.CreateRequest(sip.SUBSCRIBE, conf)
-	if d.subscriber.CallID != "" {
-		callId := sip.CallID(RandNumString(10))
-		request.AppendHeader(&callId)
-	}
-	expires := sip.Expires(3600)
-	d.subscriber.Timeout = time.Now().Add(time.Second * time.Duration(expires))
-	contentType := sip.ContentType("Application/MANSCDP+xml")
-	request.AppendHeader(&contentType)
-	request.AppendHeader(&expires)
-
-	request.SetBody(BuildCatalogXML(d.sn, d.ID), true)
-
-	response, err := d.SipRequestForResponse(request)
-	if err == nil && response != nil {
-		if response.StatusCode() == http.StatusOK {
-			callId, _ := request.CallID()
-			d.subscriber.CallID = string(*callId)
-		} else {
-			d.subscriber.CallID = ""
-		}
-		return int(response.StatusCode())
-	}
-	return http.StatusRequestTimeout
-}
-
 func (d *Device) QueryDeviceInfo(conf config.GB28181Config) {
 	for i := time.Duration(5); i < 100; i++ {
 
@@ -339,5 +312,11 @@ func (d *Device) UpdateChannelPosition(channelId string, gpsTime string, lng str
 }
 
 func (d *Device) SipRequestForResponse(request sip.Request) (sip.Response, error) {
-	return d.sipSvr.RequestWithContext(context.Background(), request)
+	resp, err := d.sipSvr.RequestWithContext(context.Background(), request)
+	result := metrics.ResultOk
+	if err != nil || resp == nil || resp.StatusCode() >= 300 {
+		result = metrics.ResultError
+	}
+	metrics.SipRequestsSent.WithLabelValues(string(request.Method()), result).Inc()
+	return resp, err
 }
@@ -0,0 +1,272 @@
+package gb28181
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/q191201771/lal/pkg/base"
+	"github.com/q191201771/lalmax/fmp4/record"
+	"github.com/q191201771/lalmax/hook"
+	"github.com/q191201771/naza/pkg/nazalog"
+)
+
+const (
+	// 等待设备推流的最长时间
+	downloadStreamTimeout = 15 * time.Second
+	// 结束的下载任务保留时间，超过后在创建新任务时清理
+	downloadJobKeep = 24 * time.Hour
+)
+
+type DownloadStatus string
+
+const (
+	DownloadStatusInviting    DownloadStatus = "inviting"    // 正在发送invite，等待设备推流
+	DownloadStatusDownloading DownloadStatus = "downloading" // 正在下载
+	DownloadStatusDone        DownloadStatus = "done"        // 下载完成
+	DownloadStatusFailed      DownloadStatus = "failed"      // 下载失败
+	DownloadStatusStopped     DownloadStatus = "stopped"     // 被手动停止
+)
+
+// DownloadJobs 录像下载任务，key为任务id
+var DownloadJobs sync.Map
+
+var ErrDownloadJobExist = errors.New("download job already exists")
+
+// DownloadJob 录像下载任务，通过 s=Download 的invite拉取录像，经过hook写入本地fmp4文件
+type DownloadJob struct {
+	mutex sync.Mutex
+
+	id        string
+	channel   *Channel
+	startTime int64
+	endTime   int64
+	speed     int
+	opt       InviteOptions
+	playInfo  PlayInfo
+	writer    *record.Fmp4FileWriter
+
+	status     DownloadStatus
+	errMsg     string
+	mediaEnd   bool // 收到设备的文件结束通知(MediaStatus 121)
+	createTime time.Time
+	finishTime time.Time
+}
+
+// StartDownload 创建录像下载任务，下载在后台进行，通过 GetDownloadJob 查询进度
+func (s *GB28181Server) StartDownload(ch *Channel, startTime, endTime int64, speed int, playInfo PlayInfo) (*DownloadJob, error) {
+	cleanDownloadJobs()
+
+	if speed <= 0 {
+		speed = s.conf.DownloadSpeed
+	}
+	id := fmt.Sprintf("download_%s_%d_%d", ch.ChannelId, startTime, endTime)
+	if v, ok := DownloadJobs.Load(id); ok && !v.(*DownloadJob).finished() {
+		return nil, ErrDownloadJobExist
+	}
+	// 先在通道上预留会话，并发的下载、回放请求不会同时invite
+	opt := InviteOptions{
+		Start:         int(startTime),
+		End:           int(endTime),
+		Download:      true,
+		DownloadSpeed: speed,
+	}
+	if _, err := ch.reserve(id, opt); err != nil {
+		return nil, err
+	}
+
+	writer, err := record.NewFmp4FileWriter(downloadFilename(s.conf.DownloadDir, id))
+	if err != nil {
+		ch.release(id)
+		return nil, err
+	}
+
+	playInfo.DeviceId = ch.device.ID
+	playInfo.ChannelId = ch.ChannelId
+	playInfo.StreamName = id
+	job := &DownloadJob{
+		id:         id,
+		channel:    ch,
+		startTime:  startTime,
+		endTime:    endTime,
+		speed:      speed,
+		opt:        opt,
+		playInfo:   playInfo,
+		writer:     writer,
+		status:     DownloadStatusInviting,
+		createTime: time.Now(),
+	}
+	DownloadJobs.Store(id, job)
+
+	nazalog.Info("start download, id:", id, " file:", writer.Filename(), " speed:", speed)
+	go job.run()
+	return job, nil
+}
+
+// downloadFilename 同一个时间段重复下载时文件名加上序号，不覆盖之前下载的文件
+func downloadFilename(dir, id string) string {
+	filename := filepath.Join(dir, id+".mp4")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filename); err != nil {
+			return filename
+		}
+		filename = filepath.Join(dir, fmt.Sprintf("%s_%d.mp4", id, i))
+	}
+}
+
+// GetDownloadJob 查询下载任务
+func GetDownloadJob(id string) (*DownloadJob, bool) {
+	if v, ok := DownloadJobs.Load(id); ok {
+		return v.(*DownloadJob), true
+	}
+	return nil, false
+}
+
+func (job *DownloadJob) run() {
+	code, err := job.channel.startInvite(&job.opt, job.id, &job.playInfo)
+	if err != nil || code != http.StatusOK {
+		job.finish(DownloadStatusFailed, fmt.Sprintf("invite failed, code:%d, err:%v", code, err))
+		return
+	}
+
+	// 设备开始推流后lal才会创建hook session
+	deadline := time.Now().Add(downloadStreamTimeout)
+	for time.Now().Before(deadline) {
+		if job.finished() {
+			return
+		}
+		if ok, session := hook.GetHookSessionManagerInstance().GetHookSession(job.id); ok {
+			job.setStatus(DownloadStatusDownloading)
+			session.AddInnerConsumer(job.id, job)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	job.channel.Bye(job.id)
+	job.finish(DownloadStatusFailed, "wait stream timeout")
+}
+
+// Stop 手动停止下载，已经下载的部分会保留
+func (job *DownloadJob) Stop() {
+	if job.finished() {
+		return
+	}
+	job.finish(DownloadStatusStopped, "")
+	job.channel.Bye(job.id)
+}
+
+// OnMsg 作为hook session的消费者接收数据
+func (job *DownloadJob) OnMsg(msg base.RtmpMsg) {
+	job.writer.OnMsg(msg)
+}
+
+// OnStop 流结束，设备发送完文件后主动结束或者收到121通知后由我们结束
+func (job *DownloadJob) OnStop() {
+	job.mutex.Lock()
+	mediaEnd := job.mediaEnd
+	job.mutex.Unlock()
+
+	if mediaEnd || job.progress() >= 0.99 {
+		job.finish(DownloadStatusDone, "")
+	} else {
+		job.finish(DownloadStatusFailed, "stream stopped before end")
+	}
+}
+
+func (job *DownloadJob) onMediaEnd() {
+	job.mutex.Lock()
+	job.mediaEnd = true
+	job.mutex.Unlock()
+}
+
+func (job *DownloadJob) finish(status DownloadStatus, errMsg string) {
+	job.mutex.Lock()
+	if job.status == DownloadStatusDone || job.status == DownloadStatusFailed || job.status == DownloadStatusStopped {
+		job.mutex.Unlock()
+		return
+	}
+	job.status = status
+	job.errMsg = errMsg
+	job.finishTime = time.Now()
+	job.mutex.Unlock()
+
+	if err := job.writer.Close(); err != nil {
+		nazalog.Error("close download file failed, id:", job.id, " err:", err)
+	}
+	nazalog.Info("download finish, id:", job.id, " status:", status, " err:", errMsg, " duration(ms):", job.writer.Duration(), " size:", job.writer.Size())
+}
+
+func (job *DownloadJob) setStatus(status DownloadStatus) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	if job.status == DownloadStatusInviting {
+		job.status = status
+	}
+}
+
+func (job *DownloadJob) finished() bool {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	return job.status == DownloadStatusDone || job.status == DownloadStatusFailed || job.status == DownloadStatusStopped
+}
+
+// progress 根据已经写入的媒体时长计算下载进度
+func (job *DownloadJob) progress() float64 {
+	total := (job.endTime - job.startTime) * 1000
+	if total <= 0 {
+		return 0
+	}
+	p := float64(job.writer.Duration()) / float64(total)
+	if p > 1 {
+		p = 1
+	}
+	return p
+}
+
+// Info 下载任务的状态
+func (job *DownloadJob) Info() *DownloadJobInfo {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	info := &DownloadJobInfo{
+		JobId:      job.id,
+		DeviceId:   job.playInfo.DeviceId,
+		ChannelId:  job.playInfo.ChannelId,
+		StartTime:  job.startTime,
+		EndTime:    job.endTime,
+		Speed:      job.speed,
+		Status:     job.status,
+		Error:      job.errMsg,
+		FileName:   job.writer.Filename(),
+		FileSize:   job.writer.Size(),
+		Progress:   job.progress(),
+		CreateTime: job.createTime.Unix(),
+	}
+	if job.status == DownloadStatusDone {
+		info.Progress = 1
+	}
+	if !job.finishTime.IsZero() {
+		info.FinishTime = job.finishTime.Unix()
+	}
+	return info
+}
+
+func cleanDownloadJobs() {
+	DownloadJobs.Range(func(key, value any) bool {
+		job := value.(*DownloadJob)
+		job.mutex.Lock()
+		expired := !job.finishTime.IsZero() && time.Since(job.finishTime) > downloadJobKeep
+		job.mutex.Unlock()
+		if expired {
+			DownloadJobs.Delete(key)
+		}
+		return true
+	})
+}
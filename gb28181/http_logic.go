@@ -1,6 +1,9 @@
 package gb28181
 
 import (
+	"fmt"
+	"net/http"
+	"slices"
 	"sync"
 
 	"github.com/gin-gonic/gin"
@@ -43,6 +46,9 @@ func (g *GbLogic) StartPlay(c *gin.Context) {
 			if len(reqPlay.NetWork) == 0 || !(reqPlay.NetWork == "udp" || reqPlay.NetWork == "tcp") {
 				reqPlay.NetWork = "udp"
 			}
+			if reqPlay.TcpMode != TcpModeActive {
+				reqPlay.TcpMode = TcpModePassive
+			}
 
 			ch.TryAutoInvite(&InviteOptions{}, streamName, &reqPlay.PlayInfo)
 			respPlay := &RespPlay{
@@ -53,6 +59,340 @@ func (g *GbLogic) StartPlay(c *gin.Context) {
 	}
 
 }
+func (g *GbLogic) RecordInfo(c *gin.Context) {
+	var reqRecord ReqRecordInfo
+	if err := c.ShouldBindJSON(&reqRecord); err != nil || reqRecord.StartTime <= 0 || reqRecord.EndTime <= reqRecord.StartTime {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	ch := g.s.FindChannel(reqRecord.DeviceId, reqRecord.ChannelId)
+	if ch == nil {
+		ResponseErrorWithMsg(c, CodeDeviceNotRegister, CodeDeviceNotRegister.Msg())
+		return
+	}
+	sumNum, items, err := ch.QueryRecordInfo(reqRecord.StartTime, reqRecord.EndTime)
+	if err != nil {
+		ResponseErrorWithMsg(c, CodeDeviceRequestError, err.Error())
+		return
+	}
+	respRecord := &RespRecordInfo{
+		DeviceId:   reqRecord.DeviceId,
+		ChannelId:  reqRecord.ChannelId,
+		SumNum:     sumNum,
+		RecordList: make([]*RecordInfo, 0, len(items)),
+	}
+	for _, item := range items {
+		respRecord.RecordList = append(respRecord.RecordList, &RecordInfo{
+			Name:       item.Name,
+			FilePath:   item.FilePath,
+			Address:    item.Address,
+			StartTime:  parseRecordTime(item.StartTime),
+			EndTime:    parseRecordTime(item.EndTime),
+			Secrecy:    item.Secrecy,
+			Type:       item.Type,
+			RecorderId: item.RecorderID,
+			FileSize:   item.FileSize,
+		})
+	}
+	ResponseSuccess(c, respRecord)
+}
+func (g *GbLogic) StartPlayback(c *gin.Context) {
+	var reqPlayback ReqPlayback
+	if err := c.ShouldBindJSON(&reqPlayback); err != nil || reqPlayback.StartTime <= 0 || reqPlayback.EndTime <= reqPlayback.StartTime {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	ch := g.s.FindChannel(reqPlayback.DeviceId, reqPlayback.ChannelId)
+	if ch == nil {
+		ResponseErrorWithMsg(c, CodeDeviceNotRegister, CodeDeviceNotRegister.Msg())
+		return
+	}
+	streamName := reqPlayback.StreamName
+	if len(streamName) == 0 {
+		streamName = fmt.Sprintf("%s_%d_%d", reqPlayback.ChannelId, reqPlayback.StartTime, reqPlayback.EndTime)
+	}
+	if len(reqPlayback.NetWork) == 0 || !(reqPlayback.NetWork == "udp" || reqPlayback.NetWork == "tcp") {
+		reqPlayback.NetWork = "udp"
+	}
+	if reqPlayback.TcpMode != TcpModeActive {
+		reqPlayback.TcpMode = TcpModePassive
+	}
+	reqPlayback.StreamName = streamName
+
+	opt := &InviteOptions{
+		Start: int(reqPlayback.StartTime),
+		End:   int(reqPlayback.EndTime),
+	}
+	// 同步发送INVITE，流名被占用或者设备拒绝时返回错误，而不是返回一个不会有数据的流名
+	code, err := ch.Invite(opt, streamName, &reqPlayback.PlayInfo)
+	if err != nil || code != http.StatusOK {
+		ResponseErrorWithMsg(c, CodeDeviceRequestError, fmt.Sprintf("invite failed, code:%d, err:%v", code, err))
+		return
+	}
+	respPlay := &RespPlay{
+		StreamName: streamName,
+	}
+	ResponseSuccess(c, respPlay)
+}
+func (g *GbLogic) PlaybackPause(c *gin.Context) {
+	var reqCtrl ReqPlaybackCtrl
+	if err := c.ShouldBindJSON(&reqCtrl); err != nil {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	g.playbackCtrl(c, &reqCtrl, func(ch *Channel) error {
+		return ch.PlaybackPause(reqCtrl.StreamName)
+	})
+}
+func (g *GbLogic) PlaybackResume(c *gin.Context) {
+	var reqCtrl ReqPlaybackCtrl
+	if err := c.ShouldBindJSON(&reqCtrl); err != nil {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	g.playbackCtrl(c, &reqCtrl, func(ch *Channel) error {
+		return ch.PlaybackResume(reqCtrl.StreamName)
+	})
+}
+func (g *GbLogic) PlaybackSeek(c *gin.Context) {
+	var reqSeek ReqPlaybackSeek
+	if err := c.ShouldBindJSON(&reqSeek); err != nil || reqSeek.SeekTime <= 0 {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	g.playbackCtrl(c, &reqSeek.ReqPlaybackCtrl, func(ch *Channel) error {
+		return ch.PlaybackSeek(reqSeek.StreamName, reqSeek.SeekTime)
+	})
+}
+func (g *GbLogic) PlaybackSpeed(c *gin.Context) {
+	var reqSpeed ReqPlaybackSpeed
+	if err := c.ShouldBindJSON(&reqSpeed); err != nil {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	if !slices.Contains(ValidScales, reqSpeed.Scale) {
+		ResponseErrorWithMsg(c, CodeInvalidParam, ScaleParamError)
+		return
+	}
+	g.playbackCtrl(c, &reqSpeed.ReqPlaybackCtrl, func(ch *Channel) error {
+		return ch.PlaybackSpeed(reqSpeed.StreamName, reqSpeed.Scale)
+	})
+}
+func (g *GbLogic) playbackCtrl(c *gin.Context, reqCtrl *ReqPlaybackCtrl, ctrl func(ch *Channel) error) {
+	ch := g.s.FindChannel(reqCtrl.DeviceId, reqCtrl.ChannelId)
+	if ch == nil {
+		ResponseErrorWithMsg(c, CodeDeviceNotRegister, CodeDeviceNotRegister.Msg())
+		return
+	}
+	if err := ctrl(ch); err != nil {
+		ResponseErrorWithMsg(c, CodeDeviceRequestError, err.Error())
+		return
+	}
+	ResponseSuccess(c, nil)
+}
+func (g *GbLogic) StartDownload(c *gin.Context) {
+	var reqDownload ReqStartDownload
+	if err := c.ShouldBindJSON(&reqDownload); err != nil || reqDownload.StartTime <= 0 || reqDownload.EndTime <= reqDownload.StartTime || reqDownload.Speed < 0 {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	ch := g.s.FindChannel(reqDownload.DeviceId, reqDownload.ChannelId)
+	if ch == nil {
+		ResponseErrorWithMsg(c, CodeDeviceNotRegister, CodeDeviceNotRegister.Msg())
+		return
+	}
+	if len(reqDownload.NetWork) == 0 || !(reqDownload.NetWork == "udp" || reqDownload.NetWork == "tcp") {
+		reqDownload.NetWork = "udp"
+	}
+	if reqDownload.TcpMode != TcpModeActive {
+		reqDownload.TcpMode = TcpModePassive
+	}
+	job, err := g.s.StartDownload(ch, reqDownload.StartTime, reqDownload.EndTime, reqDownload.Speed, reqDownload.PlayInfo)
+	if err != nil {
+		ResponseErrorWithMsg(c, CodeDeviceRequestError, err.Error())
+		return
+	}
+	ResponseSuccess(c, job.Info())
+}
+func (g *GbLogic) StopDownload(c *gin.Context) {
+	var reqJob ReqDownloadJob
+	if err := c.ShouldBindJSON(&reqJob); err != nil {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	job, ok := GetDownloadJob(reqJob.JobId)
+	if !ok {
+		ResponseErrorWithMsg(c, CodeDownloadJobNotFound, CodeDownloadJobNotFound.Msg())
+		return
+	}
+	job.Stop()
+	ResponseSuccess(c, job.Info())
+}
+func (g *GbLogic) DownloadJobs(c *gin.Context) {
+	var reqJob ReqDownloadJob
+	if err := c.ShouldBindQuery(&reqJob); err != nil {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	if reqJob.JobId != "" {
+		job, ok := GetDownloadJob(reqJob.JobId)
+		if !ok {
+			ResponseErrorWithMsg(c, CodeDownloadJobNotFound, CodeDownloadJobNotFound.Msg())
+			return
+		}
+		ResponseSuccess(c, []*DownloadJobInfo{job.Info()})
+		return
+	}
+	jobs := make([]*DownloadJobInfo, 0)
+	DownloadJobs.Range(func(_, value any) bool {
+		jobs = append(jobs, value.(*DownloadJob).Info())
+		return true
+	})
+	ResponseSuccess(c, jobs)
+}
+func (g *GbLogic) StartBroadcast(c *gin.Context) {
+	var reqBroadcast ReqBroadcast
+	if err := c.ShouldBindJSON(&reqBroadcast); err != nil || reqBroadcast.DeviceId == "" || reqBroadcast.StreamName == "" {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	bs, err := g.s.StartBroadcast(reqBroadcast.DeviceId, reqBroadcast.ChannelId, reqBroadcast.StreamName)
+	if err != nil {
+		ResponseErrorWithMsg(c, CodeDeviceRequestError, err.Error())
+		return
+	}
+	ResponseSuccess(c, bs.Info())
+}
+func (g *GbLogic) StopBroadcast(c *gin.Context) {
+	var reqBroadcast ReqBroadcast
+	if err := c.ShouldBindJSON(&reqBroadcast); err != nil {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	bs, ok := GetBroadcast(reqBroadcast.DeviceId, reqBroadcast.ChannelId)
+	if !ok {
+		ResponseErrorWithMsg(c, CodeBroadcastNotFound, CodeBroadcastNotFound.Msg())
+		return
+	}
+	bs.Stop()
+	ResponseSuccess(c, bs.Info())
+}
+func (g *GbLogic) Broadcasts(c *gin.Context) {
+	infos := make([]*BroadcastInfo, 0)
+	Broadcasts.Range(func(_, value any) bool {
+		infos = append(infos, value.(*BroadcastSession).Info())
+		return true
+	})
+	ResponseSuccess(c, infos)
+}
+func (g *GbLogic) Cascades(c *gin.Context) {
+	ResponseSuccess(c, g.s.Cascades())
+}
+func (g *GbLogic) RegisterBans(c *gin.Context) {
+	ResponseSuccess(c, g.s.RegisterBans())
+}
+func (g *GbLogic) ClearRegisterBan(c *gin.Context) {
+	var req ReqClearRegisterBan
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	ResponseSuccess(c, &RespClearRegisterBan{Cleared: g.s.ClearRegisterBan(req.DeviceId)})
+}
+func (g *GbLogic) Alarms(c *gin.Context) {
+	var req ReqAlarms
+	if err := c.ShouldBindQuery(&req); err != nil {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	ResponseSuccess(c, g.s.Alarms(&req))
+}
+func (g *GbLogic) AlarmSubscribe(c *gin.Context) {
+	var req ReqAlarmSubscribe
+	if err := c.ShouldBindJSON(&req); err != nil || req.DeviceId == "" || (req.Expires != nil && *req.Expires < 0) {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	expires := g.s.conf.Alarm.Expires
+	if req.Expires != nil {
+		expires = *req.Expires
+	}
+	if err := g.s.SubscribeAlarm(req.DeviceId, expires); err != nil {
+		ResponseErrorWithMsg(c, CodeDeviceRequestError, err.Error())
+		return
+	}
+	ResponseSuccess(c, g.s.AlarmSubscriptions(req.DeviceId))
+}
+func (g *GbLogic) AlarmSubscriptions(c *gin.Context) {
+	ResponseSuccess(c, g.s.AlarmSubscriptions(c.Query("device_id")))
+}
+func (g *GbLogic) AlarmReset(c *gin.Context) {
+	var req ReqAlarmReset
+	if err := c.ShouldBindJSON(&req); err != nil || req.DeviceId == "" {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	if err := g.s.ResetAlarm(req.DeviceId, req.ChannelId, req.AlarmMethod, req.AlarmType); err != nil {
+		ResponseErrorWithMsg(c, CodeDeviceRequestError, err.Error())
+		return
+	}
+	ResponseSuccess(c, nil)
+}
+func (g *GbLogic) Subscriptions(c *gin.Context) {
+	ResponseSuccess(c, g.s.Subscriptions(c.Query("device_id"), c.Query("cmd_type")))
+}
+func (g *GbLogic) CatalogSubscribe(c *gin.Context) {
+	var req ReqCatalogSubscribe
+	if err := c.ShouldBindJSON(&req); err != nil || req.DeviceId == "" || (req.Expires != nil && *req.Expires < 0) {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	expires := g.s.conf.Subscribe.CatalogExpires
+	if req.Expires != nil {
+		expires = *req.Expires
+	}
+	if err := g.s.SubscribeCatalog(req.DeviceId, expires); err != nil {
+		ResponseErrorWithMsg(c, CodeDeviceRequestError, err.Error())
+		return
+	}
+	ResponseSuccess(c, g.s.Subscriptions(req.DeviceId, "Catalog"))
+}
+func (g *GbLogic) PositionSubscribe(c *gin.Context) {
+	var req ReqPositionSubscribe
+	if err := c.ShouldBindJSON(&req); err != nil || req.DeviceId == "" || (req.Expires != nil && *req.Expires < 0) || req.Interval < 0 {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	expires := g.s.conf.Subscribe.PositionExpires
+	if req.Expires != nil {
+		expires = *req.Expires
+	}
+	interval := g.s.conf.Subscribe.PositionInterval
+	if req.Interval > 0 {
+		interval = req.Interval
+	}
+	if err := g.s.SubscribePosition(req.DeviceId, expires, interval); err != nil {
+		ResponseErrorWithMsg(c, CodeDeviceRequestError, err.Error())
+		return
+	}
+	ResponseSuccess(c, g.s.Subscriptions(req.DeviceId, "MobilePosition"))
+}
+func (g *GbLogic) Positions(c *gin.Context) {
+	ResponseSuccess(c, g.s.Positions(c.Query("device_id")))
+}
+func (g *GbLogic) PositionHistory(c *gin.Context) {
+	var req ReqPositionHistory
+	if err := c.ShouldBindQuery(&req); err != nil || req.DeviceId == "" {
+		ResponseErrorWithMsg(c, CodeInvalidParam, CodeInvalidParam.Msg())
+		return
+	}
+	infos, err := g.s.PositionHistory(&req)
+	if err != nil {
+		ResponseErrorWithMsg(c, CodeDeviceNotRegister, CodeDeviceNotRegister.Msg())
+		return
+	}
+	ResponseSuccess(c, infos)
+}
 func (g *GbLogic) StopPlay(c *gin.Context) {
 	var reqStop ReqStop
 	if err := c.ShouldBindJSON(&reqStop); err != nil {
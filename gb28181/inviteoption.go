@@ -6,11 +6,14 @@ import (
 )
 
 type InviteOptions struct {
-	Start     int
-	End       int
-	ssrc      string
-	SSRC      uint32
-	MediaPort uint16
+	Start int // 回放开始时间，unix时间戳，实时流为0
+	End   int // 回放结束时间，unix时间戳，实时流为0
+	// 录像下载，需要同时设置Start和End
+	Download      bool
+	DownloadSpeed int // 下载倍速
+	ssrc          string
+	SSRC          uint32
+	MediaPort     uint16
 }
 
 func (o InviteOptions) IsLive() bool {
@@ -21,9 +24,14 @@ func (o InviteOptions) String() string {
 	return fmt.Sprintf("t=%d %d", o.Start, o.End)
 }
 
-func (o *InviteOptions) CreateSSRC(serial string, number uint16) {
+func (o *InviteOptions) CreateSSRC(serial string, number uint16, live bool) {
 	//不按gb生成标准,取ID最后六位，然后按顺序生成，一个channel最大999
-	o.ssrc = fmt.Sprintf("%d%s%03d", 0, serial, number)
+	//第一位0表示实时流，1表示历史流
+	flag := 0
+	if !live {
+		flag = 1
+	}
+	o.ssrc = fmt.Sprintf("%d%s%03d", flag, serial, number)
 	_ssrc, _ := strconv.ParseInt(o.ssrc, 10, 0)
 	o.SSRC = uint32(_ssrc)
 }
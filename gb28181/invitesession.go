@@ -0,0 +1,179 @@
+package gb28181
+
+import (
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/q191201771/lalmax/gb28181/mediaserver"
+)
+
+// inviteSession 一次invite建立的会话，实时流、回放、下载各自独立，同一个通道可以同时存在多个会话
+//
+// 发送invite之前先在通道上预留，收到200之后ackReq不为nil，所有字段由channel.mutex保护
+type inviteSession struct {
+	streamName string
+	opt        InviteOptions // 回放时记录开始、结束时间
+	playInfo   *PlayInfo
+	ackReq     sip.Request
+	scale      float64 // 回放倍速
+	dialogSeq  uint32  // 会话内INFO、BYE请求CSeq的增量
+	rtspSeq    int     // MANSRTSP消息的CSeq
+
+	cascadeInvited bool // 实时流是为上级平台点播的，由最后结束的上级会话挂断
+
+	mediaInfo mediaserver.MediaInfo
+}
+
+func (sess *inviteSession) callId() string {
+	if sess.ackReq == nil {
+		return ""
+	}
+	return callIdOf(sess.ackReq)
+}
+
+// callIdOf 请求的Call-ID，没有时返回空
+func callIdOf(req sip.Request) string {
+	if callId, ok := req.CallID(); ok {
+		return callId.Value()
+	}
+	return ""
+}
+
+// nextDialogSeq 同一个会话内后续请求的CSeq需要递增
+func (sess *inviteSession) nextDialogSeq() uint32 {
+	sess.dialogSeq++
+	return sess.dialogSeq
+}
+
+// reserve 发送invite之前预留会话，同一个通道只能有一路实时流，回放和下载按流名区分，流名已经存在时返回 ErrChannelBusy
+func (channel *Channel) reserve(streamName string, opt InviteOptions) (*inviteSession, error) {
+	if !channel.canInvite() {
+		return nil, ErrChannelBusy
+	}
+
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+
+	if channel.sessions == nil {
+		channel.sessions = make(map[string]*inviteSession)
+	}
+	if _, ok := channel.sessions[streamName]; ok {
+		return nil, ErrChannelBusy
+	}
+	if opt.IsLive() && channel.liveSessionLocked() != nil {
+		return nil, ErrChannelBusy
+	}
+	sess := &inviteSession{streamName: streamName, opt: opt, scale: 1}
+	channel.sessions[streamName] = sess
+	return sess, nil
+}
+
+// release 删除会话，返回被删除的会话
+func (channel *Channel) release(streamName string) *inviteSession {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+
+	sess := channel.sessions[streamName]
+	delete(channel.sessions, streamName)
+	return sess
+}
+
+// liveSessionLocked 调用时需要持有channel.mutex
+func (channel *Channel) liveSessionLocked() *inviteSession {
+	for _, sess := range channel.sessions {
+		if sess.opt.IsLive() {
+			return sess
+		}
+	}
+	return nil
+}
+
+// LiveStreamName 正在播放的实时流的流名，没有在播放时返回空
+func (channel *Channel) LiveStreamName() string {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+
+	if sess := channel.liveSessionLocked(); sess != nil && sess.ackReq != nil {
+		return sess.streamName
+	}
+	return ""
+}
+
+// streamNames 所有已经建立的会话的流名
+func (channel *Channel) streamNames() (names []string) {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+
+	for name, sess := range channel.sessions {
+		if sess.ackReq != nil {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+// findPlaybackLocked 按流名查找回放会话，流名为空时返回唯一的回放会话，调用时需要持有channel.mutex
+func (channel *Channel) findPlaybackLocked(streamName string) *inviteSession {
+	if streamName != "" {
+		if sess := channel.sessions[streamName]; sess != nil && !sess.opt.IsLive() && !sess.opt.Download {
+			return sess
+		}
+		return nil
+	}
+	var found *inviteSession
+	for _, sess := range channel.sessions {
+		if sess.opt.IsLive() || sess.opt.Download {
+			continue
+		}
+		if found != nil {
+			// 有多路回放时需要指定流名
+			return nil
+		}
+		found = sess
+	}
+	return found
+}
+
+// historyStreamName 通道上唯一的回放或者下载会话的流名，有多个时返回空
+func (channel *Channel) historyStreamName() (streamName string) {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+
+	for name, sess := range channel.sessions {
+		if sess.opt.IsLive() || sess.ackReq == nil {
+			continue
+		}
+		if streamName != "" {
+			return ""
+		}
+		streamName = name
+	}
+	return
+}
+
+// streamNameByCallId 设备发送的BYE、MediaStatus等消息通过Call-ID找到对应的会话
+func (channel *Channel) streamNameByCallId(callId string) string {
+	if callId == "" {
+		return ""
+	}
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+
+	for name, sess := range channel.sessions {
+		if sess.callId() == callId {
+			return name
+		}
+	}
+	return ""
+}
+
+// mediaInfoBy 按条件查找会话的媒体信息，返回副本
+func (channel *Channel) mediaInfoBy(match func(info *mediaserver.MediaInfo) bool) (mediaserver.MediaInfo, bool) {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+
+	for _, sess := range channel.sessions {
+		if sess.mediaInfo.IsInvite && match(&sess.mediaInfo) {
+			return sess.mediaInfo, true
+		}
+	}
+	return mediaserver.MediaInfo{}, false
+}
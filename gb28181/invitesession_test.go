@@ -0,0 +1,92 @@
+package gb28181
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestChannel() *Channel {
+	return &Channel{ChannelInfo: ChannelInfo{ChannelId: "34020000001320000001", Status: ChannelOnStatus}}
+}
+
+func TestChannelReserveLive(t *testing.T) {
+	ch := newTestChannel()
+
+	var wg sync.WaitGroup
+	var reserved atomic.Int32
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := ch.reserve(fmt.Sprintf("live_%d", i), InviteOptions{}); err == nil {
+				reserved.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if reserved.Load() != 1 {
+		t.Fatalf("expect only one live session, got:%d", reserved.Load())
+	}
+	if ch.CanInvite(ch.ChannelId) {
+		t.Fatal("expect channel can not invite live while reserved")
+	}
+}
+
+func TestChannelReserveCoexist(t *testing.T) {
+	ch := newTestChannel()
+	testCases := []struct {
+		streamName string
+		opt        InviteOptions
+		expectErr  bool
+	}{
+		{"live", InviteOptions{}, false},
+		{"playback1", InviteOptions{Start: 1, End: 2}, false},
+		{"playback2", InviteOptions{Start: 3, End: 4}, false},
+		{"download", InviteOptions{Start: 1, End: 2, Download: true}, false},
+		{"live2", InviteOptions{}, true},
+		{"playback1", InviteOptions{Start: 1, End: 2}, true},
+	}
+	for _, tc := range testCases {
+		if _, err := ch.reserve(tc.streamName, tc.opt); (err != nil) != tc.expectErr {
+			t.Fatalf("streamName:%s, expect err:%v, got:%v", tc.streamName, tc.expectErr, err)
+		}
+	}
+
+	ch.mutex.Lock()
+	// 有两路回放时必须指定流名
+	if sess := ch.findPlaybackLocked(""); sess != nil {
+		t.Fatalf("expect nil, got:%s", sess.streamName)
+	}
+	if sess := ch.findPlaybackLocked("download"); sess != nil {
+		t.Fatal("expect download session not found as playback")
+	}
+	if sess := ch.findPlaybackLocked("playback2"); sess == nil {
+		t.Fatal("expect playback2 found")
+	}
+	ch.mutex.Unlock()
+
+	if sess := ch.release("playback2"); sess == nil || sess.streamName != "playback2" {
+		t.Fatal("expect playback2 released")
+	}
+	ch.mutex.Lock()
+	sess := ch.findPlaybackLocked("")
+	ch.mutex.Unlock()
+	if sess == nil || sess.streamName != "playback1" {
+		t.Fatal("expect the only playback found")
+	}
+
+	ch.release("live")
+	if _, err := ch.reserve("live2", InviteOptions{}); err != nil {
+		t.Fatalf("expect live reserved after release, err:%v", err)
+	}
+}
+
+func TestChannelReserveOffline(t *testing.T) {
+	ch := newTestChannel()
+	ch.Status = ChannelOffStatus
+	if _, err := ch.reserve("live", InviteOptions{}); err != ErrChannelBusy {
+		t.Fatalf("expect ErrChannelBusy, got:%v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package gb28181
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/q191201771/naza/pkg/nazalog"
+)
+
+var ErrNotInPlayback = errors.New("channel is not in playback")
+
+// ValidScales 设备一般支持的回放倍速
+var ValidScales = []float64{0.25, 0.5, 1, 2, 4, 8}
+
+// PlaybackPause 暂停回放，streamName为空时通道上只能有一路回放
+func (channel *Channel) PlaybackPause(streamName string) error {
+	return channel.mansrtsp(streamName, "PAUSE", "PauseTime: now", 0)
+}
+
+// PlaybackResume 恢复回放
+func (channel *Channel) PlaybackResume(streamName string) error {
+	return channel.mansrtsp(streamName, "PLAY", "Range: npt=now-", 0)
+}
+
+// PlaybackSeek 拖动到seekTime(unix时间戳，单位秒)继续回放
+func (channel *Channel) PlaybackSeek(streamName string, seekTime int64) error {
+	channel.mutex.Lock()
+	sess := channel.findPlaybackLocked(streamName)
+	if sess == nil {
+		channel.mutex.Unlock()
+		return ErrNotInPlayback
+	}
+	start, end := int64(sess.opt.Start), int64(sess.opt.End)
+	channel.mutex.Unlock()
+
+	if seekTime < start || seekTime > end {
+		return fmt.Errorf("seek time out of range [%d, %d]", start, end)
+	}
+	// npt为相对于回放开始时间的秒数
+	return channel.mansrtsp(streamName, "PLAY", fmt.Sprintf("Range: npt=%d-", seekTime-start), 0)
+}
+
+// PlaybackSpeed 设置回放倍速
+func (channel *Channel) PlaybackSpeed(streamName string, scale float64) error {
+	return channel.mansrtsp(streamName, "PLAY", "Scale: "+strconv.FormatFloat(scale, 'f', -1, 64), scale)
+}
+
+// mansrtsp 在回放会话上发送INFO消息，消息体为MANSRTSP格式，scale大于0时设备应答成功后更新回放倍速
+//
+// CSeq在锁内分配，发送时不持有锁，避免设备不应答时阻塞BYE
+func (channel *Channel) mansrtsp(streamName string, method string, header string, scale float64) error {
+	channel.mutex.Lock()
+	sess := channel.findPlaybackLocked(streamName)
+	if sess == nil || sess.ackReq == nil {
+		channel.mutex.Unlock()
+		return ErrNotInPlayback
+	}
+	ackReq := sess.ackReq
+	sess.rtspSeq++
+	rtspSeq := sess.rtspSeq
+	dialogSeq := sess.nextDialogSeq()
+	playInfo := sess.playInfo
+	channel.mutex.Unlock()
+
+	d := channel.device
+	body := strings.Join([]string{
+		method + " MANSRTSP/1.0",
+		fmt.Sprintf("CSeq: %d", rtspSeq),
+		header,
+	}, "\r\n") + "\r\n\r\n"
+
+	info := ackReq.Clone().(sip.Request)
+	info.SetMethod(sip.INFO)
+	// 重新生成Via的branch，作为一个新的事务
+	info.RemoveHeader("Via")
+	if seq, ok := info.CSeq(); ok {
+		seq.SeqNo += dialogSeq
+		seq.MethodName = sip.INFO
+	}
+	info.RemoveHeader("Content-Type")
+	info.AppendHeader(&sip.GenericHeader{HeaderName: "Content-Type", Contents: "Application/MANSRTSP"})
+	info.SetBody(body, true)
+
+	nazalog.Info("SIP->Playback control, channelId:", channel.ChannelId, " body:", body)
+	resp, err := d.SipRequestForResponse(info)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("sip info %s fail,code:%d", method, resp.StatusCode())
+	}
+
+	channel.mutex.Lock()
+	if scale > 0 {
+		sess.scale = scale
+	}
+	scale = sess.scale
+	channel.mutex.Unlock()
+
+	// 拖动、暂停后ps流的时间戳不再连续，需要重新计算
+	if channel.observer != nil && playInfo != nil {
+		channel.observer.OnSetMediaScale(playInfo.NetWork, playInfo.SinglePort, d.ID, channel.ChannelId, sess.streamName, scale)
+	}
+	return nil
+}
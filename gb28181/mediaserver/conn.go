@@ -8,6 +8,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/q191201771/lalmax/gb28181/mpegps"
@@ -54,6 +55,12 @@ type Conn struct {
 	mediaServer *GB28181MediaServer
 	one         sync.Once
 	oneSaveConn sync.Once
+
+	// 回放控制
+	scale      atomic.Uint64 // float64的bits
+	trickPlay  atomic.Bool
+	videoClock scaleClock
+	audioClock scaleClock
 }
 
 func NewConn(conn net.Conn, observer IGbObserver, lal logic.ILalServer) *Conn {
@@ -142,7 +149,7 @@ func (c *Conn) Serve() (err error) {
 				mediaInfo, ok = c.observer.GetMediaInfoByKey(c.key)
 				if !ok {
 					nazalog.Error("get mediaInfo :", c.key)
-					return fmt.Errorf("get mediaInfo:%d", c.key)
+					return fmt.Errorf("get mediaInfo:%s", c.key)
 				}
 			}
 			c.check = true
@@ -181,7 +188,6 @@ func (c *Conn) Serve() (err error) {
 			c.demuxer.Input(pkt.Payload)
 		}
 	}
-	return
 }
 
 func (c *Conn) Demuxer(data []byte) error {
@@ -241,10 +247,18 @@ func (c *Conn) OnFrame(frame []byte, cid mpegps.PsStreamType, pts uint64, dts ui
 			c.audioFrame.initPts = pts
 		}
 
+		if c.trickPlay.Load() {
+			c.audioFrame.dts = c.audioClock.convert(dts, c.audioFrame.dts, c.getScale())
+			c.audioFrame.pts = c.audioFrame.dts
+		} else {
+			c.audioFrame.dts = dts - c.audioFrame.initDts
+			c.audioFrame.pts = pts - c.audioFrame.initPts
+		}
+
 		var pkt base.AvPacket
 		pkt.PayloadType = payloadType
-		pkt.Timestamp = int64(dts - c.audioFrame.initDts)
-		pkt.Pts = int64(pts - c.audioFrame.initPts)
+		pkt.Timestamp = int64(c.audioFrame.dts)
+		pkt.Pts = int64(c.audioFrame.pts)
 		pkt.Payload = append(pkt.Payload, frame...)
 		c.lalSession.FeedAvPacket(pkt)
 
@@ -258,8 +272,18 @@ func (c *Conn) OnFrame(frame []byte, cid mpegps.PsStreamType, pts uint64, dts ui
 		}
 
 		// 塞入lal中
-		c.videoFrame.pts = pts - c.videoFrame.initPts
-		c.videoFrame.dts = dts - c.videoFrame.initDts
+		if c.trickPlay.Load() {
+			// 倍速时pts和dts的差值也需要按照倍速计算
+			scale := c.getScale()
+			c.videoFrame.dts = c.videoClock.convert(dts, c.videoFrame.dts, scale)
+			c.videoFrame.pts = c.videoFrame.dts
+			if pts > dts {
+				c.videoFrame.pts += uint64(float64(pts-dts) / scale)
+			}
+		} else {
+			c.videoFrame.pts = pts - c.videoFrame.initPts
+			c.videoFrame.dts = dts - c.videoFrame.initDts
+		}
 		var pkt base.AvPacket
 		pkt.PayloadType = payloadType
 		pkt.Timestamp = int64(c.videoFrame.dts)
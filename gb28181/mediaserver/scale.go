@@ -0,0 +1,58 @@
+package mediaserver
+
+import "math"
+
+const (
+	// 拖动时时间戳会跳变，超过该值(ms)时不按照实际差值计算
+	maxTimestampJump = 5000
+	// 时间戳跳变时使用的帧间隔(ms)
+	defaultFrameInterval = 40
+)
+
+// scaleClock 回放倍速和拖动后重新计算时间戳，保证推给lal的时间戳连续，并且按照倍速压缩或者拉伸
+type scaleClock struct {
+	inited  bool
+	lastIn  uint64
+	lastOut uint64
+}
+
+// convert in为ps流中的时间戳，start为切换时已经输出的最后一个时间戳
+func (t *scaleClock) convert(in uint64, start uint64, scale float64) uint64 {
+	if !t.inited {
+		t.inited = true
+		t.lastIn = in
+		t.lastOut = start
+		return t.lastOut
+	}
+
+	delta := int64(in - t.lastIn)
+	t.lastIn = in
+	if delta < 0 || float64(delta) > maxTimestampJump*math.Max(scale, 1) {
+		t.lastOut += defaultFrameInterval
+		return t.lastOut
+	}
+	t.lastOut += uint64(float64(delta) / scale)
+	return t.lastOut
+}
+
+// SetScale 回放控制(倍速、拖动、暂停、恢复)后调用，之后的时间戳都通过scaleClock计算
+func (c *Conn) SetScale(scale float64) {
+	if scale <= 0 {
+		scale = 1
+	}
+	c.scale.Store(math.Float64bits(scale))
+	c.trickPlay.Store(true)
+}
+
+func (c *Conn) getScale() float64 {
+	return math.Float64frombits(c.scale.Load())
+}
+
+// SetScale 设置某路流的回放倍速
+func (s *GB28181MediaServer) SetScale(streamName string, scale float64) bool {
+	if v, ok := s.conns.Load(streamName); ok {
+		v.(*Conn).SetScale(scale)
+		return true
+	}
+	return false
+}
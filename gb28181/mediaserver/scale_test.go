@@ -0,0 +1,32 @@
+package mediaserver
+
+import "testing"
+
+func TestScaleClockConvert(t *testing.T) {
+	testCases := []struct {
+		name   string
+		start  uint64
+		scale  float64
+		in     []uint64
+		expect []uint64
+	}{
+		{"normal", 1000, 1, []uint64{5000, 5040, 5080}, []uint64{1000, 1040, 1080}},
+		// 2倍速时ps时间戳间隔80ms，输出压缩为40ms
+		{"fast", 1000, 2, []uint64{5000, 5080, 5160}, []uint64{1000, 1040, 1080}},
+		{"slow", 1000, 0.5, []uint64{5000, 5020, 5040}, []uint64{1000, 1040, 1080}},
+		// 拖动后时间戳向后跳变，按照默认帧间隔继续
+		{"seek forward", 1000, 1, []uint64{5000, 5040, 65000, 65040}, []uint64{1000, 1040, 1080, 1120}},
+		// 向前拖动时间戳回退
+		{"seek backward", 1000, 1, []uint64{5000, 5040, 2000, 2040}, []uint64{1000, 1040, 1080, 1120}},
+		// 高倍速时允许的跳变按倍速放大
+		{"fast jump", 0, 8, []uint64{0, 8000}, []uint64{0, 1000}},
+	}
+	for _, tc := range testCases {
+		c := &scaleClock{}
+		for i, in := range tc.in {
+			if out := c.convert(in, tc.start, tc.scale); out != tc.expect[i] {
+				t.Fatalf("%s: in:%d expect:%d, got:%d", tc.name, in, tc.expect[i], out)
+			}
+		}
+	}
+}
@@ -54,23 +54,29 @@ func (s *GB28181MediaServer) Start(listener net.Listener) (err error) {
 					if ok := errors.As(err, &ne); ok && ne.Timeout() {
 						nazalog.Error("Accept failed: timeout error, retrying...")
 						time.Sleep(time.Second / 20)
+						continue
 					} else {
 						break
 					}
 				}
 
-				c := NewConn(conn, s.observer, s.lalServer)
-				c.SetKey(s.mediaKey)
-				c.SetMediaServer(s)
-				go func() {
-					c.Serve()
-					s.conns.Delete(c.streamName)
-				}()
+				s.ServeConn(conn)
 			}
 		}()
 	}
 	return
 }
+
+// ServeConn 处理一个媒体连接，tcp主动模式时由我们连接设备后调用
+func (s *GB28181MediaServer) ServeConn(conn net.Conn) {
+	c := NewConn(conn, s.observer, s.lalServer)
+	c.SetKey(s.mediaKey)
+	c.SetMediaServer(s)
+	go func() {
+		c.Serve()
+		s.conns.Delete(c.streamName)
+	}()
+}
 func (s *GB28181MediaServer) CloseConn(streamName string) {
 	if v, ok := s.conns.Load(streamName); ok {
 		conn := v.(*Conn)
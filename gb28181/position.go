@@ -0,0 +1,180 @@
+package gb28181
+
+import (
+	"bytes"
+	"encoding/xml"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/q191201771/naza/pkg/nazalog"
+	"golang.org/x/net/html/charset"
+)
+
+// PositionInfo 设备或者通道上报的移动位置
+type PositionInfo struct {
+	DeviceId    string `json:"device_id"`
+	ChannelId   string `json:"channel_id"`   // 上报位置的通道，设备本身上报时和device_id相同
+	Time        string `json:"time"`         // 设备上报的gps时间
+	Longitude   string `json:"longitude"`    // 经度
+	Latitude    string `json:"latitude"`     // 纬度
+	Speed       string `json:"speed"`        // 速度，单位km/h
+	Direction   string `json:"direction"`    // 方向，正北为0度，顺时针
+	Altitude    string `json:"altitude"`     // 海拔高度，单位m
+	ReceiveTime int64  `json:"receive_time"` // 收到位置的时间，unix毫秒时间戳
+}
+
+// positionMessage 移动位置的消息体，设备订阅后通过NOTIFY上报，部分设备使用MESSAGE
+type positionMessage struct {
+	XMLName   xml.Name
+	CmdType   string
+	SN        int
+	DeviceID  string
+	Time      string
+	Longitude string
+	Latitude  string
+	Speed     string
+	Direction string
+	Altitude  string
+}
+
+// positionTrack 一个通道最近的移动位置，超过size条时丢弃最早的
+type positionTrack struct {
+	mutex     sync.Mutex
+	positions []*PositionInfo
+}
+
+func (t *positionTrack) add(info *PositionInfo, size int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.positions = append(t.positions, info)
+	if len(t.positions) > size {
+		t.positions = append(t.positions[:0], t.positions[len(t.positions)-size:]...)
+	}
+}
+
+func (t *positionTrack) last() *PositionInfo {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.positions) == 0 {
+		return nil
+	}
+	return t.positions[len(t.positions)-1]
+}
+
+// query 按时间查询，结果按收到时间正序，limit大于0时只返回最近的limit条
+func (t *positionTrack) query(start, end int64, limit int) []*PositionInfo {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	infos := make([]*PositionInfo, 0)
+	for _, p := range t.positions {
+		if start > 0 && p.ReceiveTime < start*1000 {
+			continue
+		}
+		if end > 0 && p.ReceiveTime >= end*1000 {
+			continue
+		}
+		infos = append(infos, p)
+	}
+	if limit > 0 && len(infos) > limit {
+		infos = infos[len(infos)-limit:]
+	}
+	return infos
+}
+
+// onPosition 处理设备上报的移动位置，更新通道坐标并记录轨迹
+func (s *GB28181Server) onPosition(d *Device, body string) {
+	msg := &positionMessage{}
+	decoder := xml.NewDecoder(bytes.NewReader([]byte(body)))
+	decoder.CharsetReader = charset.NewReaderLabel
+	if err := decoder.Decode(msg); err != nil {
+		if err = DecodeGbk(msg, []byte(body)); err != nil {
+			nazalog.Error("decode mobile position failed, err:", err)
+			return
+		}
+	}
+	//更新channel的坐标
+	d.UpdateChannelPosition(msg.DeviceID, msg.Time, msg.Longitude, msg.Latitude)
+
+	info := &PositionInfo{
+		DeviceId:    d.ID,
+		ChannelId:   msg.DeviceID,
+		Time:        msg.Time,
+		Longitude:   msg.Longitude,
+		Latitude:    msg.Latitude,
+		Speed:       msg.Speed,
+		Direction:   msg.Direction,
+		Altitude:    msg.Altitude,
+		ReceiveTime: time.Now().UnixMilli(),
+	}
+	if info.ChannelId == "" {
+		info.ChannelId = d.ID
+	}
+	v, _ := d.positions.LoadOrStore(info.ChannelId, &positionTrack{})
+	v.(*positionTrack).add(info, s.conf.Subscribe.PositionHistorySize)
+}
+
+// seedPosition 启动时用保存的设备、通道坐标作为最近一次的位置，没有上报过位置(gpsTime为零)时忽略
+func (d *Device) seedPosition(channelId string, lng string, lat string, gpsTime time.Time) {
+	if gpsTime.IsZero() || (lng == "" && lat == "") {
+		return
+	}
+	v, _ := d.positions.LoadOrStore(channelId, &positionTrack{})
+	t := v.(*positionTrack)
+	if t.last() != nil {
+		return
+	}
+	t.add(&PositionInfo{
+		DeviceId:    d.ID,
+		ChannelId:   channelId,
+		Time:        gpsTime.Format("2006-01-02T15:04:05"),
+		Longitude:   lng,
+		Latitude:    lat,
+		ReceiveTime: gpsTime.UnixMilli(),
+	}, 1)
+}
+
+// Positions 查询设备和通道最近一次上报的位置，deviceId为空时返回所有设备的
+func (s *GB28181Server) Positions(deviceId string) []*PositionInfo {
+	infos := make([]*PositionInfo, 0)
+	Devices.Range(func(_, value any) bool {
+		d := value.(*Device)
+		if deviceId != "" && d.ID != deviceId {
+			return true
+		}
+		d.positions.Range(func(_, value any) bool {
+			if p := value.(*positionTrack).last(); p != nil {
+				infos = append(infos, p)
+			}
+			return true
+		})
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].DeviceId != infos[j].DeviceId {
+			return infos[i].DeviceId < infos[j].DeviceId
+		}
+		return infos[i].ChannelId < infos[j].ChannelId
+	})
+	return infos
+}
+
+// PositionHistory 查询通道的历史位置，channelId为空时查询设备本身上报的
+func (s *GB28181Server) PositionHistory(req *ReqPositionHistory) ([]*PositionInfo, error) {
+	d := s.FindDevice(req.DeviceId)
+	if d == nil {
+		return nil, ErrDeviceNotOnline
+	}
+	channelId := req.ChannelId
+	if channelId == "" {
+		channelId = d.ID
+	}
+	v, ok := d.positions.Load(channelId)
+	if !ok {
+		return make([]*PositionInfo, 0), nil
+	}
+	return v.(*positionTrack).query(req.StartTime, req.EndTime, req.Limit), nil
+}
@@ -0,0 +1,68 @@
+package gb28181
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPositionTrackQuery(t *testing.T) {
+	track := &positionTrack{}
+	for i := int64(1); i <= 5; i++ {
+		track.add(&PositionInfo{ReceiveTime: i * 1000}, 4)
+	}
+	if p := track.last(); p == nil || p.ReceiveTime != 5000 {
+		t.Fatalf("expect last 5000, got:%v", p)
+	}
+
+	testCases := []struct {
+		start, end int64
+		limit      int
+		expect     []int64
+	}{
+		// 超过size时丢弃最早的
+		{0, 0, 0, []int64{2000, 3000, 4000, 5000}},
+		{3, 0, 0, []int64{3000, 4000, 5000}},
+		{0, 4, 0, []int64{2000, 3000}},
+		{3, 5, 0, []int64{3000, 4000}},
+		{0, 0, 2, []int64{4000, 5000}},
+		{6, 0, 0, []int64{}},
+	}
+	for _, tc := range testCases {
+		out := track.query(tc.start, tc.end, tc.limit)
+		if len(out) != len(tc.expect) {
+			t.Fatalf("start:%d end:%d limit:%d, expect:%v, got len:%d", tc.start, tc.end, tc.limit, tc.expect, len(out))
+		}
+		for i := range out {
+			if out[i].ReceiveTime != tc.expect[i] {
+				t.Fatalf("start:%d end:%d limit:%d, expect:%v, got:%d at %d", tc.start, tc.end, tc.limit, tc.expect, out[i].ReceiveTime, i)
+			}
+		}
+	}
+}
+
+func TestDeviceSeedPosition(t *testing.T) {
+	d := &Device{ID: "34020000001110000001"}
+	gpsTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)
+
+	d.seedPosition("34020000001320000001", "116.3", "39.9", gpsTime)
+	// 没有上报过位置的不作为轨迹
+	d.seedPosition("34020000001320000002", "116.3", "39.9", time.Time{})
+
+	v, ok := d.positions.Load("34020000001320000001")
+	if !ok {
+		t.Fatal("expect position seeded")
+	}
+	p := v.(*positionTrack).last()
+	if p.DeviceId != d.ID || p.Longitude != "116.3" || p.Latitude != "39.9" || p.ReceiveTime != gpsTime.UnixMilli() || p.Time != "2024-01-02T03:04:05" {
+		t.Fatalf("unexpected position:%+v", p)
+	}
+	if _, ok := d.positions.Load("34020000001320000002"); ok {
+		t.Fatal("expect position without gps time not seeded")
+	}
+
+	// 已经有位置时不覆盖
+	d.seedPosition("34020000001320000001", "1", "1", time.Now())
+	if p := v.(*positionTrack).last(); p.Longitude != "116.3" {
+		t.Fatalf("expect position kept, got:%+v", p)
+	}
+}
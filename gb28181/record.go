@@ -0,0 +1,149 @@
+package gb28181
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/q191201771/naza/pkg/nazalog"
+)
+
+// 等待设备返回全部录像结果的最长时间
+const recordInfoTimeout = 10 * time.Second
+
+// RecordItem 录像文件信息
+type RecordItem struct {
+	DeviceID   string `xml:"DeviceID"`   // 通道id
+	Name       string `xml:"Name"`       // 名称
+	FilePath   string `xml:"FilePath"`   // 文件路径
+	Address    string `xml:"Address"`    // 录像地址
+	StartTime  string `xml:"StartTime"`  // 开始时间
+	EndTime    string `xml:"EndTime"`    // 结束时间
+	Secrecy    int    `xml:"Secrecy"`    // 保密属性 0:不涉密 1:涉密
+	Type       string `xml:"Type"`       // 录像产生类型 time/alarm/manual
+	RecorderID string `xml:"RecorderID"` // 录像触发者id
+	FileSize   string `xml:"FileSize"`   // 文件大小，单位Byte
+}
+
+// recordQuery 一次录像查询，设备会按照多条消息返回结果，按SN聚合
+type recordQuery struct {
+	mutex  sync.Mutex
+	sumNum int
+	items  []RecordItem
+	done   chan struct{}
+	closed bool
+}
+
+func (q *recordQuery) append(sumNum int, items []RecordItem) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.sumNum = sumNum
+	q.items = append(q.items, items...)
+	if len(q.items) >= q.sumNum {
+		q.closed = true
+		close(q.done)
+	}
+}
+
+func (q *recordQuery) result() (int, []RecordItem) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.sumNum, q.items
+}
+
+// wait 等待设备返回全部结果，超时时返回已经收到的部分，一条都没有收到时返回错误
+func (q *recordQuery) wait(timeout time.Duration) (int, []RecordItem, error) {
+	select {
+	case <-q.done:
+	case <-time.After(timeout):
+		if sumNum, items := q.result(); len(items) == 0 && sumNum == 0 {
+			return 0, nil, errors.New("query record info timeout")
+		}
+	}
+	sumNum, items := q.result()
+	return sumNum, items, nil
+}
+
+func recordQueryKey(channelId string, sn int) string {
+	return fmt.Sprintf("%s_%d", channelId, sn)
+}
+
+// QueryRecordInfo 查询通道在[start, end]时间段内的录像，start和end为unix时间戳，单位秒
+// 返回设备上报的录像总数和已经收到的录像列表，超时时返回已经收到的部分
+func (channel *Channel) QueryRecordInfo(start, end int64) (sumNum int, items []RecordItem, err error) {
+	d := channel.device
+	sn := int(channel.sn.Add(1))
+	key := recordQueryKey(channel.ChannelId, sn)
+	query := &recordQuery{done: make(chan struct{})}
+	d.recordQueries.Store(key, query)
+	defer d.recordQueries.Delete(key)
+
+	msg := channel.CreateRequst(sip.MESSAGE, channel.conf)
+	msg.AppendHeader(&sip.GenericHeader{HeaderName: "Content-Type", Contents: "Application/MANSCDP+xml"})
+	msg.SetBody(BuildRecordInfoXML(sn, channel.ChannelId, start, end), true)
+	resp, err := d.SipRequestForResponse(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return 0, nil, fmt.Errorf("sip message record info fail,code:%d", resp.StatusCode())
+	}
+
+	sumNum, items, err = query.wait(recordInfoTimeout)
+	if err == nil && len(items) < sumNum {
+		nazalog.Warnf("query record info timeout, channelId:%s, sumNum:%d, received:%d", channel.ChannelId, sumNum, len(items))
+	}
+	return
+}
+
+// onRecordInfo 收到设备返回的录像查询结果
+func (d *Device) onRecordInfo(channelId string, sn int, sumNum int, items []RecordItem) {
+	v, ok := d.recordQueries.Load(recordQueryKey(channelId, sn))
+	if !ok {
+		nazalog.Warn("record info query not found, channelId:", channelId, " sn:", sn)
+		return
+	}
+	v.(*recordQuery).append(sumNum, items)
+}
+
+// parseRecordTime 设备返回的时间格式为 2006-01-02T15:04:05，按本地时区解析
+func parseRecordTime(s string) int64 {
+	t, err := time.ParseInLocation(TIME_LAYOUT, s, time.Local)
+	if err != nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+// onMediaEnd 回放或者下载时设备通知历史媒体文件发送结束，主动结束会话
+//
+// 通过消息的Call-ID找到会话，设备没有携带会话的Call-ID时只处理通道上唯一的历史媒体会话
+func (d *Device) onMediaEnd(channelId string, callId string) {
+	v, ok := d.channelMap.Load(channelId)
+	if !ok {
+		nazalog.Warn("media end, channel not found, channelId:", channelId)
+		return
+	}
+	ch := v.(*Channel)
+	streamName := ch.streamNameByCallId(callId)
+	if streamName == "" {
+		streamName = ch.historyStreamName()
+	}
+	if streamName == "" {
+		nazalog.Warn("media end, session not found, channelId:", channelId, " callId:", callId)
+		return
+	}
+	nazalog.Info("media end, bye channel:", channelId, " streamName:", streamName)
+	if job, ok := GetDownloadJob(streamName); ok {
+		job.onMediaEnd()
+	}
+	ch.Bye(streamName)
+}
@@ -0,0 +1,60 @@
+package gb28181
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordQueryAggregate(t *testing.T) {
+	d := &Device{ID: "34020000001110000001"}
+	channelId := "34020000001320000001"
+	query := &recordQuery{done: make(chan struct{})}
+	d.recordQueries.Store(recordQueryKey(channelId, 7), query)
+
+	// 设备分多条消息返回，其他SN的结果不会混入
+	d.onRecordInfo(channelId, 7, 3, []RecordItem{{Name: "a"}, {Name: "b"}})
+	d.onRecordInfo(channelId, 8, 3, []RecordItem{{Name: "x"}})
+	d.onRecordInfo(channelId, 7, 3, []RecordItem{{Name: "c"}})
+	// 聚合完成后再收到的忽略
+	d.onRecordInfo(channelId, 7, 3, []RecordItem{{Name: "d"}})
+
+	sumNum, items, err := query.wait(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sumNum != 3 || len(items) != 3 {
+		t.Fatalf("expect 3 items, got sumNum:%d items:%d", sumNum, len(items))
+	}
+	for i, name := range []string{"a", "b", "c"} {
+		if items[i].Name != name {
+			t.Fatalf("expect %s at %d, got:%s", name, i, items[i].Name)
+		}
+	}
+}
+
+func TestRecordQueryTimeout(t *testing.T) {
+	testCases := []struct {
+		name      string
+		sumNum    int
+		items     []RecordItem
+		expectErr bool
+		expectNum int
+	}{
+		{"empty", -1, nil, true, 0},
+		{"partial", 3, []RecordItem{{Name: "a"}}, false, 1},
+		{"no record", 0, nil, false, 0},
+	}
+	for _, tc := range testCases {
+		query := &recordQuery{done: make(chan struct{})}
+		if tc.sumNum >= 0 {
+			query.append(tc.sumNum, tc.items)
+		}
+		sumNum, items, err := query.wait(10 * time.Millisecond)
+		if (err != nil) != tc.expectErr {
+			t.Fatalf("%s: expect err:%v, got:%v", tc.name, tc.expectErr, err)
+		}
+		if len(items) != tc.expectNum || (!tc.expectErr && sumNum != tc.sumNum) {
+			t.Fatalf("%s: unexpected result, sumNum:%d items:%d", tc.name, sumNum, len(items))
+		}
+	}
+}
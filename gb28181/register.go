@@ -0,0 +1,311 @@
+package gb28181
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/q191201771/naza/pkg/nazalog"
+)
+
+const (
+	// 回调获取的密码缓存一段时间，避免设备注册的两次请求都回调
+	passwordCacheDuration = 30 * time.Second
+
+	// 最多记录的鉴权失败个数，超过后淘汰最早的记录，避免伪造大量设备id占用内存
+	maxRegisterFailures = 10000
+)
+
+var (
+	ErrRegisterDenied   = errors.New("device id denied by register policy")
+	ErrRegisterRejected = errors.New("device rejected by password callback")
+)
+
+// registerFailure 设备注册鉴权失败的记录，连续失败超过max_auth_failures次后封禁ban_sec秒
+//
+// 按照设备id和来源ip分别记录，其他地址伪造同一个设备id注册失败不会封禁正常的设备
+type registerFailure struct {
+	deviceId     string
+	source       string
+	failures     int
+	lastFailTime time.Time
+	banTime      time.Time // 封禁开始时间，零值表示没有封禁
+}
+
+// passwordCallbackReq 获取设备密码的http回调请求
+type passwordCallbackReq struct {
+	DeviceId string `json:"device_id"`
+	Source   string `json:"source"` // 设备信令的来源地址
+	Realm    string `json:"realm"`
+}
+
+// passwordCallbackResp 回调返回200表示允许注册，password为空表示该设备不需要鉴权
+type passwordCallbackResp struct {
+	Password string `json:"password"`
+}
+
+type cachedPassword struct {
+	password string
+	expire   time.Time
+}
+
+// registerPolicy 设备注册的准入、密码查找以及鉴权失败封禁
+type registerPolicy struct {
+	s      *GB28181Server
+	client *http.Client
+
+	mutex     sync.Mutex
+	failures  map[string]*registerFailure // key为 failureKey
+	passwords map[string]*cachedPassword  // 回调获取的密码缓存
+}
+
+func newRegisterPolicy(s *GB28181Server) *registerPolicy {
+	return &registerPolicy{
+		s: s,
+		client: &http.Client{
+			Timeout: time.Duration(s.conf.Register.CallbackTimeoutMs) * time.Millisecond,
+		},
+		failures:  make(map[string]*registerFailure),
+		passwords: make(map[string]*cachedPassword),
+	}
+}
+
+// check 检查设备id是否在允许注册的范围内
+func (p *registerPolicy) check(id string) error {
+	conf := p.s.conf.Register
+	if hasPrefix(id, conf.DenyPrefixes) || hasPrefix(id, conf.DenyCivilCodes) {
+		return ErrRegisterDenied
+	}
+	if len(conf.AllowPrefixes) == 0 && len(conf.AllowCivilCodes) == 0 {
+		return nil
+	}
+	if hasPrefix(id, conf.AllowPrefixes) || hasPrefix(id, conf.AllowCivilCodes) {
+		return nil
+	}
+	return ErrRegisterDenied
+}
+
+// password 查找设备的密码，needAuth为false表示该设备不需要鉴权
+func (p *registerPolicy) password(id, source string) (password string, needAuth bool, err error) {
+	conf := p.s.conf
+	if pwd, ok := conf.Register.Passwords[id]; ok {
+		return pwd, true, nil
+	}
+	if conf.Register.PasswordCallback != "" {
+		pwd, err := p.callbackPassword(id, source)
+		return pwd, pwd != "", err
+	}
+	return conf.Password, conf.Username != "" || conf.Password != "", nil
+}
+
+func (p *registerPolicy) callbackPassword(id, source string) (string, error) {
+	p.mutex.Lock()
+	if c, ok := p.passwords[id]; ok && time.Now().Before(c.expire) {
+		p.mutex.Unlock()
+		return c.password, nil
+	}
+	p.mutex.Unlock()
+
+	body, err := json.Marshal(&passwordCallbackReq{DeviceId: id, Source: source, Realm: p.s.conf.Realm})
+	if err != nil {
+		return "", err
+	}
+	resp, err := p.client.Post(p.s.conf.Register.PasswordCallback, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", ErrRegisterRejected
+	}
+	var result passwordCallbackResp
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decode password callback response failed, err:%w", err)
+	}
+
+	now := time.Now()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.passwords[id] = &cachedPassword{password: result.Password, expire: now.Add(passwordCacheDuration)}
+	for k, c := range p.passwords {
+		if now.After(c.expire) {
+			delete(p.passwords, k)
+		}
+	}
+	return result.Password, nil
+}
+
+// failureKey 鉴权失败记录的key，来源只使用ip，设备重连后端口会变化
+func failureKey(id, source string) string {
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	return id + "@" + source
+}
+
+// isBanned 设备从该来源注册是否在封禁中，封禁到期后自动解除
+func (p *registerPolicy) isBanned(id, source string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	key := failureKey(id, source)
+	f, ok := p.failures[key]
+	if !ok || f.banTime.IsZero() {
+		return false
+	}
+	if time.Since(f.banTime) >= p.banDuration() {
+		delete(p.failures, key)
+		return false
+	}
+	return true
+}
+
+// onAuthFailed 记录一次鉴权失败，返回是否因此被封禁
+func (p *registerPolicy) onAuthFailed(id, source string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	key := failureKey(id, source)
+	f, ok := p.failures[key]
+	if !ok {
+		if len(p.failures) >= maxRegisterFailures {
+			p.evictOldest()
+		}
+		f = &registerFailure{deviceId: id}
+		p.failures[key] = f
+	}
+	f.source = source
+	f.failures++
+	f.lastFailTime = time.Now()
+	if f.failures >= p.s.conf.Register.MaxAuthFailures && f.banTime.IsZero() {
+		f.banTime = f.lastFailTime
+		nazalog.Warn("gb28181 device banned, id:", id, " source:", source, " failures:", f.failures)
+		return true
+	}
+	return !f.banTime.IsZero()
+}
+
+// onAuthSuccess 鉴权成功后清除该来源的失败记录
+func (p *registerPolicy) onAuthSuccess(id, source string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.failures, failureKey(id, source))
+}
+
+// evictOldest 淘汰最近一次失败时间最早的记录，优先淘汰没有封禁的记录
+func (p *registerPolicy) evictOldest() {
+	var oldestKey string
+	var oldest *registerFailure
+	for key, f := range p.failures {
+		if oldest == nil || f.evictBefore(oldest) {
+			oldestKey, oldest = key, f
+		}
+	}
+	delete(p.failures, oldestKey)
+}
+
+func (f *registerFailure) evictBefore(other *registerFailure) bool {
+	banned, otherBanned := !f.banTime.IsZero(), !other.banTime.IsZero()
+	if banned != otherBanned {
+		return !banned
+	}
+	return f.lastFailTime.Before(other.lastFailTime)
+}
+
+// removeExpired 删除到期的封禁和长时间没有再失败的记录
+func (p *registerPolicy) removeExpired() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for key, f := range p.failures {
+		since := f.lastFailTime
+		if !f.banTime.IsZero() {
+			since = f.banTime
+		}
+		if time.Since(since) >= p.banDuration() {
+			delete(p.failures, key)
+		}
+	}
+}
+
+func (p *registerPolicy) banDuration() time.Duration {
+	return time.Duration(p.s.conf.Register.BanSec) * time.Second
+}
+
+// infos 所有鉴权失败的记录，包括已经封禁和还没有达到封禁次数的
+func (p *registerPolicy) infos() []*RegisterBanInfo {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	infos := make([]*RegisterBanInfo, 0, len(p.failures))
+	for _, f := range p.failures {
+		info := &RegisterBanInfo{
+			DeviceId:     f.deviceId,
+			Source:       f.source,
+			Failures:     f.failures,
+			LastFailTime: f.lastFailTime.Unix(),
+			Banned:       !f.banTime.IsZero(),
+		}
+		if info.Banned {
+			info.BanTime = f.banTime.Unix()
+			info.UnbanTime = f.banTime.Add(p.banDuration()).Unix()
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].DeviceId != infos[j].DeviceId {
+			return infos[i].DeviceId < infos[j].DeviceId
+		}
+		return infos[i].Source < infos[j].Source
+	})
+	return infos
+}
+
+// clear 清除设备所有来源的封禁和失败记录，id为空时清除全部，返回清除的个数
+func (p *registerPolicy) clear(id string) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if id == "" {
+		n := len(p.failures)
+		p.failures = make(map[string]*registerFailure)
+		return n
+	}
+	n := 0
+	for key, f := range p.failures {
+		if f.deviceId == id {
+			delete(p.failures, key)
+			n++
+		}
+	}
+	return n
+}
+
+// RegisterBans 查询设备注册鉴权失败和封禁的记录
+func (s *GB28181Server) RegisterBans() []*RegisterBanInfo {
+	return s.registerPolicy.infos()
+}
+
+// ClearRegisterBan 解除设备的封禁，deviceId为空时解除全部
+func (s *GB28181Server) ClearRegisterBan(deviceId string) int {
+	n := s.registerPolicy.clear(deviceId)
+	nazalog.Info("gb28181 clear register ban, deviceId:", deviceId, " count:", n)
+	return n
+}
+
+func hasPrefix(id string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(id, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package gb28181
+
+import (
+	"testing"
+	"time"
+
+	config "github.com/q191201771/lalmax/conf"
+)
+
+func newTestRegisterPolicy(reg config.GB28181RegisterConfig) *registerPolicy {
+	return newRegisterPolicy(&GB28181Server{conf: config.GB28181Config{Register: reg}})
+}
+
+func TestRegisterPolicyCheck(t *testing.T) {
+	testCases := []struct {
+		name   string
+		reg    config.GB28181RegisterConfig
+		id     string
+		expect error
+	}{
+		{"no limit", config.GB28181RegisterConfig{}, "34020000001320000001", nil},
+		{"allow prefix", config.GB28181RegisterConfig{AllowPrefixes: []string{"3402"}}, "34020000001320000001", nil},
+		{"not allowed", config.GB28181RegisterConfig{AllowPrefixes: []string{"3502"}}, "34020000001320000001", ErrRegisterDenied},
+		{"allow civil code", config.GB28181RegisterConfig{AllowCivilCodes: []string{"340200"}}, "34020000001320000001", nil},
+		{"deny prefix", config.GB28181RegisterConfig{DenyPrefixes: []string{"34020000001320"}}, "34020000001320000001", ErrRegisterDenied},
+		// 禁止优先于允许
+		{"deny over allow", config.GB28181RegisterConfig{AllowPrefixes: []string{"3402"}, DenyCivilCodes: []string{"34"}}, "34020000001320000001", ErrRegisterDenied},
+	}
+	for _, tc := range testCases {
+		if err := newTestRegisterPolicy(tc.reg).check(tc.id); err != tc.expect {
+			t.Fatalf("%s: expect:%v, got:%v", tc.name, tc.expect, err)
+		}
+	}
+}
+
+func TestRegisterPolicyBan(t *testing.T) {
+	p := newTestRegisterPolicy(config.GB28181RegisterConfig{MaxAuthFailures: 3, BanSec: 600})
+	id := "34020000001320000001"
+
+	for i := 1; i <= 3; i++ {
+		if banned := p.onAuthFailed(id, "192.168.1.10:5060"); banned != (i == 3) {
+			t.Fatalf("failure %d, expect banned:%v", i, i == 3)
+		}
+	}
+	// 同一个ip换了端口仍然封禁，其他来源不受影响
+	if !p.isBanned(id, "192.168.1.10:5070") {
+		t.Fatal("expect banned from same ip")
+	}
+	if p.isBanned(id, "192.168.1.11:5060") {
+		t.Fatal("expect not banned from other ip")
+	}
+
+	p.onAuthFailed(id, "192.168.1.11:5060")
+	p.onAuthFailed("34020000001320000002", "192.168.1.12:5060")
+	infos := p.infos()
+	if len(infos) != 3 || !infos[0].Banned || infos[0].Failures != 3 || infos[1].Banned {
+		t.Fatalf("unexpected infos:%+v %+v", infos[0], infos[1])
+	}
+
+	// 鉴权成功后清除该来源的记录
+	p.onAuthSuccess(id, "192.168.1.11:5060")
+	if n := p.clear(id); n != 1 {
+		t.Fatalf("expect clear 1, got:%d", n)
+	}
+	if p.isBanned(id, "192.168.1.10:5060") {
+		t.Fatal("expect ban cleared")
+	}
+	if n := p.clear(""); n != 1 {
+		t.Fatalf("expect clear all 1, got:%d", n)
+	}
+}
+
+func TestRegisterPolicyBanExpire(t *testing.T) {
+	p := newTestRegisterPolicy(config.GB28181RegisterConfig{MaxAuthFailures: 1, BanSec: 600})
+	id := "34020000001320000001"
+	p.onAuthFailed(id, "192.168.1.10:5060")
+	p.onAuthFailed("34020000001320000002", "192.168.1.10:5060")
+
+	p.mutex.Lock()
+	p.failures[failureKey(id, "192.168.1.10")].banTime = time.Now().Add(-time.Hour)
+	p.mutex.Unlock()
+
+	if p.isBanned(id, "192.168.1.10:5060") {
+		t.Fatal("expect ban expired")
+	}
+	p.removeExpired()
+	if infos := p.infos(); len(infos) != 1 || infos[0].DeviceId != "34020000001320000002" {
+		t.Fatalf("expect only unexpired ban left, got:%d", len(infos))
+	}
+}
+
+func TestRegisterPolicyEvict(t *testing.T) {
+	p := newTestRegisterPolicy(config.GB28181RegisterConfig{MaxAuthFailures: 3, BanSec: 600})
+	now := time.Now()
+	p.failures = map[string]*registerFailure{
+		"banned":   {deviceId: "banned", lastFailTime: now.Add(-3 * time.Minute), banTime: now.Add(-3 * time.Minute)},
+		"old":      {deviceId: "old", lastFailTime: now.Add(-2 * time.Minute)},
+		"recently": {deviceId: "recently", lastFailTime: now.Add(-time.Minute)},
+	}
+
+	// 优先淘汰没有封禁的记录中最早失败的
+	p.evictOldest()
+	if _, ok := p.failures["old"]; ok {
+		t.Fatal("expect oldest unbanned failure evicted")
+	}
+	p.evictOldest()
+	if _, ok := p.failures["banned"]; !ok || len(p.failures) != 1 {
+		t.Fatal("expect banned failure kept")
+	}
+}
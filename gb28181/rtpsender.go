@@ -0,0 +1,265 @@
+package gb28181
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/q191201771/naza/pkg/nazalog"
+)
+
+const (
+	// ps封装时单个rtp包的最大负载
+	maxRtpPayloadSize = 1400
+	// tcp方式建立连接的超时时间
+	rtpConnectTimeout = 5 * time.Second
+)
+
+// sdpMedia 对端sdp中指定媒体的传输信息
+type sdpMedia struct {
+	sessionName  string // s行，Play/Playback/Download/Talk
+	ip           string
+	port         int
+	tcp          bool
+	setup        string // tcp时对端的连接方式 active/passive
+	ssrc         string
+	payloadTypes []string
+	rtpmap       map[string]string // 负载类型对应的编码名称，大写
+}
+
+// parseSdpMedia 解析sdp中media(audio/video)对应的m行，以及会话级和该m行下的属性
+func parseSdpMedia(body string, media string) (*sdpMedia, error) {
+	m := &sdpMedia{rtpmap: make(map[string]string)}
+	inSession, inMedia := true, false
+	for _, l := range strings.Split(body, "\n") {
+		l = strings.TrimSpace(l)
+		if len(l) < 2 || l[1] != '=' {
+			continue
+		}
+		v := l[2:]
+		switch l[0] {
+		case 's':
+			m.sessionName = v
+		case 'c':
+			if fs := strings.Fields(v); len(fs) == 3 && (inSession || inMedia) {
+				m.ip = fs[2]
+			}
+		case 'm':
+			inSession = false
+			fs := strings.Fields(v)
+			inMedia = len(fs) >= 4 && fs[0] == media
+			if !inMedia {
+				continue
+			}
+			m.port, _ = strconv.Atoi(fs[1])
+			m.tcp = strings.HasPrefix(strings.ToUpper(fs[2]), "TCP")
+			m.payloadTypes = fs[3:]
+		case 'a':
+			if !inSession && !inMedia {
+				continue
+			}
+			if strings.HasPrefix(v, "rtpmap:") {
+				if fs := strings.Fields(strings.TrimPrefix(v, "rtpmap:")); len(fs) == 2 {
+					m.rtpmap[fs[0]] = strings.ToUpper(strings.Split(fs[1], "/")[0])
+				}
+			} else if strings.HasPrefix(v, "setup:") {
+				m.setup = strings.TrimPrefix(v, "setup:")
+			}
+		case 'y':
+			// 国标扩展的ssrc，一般在sdp的最后
+			m.ssrc = v
+		}
+	}
+	if m.ip == "" || m.port == 0 {
+		return nil, fmt.Errorf("invalid sdp, no %s media, ip:%s port:%d", media, m.ip, m.port)
+	}
+	return m, nil
+}
+
+var errRtpSenderClosed = errors.New("rtp sender closed")
+
+// rtpSender 按照国标的方式向对端发送rtp，支持udp和tcp(rfc4571)，tcp时支持主动和被动连接
+type rtpSender struct {
+	connMutex sync.Mutex
+
+	remoteIp    string
+	remotePort  int
+	tcp         bool
+	setup       string // tcp时对端的连接方式 active/passive
+	payloadType uint8
+	ssrc        uint32
+	localPort   uint16
+
+	conn     net.Conn
+	listener net.Listener // 对端主动连接时使用
+	closed   bool
+
+	seq     uint16
+	packets uint64
+}
+
+// newRtpSender 准备好本地端口，本地端口需要在sdp中带给对端
+func newRtpSender(s *GB28181Server, ip string, port int, tcp bool, setup string, payloadType uint8, ssrc uint32) (*rtpSender, error) {
+	sender := &rtpSender{
+		remoteIp:    ip,
+		remotePort:  port,
+		tcp:         tcp,
+		setup:       setup,
+		payloadType: payloadType,
+		ssrc:        ssrc,
+	}
+
+	remote := net.JoinHostPort(ip, strconv.Itoa(port))
+	switch {
+	case !tcp:
+		raddr, err := net.ResolveUDPAddr("udp", remote)
+		if err != nil {
+			return nil, err
+		}
+		laddr := &net.UDPAddr{}
+		if port, err := s.udpAvailConnPool.Peek(); err == nil {
+			laddr.Port = int(port)
+		}
+		conn, err := net.DialUDP("udp", laddr, raddr)
+		if err != nil {
+			return nil, err
+		}
+		sender.conn = conn
+		sender.localPort = uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	case setup == "active":
+		// 对端主动连接，本地监听
+		listener, port, err := s.tcpAvailConnPool.Acquire()
+		if err != nil {
+			return nil, err
+		}
+		sender.listener = listener
+		sender.localPort = port
+	default:
+		// 对端被动，由我们发起连接，本地端口在连接时绑定
+		port, err := s.tcpAvailConnPool.Peek()
+		if err != nil {
+			return nil, err
+		}
+		sender.localPort = port
+	}
+	return sender, nil
+}
+
+// connect 收到ack后建立tcp连接，udp不需要
+func (sender *rtpSender) connect() error {
+	if !sender.tcp {
+		return nil
+	}
+
+	var conn net.Conn
+	var err error
+	if sender.listener != nil {
+		if l, ok := sender.listener.(*net.TCPListener); ok {
+			l.SetDeadline(time.Now().Add(rtpConnectTimeout))
+		}
+		conn, err = sender.listener.Accept()
+		sender.listener.Close()
+	} else {
+		dialer := net.Dialer{
+			Timeout:   rtpConnectTimeout,
+			LocalAddr: &net.TCPAddr{Port: int(sender.localPort)},
+		}
+		conn, err = dialer.Dial("tcp", net.JoinHostPort(sender.remoteIp, strconv.Itoa(sender.remotePort)))
+	}
+	if err != nil {
+		return err
+	}
+
+	sender.connMutex.Lock()
+	defer sender.connMutex.Unlock()
+	if sender.closed {
+		conn.Close()
+		return errRtpSenderClosed
+	}
+	sender.conn = conn
+	return nil
+}
+
+// ready 连接是否已经建立
+func (sender *rtpSender) ready() bool {
+	sender.connMutex.Lock()
+	defer sender.connMutex.Unlock()
+
+	return !sender.closed && sender.conn != nil
+}
+
+// sendPs 发送ps muxer输出的ps包，按照rtp负载大小拆分，时间戳为90000
+func (sender *rtpSender) sendPs(pkg []byte, pts uint64) error {
+	for len(pkg) > 0 {
+		n := min(len(pkg), maxRtpPayloadSize)
+		if err := sender.sendRtp(pkg[:n], uint32(pts), n == len(pkg)); err != nil {
+			return err
+		}
+		pkg = pkg[n:]
+	}
+	return nil
+}
+
+func (sender *rtpSender) sendRtp(payload []byte, timestamp uint32, marker bool) error {
+	sender.connMutex.Lock()
+	defer sender.connMutex.Unlock()
+	if sender.closed || sender.conn == nil {
+		return nil
+	}
+
+	pkt := rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         marker,
+			PayloadType:    sender.payloadType,
+			SequenceNumber: sender.seq,
+			Timestamp:      timestamp,
+			SSRC:           sender.ssrc,
+		},
+		Payload: payload,
+	}
+	sender.seq++
+	b, err := pkt.Marshal()
+	if err != nil {
+		return err
+	}
+	if sender.tcp {
+		// rfc4571，tcp时每个rtp包前加2字节长度
+		b = append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...)
+	}
+	if _, err = sender.conn.Write(b); err != nil {
+		return err
+	}
+	sender.packets++
+	return nil
+}
+
+func (sender *rtpSender) sentPackets() uint64 {
+	sender.connMutex.Lock()
+	defer sender.connMutex.Unlock()
+
+	return sender.packets
+}
+
+func (sender *rtpSender) close() {
+	sender.connMutex.Lock()
+	defer sender.connMutex.Unlock()
+
+	if sender.closed {
+		return
+	}
+	sender.closed = true
+	if sender.listener != nil {
+		sender.listener.Close()
+	}
+	if sender.conn != nil {
+		sender.conn.Close()
+	}
+	nazalog.Debug("rtp sender closed, remote:", sender.remoteIp, ":", sender.remotePort, " packets:", sender.packets)
+}
@@ -0,0 +1,77 @@
+package gb28181
+
+import (
+	"testing"
+)
+
+func TestParseSdpMedia(t *testing.T) {
+	body := "v=0\r\n" +
+		"o=34020000001320000001 0 0 IN IP4 192.168.1.64\r\n" +
+		"s=Play\r\n" +
+		"c=IN IP4 192.168.1.64\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 15062 RTP/AVP 8\r\n" +
+		"c=IN IP4 192.168.1.65\r\n" +
+		"a=rtpmap:8 PCMA/8000\r\n" +
+		"m=video 15060 TCP/RTP/AVP 96 98\r\n" +
+		"a=setup:passive\r\n" +
+		"a=connection:new\r\n" +
+		"a=rtpmap:96 PS/90000\r\n" +
+		"a=rtpmap:98 h264/90000\r\n" +
+		"y=0200000001\r\n"
+
+	video, err := parseSdpMedia(body, "video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.sessionName != "Play" || video.ip != "192.168.1.64" || video.port != 15060 || !video.tcp ||
+		video.setup != "passive" || video.ssrc != "0200000001" {
+		t.Fatalf("unexpected video media:%+v", video)
+	}
+	if len(video.payloadTypes) != 2 || video.rtpmap["96"] != "PS" || video.rtpmap["98"] != "H264" {
+		t.Fatalf("unexpected video payload:%v %v", video.payloadTypes, video.rtpmap)
+	}
+	// 其他m行下的属性不会混入
+	if _, ok := video.rtpmap["8"]; ok {
+		t.Fatal("expect audio rtpmap not in video media")
+	}
+
+	audio, err := parseSdpMedia(body, "audio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audio.ip != "192.168.1.65" || audio.port != 15062 || audio.tcp || audio.rtpmap["8"] != "PCMA" {
+		t.Fatalf("unexpected audio media:%+v", audio)
+	}
+
+	if _, err := parseSdpMedia("v=0\r\ns=Play\r\nc=IN IP4 1.2.3.4\r\n", "video"); err == nil {
+		t.Fatal("expect error without video media")
+	}
+}
+
+func TestMediaDialAddr(t *testing.T) {
+	testCases := []struct {
+		sdpIp   string
+		netAddr string
+		expect  string
+	}{
+		// 设备在nat后面，sdp中为内网地址
+		{"192.168.1.64", "203.0.113.10:5060", "203.0.113.10:15060"},
+		// 同一个内网
+		{"192.168.1.64", "192.168.1.64:5060", "192.168.1.64:15060"},
+		{"192.168.1.64", "10.0.0.2:5060", "192.168.1.64:15060"},
+		{"192.168.1.64", "127.0.0.1:5060", "192.168.1.64:15060"},
+		// sdp中为公网地址时以sdp为准
+		{"198.51.100.20", "203.0.113.10:5060", "198.51.100.20:15060"},
+		{"0.0.0.0", "203.0.113.10:5060", "203.0.113.10:15060"},
+		{"device.local", "203.0.113.10:5060", "203.0.113.10:15060"},
+		// 没有信令地址时使用sdp中的地址
+		{"192.168.1.64", "", "192.168.1.64:15060"},
+	}
+	for _, tc := range testCases {
+		m := &sdpMedia{ip: tc.sdpIp, port: 15060}
+		if out := mediaDialAddr(m, tc.netAddr); out != tc.expect {
+			t.Fatalf("sdp ip:%s netAddr:%s, expect:%s, got:%s", tc.sdpIp, tc.netAddr, tc.expect, out)
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	udpTransport "github.com/pion/transport/v3/udp"
 	config "github.com/q191201771/lalmax/conf"
 	"github.com/q191201771/lalmax/gb28181/mediaserver"
+	"github.com/q191201771/lalmax/metrics"
 
 	"github.com/ghettovoice/gosip"
 	"github.com/ghettovoice/gosip/log"
@@ -24,14 +25,15 @@ import (
 )
 
 type IMediaOpObserver interface {
-	OnStartMediaServer(netWork string, singlePort bool, deviceId string, channelId string) *mediaserver.GB28181MediaServer
+	OnStartMediaServer(netWork string, singlePort bool, deviceId string, channelId string, streamName string) *mediaserver.GB28181MediaServer
 	OnStopMediaServer(netWork string, singlePort bool, deviceId string, channelId string, StreamName string) error
+	OnSetMediaScale(netWork string, singlePort bool, deviceId string, channelId string, streamName string, scale float64)
 }
 type GB28181Server struct {
 	conf              config.GB28181Config
 	RegisterValidity  time.Duration // 注册有效期，单位秒，默认 3600
 	HeartbeatInterval time.Duration // 心跳间隔，单位秒，默认 60
-	RemoveBanInterval time.Duration // 移除禁止设备间隔,默认600s
+	RemoveBanInterval time.Duration // 清理到期封禁记录的间隔，默认为封禁时长
 	keepaliveInterval int
 
 	lalServer logic.ILalServer
@@ -44,9 +46,18 @@ type GB28181Server struct {
 
 	MediaServerMap sync.Map
 	disposeOnce    sync.Once
-}
 
-const MaxRegisterCount = 3
+	cascades []*Cascade // 级联的上级平台
+
+	store      IDeviceStore // 设备和通道的持久化存储
+	storeMutex sync.Mutex
+	storeData  []byte // 最近一次保存的内容，用于判断是否有变化
+
+	registerPolicy *registerPolicy
+
+	notify INotifyHandler
+	alarms *alarmHistory
+}
 
 var (
 	logger log.Logger
@@ -57,39 +68,13 @@ func init() {
 	logger = log.NewDefaultLogrusLogger().WithPrefix("LalMaxServer")
 }
 
+// NewGB28181Server conf需要已经通过 config.Config.SetDefaults 填充默认值
 func NewGB28181Server(conf config.GB28181Config, lal logic.ILalServer) *GB28181Server {
-	if conf.ListenAddr == "" {
-		conf.ListenAddr = "0.0.0.0"
-	}
-	if conf.SipPort == 0 {
-		conf.SipPort = 5060
-	}
-	if conf.KeepaliveInterval == 0 {
-		conf.KeepaliveInterval = 60
-	}
-	if conf.Serial == "" {
-		conf.Serial = "34020000002000000001"
-	}
-
-	if conf.Realm == "" {
-		conf.Realm = "3402000000"
-	}
-
-	if conf.MediaConfig.MediaIp == "" {
-		conf.MediaConfig.MediaIp = "0.0.0.0"
-	}
-
-	if conf.MediaConfig.ListenPort == 0 {
-		conf.MediaConfig.ListenPort = 30000
-	}
-	if conf.MediaConfig.MultiPortMaxIncrement == 0 {
-		conf.MediaConfig.MultiPortMaxIncrement = 3000
-	}
 	gb28181Server := &GB28181Server{
 		conf:              conf,
-		RegisterValidity:  3600 * time.Second,
+		RegisterValidity:  time.Duration(conf.Register.Expires) * time.Second,
 		HeartbeatInterval: 60 * time.Second,
-		RemoveBanInterval: 600 * time.Second,
+		RemoveBanInterval: time.Duration(conf.Register.BanSec) * time.Second,
 		keepaliveInterval: conf.KeepaliveInterval,
 		lalServer:         lal,
 		udpAvailConnPool:  NewAvailConnPool(conf.MediaConfig.ListenPort+1, conf.MediaConfig.ListenPort+conf.MediaConfig.MultiPortMaxIncrement),
@@ -108,12 +93,19 @@ func NewGB28181Server(conf config.GB28181Config, lal logic.ILalServer) *GB28181S
 
 		return udpTransport.Listen("udp", addr)
 	}
+	gb28181Server.registerPolicy = newRegisterPolicy(gb28181Server)
+	gb28181Server.alarms = &alarmHistory{size: conf.Alarm.HistorySize}
+	if conf.Store.Enable {
+		gb28181Server.store = NewFileDeviceStore(conf.Store.Path)
+	}
 	return gb28181Server
 }
 
 func (s *GB28181Server) Start() {
 	s.sipUdpSvr = s.newSipServer("udp")
 	s.sipTcpSvr = s.newSipServer("tcp")
+	s.loadDevices()
+	s.startCascades()
 	go s.startJob()
 }
 func (s *GB28181Server) newSipServer(network string) gosip.Server {
@@ -123,10 +115,12 @@ func (s *GB28181Server) newSipServer(network string) gosip.Server {
 		srvConf.Host = s.conf.SipIP
 	}
 	sipSvr := gosip.NewServer(srvConf, nil, nil, logger)
-	sipSvr.OnRequest(sip.REGISTER, s.OnRegister)
-	sipSvr.OnRequest(sip.MESSAGE, s.OnMessage)
-	sipSvr.OnRequest(sip.NOTIFY, s.OnNotify)
-	sipSvr.OnRequest(sip.BYE, s.OnBye)
+	sipSvr.OnRequest(sip.REGISTER, countSipRequest(s.OnRegister))
+	sipSvr.OnRequest(sip.MESSAGE, countSipRequest(s.OnMessage))
+	sipSvr.OnRequest(sip.NOTIFY, countSipRequest(s.OnNotify))
+	sipSvr.OnRequest(sip.BYE, countSipRequest(s.OnBye))
+	sipSvr.OnRequest(sip.INVITE, countSipRequest(s.OnInvite))
+	sipSvr.OnRequest(sip.ACK, countSipRequest(s.OnAck))
 
 	addr := s.conf.ListenAddr + ":" + strconv.Itoa(int(s.conf.SipPort))
 	err := sipSvr.Listen(network, addr)
@@ -137,19 +131,50 @@ func (s *GB28181Server) newSipServer(network string) gosip.Server {
 	nazalog.Info(" start sip server listen. addr= " + addr + "  network:" + network)
 	return sipSvr
 }
+
+// countSipRequest 统计设备发起的sip请求数
+func countSipRequest(handler gosip.RequestHandler) gosip.RequestHandler {
+	return func(req sip.Request, tx sip.ServerTransaction) {
+		metrics.SipRequestsReceived.WithLabelValues(string(req.Method())).Inc()
+		handler(req, tx)
+	}
+}
+
 func (s *GB28181Server) Dispose() {
 	s.disposeOnce.Do(
 		func() {
+			s.stopCascades()
+			stopAllBroadcasts()
+			// 先给正在播放的通道发送BYE，否则设备会一直保持invite状态
+			Devices.Range(func(_, value any) bool {
+				d := value.(*Device)
+				d.channelMap.Range(func(_, value any) bool {
+					value.(*Channel).byeAll()
+					return true
+				})
+				return true
+			})
 			s.MediaServerMap.Range(func(_, value any) bool {
 				mediaServer := value.(*mediaserver.GB28181MediaServer)
 				mediaServer.Dispose()
 				return true
 			})
-			s.sipTcpSvr.Shutdown()
-			s.sipUdpSvr.Shutdown()
+			s.saveDevices()
+			if s.sipTcpSvr != nil {
+				s.sipTcpSvr.Shutdown()
+			}
+			if s.sipUdpSvr != nil {
+				s.sipUdpSvr.Shutdown()
+			}
 		})
 }
-func (s *GB28181Server) OnStartMediaServer(netWork string, singlePort bool, deviceId string, channelId string) *mediaserver.GB28181MediaServer {
+
+// mediaServerKey 多端口模式下每个会话独立监听，同一个通道的实时流、回放、下载用流名区分
+func mediaServerKey(deviceId string, channelId string, streamName string) string {
+	return fmt.Sprintf("%s%s/%s", deviceId, channelId, streamName)
+}
+
+func (s *GB28181Server) OnStartMediaServer(netWork string, singlePort bool, deviceId string, channelId string, streamName string) *mediaserver.GB28181MediaServer {
 	isTcpFlag := false
 	if netWork == "tcp" {
 		isTcpFlag = true
@@ -168,7 +193,7 @@ func (s *GB28181Server) OnStartMediaServer(netWork string, singlePort bool, devi
 			}
 		}
 	} else {
-		value, ok := s.MediaServerMap.Load(fmt.Sprintf("%s%s", deviceId, channelId))
+		value, ok := s.MediaServerMap.Load(mediaServerKey(deviceId, channelId, streamName))
 		if ok {
 			mediasvr = value.(*mediaserver.GB28181MediaServer)
 		}
@@ -182,7 +207,7 @@ func (s *GB28181Server) OnStartMediaServer(netWork string, singlePort bool, devi
 				mediasvr = mediaserver.NewGB28181MediaServer(int(s.conf.MediaConfig.ListenPort), fmt.Sprintf("%s%d", "tcp", s.conf.MediaConfig.ListenPort), s, s.lalServer)
 				listener, err = s.tcpAvailConnPool.ListenWithPort(s.conf.MediaConfig.ListenPort)
 				if err != nil {
-					nazalog.Error("gb28181 media server tcp Listen failed:%s", err.Error())
+					nazalog.Errorf("gb28181 media server tcp Listen failed:%s", err.Error())
 					return nil
 				}
 				s.MediaServerMap.Store(fmt.Sprintf("%s%d", "tcp", s.conf.MediaConfig.ListenPort), mediasvr)
@@ -190,7 +215,7 @@ func (s *GB28181Server) OnStartMediaServer(netWork string, singlePort bool, devi
 				mediasvr = mediaserver.NewGB28181MediaServer(int(s.conf.MediaConfig.ListenPort), fmt.Sprintf("%s%d", "udp", s.conf.MediaConfig.ListenPort), s, s.lalServer)
 				listener, err = s.udpAvailConnPool.ListenWithPort(s.conf.MediaConfig.ListenPort)
 				if err != nil {
-					nazalog.Error("gb28181 media server udp Listen failed:%s", err.Error())
+					nazalog.Errorf("gb28181 media server udp Listen failed:%s", err.Error())
 					return nil
 				}
 				s.MediaServerMap.Store(fmt.Sprintf("%s%d", "udp", s.conf.MediaConfig.ListenPort), mediasvr)
@@ -200,20 +225,20 @@ func (s *GB28181Server) OnStartMediaServer(netWork string, singlePort bool, devi
 			if isTcpFlag {
 				listener, port, err = s.tcpAvailConnPool.Acquire()
 				if err != nil {
-					nazalog.Error("gb28181 media server tcp acquire failed:%s", err.Error())
+					nazalog.Errorf("gb28181 media server tcp acquire failed:%s", err.Error())
 					return nil
 				}
 				mediaKey = fmt.Sprintf("%s%d", "tcp", port)
 			} else {
 				listener, port, err = s.udpAvailConnPool.Acquire()
 				if err != nil {
-					nazalog.Error("gb28181 media server udp acquire failed:%s", err.Error())
+					nazalog.Errorf("gb28181 media server udp acquire failed:%s", err.Error())
 					return nil
 				}
 				mediaKey = fmt.Sprintf("%s%d", "udp", port)
 			}
 			mediasvr = mediaserver.NewGB28181MediaServer(int(port), mediaKey, s, s.lalServer)
-			s.MediaServerMap.Store(fmt.Sprintf("%s%s", deviceId, channelId), mediasvr)
+			s.MediaServerMap.Store(mediaServerKey(deviceId, channelId, streamName), mediasvr)
 		}
 		go mediasvr.Start(listener)
 	}
@@ -226,23 +251,16 @@ func (s *GB28181Server) OnStopMediaServer(netWork string, singlePort bool, devic
 	}
 	var mediasvr *mediaserver.GB28181MediaServer
 	if singlePort {
+		// 单端口的media server被所有会话共享，只关闭流名对应的连接
+		key := fmt.Sprintf("%s%d", "udp", s.conf.MediaConfig.ListenPort)
 		if isTcpFlag {
-			key := fmt.Sprintf("%s%d", "tcp", s.conf.MediaConfig.ListenPort)
-			value, ok := s.MediaServerMap.Load(key)
-			if ok {
-				mediasvr = value.(*mediaserver.GB28181MediaServer)
-				s.MediaServerMap.Delete(key)
-			}
-		} else {
-			key := fmt.Sprintf("%s%d", "udp", s.conf.MediaConfig.ListenPort)
-			value, ok := s.MediaServerMap.Load(key)
-			if ok {
-				mediasvr = value.(*mediaserver.GB28181MediaServer)
-				s.MediaServerMap.Delete(key)
-			}
+			key = fmt.Sprintf("%s%d", "tcp", s.conf.MediaConfig.ListenPort)
+		}
+		if value, ok := s.MediaServerMap.Load(key); ok {
+			mediasvr = value.(*mediaserver.GB28181MediaServer)
 		}
 	} else {
-		key := fmt.Sprintf("%s%s", deviceId, channelId)
+		key := mediaServerKey(deviceId, channelId, StreamName)
 		value, ok := s.MediaServerMap.Load(key)
 		if ok {
 			mediasvr = value.(*mediaserver.GB28181MediaServer)
@@ -258,59 +276,41 @@ func (s *GB28181Server) OnStopMediaServer(netWork string, singlePort bool, devic
 	}
 	return nil
 }
-func (s *GB28181Server) CheckSsrc(ssrc uint32) (*mediaserver.MediaInfo, bool) {
-	var isValidSsrc bool
-	var mediaInfo *mediaserver.MediaInfo
-
-	Devices.Range(func(_, value any) bool {
-		d := value.(*Device)
-		d.channelMap.Range(func(key, value any) bool {
-			ch := value.(*Channel)
-			if ch.MediaInfo.Ssrc == ssrc {
-				isValidSsrc = true
-				mediaInfo = &ch.MediaInfo
-				return false
-			}
-			return true
-		})
-		if isValidSsrc {
-			return false
+func (s *GB28181Server) OnSetMediaScale(netWork string, singlePort bool, deviceId string, channelId string, streamName string, scale float64) {
+	key := mediaServerKey(deviceId, channelId, streamName)
+	if singlePort {
+		key = fmt.Sprintf("%s%d", netWork, s.conf.MediaConfig.ListenPort)
+	}
+	if value, ok := s.MediaServerMap.Load(key); ok {
+		if !value.(*mediaserver.GB28181MediaServer).SetScale(streamName, scale) {
+			nazalog.Warn("set media scale, conn not found, streamName:", streamName)
 		}
-		return true
-	})
-
-	if isValidSsrc {
-		return mediaInfo, true
 	}
-
-	return nil, false
+}
+func (s *GB28181Server) CheckSsrc(ssrc uint32) (*mediaserver.MediaInfo, bool) {
+	return findMediaInfo(func(info *mediaserver.MediaInfo) bool {
+		return info.Ssrc == ssrc
+	})
 }
 func (s *GB28181Server) GetMediaInfoByKey(key string) (*mediaserver.MediaInfo, bool) {
-	var isValidMediaInfo bool
-	var mediaInfo *mediaserver.MediaInfo
+	return findMediaInfo(func(info *mediaserver.MediaInfo) bool {
+		return info.MediaKey == key
+	})
+}
 
+// findMediaInfo 在所有通道的会话中查找媒体信息
+func findMediaInfo(match func(info *mediaserver.MediaInfo) bool) (mediaInfo *mediaserver.MediaInfo, ok bool) {
 	Devices.Range(func(_, value any) bool {
-		d := value.(*Device)
-		d.channelMap.Range(func(_, value any) bool {
-			ch := value.(*Channel)
-			if ch.MediaInfo.MediaKey == key {
-				isValidMediaInfo = true
-				mediaInfo = &ch.MediaInfo
-				return false
+		value.(*Device).channelMap.Range(func(_, value any) bool {
+			var info mediaserver.MediaInfo
+			if info, ok = value.(*Channel).mediaInfoBy(match); ok {
+				mediaInfo = &info
 			}
-			return true
+			return !ok
 		})
-		if isValidMediaInfo {
-			return false
-		}
-		return true
+		return !ok
 	})
-
-	if isValidMediaInfo {
-		return mediaInfo, true
-	}
-
-	return nil, false
+	return
 }
 
 func (s *GB28181Server) NotifyClose(streamName string) {
@@ -319,11 +319,7 @@ func (s *GB28181Server) NotifyClose(streamName string) {
 		d := value.(*Device)
 		d.channelMap.Range(func(key, value any) bool {
 			ch := value.(*Channel)
-			if ch.MediaInfo.StreamName == streamName {
-				if ch.MediaInfo.IsInvite {
-					ch.Bye(streamName)
-				}
-				ch.MediaInfo.Clear()
+			if ch.Bye(streamName) == nil {
 				ok = true
 				return false
 			}
@@ -339,27 +335,26 @@ func (s *GB28181Server) NotifyClose(streamName string) {
 func (s *GB28181Server) startJob() {
 	statusTick := time.NewTicker(s.HeartbeatInterval / 2)
 	banTick := time.NewTicker(s.RemoveBanInterval)
+	subscribeTick := time.NewTicker(subscribeCheckInterval)
+	var saveChan <-chan time.Time
+	if s.store != nil {
+		saveTick := time.NewTicker(time.Duration(s.conf.Store.SaveIntervalSec) * time.Second)
+		saveChan = saveTick.C
+	}
 	for {
 		select {
+		case <-saveChan:
+			s.saveDevices()
 		case <-banTick.C:
-			if s.conf.Username != "" || s.conf.Password != "" {
-				s.removeBanDevice()
-			}
+			s.registerPolicy.removeExpired()
+		case <-subscribeTick.C:
+			s.refreshSubscriptions()
 		case <-statusTick.C:
 			s.statusCheck()
 		}
 	}
 }
 
-func (s *GB28181Server) removeBanDevice() {
-	DeviceRegisterCount.Range(func(key, value interface{}) bool {
-		if value.(int) > MaxRegisterCount {
-			DeviceRegisterCount.Delete(key)
-		}
-		return true
-	})
-}
-
 // statusCheck
 // -  当设备超过 3 倍心跳时间未发送过心跳（通过 UpdateTime 判断）, 视为离线
 // - 	当设备超过注册有效期内为发送过消息，则从设备列表中删除
@@ -369,9 +364,11 @@ func (s *GB28181Server) statusCheck() {
 		d := value.(*Device)
 		if int(time.Since(d.LastKeepaliveAt).Seconds()) > s.keepaliveInterval*3 {
 			Devices.Delete(key)
+			d.stopSubscriptions()
 			nazalog.Warn("Device Keepalive timeout, id:", d.ID, " LastKeepaliveAt:", d.LastKeepaliveAt, " updateTime:", d.UpdateTime)
 		} else if time.Since(d.UpdateTime) > s.HeartbeatInterval*3 {
 			d.Status = DeviceOfflineStatus
+			d.stopSubscriptions()
 			d.channelMap.Range(func(key, value any) bool {
 				ch := value.(*Channel)
 				ch.Status = ChannelOffStatus
@@ -391,6 +388,7 @@ func (s *GB28181Server) getDeviceInfos() (deviceInfos *DeviceInfos) {
 		d.Status = DeviceOfflineStatus
 		deviceItem := &DeviceItem{
 			DeviceId: d.ID,
+			Status:   d.Status,
 			Channels: make([]*ChannelItem, 0),
 		}
 		d.channelMap.Range(func(key, value any) bool {
@@ -415,6 +413,23 @@ func (s *GB28181Server) getDeviceInfos() (deviceInfos *DeviceInfos) {
 	})
 	return deviceInfos
 }
+
+// StatStatus 按状态统计设备数和通道数
+func (s *GB28181Server) StatStatus() (devices map[string]int, channels map[string]int) {
+	devices = make(map[string]int)
+	channels = make(map[string]int)
+	Devices.Range(func(_, value any) bool {
+		d := value.(*Device)
+		devices[string(d.Status)]++
+		d.channelMap.Range(func(_, value any) bool {
+			channels[string(value.(*Channel).Status)]++
+			return true
+		})
+		return true
+	})
+	return
+}
+
 func (s *GB28181Server) GetAllSyncChannels() {
 	Devices.Range(func(key, value any) bool {
 		d := value.(*Device)
@@ -431,6 +446,12 @@ func (s *GB28181Server) GetSyncChannels(deviceId string) bool {
 		return false
 	}
 }
+func (s *GB28181Server) FindDevice(deviceId string) *Device {
+	if v, ok := Devices.Load(deviceId); ok {
+		return v.(*Device)
+	}
+	return nil
+}
 func (s *GB28181Server) FindChannel(deviceId string, channelId string) (channel *Channel) {
 	if v, ok := Devices.Load(deviceId); ok {
 		d := v.(*Device)
@@ -455,9 +476,11 @@ func (s *GB28181Server) OnRegister(req sip.Request, tx sip.ServerTransaction) {
 	nazalog.Info("OnRegister", " id:", id, " source:", req.Source(), " req:", req.String())
 
 	isUnregister := false
+	var expSec int64
 	if exps := req.GetHeaders("Expires"); len(exps) > 0 {
 		exp := exps[0]
-		expSec, err := strconv.ParseInt(exp.Value(), 10, 32)
+		var err error
+		expSec, err = strconv.ParseInt(exp.Value(), 10, 32)
 		if err != nil {
 			nazalog.Error(err)
 			return
@@ -477,9 +500,21 @@ func (s *GB28181Server) OnRegister(req sip.Request, tx sip.ServerTransaction) {
 		return
 	}
 
+	if err := s.registerPolicy.check(id); err != nil || s.registerPolicy.isBanned(id, req.Source()) {
+		nazalog.Warn("OnRegister forbidden, id:", id, " source:", req.Source(), " err:", err)
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusForbidden, "Forbidden", ""))
+		return
+	}
+	password, needAuth, err := s.registerPolicy.password(id, req.Source())
+	if err != nil {
+		nazalog.Warn("OnRegister get password failed, id:", id, " source:", req.Source(), " err:", err)
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusForbidden, "Forbidden", ""))
+		return
+	}
+
 	passAuth := false
 	// 不需要密码情况
-	if s.conf.Username == "" && s.conf.Password == "" {
+	if !needAuth {
 		passAuth = true
 	} else {
 		// 需要密码情况 设备第一次上报，返回401和加密算法
@@ -495,18 +530,14 @@ func (s *GB28181Server) OnRegister(req sip.Request, tx sip.ServerTransaction) {
 				username = s.conf.Username
 			}
 
-			if dc, ok := DeviceRegisterCount.LoadOrStore(id, 1); ok && dc.(int) > MaxRegisterCount {
-				response := sip.NewResponseFromRequest("", req, http.StatusForbidden, "Forbidden", "")
-				tx.Respond(response)
+			// 设备第二次上报，校验
+			_nonce, loaded := DeviceNonce.Load(id)
+			if loaded && auth.Verify(username, password, s.conf.Realm, _nonce.(string)) {
+				passAuth = true
+			} else if s.registerPolicy.onAuthFailed(id, req.Source()) {
+				DeviceNonce.Delete(id)
+				tx.Respond(sip.NewResponseFromRequest("", req, http.StatusForbidden, "Forbidden", ""))
 				return
-			} else {
-				// 设备第二次上报，校验
-				_nonce, loaded := DeviceNonce.Load(id)
-				if loaded && auth.Verify(username, s.conf.Password, s.conf.Realm, _nonce.(string)) {
-					passAuth = true
-				} else {
-					DeviceRegisterCount.Store(id, dc.(int)+1)
-				}
 			}
 		}
 	}
@@ -531,12 +562,16 @@ func (s *GB28181Server) OnRegister(req sip.Request, tx sip.ServerTransaction) {
 		}
 
 		DeviceNonce.Delete(id)
-		DeviceRegisterCount.Delete(id)
+		s.registerPolicy.onAuthSuccess(id, req.Source())
 		resp := sip.NewResponseFromRequest("", req, http.StatusOK, "OK", "")
 		to, _ := resp.To()
 		resp.ReplaceHeaders("To", []sip.Header{&sip.ToHeader{Address: to.Address, Params: sip.NewParams().Add("tag", sip.String{Str: RandNumString(9)})}})
 		resp.RemoveHeader("Allow")
-		expires := sip.Expires(3600)
+		// 设备请求的有效期比配置的短时使用设备的
+		expires := sip.Expires(s.conf.Register.Expires)
+		if expSec > 0 && expSec < int64(expires) {
+			expires = sip.Expires(expSec)
+		}
 		resp.AppendHeader(&expires)
 		resp.AppendHeader(&sip.GenericHeader{
 			HeaderName: "Date",
@@ -547,6 +582,9 @@ func (s *GB28181Server) OnRegister(req sip.Request, tx sip.ServerTransaction) {
 		if !isUnregister {
 			//订阅设备更新
 			go d.syncChannels()
+			go s.subscribeDevice(d)
+		} else {
+			d.stopSubscriptions()
 		}
 	} else {
 		nazalog.Info("OnRegister unauthorized, id:", id, " source:", req.Source(), " destination:", req.Destination())
@@ -569,6 +607,12 @@ func (s *GB28181Server) OnRegister(req sip.Request, tx sip.ServerTransaction) {
 func (s *GB28181Server) OnMessage(req sip.Request, tx sip.ServerTransaction) {
 	from, _ := req.From()
 	id := from.Address.User().String()
+	if c := s.findCascade(id); c != nil {
+		if c.checkSource(req, tx) {
+			c.onMessage(req, tx)
+		}
+		return
+	}
 	nazalog.Info("SIP<-OnMessage, id:", id, " source:", req.Source(), " req:", req.String())
 	temp := &struct {
 		XMLName      xml.Name
@@ -581,6 +625,9 @@ func (s *GB28181Server) OnMessage(req sip.Request, tx sip.ServerTransaction) {
 		Channel      string
 		DeviceList   []ChannelInfo `xml:"DeviceList>Item"`
 		SumNum       int           // 录像结果的总数 SumNum，录像结果会按照多条消息返回，可用于判断是否全部返回
+		RecordList   []RecordItem  `xml:"RecordList>Item"`
+		NotifyType   string        // 媒体通知类型，121表示历史媒体文件发送结束
+		Result       string        // 命令执行结果 OK/ERROR
 	}{}
 	decoder := xml.NewDecoder(bytes.NewReader([]byte(req.Body())))
 	decoder.CharsetReader = charset.NewReaderLabel
@@ -596,6 +643,8 @@ func (s *GB28181Server) OnMessage(req sip.Request, tx sip.ServerTransaction) {
 		switch d.Status {
 		case DeviceOfflineStatus, DeviceRecoverStatus:
 			s.RecoverDevice(d, req)
+			// 离线时取消了订阅，恢复后按配置重新订阅
+			go s.subscribeDevice(d)
 			//go d.syncChannels(s.conf)
 		case DeviceRegisterStatus:
 			d.Status = DeviceOnlineStatus
@@ -618,8 +667,18 @@ func (s *GB28181Server) OnMessage(req sip.Request, tx sip.ServerTransaction) {
 			d.Manufacturer = temp.Manufacturer
 			d.Model = temp.Model
 		case "Alarm":
-			d.Status = DeviceAlarmedStatus
+			s.onAlarm(d, req.Body())
 			body = BuildAlarmResponseXML(d.ID)
+		case "RecordInfo":
+			d.onRecordInfo(temp.DeviceID, temp.SN, temp.SumNum, temp.RecordList)
+		case "MediaStatus":
+			if temp.NotifyType == "121" {
+				d.onMediaEnd(temp.DeviceID, callIdOf(req))
+			}
+		case "Broadcast":
+			d.onBroadcastResult(temp.DeviceID, temp.Result)
+		case "MobilePosition":
+			s.onPosition(d, req.Body())
 		default:
 			nazalog.Warn("Not supported CmdType, CmdType:", temp.CmdType, " body:", req.Body())
 			response := sip.NewResponseFromRequest("", req, http.StatusBadRequest, "", "")
@@ -636,6 +695,7 @@ func (s *GB28181Server) OnMessage(req sip.Request, tx sip.ServerTransaction) {
 				d.LastKeepaliveAt = time.Now()
 				tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", ""))
 				go d.syncChannels()
+				go s.subscribeDevice(d)
 				return
 			}
 		}
@@ -655,9 +715,6 @@ func (s *GB28181Server) OnNotify(req sip.Request, tx sip.ServerTransaction) {
 			XMLName    xml.Name
 			CmdType    string
 			DeviceID   string
-			Time       string           //位置订阅-GPS时间
-			Longitude  string           //位置订阅-经度
-			Latitude   string           //位置订阅-维度
 			DeviceList []*notifyMessage `xml:"DeviceList>Item"` //目录订阅
 		}{}
 		decoder := xml.NewDecoder(bytes.NewReader([]byte(req.Body())))
@@ -675,8 +732,10 @@ func (s *GB28181Server) OnNotify(req sip.Request, tx sip.ServerTransaction) {
 			//目录状态
 			d.UpdateChannelStatus(temp.DeviceList, s.conf)
 		case "MobilePosition":
-			//更新channel的坐标
-			d.UpdateChannelPosition(temp.DeviceID, temp.Time, temp.Longitude, temp.Latitude)
+			s.onPosition(d, req.Body())
+		case "Alarm":
+			//报警订阅
+			s.onAlarm(d, req.Body())
 		default:
 			nazalog.Warn("Not supported CmdType, cmdType:", temp.CmdType, " body:", req.Body())
 			response := sip.NewResponseFromRequest("", req, http.StatusBadRequest, "", "")
@@ -691,9 +750,19 @@ func (s *GB28181Server) OnNotify(req sip.Request, tx sip.ServerTransaction) {
 }
 
 func (s *GB28181Server) OnBye(req sip.Request, tx sip.ServerTransaction) {
-	callIdStr := ""
-	if callId, ok := req.CallID(); ok {
-		callIdStr = callId.Value()
+	callIdStr := callIdOf(req)
+	if cs := s.findCascadeSession(callIdStr); cs != nil {
+		if !cs.cascade.checkSource(req, tx) {
+			return
+		}
+		cs.stop(false, "superior bye")
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", ""))
+		return
+	}
+	if bs := findBroadcastByCallId(callIdStr); bs != nil {
+		bs.stop(false, "device bye")
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", ""))
+		return
 	}
 	from, _ := req.From()
 	devId := from.Address.User().String()
@@ -701,8 +770,8 @@ func (s *GB28181Server) OnBye(req sip.Request, tx sip.ServerTransaction) {
 		d := _d.(*Device)
 		d.channelMap.Range(func(key, value any) bool {
 			ch := value.(*Channel)
-			if ch.GetCallId() == callIdStr {
-				ch.byeClear()
+			if streamName := ch.streamNameByCallId(callIdStr); streamName != "" {
+				ch.onDeviceBye(streamName)
 				return false
 			}
 			return true
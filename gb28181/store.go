@@ -0,0 +1,273 @@
+package gb28181
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/q191201771/naza/pkg/nazalog"
+)
+
+// IDeviceStore 设备和通道的持久化存储，默认使用本地文件，可以通过SetDeviceStore替换为数据库等实现
+type IDeviceStore interface {
+	// Load 读取保存的设备，没有数据时返回空
+	Load() ([]*DeviceRecord, error)
+	// Save 保存当前所有设备，只有设备或通道发生变化时才会调用
+	Save(devices []*DeviceRecord) error
+}
+
+// DeviceRecord 持久化的设备信息
+type DeviceRecord struct {
+	DeviceId     string           `json:"device_id"`
+	Name         string           `json:"name"`
+	Manufacturer string           `json:"manufacturer"`
+	Model        string           `json:"model"`
+	Owner        string           `json:"owner"`
+	Addr         string           `json:"addr"`     // 设备的sip地址
+	NetAddr      string           `json:"net_addr"` // 设备信令的来源地址
+	Network      string           `json:"network"`  // 信令传输方式 udp/tcp
+	RegisterTime time.Time        `json:"register_time"`
+	GpsTime      time.Time        `json:"gps_time"`
+	Longitude    string           `json:"longitude"`
+	Latitude     string           `json:"latitude"`
+	Channels     []*ChannelRecord `json:"channels"`
+}
+
+// ChannelRecord 持久化的通道信息
+type ChannelRecord struct {
+	ChannelId    string        `json:"channel_id"`
+	ParentId     string        `json:"parent_id"`
+	Name         string        `json:"name"`
+	Manufacturer string        `json:"manufacturer"`
+	Model        string        `json:"model"`
+	Owner        string        `json:"owner"`
+	CivilCode    string        `json:"civil_code"`
+	Address      string        `json:"address"`
+	Port         int           `json:"port"`
+	Parental     int           `json:"parental"`
+	SafetyWay    int           `json:"safety_way"`
+	RegisterWay  int           `json:"register_way"`
+	Secrecy      int           `json:"secrecy"`
+	Status       ChannelStatus `json:"status"`
+	GpsTime      time.Time     `json:"gps_time"`
+	Longitude    string        `json:"longitude"`
+	Latitude     string        `json:"latitude"`
+	StreamName   string        `json:"stream_name"` // 通道最近一次实时播放使用的流名
+}
+
+// FileDeviceStore 使用本地json文件保存设备，写入时先写临时文件再重命名，避免写一半时退出导致文件损坏
+type FileDeviceStore struct {
+	path string
+}
+
+func NewFileDeviceStore(path string) *FileDeviceStore {
+	return &FileDeviceStore{path: path}
+}
+
+func (f *FileDeviceStore) Load() ([]*DeviceRecord, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var devices []*DeviceRecord
+	if err = json.Unmarshal(data, &devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func (f *FileDeviceStore) Save(devices []*DeviceRecord) error {
+	data, err := json.MarshalIndent(devices, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// SetDeviceStore 设置设备的持久化存储，需要在Start之前调用
+func (s *GB28181Server) SetDeviceStore(store IDeviceStore) {
+	s.store = store
+}
+
+// loadDevices 启动时恢复保存的设备和通道，设备状态为RECOVER，收到设备的注册或者消息后恢复正常
+func (s *GB28181Server) loadDevices() {
+	if s.store == nil {
+		return
+	}
+	records, err := s.store.Load()
+	if err != nil {
+		nazalog.Error("gb28181 load devices failed, err:", err)
+		return
+	}
+	count := 0
+	for _, r := range records {
+		// 启动后设备已经重新注册的，以注册的为准
+		if _, ok := Devices.Load(r.DeviceId); ok {
+			continue
+		}
+		uri, err := parser.ParseUri(r.Addr)
+		if err != nil {
+			nazalog.Warn("gb28181 load device, invalid addr, id:", r.DeviceId, " addr:", r.Addr)
+			continue
+		}
+		now := time.Now()
+		d := &Device{
+			ID:           r.DeviceId,
+			Name:         r.Name,
+			Manufacturer: r.Manufacturer,
+			Model:        r.Model,
+			Owner:        r.Owner,
+			RegisterTime: r.RegisterTime,
+			// 从恢复时开始计算心跳超时，超时后和正常设备一样删除
+			UpdateTime:      now,
+			LastKeepaliveAt: now,
+			Status:          DeviceRecoverStatus,
+			addr:            sip.Address{Uri: uri},
+			sipIP:           s.conf.SipIP,
+			mediaIP:         s.conf.MediaConfig.MediaIp,
+			NetAddr:         r.NetAddr,
+			GpsTime:         r.GpsTime,
+			Longitude:       r.Longitude,
+			Latitude:        r.Latitude,
+			conf:            s.conf,
+			network:         r.Network,
+		}
+		if d.network == "tcp" {
+			d.sipSvr = s.sipTcpSvr
+		} else {
+			d.sipSvr = s.sipUdpSvr
+		}
+		d.WithMediaServer(s)
+		for _, cr := range r.Channels {
+			c := d.addOrUpdateChannel(ChannelInfo{
+				ChannelId:    cr.ChannelId,
+				ParentId:     cr.ParentId,
+				Name:         cr.Name,
+				Manufacturer: cr.Manufacturer,
+				Model:        cr.Model,
+				Owner:        cr.Owner,
+				CivilCode:    cr.CivilCode,
+				Address:      cr.Address,
+				Port:         cr.Port,
+				Parental:     cr.Parental,
+				SafetyWay:    cr.SafetyWay,
+				RegisterWay:  cr.RegisterWay,
+				Secrecy:      cr.Secrecy,
+				Status:       cr.Status,
+				Longitude:    cr.Longitude,
+				Latitude:     cr.Latitude,
+				StreamName:   cr.StreamName,
+			})
+			c.GpsTime = cr.GpsTime
+			d.seedPosition(cr.ChannelId, cr.Longitude, cr.Latitude, cr.GpsTime)
+		}
+		d.seedPosition(d.ID, d.Longitude, d.Latitude, d.GpsTime)
+		Devices.Store(d.ID, d)
+		count++
+	}
+	nazalog.Info("gb28181 load devices, count:", count)
+
+	s.storeMutex.Lock()
+	s.storeData, _ = json.Marshal(s.deviceRecords())
+	s.storeMutex.Unlock()
+}
+
+// saveDevices 设备或通道有变化时保存
+func (s *GB28181Server) saveDevices() {
+	if s.store == nil {
+		return
+	}
+	s.storeMutex.Lock()
+	defer s.storeMutex.Unlock()
+
+	records := s.deviceRecords()
+	data, err := json.Marshal(records)
+	if err != nil {
+		nazalog.Error("gb28181 marshal devices failed, err:", err)
+		return
+	}
+	if bytes.Equal(data, s.storeData) {
+		return
+	}
+	if err = s.store.Save(records); err != nil {
+		nazalog.Error("gb28181 save devices failed, err:", err)
+		return
+	}
+	s.storeData = data
+	nazalog.Debug("gb28181 save devices, count:", len(records))
+}
+
+// deviceRecords 当前所有设备，按id排序保证内容不变时序列化结果一致
+func (s *GB28181Server) deviceRecords() []*DeviceRecord {
+	records := make([]*DeviceRecord, 0)
+	Devices.Range(func(_, value any) bool {
+		d := value.(*Device)
+		if d.addr.Uri == nil {
+			return true
+		}
+		r := &DeviceRecord{
+			DeviceId:     d.ID,
+			Name:         d.Name,
+			Manufacturer: d.Manufacturer,
+			Model:        d.Model,
+			Owner:        d.Owner,
+			Addr:         d.addr.Uri.String(),
+			NetAddr:      d.NetAddr,
+			Network:      d.network,
+			RegisterTime: d.RegisterTime,
+			GpsTime:      d.GpsTime,
+			Longitude:    d.Longitude,
+			Latitude:     d.Latitude,
+			Channels:     make([]*ChannelRecord, 0),
+		}
+		d.channelMap.Range(func(_, value any) bool {
+			ch := value.(*Channel)
+			r.Channels = append(r.Channels, &ChannelRecord{
+				ChannelId:    ch.ChannelId,
+				ParentId:     ch.ParentId,
+				Name:         ch.Name,
+				Manufacturer: ch.Manufacturer,
+				Model:        ch.Model,
+				Owner:        ch.Owner,
+				CivilCode:    ch.CivilCode,
+				Address:      ch.Address,
+				Port:         ch.Port,
+				Parental:     ch.Parental,
+				SafetyWay:    ch.SafetyWay,
+				RegisterWay:  ch.RegisterWay,
+				Secrecy:      ch.Secrecy,
+				Status:       ch.Status,
+				GpsTime:      ch.GpsTime,
+				Longitude:    ch.Longitude,
+				Latitude:     ch.Latitude,
+				StreamName:   ch.StreamName,
+			})
+			return true
+		})
+		sort.Slice(r.Channels, func(i, j int) bool {
+			return r.Channels[i].ChannelId < r.Channels[j].ChannelId
+		})
+		records = append(records, r)
+		return true
+	})
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].DeviceId < records[j].DeviceId
+	})
+	return records
+}
@@ -0,0 +1,64 @@
+package gb28181
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileDeviceStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gb28181", "devices.json")
+	store := NewFileDeviceStore(path)
+
+	// 文件不存在时没有数据
+	devices, err := store.Load()
+	if err != nil || devices != nil {
+		t.Fatalf("expect empty, got:%v err:%v", devices, err)
+	}
+
+	gpsTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	records := []*DeviceRecord{
+		{
+			DeviceId:     "34020000001110000001",
+			Name:         "NVR",
+			Addr:         "sip:34020000001110000001@192.168.1.10:5060",
+			NetAddr:      "192.168.1.10:5060",
+			Network:      "udp",
+			RegisterTime: gpsTime,
+			Channels: []*ChannelRecord{
+				{
+					ChannelId:  "34020000001320000001",
+					Name:       "通道1",
+					Status:     ChannelOnStatus,
+					GpsTime:    gpsTime,
+					Longitude:  "116.3",
+					Latitude:   "39.9",
+					StreamName: "live1",
+				},
+			},
+		},
+	}
+	if err = store.Save(records); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expect tmp file renamed, err:%v", err)
+	}
+
+	loaded, err := NewFileDeviceStore(path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, records) {
+		t.Fatalf("round trip mismatch, got:%+v", loaded[0])
+	}
+
+	if err = os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Load(); err == nil {
+		t.Fatal("expect error for broken file")
+	}
+}
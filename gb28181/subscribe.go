@@ -0,0 +1,311 @@
+package gb28181
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/q191201771/naza/pkg/nazalog"
+)
+
+const (
+	// subscribeCheckInterval 检查订阅是否需要刷新的间隔
+	subscribeCheckInterval = 10 * time.Second
+	// subscribeRetryInterval 订阅失败后的重试间隔
+	subscribeRetryInterval = 30 * time.Second
+	// subscribeRefreshAhead 订阅到期前多久刷新
+	subscribeRefreshAhead = 60 * time.Second
+)
+
+// subscription 向设备发起的事件订阅，刷新和取消订阅在订阅建立的对话中进行
+type subscription struct {
+	cmdType string              // 订阅的CmdType，例如Alarm
+	event   string              // Event头
+	expires int                 // 订阅有效期，单位秒
+	body    func(sn int) string // 订阅的消息体
+
+	mutex         sync.Mutex
+	callId        string
+	fromTag       string
+	toTag         string
+	eventId       string // Event头的id参数，建立对话时生成，刷新和取消订阅时不变
+	active        bool
+	subscribeTime time.Time
+	expireAt      time.Time
+	refreshAt     time.Time // 下次刷新或者失败后重试的时间
+}
+
+// SubscriptionInfo 设备的订阅状态
+type SubscriptionInfo struct {
+	DeviceId      string `json:"device_id"`
+	CmdType       string `json:"cmd_type"`       // 订阅类型
+	Active        bool   `json:"active"`         // 订阅是否成功，失败时会定时重试
+	Expires       int    `json:"expires"`        // 订阅有效期，单位秒
+	SubscribeTime int64  `json:"subscribe_time"` // 最近一次订阅或者刷新成功的时间，unix时间戳
+	ExpireTime    int64  `json:"expire_time"`    // 订阅到期时间，unix时间戳
+}
+
+// subscribe 发起订阅，已经存在的订阅在原来的对话中刷新，expires为0表示取消订阅
+func (d *Device) subscribe(sub *subscription) error {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+
+	request := d.CreateRequest(sip.SUBSCRIBE, d.conf)
+	if sub.callId != "" {
+		callId := sip.CallID(sub.callId)
+		request.ReplaceHeaders("Call-ID", []sip.Header{&callId})
+		if from, ok := request.From(); ok {
+			from.Params = sip.NewParams().Add("tag", sip.String{Str: sub.fromTag})
+		}
+		if to, ok := request.To(); ok && sub.toTag != "" {
+			to.Params = sip.NewParams().Add("tag", sip.String{Str: sub.toTag})
+		}
+	} else {
+		callId, _ := request.CallID()
+		sub.callId = string(*callId)
+		if from, ok := request.From(); ok {
+			if tag, ok := from.Params.Get("tag"); ok {
+				sub.fromTag = tag.String()
+			}
+		}
+		sub.eventId = strconv.Itoa(d.sn)
+	}
+	expires := sip.Expires(sub.expires)
+	contentType := sip.ContentType("Application/MANSCDP+xml")
+	// 设备根据Event头的id区分订阅，同一个订阅的刷新和取消需要使用相同的id
+	request.AppendHeader(&sip.GenericHeader{HeaderName: "Event", Contents: sub.event + ";id=" + sub.eventId})
+	request.AppendHeader(&expires)
+	request.AppendHeader(&contentType)
+	request.SetBody(sub.body(d.sn), true)
+
+	resp, err := d.SipRequestForResponse(request)
+	if err == nil && resp != nil && resp.StatusCode() != http.StatusOK {
+		err = fmt.Errorf("subscribe response code:%d", resp.StatusCode())
+	}
+	if err != nil {
+		// 对话可能已经失效(例如设备重启)，下次重试时重新建立订阅
+		sub.active = false
+		sub.callId = ""
+		sub.toTag = ""
+		sub.refreshAt = time.Now().Add(subscribeRetryInterval)
+		return err
+	}
+
+	if to, ok := resp.To(); ok && to.Params != nil {
+		if tag, ok := to.Params.Get("tag"); ok {
+			sub.toTag = tag.String()
+		}
+	}
+	// 设备可以缩短订阅的有效期
+	validity := sub.expires
+	if hdrs := resp.GetHeaders("Expires"); len(hdrs) > 0 {
+		if v, err := strconv.Atoi(hdrs[0].Value()); err == nil && v > 0 && v < validity {
+			validity = v
+		}
+	}
+	now := time.Now()
+	ahead := subscribeRefreshAhead
+	if time.Duration(validity)*time.Second/5 < ahead {
+		ahead = time.Duration(validity) * time.Second / 5
+	}
+	sub.active = sub.expires > 0
+	sub.subscribeTime = now
+	sub.expireAt = now.Add(time.Duration(validity) * time.Second)
+	sub.refreshAt = sub.expireAt.Add(-ahead)
+	return nil
+}
+
+// startSubscription 发起或者刷新订阅，订阅失败也会保留，之后定时重试
+func (d *Device) startSubscription(sub *subscription) error {
+	if old, loaded := d.subscriptions.LoadOrStore(sub.cmdType, sub); loaded {
+		// 已经订阅过的更新有效期和消息体后在原来的对话中刷新
+		oldSub := old.(*subscription)
+		oldSub.mutex.Lock()
+		oldSub.expires = sub.expires
+		oldSub.body = sub.body
+		oldSub.mutex.Unlock()
+		sub = oldSub
+	}
+	err := d.subscribe(sub)
+	if err != nil {
+		nazalog.Warn("gb28181 subscribe failed, deviceId:", d.ID, " cmdType:", sub.cmdType, " err:", err)
+	} else {
+		nazalog.Info("gb28181 subscribe succ, deviceId:", d.ID, " cmdType:", sub.cmdType, " expires:", sub.expires)
+	}
+	return err
+}
+
+// stopSubscription 取消订阅
+func (d *Device) stopSubscription(cmdType string) error {
+	v, ok := d.subscriptions.LoadAndDelete(cmdType)
+	if !ok {
+		return errors.New("subscription not found")
+	}
+	sub := v.(*subscription)
+	sub.mutex.Lock()
+	active := sub.active
+	sub.expires = 0
+	sub.mutex.Unlock()
+	if !active {
+		return nil
+	}
+	err := d.subscribe(sub)
+	nazalog.Info("gb28181 unsubscribe, deviceId:", d.ID, " cmdType:", cmdType, " err:", err)
+	return err
+}
+
+// stopSubscriptions 向设备发送expires为0的SUBSCRIBE取消所有的订阅，设备离线、注销时调用
+func (d *Device) stopSubscriptions() {
+	d.subscriptions.Range(func(key, _ any) bool {
+		go d.stopSubscription(key.(string))
+		return true
+	})
+}
+
+// SubscribeCatalog 订阅设备的目录变化，到期前自动刷新
+func (d *Device) SubscribeCatalog(expires int) error {
+	return d.startSubscription(&subscription{
+		cmdType: "Catalog",
+		event:   "Catalog",
+		expires: expires,
+		body: func(sn int) string {
+			return BuildCatalogXML(sn, d.ID)
+		},
+	})
+}
+
+// SubscribePosition 订阅设备的移动位置，interval为设备上报的间隔，单位秒
+func (d *Device) SubscribePosition(expires, interval int) error {
+	return d.startSubscription(&subscription{
+		cmdType: "MobilePosition",
+		event:   "presence",
+		expires: expires,
+		body: func(sn int) string {
+			return BuildDevicePositionXML(sn, d.ID, interval)
+		},
+	})
+}
+
+// refreshSubscriptions 刷新快要到期的订阅，重试失败的订阅
+func (d *Device) refreshSubscriptions() {
+	now := time.Now()
+	d.subscriptions.Range(func(_, value any) bool {
+		sub := value.(*subscription)
+		// 正在订阅中的跳过，下次再检查
+		if !sub.mutex.TryLock() {
+			return true
+		}
+		due := now.After(sub.refreshAt)
+		sub.mutex.Unlock()
+		if due {
+			go func() {
+				if err := d.subscribe(sub); err != nil {
+					nazalog.Warn("gb28181 refresh subscription failed, deviceId:", d.ID, " cmdType:", sub.cmdType, " err:", err)
+				}
+			}()
+		}
+		return true
+	})
+}
+
+// subscriptionInfos 设备所有订阅的状态
+func (d *Device) subscriptionInfos() []*SubscriptionInfo {
+	infos := make([]*SubscriptionInfo, 0)
+	d.subscriptions.Range(func(_, value any) bool {
+		sub := value.(*subscription)
+		sub.mutex.Lock()
+		info := &SubscriptionInfo{
+			DeviceId: d.ID,
+			CmdType:  sub.cmdType,
+			Active:   sub.active,
+			Expires:  sub.expires,
+		}
+		if sub.active {
+			info.SubscribeTime = sub.subscribeTime.Unix()
+			info.ExpireTime = sub.expireAt.Unix()
+		}
+		sub.mutex.Unlock()
+		infos = append(infos, info)
+		return true
+	})
+	return infos
+}
+
+// refreshSubscriptions 定时检查所有设备的订阅
+func (s *GB28181Server) refreshSubscriptions() {
+	Devices.Range(func(_, value any) bool {
+		d := value.(*Device)
+		if d.Status == DeviceOfflineStatus || d.Status == DeviceRecoverStatus {
+			return true
+		}
+		d.refreshSubscriptions()
+		return true
+	})
+}
+
+// subscribeDevice 按配置订阅设备的目录、移动位置和报警，设备注册或者离线后恢复时调用
+func (s *GB28181Server) subscribeDevice(d *Device) {
+	conf := s.conf.Subscribe
+	if conf.Catalog {
+		d.SubscribeCatalog(conf.CatalogExpires)
+	}
+	if conf.Position {
+		d.SubscribePosition(conf.PositionExpires, conf.PositionInterval)
+	}
+	if s.conf.Alarm.Subscribe {
+		d.SubscribeAlarm(s.conf.Alarm.Expires)
+	}
+}
+
+// SubscribeCatalog 向设备订阅目录，expires为0时取消订阅
+func (s *GB28181Server) SubscribeCatalog(deviceId string, expires int) error {
+	d := s.FindDevice(deviceId)
+	if d == nil || d.Status == DeviceOfflineStatus {
+		return ErrDeviceNotOnline
+	}
+	if expires == 0 {
+		return d.stopSubscription("Catalog")
+	}
+	return d.SubscribeCatalog(expires)
+}
+
+// SubscribePosition 向设备订阅移动位置，expires为0时取消订阅
+func (s *GB28181Server) SubscribePosition(deviceId string, expires, interval int) error {
+	d := s.FindDevice(deviceId)
+	if d == nil || d.Status == DeviceOfflineStatus {
+		return ErrDeviceNotOnline
+	}
+	if expires == 0 {
+		return d.stopSubscription("MobilePosition")
+	}
+	return d.SubscribePosition(expires, interval)
+}
+
+// Subscriptions 查询设备的订阅，deviceId和cmdType为空时不过滤
+func (s *GB28181Server) Subscriptions(deviceId, cmdType string) []*SubscriptionInfo {
+	infos := make([]*SubscriptionInfo, 0)
+	Devices.Range(func(_, value any) bool {
+		d := value.(*Device)
+		if deviceId != "" && d.ID != deviceId {
+			return true
+		}
+		for _, info := range d.subscriptionInfos() {
+			if cmdType == "" || info.CmdType == cmdType {
+				infos = append(infos, info)
+			}
+		}
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].DeviceId != infos[j].DeviceId {
+			return infos[i].DeviceId < infos[j].DeviceId
+		}
+		return infos[i].CmdType < infos[j].CmdType
+	})
+	return infos
+}
@@ -11,6 +11,7 @@ type DeviceInfos struct {
 }
 type DeviceItem struct {
 	DeviceId string         `json:"device_id"` // 设备ID
+	Status   DeviceStatus   `json:"status"`    // 设备状态
 	Channels []*ChannelItem `json:"channels"`
 }
 type ChannelItem struct {
@@ -25,8 +26,15 @@ type ChannelItem struct {
 	Latitude     string        `json:"latitude"`     // 纬度
 	StreamName   string        `json:"-"`
 }
+
+const (
+	TcpModePassive = "passive" // 设备连接lalmax的媒体端口
+	TcpModeActive  = "active"  // lalmax连接设备的媒体端口
+)
+
 type PlayInfo struct {
 	NetWork      string `json:"network" form:"network" url:"network"`                      // 媒体传输类型,tcp/udp,默认udp
+	TcpMode      string `json:"tcp_mode" form:"tcp_mode" url:"tcp_mode"`                   // tcp时的连接方式,passive:设备连接lalmax,active:lalmax连接设备,默认passive
 	DeviceId     string `json:"device_id" form:"device_id" url:"device_id"`                // 设备 Id
 	ChannelId    string `json:"channel_id" form:"channel_id" url:"channel_id"`             // channel id
 	StreamName   string `json:"stream_name" form:"stream_name" url:"stream_name"`          // 对应的流名
@@ -86,6 +94,157 @@ type PtzStop struct {
 	DeviceId  string `json:"device_id" form:"device_id" url:"device_id"`    // 设备 Id
 	ChannelId string `json:"channel_id" form:"channel_id" url:"channel_id"` // channel id
 }
+type ReqRecordInfo struct {
+	DeviceId  string `json:"device_id" form:"device_id" url:"device_id"`    // 设备 Id
+	ChannelId string `json:"channel_id" form:"channel_id" url:"channel_id"` // channel id
+	StartTime int64  `json:"start_time" form:"start_time" url:"start_time"` // 开始时间，unix时间戳，单位秒
+	EndTime   int64  `json:"end_time" form:"end_time" url:"end_time"`       // 结束时间，unix时间戳，单位秒
+}
+type RespRecordInfo struct {
+	DeviceId   string        `json:"device_id"`
+	ChannelId  string        `json:"channel_id"`
+	SumNum     int           `json:"sum_num"` // 设备上报的录像总数，超时时可能大于record_list的长度
+	RecordList []*RecordInfo `json:"record_list"`
+}
+type RecordInfo struct {
+	Name       string `json:"name"`        // 名称
+	FilePath   string `json:"file_path"`   // 文件路径
+	Address    string `json:"address"`     // 录像地址
+	StartTime  int64  `json:"start_time"`  // 开始时间，unix时间戳，单位秒
+	EndTime    int64  `json:"end_time"`    // 结束时间，unix时间戳，单位秒
+	Secrecy    int    `json:"secrecy"`     // 保密属性 0:不涉密 1:涉密
+	Type       string `json:"type"`        // 录像产生类型 time/alarm/manual
+	RecorderId string `json:"recorder_id"` // 录像触发者id
+	FileSize   string `json:"file_size"`   // 文件大小，单位Byte
+}
+type ReqPlayback struct {
+	PlayInfo
+	StartTime int64 `json:"start_time" form:"start_time" url:"start_time"` // 回放开始时间，unix时间戳，单位秒
+	EndTime   int64 `json:"end_time" form:"end_time" url:"end_time"`       // 回放结束时间，unix时间戳，单位秒
+}
+type ReqPlaybackCtrl struct {
+	DeviceId   string `json:"device_id" form:"device_id" url:"device_id"`       // 设备 Id
+	ChannelId  string `json:"channel_id" form:"channel_id" url:"channel_id"`    // channel id
+	StreamName string `json:"stream_name" form:"stream_name" url:"stream_name"` // 回放的流名，通道上只有一路回放时可以不填
+}
+type ReqPlaybackSeek struct {
+	ReqPlaybackCtrl
+	SeekTime int64 `json:"seek_time" form:"seek_time" url:"seek_time"` // 拖动到的时间，unix时间戳，单位秒
+}
+type ReqPlaybackSpeed struct {
+	ReqPlaybackCtrl
+	Scale float64 `json:"scale" form:"scale" url:"scale"` // 倍速 0.25/0.5/1/2/4/8
+}
+type ReqStartDownload struct {
+	PlayInfo
+	StartTime int64 `json:"start_time" form:"start_time" url:"start_time"` // 开始时间，unix时间戳，单位秒
+	EndTime   int64 `json:"end_time" form:"end_time" url:"end_time"`       // 结束时间，unix时间戳，单位秒
+	Speed     int   `json:"speed" form:"speed" url:"speed"`                // 下载倍速，不填使用配置中的download_speed
+}
+type ReqDownloadJob struct {
+	JobId string `json:"job_id" form:"job_id" url:"job_id"` // 下载任务id
+}
+type DownloadJobInfo struct {
+	JobId      string         `json:"job_id"`
+	DeviceId   string         `json:"device_id"`
+	ChannelId  string         `json:"channel_id"`
+	StartTime  int64          `json:"start_time"`
+	EndTime    int64          `json:"end_time"`
+	Speed      int            `json:"speed"`
+	Status     DownloadStatus `json:"status"`      // inviting/downloading/done/failed/stopped
+	Error      string         `json:"error"`       // 失败原因
+	FileName   string         `json:"file_name"`   // 本地文件路径
+	FileSize   int64          `json:"file_size"`   // 已经写入的字节数
+	Progress   float64        `json:"progress"`    // 下载进度 0~1
+	CreateTime int64          `json:"create_time"` // 创建时间，unix时间戳
+	FinishTime int64          `json:"finish_time"` // 结束时间，unix时间戳，未结束为0
+}
+type ReqBroadcast struct {
+	DeviceId   string `json:"device_id" form:"device_id" url:"device_id"`       // 设备 Id
+	ChannelId  string `json:"channel_id" form:"channel_id" url:"channel_id"`    // 语音输出通道id，不填使用设备id
+	StreamName string `json:"stream_name" form:"stream_name" url:"stream_name"` // 音频来源的流名，音频需要为G.711A/G.711U
+}
+type BroadcastInfo struct {
+	DeviceId    string          `json:"device_id"`
+	ChannelId   string          `json:"channel_id"`
+	StreamName  string          `json:"stream_name"`
+	Status      BroadcastStatus `json:"status"`       // notifying/connecting/talking/stopped
+	Error       string          `json:"error"`        // 结束原因
+	NetWork     string          `json:"network"`      // 设备选择的传输方式 udp/tcp
+	Payload     string          `json:"payload"`      // 设备选择的负载类型 PS/PCMA/PCMU
+	RemoteAddr  string          `json:"remote_addr"`  // 设备接收音频的地址
+	SentPackets uint64          `json:"sent_packets"` // 已经发送的rtp包数
+	CreateTime  int64           `json:"create_time"`  // 创建时间，unix时间戳
+}
+type CascadeInfo struct {
+	ServerId      string                `json:"server_id"`
+	ServerAddr    string                `json:"server_addr"` // 上级平台sip地址
+	Transport     string                `json:"transport"`
+	LocalId       string                `json:"local_id"`       // 本平台在上级平台中的id
+	Status        CascadeStatus         `json:"status"`         // registering/registered/failed/stopped
+	Error         string                `json:"error"`          // 最近一次注册或心跳失败的原因
+	RegisterTime  int64                 `json:"register_time"`  // 注册成功时间，unix时间戳
+	KeepaliveTime int64                 `json:"keepalive_time"` // 最近一次心跳成功时间，unix时间戳
+	Sessions      []*CascadeSessionInfo `json:"sessions"`       // 上级平台正在点播的通道
+}
+type CascadeSessionInfo struct {
+	ChannelId   string `json:"channel_id"`
+	StreamName  string `json:"stream_name"`
+	NetWork     string `json:"network"`      // 上级平台选择的传输方式 udp/tcp
+	RemoteAddr  string `json:"remote_addr"`  // 上级平台接收媒体的地址
+	SentPackets uint64 `json:"sent_packets"` // 已经发送的rtp包数
+	CreateTime  int64  `json:"create_time"`  // 创建时间，unix时间戳
+}
+type RegisterBanInfo struct {
+	DeviceId     string `json:"device_id"`
+	Source       string `json:"source"`         // 设备信令的来源地址，按照设备id和来源ip分别记录
+	Failures     int    `json:"failures"`       // 连续鉴权失败次数
+	LastFailTime int64  `json:"last_fail_time"` // 最近一次失败时间，unix时间戳
+	Banned       bool   `json:"banned"`         // 是否已经封禁
+	BanTime      int64  `json:"ban_time"`       // 封禁开始时间，unix时间戳
+	UnbanTime    int64  `json:"unban_time"`     // 自动解除封禁的时间，unix时间戳
+}
+type ReqClearRegisterBan struct {
+	DeviceId string `json:"device_id" form:"device_id" url:"device_id"` // 设备 Id，不填时解除全部
+}
+type RespClearRegisterBan struct {
+	Cleared int `json:"cleared"` // 清除的记录数
+}
+type ReqAlarms struct {
+	DeviceId  string `json:"device_id" form:"device_id" url:"device_id"`    // 设备 Id
+	ChannelId string `json:"channel_id" form:"channel_id" url:"channel_id"` // 报警源 Id
+	Priority  string `json:"priority" form:"priority" url:"priority"`       // 报警级别
+	Method    string `json:"method" form:"method" url:"method"`             // 报警方式
+	StartTime int64  `json:"start_time" form:"start_time" url:"start_time"` // 开始时间，unix时间戳
+	EndTime   int64  `json:"end_time" form:"end_time" url:"end_time"`       // 结束时间，unix时间戳
+	Limit     int    `json:"limit" form:"limit" url:"limit"`                // 最多返回的条数，不填时返回全部
+}
+type ReqAlarmSubscribe struct {
+	DeviceId string `json:"device_id" form:"device_id" url:"device_id"` // 设备 Id
+	Expires  *int   `json:"expires" form:"expires" url:"expires"`       // 订阅有效期，单位秒，不填时使用配置，为0时取消订阅
+}
+type ReqAlarmReset struct {
+	DeviceId    string `json:"device_id" form:"device_id" url:"device_id"`          // 设备 Id
+	ChannelId   string `json:"channel_id" form:"channel_id" url:"channel_id"`       // 报警源 Id，不填时为设备本身
+	AlarmMethod string `json:"alarm_method" form:"alarm_method" url:"alarm_method"` // 复位的报警方式，不填时复位所有
+	AlarmType   string `json:"alarm_type" form:"alarm_type" url:"alarm_type"`       // 复位的报警类型，不填时复位所有
+}
+type ReqCatalogSubscribe struct {
+	DeviceId string `json:"device_id" form:"device_id" url:"device_id"` // 设备 Id
+	Expires  *int   `json:"expires" form:"expires" url:"expires"`       // 订阅有效期，单位秒，不填时使用配置，为0时取消订阅
+}
+type ReqPositionSubscribe struct {
+	DeviceId string `json:"device_id" form:"device_id" url:"device_id"` // 设备 Id
+	Expires  *int   `json:"expires" form:"expires" url:"expires"`       // 订阅有效期，单位秒，不填时使用配置，为0时取消订阅
+	Interval int    `json:"interval" form:"interval" url:"interval"`    // 设备上报位置的间隔，单位秒，不填时使用配置
+}
+type ReqPositionHistory struct {
+	DeviceId  string `json:"device_id" form:"device_id" url:"device_id"`    // 设备 Id
+	ChannelId string `json:"channel_id" form:"channel_id" url:"channel_id"` // 通道 Id，不填时为设备本身
+	StartTime int64  `json:"start_time" form:"start_time" url:"start_time"` // 开始时间，unix时间戳
+	EndTime   int64  `json:"end_time" form:"end_time" url:"end_time"`       // 结束时间，unix时间戳
+	Limit     int    `json:"limit" form:"limit" url:"limit"`                // 最多返回最近的条数，不填时返回全部
+}
 type ReqUpdateNotify struct {
 	DeviceId string `json:"device_id" form:"device_id" url:"device_id"` //设备 Id
 }
@@ -114,19 +273,26 @@ const (
 	CodeServerBusy
 	CodeDeviceNotRegister
 	CodeDeviceStopError
+	CodeDeviceRequestError
+	CodeDownloadJobNotFound
+	CodeBroadcastNotFound
 )
 
 var codeMsgMap = map[ResCode]string{
-	CodeSuccess:           "success",
-	CodeInvalidParam:      "请求参数错误",
-	CodeServerBusy:        "服务繁忙",
-	CodeDeviceNotRegister: "设备暂时未注册",
-	CodeDeviceStopError:   "设备停止播放错误",
+	CodeSuccess:             "success",
+	CodeInvalidParam:        "请求参数错误",
+	CodeServerBusy:          "服务繁忙",
+	CodeDeviceNotRegister:   "设备暂时未注册",
+	CodeDeviceStopError:     "设备停止播放错误",
+	CodeDeviceRequestError:  "设备请求失败",
+	CodeDownloadJobNotFound: "下载任务不存在",
+	CodeBroadcastNotFound:   "语音广播不存在",
 }
 
 const (
 	SpeedParamError = "speed 范围(0,8]"
 	PointParamError = "point 范围(0,50]"
+	ScaleParamError = "scale 取值 0.25/0.5/1/2/4/8"
 )
 
 func (c ResCode) Msg() string {
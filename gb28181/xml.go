@@ -3,6 +3,7 @@ package gb28181
 import (
 	"encoding/xml"
 	"fmt"
+	"time"
 )
 
 var (
@@ -41,12 +42,85 @@ var (
 <DeviceID>%s</DeviceID>
 <Interval>%d</Interval>
 </Query>`
+	// KeepaliveXML 级联时向上级平台发送的心跳
+	KeepaliveXML = `<?xml version="1.0"?>
+<Notify>
+<CmdType>Keepalive</CmdType>
+<SN>%d</SN>
+<DeviceID>%s</DeviceID>
+<Status>OK</Status>
+</Notify>
+`
+	// DeviceInfoResponseXML 级联时应答上级平台的设备信息查询
+	DeviceInfoResponseXML = `<?xml version="1.0"?>
+<Response>
+<CmdType>DeviceInfo</CmdType>
+<SN>%d</SN>
+<DeviceID>%s</DeviceID>
+<Result>OK</Result>
+<DeviceName>LALMax</DeviceName>
+<Manufacturer>LALMax</Manufacturer>
+<Model>LALMax</Model>
+<Firmware>%s</Firmware>
+<Channel>%d</Channel>
+</Response>
+`
+	// DeviceStatusResponseXML 级联时应答上级平台的设备状态查询
+	DeviceStatusResponseXML = `<?xml version="1.0"?>
+<Response>
+<CmdType>DeviceStatus</CmdType>
+<SN>%d</SN>
+<DeviceID>%s</DeviceID>
+<Result>OK</Result>
+<Online>ONLINE</Online>
+<Status>OK</Status>
+<DeviceTime>%s</DeviceTime>
+</Response>
+`
+	// AlarmSubscribeXML 报警订阅，订阅所有级别和方式的报警
+	AlarmSubscribeXML = `<?xml version="1.0"?>
+<Query>
+<CmdType>Alarm</CmdType>
+<SN>%d</SN>
+<DeviceID>%s</DeviceID>
+<StartAlarmPriority>1</StartAlarmPriority>
+<EndAlarmPriority>4</EndAlarmPriority>
+<AlarmMethod>0</AlarmMethod>
+</Query>
+`
+	// AlarmResetXML 报警复位
+	AlarmResetXML = `<?xml version="1.0"?>
+<Control>
+<CmdType>DeviceControl</CmdType>
+<SN>%d</SN>
+<DeviceID>%s</DeviceID>
+<AlarmCmd>ResetAlarm</AlarmCmd>
+<Info>
+<AlarmMethod>%s</AlarmMethod>
+<AlarmType>%s</AlarmType>
+</Info>
+</Control>
+`
+	// BroadcastXML 语音广播通知
+	BroadcastXML = `<?xml version="1.0"?>
+<Notify>
+<CmdType>Broadcast</CmdType>
+<SN>%d</SN>
+<SourceID>%s</SourceID>
+<TargetID>%s</TargetID>
+</Notify>
+`
 )
 
 func BuildCatalogXML(sn int, id string) string {
 	return fmt.Sprintf(CatalogXML, sn, id)
 }
 
+// BuildRecordInfoXML 获取录像文件列表指令，start和end为unix时间戳
+func BuildRecordInfoXML(sn int, id string, start, end int64) string {
+	return fmt.Sprintf(RecordInfoXML, sn, id, time.Unix(start, 0).Format(TIME_LAYOUT), time.Unix(end, 0).Format(TIME_LAYOUT))
+}
+
 // AlarmResponseXML alarm response xml样式
 var (
 	AlarmResponseXML = `<?xml version="1.0"?>
@@ -58,11 +132,46 @@ var (
 `
 )
 
-// BuildRecordInfoXML 获取录像文件列表指令
+// BuildAlarmResponseXML 报警响应指令
 func BuildAlarmResponseXML(id string) string {
 	return fmt.Sprintf(AlarmResponseXML, id)
 }
 
+// BuildAlarmSubscribeXML 报警订阅指令
+func BuildAlarmSubscribeXML(sn int, id string) string {
+	return fmt.Sprintf(AlarmSubscribeXML, sn, id)
+}
+
+// BuildAlarmResetXML 报警复位指令，alarmMethod和alarmType为空时复位所有报警
+func BuildAlarmResetXML(sn int, id string, alarmMethod, alarmType string) string {
+	return fmt.Sprintf(AlarmResetXML, sn, id, alarmMethod, alarmType)
+}
+
+// BuildBroadcastXML 语音广播通知指令，sourceId为语音输入设备(sip服务器)id，targetId为语音输出设备id
+func BuildBroadcastXML(sn int, sourceId, targetId string) string {
+	return fmt.Sprintf(BroadcastXML, sn, sourceId, targetId)
+}
+
+// BuildKeepaliveXML 级联心跳指令
+func BuildKeepaliveXML(sn int, id string) string {
+	return fmt.Sprintf(KeepaliveXML, sn, id)
+}
+
+// BuildDeviceInfoResponseXML 级联设备信息应答，channelNum为共享给上级的通道数
+func BuildDeviceInfoResponseXML(sn int, id string, firmware string, channelNum int) string {
+	return fmt.Sprintf(DeviceInfoResponseXML, sn, id, firmware, channelNum)
+}
+
+// BuildDeviceStatusResponseXML 级联设备状态应答
+func BuildDeviceStatusResponseXML(sn int, id string) string {
+	return fmt.Sprintf(DeviceStatusResponseXML, sn, id, time.Now().Format(TIME_LAYOUT))
+}
+
+// BuildDevicePositionXML 移动位置订阅指令，interval为设备上报的间隔，单位秒
+func BuildDevicePositionXML(sn int, id string, interval int) string {
+	return fmt.Sprintf(DevicePositionXML, sn, id, interval)
+}
+
 func BuildDeviceInfoXML(sn int, id string) string {
 	return fmt.Sprintf(DeviceInfoXML, sn, id)
 }
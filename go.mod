@@ -3,6 +3,7 @@ module github.com/q191201771/lalmax
 go 1.22
 
 require (
+	github.com/Eyevinn/mp4ff v0.47.0
 	github.com/bluenviron/gohlslib v1.3.0
 	github.com/bluenviron/gortsplib/v4 v4.8.0
 	github.com/bluenviron/mediacommon v1.9.2
@@ -16,6 +17,7 @@ require (
 	github.com/pion/rtp v1.8.6
 	github.com/pion/transport/v3 v3.0.2
 	github.com/pion/webrtc/v3 v3.2.40
+	github.com/prometheus/client_golang v1.19.1
 	github.com/q191201771/lal v0.37.4
 	github.com/q191201771/naza v0.30.48
 	github.com/satori/go.uuid v1.2.1-0.20181028125025-b2ce2384e17b
@@ -27,7 +29,6 @@ require (
 )
 
 require (
-	github.com/Eyevinn/mp4ff v0.47.0 // indirect
 	github.com/abema/go-mp4 v1.2.0 // indirect
 	github.com/asticode/go-astikit v0.30.0 // indirect
 	github.com/asticode/go-astits v1.13.0 // indirect
@@ -114,7 +115,6 @@ require (
 	github.com/pion/turn/v2 v2.1.6 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/prometheus/client_golang v1.19.1 // indirect
 	github.com/prometheus/client_model v0.5.0 // indirect
 	github.com/prometheus/common v0.48.0 // indirect
 	github.com/prometheus/procfs v0.12.0 // indirect
@@ -95,6 +95,15 @@ func (c *GopCache) GetGopCount() int {
 	return (c.last + c.gopSize - c.first) % c.gopSize
 }
 
+// GetFrameCount 缓存的音视频帧总数
+func (c *GopCache) GetFrameCount() int {
+	n := 0
+	for i := 0; i < c.GetGopCount(); i++ {
+		n += c.data[(c.first+i)%c.gopSize].size()
+	}
+	return n
+}
+
 func (c *GopCache) GetGopDataAt(pos int) []base.RtmpMsg {
 	if pos >= c.GetGopCount() || pos < 0 {
 		return nil
@@ -8,6 +8,7 @@ import (
 
 type HookSessionMangaer struct {
 	sessionMap sync.Map
+	notify     INotifyHandler
 }
 
 var (
@@ -36,6 +37,15 @@ func (m *HookSessionMangaer) RemoveHookSession(streamName string) {
 	// }
 }
 
+// StreamNames 当前所有流的流名
+func (m *HookSessionMangaer) StreamNames() (streamNames []string) {
+	m.sessionMap.Range(func(k, _ any) bool {
+		streamNames = append(streamNames, k.(string))
+		return true
+	})
+	return
+}
+
 func (m *HookSessionMangaer) GetHookSession(streamName string) (bool, *HookSession) {
 	s, ok := m.sessionMap.Load(streamName)
 	if ok {
@@ -2,7 +2,7 @@ package hook
 
 import (
 	"sync"
-	"time"
+	"sync/atomic"
 
 	"github.com/q191201771/lalmax/fmp4/hls"
 
@@ -24,11 +24,17 @@ type HookSession struct {
 	hlssvr     *hls.HlsServer
 	gopCache   *GopCache
 	hasVideo   bool
+
+	// gop缓存的统计，OnMsg之外读取gopCache不安全，这里单独记录
+	gopNum   atomic.Int32
+	frameNum atomic.Int32
 }
 
 type consumerInfo struct {
 	subscriber   IHookSessionSubscriber
 	hasSendVideo bool
+	inner        bool // lalmax内部的消费者，例如按需创建的hls muxer，不在统计中展示
+	info         SessionInfo
 
 	base.StatSession
 }
@@ -50,7 +56,7 @@ func (c *consumerInfo) IsAlive() (readAlive bool, writeAlive bool) {
 
 // RawQuery implements base.ISession.
 func (c *consumerInfo) RawQuery() string {
-	return ""
+	return c.info.RawQuery
 }
 
 // StreamName implements base.ISession.
@@ -68,8 +74,8 @@ func (c *consumerInfo) UpdateStat(intervalSec uint32) {
 }
 
 // Url implements base.ISession.
-func (*consumerInfo) Url() string {
-	return ""
+func (c *consumerInfo) Url() string {
+	return c.info.Url
 }
 
 func NewHookSession(uniqueKey, streamName string, hlssvr *hls.HlsServer, gopNum, singleGopMaxFrameNum int) *HookSession {
@@ -142,6 +148,13 @@ func (session *HookSession) OnMsg(msg base.RtmpMsg) {
 	}
 
 	session.gopCache.Feed(msg)
+	session.gopNum.Store(int32(session.gopCache.GetGopCount()))
+	session.frameNum.Store(int32(session.gopCache.GetFrameCount()))
+}
+
+// GopCacheStat 返回当前缓存的gop个数和帧数
+func (session *HookSession) GopCacheStat() (gopNum, frameNum int) {
+	return int(session.gopNum.Load()), int(session.frameNum.Load())
 }
 
 func (session *HookSession) OnStop() {
@@ -153,32 +166,61 @@ func (session *HookSession) OnStop() {
 	session.consumers.Range(func(key, value interface{}) bool {
 		c := value.(*consumerInfo)
 		c.subscriber.OnStop()
+		session.RemoveConsumer(key.(string))
 		return true
 	})
 
 	GetHookSessionManagerInstance().RemoveHookSession(session.streamName)
 }
 
-func (session *HookSession) AddConsumer(consumerId string, subscriber IHookSessionSubscriber) {
+// AddConsumer 添加拉流消费者，info用于统计和on_sub_start/on_sub_stop通知，on_sub_start同步回调拒绝时返回错误
+func (session *HookSession) AddConsumer(consumerId string, subscriber IHookSessionSubscriber, info SessionInfo) error {
+	if err := session.CheckConsumer(consumerId, info); err != nil {
+		return err
+	}
+	session.addConsumer(consumerId, subscriber, false, info)
+	return nil
+}
+
+// CheckConsumer on_sub_start同步回调，需要在应答拉流端之前拒绝时(例如http-fmp4、whep)先调用，通过后再调用 AddCheckedConsumer
+func (session *HookSession) CheckConsumer(consumerId string, info SessionInfo) error {
+	if err := checkSubStart(consumerId, session.streamName, info); err != nil {
+		nazalog.Warnf("AddConsumer rejected, consumerId:%s, protocol:%s, err:%+v", consumerId, info.Protocol, err)
+		return err
+	}
+	return nil
+}
+
+// AddCheckedConsumer 添加已经通过 CheckConsumer 检查的拉流消费者
+func (session *HookSession) AddCheckedConsumer(consumerId string, subscriber IHookSessionSubscriber, info SessionInfo) {
+	session.addConsumer(consumerId, subscriber, false, info)
+}
+
+// AddInnerConsumer 添加lalmax内部的消费者，不会出现在 GetAllConsumer 中，也不会触发通知
+func (session *HookSession) AddInnerConsumer(consumerId string, subscriber IHookSessionSubscriber) {
+	session.addConsumer(consumerId, subscriber, true, SessionInfo{})
+}
 
-	info := &consumerInfo{
-		subscriber: subscriber,
-		StatSession: base.StatSession{
-			SessionId: consumerId,
-			StartTime: time.Now().Format(time.DateTime),
-			// Protocol: , TODO: (xugo)需要传递更多的参数来填充数据
-		},
+func (session *HookSession) addConsumer(consumerId string, subscriber IHookSessionSubscriber, inner bool, info SessionInfo) {
+	c := &consumerInfo{
+		subscriber:  subscriber,
+		inner:       inner,
+		info:        info,
+		StatSession: info.statSession(consumerId),
 	}
 
-	nazalog.Info("AddConsumer, consumerId:", consumerId)
-	session.consumers.Store(consumerId, info)
+	nazalog.Infof("AddConsumer, consumerId:%s, protocol:%s, remoteAddr:%s", consumerId, info.Protocol, info.RemoteAddr)
+	session.consumers.Store(consumerId, c)
+	if !inner {
+		notifySubStart(consumerId, session.streamName, info)
+	}
 }
 
 func (session *HookSession) GetAllConsumer() []base.StatSub {
 	out := make([]base.StatSub, 0, 10)
 	session.consumers.Range(func(key, value any) bool {
 		v, ok := value.(*consumerInfo)
-		if ok {
+		if ok && !v.inner {
 			// TODO: (xugo)先简单实现，此处需要优化数据准确性
 			out = append(out, base.Session2StatSub(v))
 		}
@@ -187,11 +229,22 @@ func (session *HookSession) GetAllConsumer() []base.StatSub {
 	return out
 }
 
+// ConsumerCount 当前消费者个数，包括lalmax内部的消费者
+func (session *HookSession) ConsumerCount() (n int) {
+	session.consumers.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return
+}
+
 func (session *HookSession) RemoveConsumer(consumerId string) {
-	_, ok := session.consumers.Load(consumerId)
+	value, ok := session.consumers.LoadAndDelete(consumerId)
 	if ok {
 		nazalog.Info("RemoveConsumer, consumerId:", consumerId)
-		session.consumers.Delete(consumerId)
+		if c := value.(*consumerInfo); !c.inner {
+			notifySubStop(consumerId, session.streamName, c.info)
+		}
 	}
 }
 
@@ -0,0 +1,120 @@
+package hook
+
+import (
+	"time"
+
+	"github.com/q191201771/lal/pkg/base"
+)
+
+// INotifyHandler lalmax自己接入的推拉流(srt、whip、whep、jessibuca、http-fmp4)的开始、结束事件通知
+type INotifyHandler interface {
+	OnPubStart(info base.PubStartInfo)
+	OnPubStop(info base.PubStopInfo)
+	OnSubStart(info base.SubStartInfo)
+	OnSubStop(info base.SubStopInfo)
+}
+
+// IStartChecker 可选，INotifyHandler同时实现时，推拉流开始前同步检查，返回非nil时拒绝，用于业务方同步回调
+type IStartChecker interface {
+	CheckPubStart(info base.PubStartInfo) error
+	CheckSubStart(info base.SubStartInfo) error
+}
+
+// SessionInfo 推拉流会话的协议、地址等信息，用于统计和事件通知
+type SessionInfo struct {
+	Protocol   string
+	RemoteAddr string
+	Url        string
+	RawQuery   string
+}
+
+func (m *HookSessionMangaer) SetNotifyHandler(notify INotifyHandler) {
+	m.notify = notify
+}
+
+func (info SessionInfo) eventInfo(sessionId, baseType, streamName string) base.SessionEventCommonInfo {
+	return base.SessionEventCommonInfo{
+		SessionId:  sessionId,
+		Protocol:   info.Protocol,
+		BaseType:   baseType,
+		RemoteAddr: info.RemoteAddr,
+		Url:        info.Url,
+		AppName:    "live",
+		StreamName: streamName,
+		UrlParam:   info.RawQuery,
+	}
+}
+
+func (info SessionInfo) statSession(sessionId string) base.StatSession {
+	return base.StatSession{
+		SessionId:  sessionId,
+		Protocol:   info.Protocol,
+		BaseType:   base.SessionBaseTypeSubStr,
+		RemoteAddr: info.RemoteAddr,
+		StartTime:  time.Now().Format(time.DateTime),
+	}
+}
+
+func subStartInfo(sessionId, streamName string, info SessionInfo) base.SubStartInfo {
+	event := base.SubStartInfo{SessionEventCommonInfo: info.eventInfo(sessionId, base.SessionBaseTypeSubStr, streamName)}
+	event.HasInSession = true
+	event.HasOutSession = true
+	return event
+}
+
+func pubStartInfo(sessionId, streamName string, info SessionInfo) base.PubStartInfo {
+	event := base.PubStartInfo{SessionEventCommonInfo: info.eventInfo(sessionId, base.SessionBaseTypePubStr, streamName)}
+	event.HasInSession = true
+	return event
+}
+
+func checkSubStart(sessionId, streamName string, info SessionInfo) error {
+	checker, ok := GetHookSessionManagerInstance().notify.(IStartChecker)
+	if !ok {
+		return nil
+	}
+	return checker.CheckSubStart(subStartInfo(sessionId, streamName, info))
+}
+
+// checkPubStart 推流会话在检查通过之后才创建，sessionId为空
+func checkPubStart(streamName string, info SessionInfo) error {
+	checker, ok := GetHookSessionManagerInstance().notify.(IStartChecker)
+	if !ok {
+		return nil
+	}
+	return checker.CheckPubStart(pubStartInfo("", streamName, info))
+}
+
+func notifySubStart(sessionId, streamName string, info SessionInfo) {
+	notify := GetHookSessionManagerInstance().notify
+	if notify == nil {
+		return
+	}
+	notify.OnSubStart(subStartInfo(sessionId, streamName, info))
+}
+
+func notifySubStop(sessionId, streamName string, info SessionInfo) {
+	notify := GetHookSessionManagerInstance().notify
+	if notify == nil {
+		return
+	}
+	event := base.SubStopInfo{SessionEventCommonInfo: info.eventInfo(sessionId, base.SessionBaseTypeSubStr, streamName)}
+	notify.OnSubStop(event)
+}
+
+func notifyPubStart(sessionId, streamName string, info SessionInfo) {
+	notify := GetHookSessionManagerInstance().notify
+	if notify == nil {
+		return
+	}
+	notify.OnPubStart(pubStartInfo(sessionId, streamName, info))
+}
+
+func notifyPubStop(sessionId, streamName string, info SessionInfo) {
+	notify := GetHookSessionManagerInstance().notify
+	if notify == nil {
+		return
+	}
+	event := base.PubStopInfo{SessionEventCommonInfo: info.eventInfo(sessionId, base.SessionBaseTypePubStr, streamName)}
+	notify.OnPubStop(event)
+}
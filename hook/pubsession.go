@@ -0,0 +1,272 @@
+package hook
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/q191201771/lal/pkg/base"
+	"github.com/q191201771/lal/pkg/logic"
+	"github.com/q191201771/naza/pkg/nazalog"
+)
+
+// 同名流重复推流时的处理策略
+const (
+	RepublishPolicyReject   = "reject"   // 拒绝新的推流，默认策略
+	RepublishPolicyKickOld  = "kick_old" // 踢掉旧的推流，新推流重新建流
+	RepublishPolicyTakeover = "takeover" // 新推流无缝接管旧推流，保留hook session和gop缓存，拉流端不断开
+)
+
+const (
+	// takeoverGapMs 接管后新推流的第一帧相对旧推流最后一帧的时间戳间隔
+	takeoverGapMs = 40
+
+	// kickRetryCount 踢掉非lalmax接入的推流(rtmp、rtsp等)后，等待其退出的重试次数
+	kickRetryCount    = 10
+	kickRetryInterval = 100 * time.Millisecond
+)
+
+// IPublisher lalmax自己接入的推流(srt、whip)需要实现，用于被踢掉或者被接管时断开推流连接
+//
+// Kick 不能阻塞，也不能在其中调用 PubSessionManager 的方法
+type IPublisher interface {
+	Kick()
+}
+
+// PubSessionManager 管理lalmax自己接入的推流，按照配置的策略处理同名流的重复推流
+type PubSessionManager struct {
+	lalServer logic.ILalServer
+	policy    string
+
+	mutex sync.Mutex
+	pubs  map[string]*PubSession
+}
+
+func NewPubSessionManager(lal logic.ILalServer, policy string) *PubSessionManager {
+	switch policy {
+	case RepublishPolicyReject, RepublishPolicyKickOld, RepublishPolicyTakeover:
+	default:
+		if policy != "" {
+			nazalog.Warnf("invalid republish policy:%s, use %s", policy, RepublishPolicyReject)
+		}
+		policy = RepublishPolicyReject
+	}
+
+	return &PubSessionManager{
+		lalServer: lal,
+		policy:    policy,
+		pubs:      make(map[string]*PubSession),
+	}
+}
+
+// AddPubSession 创建推流，同名流已经存在时按照策略处理，info用于on_pub_start/on_pub_stop通知
+//
+// on_pub_start同步回调拒绝时返回错误，此时不会影响同名的旧推流
+func (m *PubSessionManager) AddPubSession(streamName string, publisher IPublisher, info SessionInfo) (*PubSession, error) {
+	// 同步回调可能耗时较长，在加锁之前完成
+	if err := checkPubStart(streamName, info); err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+
+	var kicked IPublisher
+	defer func() {
+		m.mutex.Unlock()
+		if kicked != nil {
+			kicked.Kick()
+		}
+	}()
+
+	if old, ok := m.pubs[streamName]; ok {
+		switch m.policy {
+		case RepublishPolicyTakeover:
+			session := old.takeover(publisher, info)
+			m.pubs[streamName] = session
+			kicked = old.publisher
+			nazalog.Infof("[%s] republish takeover, streamName:%s", session.UniqueKey(), streamName)
+			old.notifyStop()
+			session.notifyStart()
+			return session, nil
+		case RepublishPolicyKickOld:
+			old.close()
+			delete(m.pubs, streamName)
+			m.lalServer.DelCustomizePubSession(old.ICustomizePubSessionContext)
+			old.notifyStop()
+			kicked = old.publisher
+			nazalog.Infof("[%s] republish kick old, streamName:%s", old.UniqueKey(), streamName)
+		default:
+			return nil, fmt.Errorf("stream already published, streamName:%s", streamName)
+		}
+	}
+
+	ctx, err := m.lalServer.AddCustomizePubSession(streamName)
+	if err != nil && m.policy != RepublishPolicyReject {
+		// 旧的推流不是lalmax接入的，通过lal踢掉之后重试，重试会等待较长时间，期间不持有锁
+		m.mutex.Unlock()
+		ctx, err = m.kickLalPubAndRetry(streamName)
+		m.mutex.Lock()
+
+		if _, ok := m.pubs[streamName]; ok && err == nil {
+			// 重试期间同名流被其他lalmax推流抢先
+			m.lalServer.DelCustomizePubSession(ctx)
+			err = fmt.Errorf("stream already published, streamName:%s", streamName)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session := &PubSession{
+		ICustomizePubSessionContext: ctx,
+		publisher:                   publisher,
+		info:                        info,
+	}
+	m.pubs[streamName] = session
+	session.notifyStart()
+	return session, nil
+}
+
+// DelPubSession 推流结束时调用，已经被踢掉或者被接管的推流调用时不做处理
+func (m *PubSessionManager) DelPubSession(session *PubSession) {
+	if session == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	session.close()
+	if m.pubs[session.StreamName()] != session {
+		return
+	}
+	delete(m.pubs, session.StreamName())
+	m.lalServer.DelCustomizePubSession(session.ICustomizePubSessionContext)
+	session.notifyStop()
+}
+
+func (m *PubSessionManager) kickLalPubAndRetry(streamName string) (logic.ICustomizePubSessionContext, error) {
+	group := m.lalServer.StatGroup(streamName)
+	if group == nil || group.StatPub.SessionId == "" {
+		return nil, fmt.Errorf("stream already published, streamName:%s", streamName)
+	}
+
+	nazalog.Infof("[%s] republish kick lal pub session, streamName:%s", group.StatPub.SessionId, streamName)
+	m.lalServer.CtrlKickSession(base.ApiCtrlKickSessionReq{
+		StreamName: streamName,
+		SessionId:  group.StatPub.SessionId,
+	})
+
+	var err error
+	for i := 0; i < kickRetryCount; i++ {
+		time.Sleep(kickRetryInterval)
+
+		var ctx logic.ICustomizePubSessionContext
+		if ctx, err = m.lalServer.AddCustomizePubSession(streamName); err == nil {
+			return ctx, nil
+		}
+	}
+	return nil, err
+}
+
+// PubSession 对lal的ICustomizePubSessionContext的封装
+//
+// 接管旧推流时，新推流和旧推流共用同一个lal推流会话，这里对新推流的时间戳做偏移，保证拉流端看到的时间戳连续
+type PubSession struct {
+	logic.ICustomizePubSessionContext
+
+	publisher IPublisher
+	info      SessionInfo
+	stopped   bool // 是否已经发送过on_pub_stop，由PubSessionManager加锁访问
+
+	mutex    sync.Mutex
+	closed   bool
+	rebase   bool  // 是否需要根据第一帧计算偏移
+	baseTs   int64 // 第一帧的目标时间戳
+	offset   int64
+	lastTs   int64
+	hasFrame bool
+}
+
+func (s *PubSession) FeedAudioSpecificConfig(asc []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return base.ErrDisposedInStream
+	}
+	return s.ICustomizePubSessionContext.FeedAudioSpecificConfig(asc)
+}
+
+func (s *PubSession) FeedAvPacket(packet base.AvPacket) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return base.ErrDisposedInStream
+	}
+	offset := s.fixTimestamp(packet.Timestamp)
+	packet.Timestamp += offset
+	packet.Pts += offset
+	return s.ICustomizePubSessionContext.FeedAvPacket(packet)
+}
+
+func (s *PubSession) FeedRtmpMsg(msg base.RtmpMsg) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return base.ErrDisposedInStream
+	}
+	msg.Header.TimestampAbs = uint32(int64(msg.Header.TimestampAbs) + s.fixTimestamp(int64(msg.Header.TimestampAbs)))
+	return s.ICustomizePubSessionContext.FeedRtmpMsg(msg)
+}
+
+func (s *PubSession) fixTimestamp(ts int64) int64 {
+	if s.rebase {
+		s.rebase = false
+		s.offset = s.baseTs - ts
+	}
+	if !s.hasFrame || ts+s.offset > s.lastTs {
+		s.lastTs = ts + s.offset
+	}
+	s.hasFrame = true
+	return s.offset
+}
+
+// takeover 关闭当前推流，返回复用同一个lal推流会话的新推流
+func (s *PubSession) takeover(publisher IPublisher, info SessionInfo) *PubSession {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	session := &PubSession{
+		ICustomizePubSessionContext: s.ICustomizePubSessionContext,
+		publisher:                   publisher,
+		info:                        info,
+	}
+	if s.hasFrame {
+		session.rebase = true
+		session.baseTs = s.lastTs + takeoverGapMs
+	}
+	return session
+}
+
+func (s *PubSession) notifyStart() {
+	notifyPubStart(s.UniqueKey(), s.StreamName(), s.info)
+}
+
+func (s *PubSession) notifyStop() {
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	notifyPubStop(s.UniqueKey(), s.StreamName(), s.info)
+}
+
+func (s *PubSession) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+}
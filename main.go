@@ -4,7 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/q191201771/lalmax/server"
 
@@ -23,7 +25,7 @@ func main() {
 	confFilename := parseFlag()
 	err := config.Open(confFilename)
 	if err != nil {
-		nazalog.Errorf("open config failed, configname:%+v", confFilename)
+		nazalog.Errorf("open config failed, configname:%+v, err:%+v", confFilename, err)
 		return
 	}
 
@@ -34,9 +36,29 @@ func main() {
 		nazalog.Fatalf("create lalmax server failed. err=%+v", err)
 	}
 
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-ch
+		nazalog.Infof("recv signal, dispose. signal=%s", sig)
+		svr.Dispose()
+	}()
+
+	// SIGHUP 重新加载配置文件
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGHUP)
+		for range ch {
+			nazalog.Info("recv SIGHUP, reload config")
+			_ = svr.Reload()
+		}
+	}()
+
 	if err = svr.Run(); err != nil {
 		nazalog.Infof("server manager done. err=%+v", err)
 	}
+	// 等待退出流程结束，例如剩余通知的发送
+	svr.Dispose()
 }
 
 func parseFlag() string {
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// 事件类的指标由各个模块直接累加，流、会话、gop缓存、国标设备等状态类的指标在采集时由server统计
+const Namespace = "lalmax"
+
+var (
+	// SipRequestsReceived 设备发起的国标sip请求数
+	SipRequestsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "gb28181",
+		Name:      "sip_requests_received_total",
+		Help:      "Number of GB28181 SIP requests received from devices.",
+	}, []string{"method"})
+
+	// SipRequestsSent lalmax发起的国标sip事务数，超时或者非2xx响应的result为error
+	SipRequestsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "gb28181",
+		Name:      "sip_requests_sent_total",
+		Help:      "Number of GB28181 SIP transactions initiated by lalmax.",
+	}, []string{"method", "result"})
+
+	// WebhookFailures http回调失败次数，每次失败的请求都会累加，包括后续重试成功的
+	WebhookFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "http_notify",
+		Name:      "failures_total",
+		Help:      "Number of failed HTTP notify requests.",
+	}, []string{"url"})
+
+	// WebhookDropped http回调重试次数用完或者队列满而丢弃的事件数
+	WebhookDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "http_notify",
+		Name:      "dropped_total",
+		Help:      "Number of HTTP notify events dropped after retries or on full queue.",
+	}, []string{"url"})
+
+	webrtcConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "webrtc",
+		Name:      "connections",
+		Help:      "Number of WebRTC peer connections by current state.",
+	}, []string{"kind", "state"})
+
+	webrtcStateChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "webrtc",
+		Name:      "connection_state_changes_total",
+		Help:      "Number of WebRTC peer connection state changes.",
+	}, []string{"kind", "state"})
+)
+
+// 统计结果
+const (
+	ResultOk    = "ok"
+	ResultError = "error"
+)
+
+const rtcStateClosed = "closed"
+
+// RtcConnState 记录一个webrtc连接当前的状态，连接关闭后不再计入connections
+type RtcConnState struct {
+	mutex sync.Mutex
+	kind  string
+	state string
+}
+
+// NewRtcConnState kind为whip、whep、jessibuca
+func NewRtcConnState(kind string) *RtcConnState {
+	return &RtcConnState{kind: kind}
+}
+
+// Set 在OnConnectionStateChange中调用
+func (s *RtcConnState) Set(state string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state == state {
+		return
+	}
+	if s.state != "" && s.state != rtcStateClosed {
+		webrtcConnections.WithLabelValues(s.kind, s.state).Dec()
+	}
+	webrtcStateChanges.WithLabelValues(s.kind, state).Inc()
+
+	s.state = state
+	if state != rtcStateClosed {
+		webrtcConnections.WithLabelValues(s.kind, state).Inc()
+	}
+}
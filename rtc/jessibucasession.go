@@ -12,6 +12,7 @@ import (
 	"github.com/q191201771/lal/pkg/logic"
 	"github.com/q191201771/lal/pkg/remux"
 	"github.com/q191201771/lalmax/hook"
+	"github.com/q191201771/lalmax/metrics"
 	"github.com/q191201771/naza/pkg/nazalog"
 	"github.com/smallnest/chanx"
 )
@@ -32,9 +33,10 @@ type jessibucaSession struct {
 	streamId     string
 	cancel       context.CancelFunc
 	stopOne      sync.Once
+	info         hook.SessionInfo
 }
 
-func NewJessibucaSession(streamid string, writeChanSize int, pc *peerConnection, lalServer logic.ILalServer) *jessibucaSession {
+func NewJessibucaSession(streamid string, writeChanSize int, pc *peerConnection, lalServer logic.ILalServer, info hook.SessionInfo) *jessibucaSession {
 	ok, session := hook.GetHookSessionManagerInstance().GetHookSession(streamid)
 	if !ok {
 		nazalog.Error("not found streamid:", streamid)
@@ -52,8 +54,19 @@ func NewJessibucaSession(streamid string, writeChanSize int, pc *peerConnection,
 		cancel:       cancel,
 		msgChan:      chanx.NewUnboundedChan[base.RtmpMsg](ctx, writeChanSize),
 		closeChan:    make(chan bool, 1),
+		info:         info,
 	}
 }
+
+// Check on_sub_start同步回调，需要在应答sdp之前调用，拒绝时释放会话
+func (conn *jessibucaSession) Check() error {
+	if err := conn.hooks.CheckConsumer(conn.subscriberId, conn.info); err != nil {
+		conn.cancel()
+		return err
+	}
+	return nil
+}
+
 func (conn *jessibucaSession) createDataChannel() {
 	if conn.DC != nil {
 		return
@@ -92,10 +105,12 @@ func (conn *jessibucaSession) GetAnswerSDP(offer string) (sdp string) {
 func (conn *jessibucaSession) Run() {
 	ok, _ := hook.GetHookSessionManagerInstance().GetHookSession(conn.streamId)
 	if ok {
-		conn.hooks.AddConsumer(conn.subscriberId, conn)
+		conn.hooks.AddCheckedConsumer(conn.subscriberId, conn, conn.info)
 
+		rtcState := metrics.NewRtcConnState("jessibuca")
 		conn.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 			nazalog.Info("peer connection state: ", state.String())
+			rtcState.Set(state.String())
 
 			switch state {
 			case webrtc.PeerConnectionStateConnected:
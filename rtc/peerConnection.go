@@ -11,7 +11,8 @@ type peerConnection struct {
 	*webrtc.PeerConnection
 }
 
-func newPeerConnection(ips []string, iceUDPMux ice.UDPMux, iceTCPMux ice.TCPMux) (conn *peerConnection, err error) {
+// newPeerConnection g711Only为true时音频只协商PCMU/PCMA，不协商opus
+func newPeerConnection(ips []string, iceUDPMux ice.UDPMux, iceTCPMux ice.TCPMux, g711Only bool) (conn *peerConnection, err error) {
 	configuration := webrtc.Configuration{}
 	settingsEngine := webrtc.SettingEngine{}
 
@@ -66,19 +67,21 @@ func newPeerConnection(ips []string, iceUDPMux ice.UDPMux, iceTCPMux ice.TCPMux)
 	}
 
 	// opus
-	err = mediaEngine.RegisterCodec(
-		webrtc.RTPCodecParameters{
-			RTPCodecCapability: webrtc.RTPCodecCapability{
-				MimeType:  webrtc.MimeTypeOpus,
-				ClockRate: 48000,
+	if !g711Only {
+		err = mediaEngine.RegisterCodec(
+			webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{
+					MimeType:  webrtc.MimeTypeOpus,
+					ClockRate: 48000,
+				},
+				PayloadType: 111,
 			},
-			PayloadType: 111,
-		},
-		webrtc.RTPCodecTypeAudio)
+			webrtc.RTPCodecTypeAudio)
 
-	if err != nil {
-		nazalog.Error(err)
-		return
+		if err != nil {
+			nazalog.Error(err)
+			return
+		}
 	}
 
 	// PCMU
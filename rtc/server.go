@@ -5,8 +5,11 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 
+	"github.com/q191201771/lalmax/auth"
 	config "github.com/q191201771/lalmax/conf"
+	"github.com/q191201771/lalmax/hook"
 
 	"github.com/gin-gonic/gin"
 	"github.com/pion/ice/v2"
@@ -15,14 +18,21 @@ import (
 	"github.com/q191201771/naza/pkg/nazalog"
 )
 
+// whip推流时只协商G.711音频的audio_codec参数值
+const whipAudioCodecG711 = "g711"
+
 type RtcServer struct {
-	config    config.RtcConfig
-	lalServer logic.ILalServer
-	udpMux    ice.UDPMux
-	tcpMux    ice.TCPMux
+	config     config.RtcConfig
+	lalServer  logic.ILalServer
+	pubManager *hook.PubSessionManager
+	udpMux     ice.UDPMux
+	tcpMux     ice.TCPMux
+	auth       auth.IAuthenticator
+	pcs        sync.Map // 当前所有的peer connection，退出时关闭
 }
 
-func NewRtcServer(config config.RtcConfig, lal logic.ILalServer) (*RtcServer, error) {
+// NewRtcServer config需要已经通过 config.Config.SetDefaults 填充默认值
+func NewRtcServer(config config.RtcConfig, lal logic.ILalServer, pubManager *hook.PubSessionManager) (*RtcServer, error) {
 	var udpMux ice.UDPMux
 	var tcpMux ice.TCPMux
 
@@ -41,9 +51,6 @@ func NewRtcServer(config config.RtcConfig, lal logic.ILalServer) (*RtcServer, er
 		nazalog.Infof("webrtc ice udp listen. port=%d", config.ICEUDPMuxPort)
 		udpMux = webrtc.NewICEUDPMux(nil, udplistener)
 	}
-	if config.WriteChanSize == 0 {
-		config.WriteChanSize = 1024
-	}
 	if config.ICETCPMuxPort != 0 {
 		var tcplistener *net.TCPListener
 
@@ -61,15 +68,74 @@ func NewRtcServer(config config.RtcConfig, lal logic.ILalServer) (*RtcServer, er
 	}
 
 	svr := &RtcServer{
-		config:    config,
-		lalServer: lal,
-		udpMux:    udpMux,
-		tcpMux:    tcpMux,
+		config:     config,
+		lalServer:  lal,
+		pubManager: pubManager,
+		udpMux:     udpMux,
+		tcpMux:     tcpMux,
 	}
 
 	return svr, nil
 }
 
+func (s *RtcServer) SetAuthenticator(authenticator auth.IAuthenticator) {
+	s.auth = authenticator
+}
+
+// authenticate 鉴权失败时返回403
+func (s *RtcServer) authenticate(c *gin.Context, protocol, action, streamid string) bool {
+	if s.auth == nil {
+		return true
+	}
+	if err := s.auth.Authenticate(auth.NewHttpAuthInfo(protocol, action, streamid, c.Request, c.ClientIP())); err != nil {
+		c.Status(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// newPeerConnection 创建peer connection并记录下来，ice关闭或者失败后移除
+func (s *RtcServer) newPeerConnection(g711Only bool) (*peerConnection, error) {
+	pc, err := newPeerConnection(s.config.ICEHostNATToIPs, s.udpMux, s.tcpMux, g711Only)
+	if err != nil {
+		return nil, err
+	}
+	s.pcs.Store(pc, struct{}{})
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateClosed || state == webrtc.ICEConnectionStateFailed {
+			s.pcs.Delete(pc)
+		}
+	})
+	return pc, nil
+}
+
+// Dispose 关闭所有的peer connection，各个会话收到关闭事件后停止推拉流
+func (s *RtcServer) Dispose() {
+	s.pcs.Range(func(key, _ any) bool {
+		pc := key.(*peerConnection)
+		if err := pc.Close(); err != nil {
+			nazalog.Warnf("close peer connection failed. err=%+v", err)
+		}
+		s.pcs.Delete(key)
+		return true
+	})
+	if s.udpMux != nil {
+		s.udpMux.Close()
+	}
+	if s.tcpMux != nil {
+		s.tcpMux.Close()
+	}
+}
+
+func newSessionInfo(r *http.Request, protocol string) hook.SessionInfo {
+	return hook.SessionInfo{
+		Protocol:   protocol,
+		RemoteAddr: r.RemoteAddr,
+		Url:        r.URL.String(),
+		RawQuery:   r.URL.RawQuery,
+	}
+}
+
 func (s *RtcServer) HandleWHIP(c *gin.Context) {
 	streamid := c.Request.URL.Query().Get("streamid")
 	if streamid == "" {
@@ -77,6 +143,17 @@ func (s *RtcServer) HandleWHIP(c *gin.Context) {
 		return
 	}
 
+	if !s.authenticate(c, auth.ProtocolWhip, auth.ActionPub, streamid) {
+		return
+	}
+
+	// audio_codec=g711时音频只协商PCMU/PCMA，用于国标语音广播等不支持opus的场景
+	audioCodec := c.Request.URL.Query().Get("audio_codec")
+	if audioCodec != "" && audioCodec != whipAudioCodecG711 {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
 	body, err := c.GetRawData()
 	if err != nil {
 		nazalog.Error(err)
@@ -90,13 +167,13 @@ func (s *RtcServer) HandleWHIP(c *gin.Context) {
 		return
 	}
 
-	pc, err := newPeerConnection(s.config.ICEHostNATToIPs, s.udpMux, s.tcpMux)
+	pc, err := s.newPeerConnection(audioCodec == whipAudioCodecG711)
 	if err != nil {
 		c.Status(http.StatusInternalServerError)
 		return
 	}
 
-	whipsession := NewWhipSession(streamid, pc, s.lalServer)
+	whipsession := NewWhipSession(streamid, pc, s.pubManager, newSessionInfo(c.Request, auth.ProtocolWhip))
 	if whipsession == nil {
 		c.Status(http.StatusInternalServerError)
 		return
@@ -106,6 +183,7 @@ func (s *RtcServer) HandleWHIP(c *gin.Context) {
 
 	sdp := whipsession.GetAnswerSDP(string(body))
 	if sdp == "" {
+		s.pubManager.DelPubSession(whipsession.lalSession)
 		c.Status(http.StatusInternalServerError)
 		return
 	}
@@ -121,6 +199,10 @@ func (s *RtcServer) HandleJessibuca(c *gin.Context) {
 		return
 	}
 
+	if !s.authenticate(c, auth.ProtocolJessibuca, auth.ActionSub, streamid) {
+		return
+	}
+
 	body, err := c.GetRawData()
 	if err != nil {
 		nazalog.Error(err)
@@ -134,18 +216,24 @@ func (s *RtcServer) HandleJessibuca(c *gin.Context) {
 		return
 	}
 
-	pc, err := newPeerConnection(s.config.ICEHostNATToIPs, s.udpMux, s.tcpMux)
+	pc, err := s.newPeerConnection(false)
 	if err != nil {
 		c.Status(http.StatusInternalServerError)
 		return
 	}
 
-	jessibucaSession := NewJessibucaSession(streamid, s.config.WriteChanSize, pc, s.lalServer)
+	jessibucaSession := NewJessibucaSession(streamid, s.config.WriteChanSize, pc, s.lalServer, newSessionInfo(c.Request, auth.ProtocolJessibuca))
 	if jessibucaSession == nil {
 		c.Status(http.StatusInternalServerError)
 		return
 	}
 
+	if err = jessibucaSession.Check(); err != nil {
+		pc.Close()
+		c.Status(http.StatusForbidden)
+		return
+	}
+
 	c.Header("Location", fmt.Sprintf("jessibucaflv/%s", jessibucaSession.subscriberId))
 
 	sdp := jessibucaSession.GetAnswerSDP(string(body))
@@ -165,6 +253,10 @@ func (s *RtcServer) HandleWHEP(c *gin.Context) {
 		return
 	}
 
+	if !s.authenticate(c, auth.ProtocolWhep, auth.ActionSub, streamid) {
+		return
+	}
+
 	body, err := c.GetRawData()
 	if err != nil {
 		nazalog.Error(err)
@@ -178,18 +270,24 @@ func (s *RtcServer) HandleWHEP(c *gin.Context) {
 		return
 	}
 
-	pc, err := newPeerConnection(s.config.ICEHostNATToIPs, s.udpMux, s.tcpMux)
+	pc, err := s.newPeerConnection(false)
 	if err != nil {
 		c.Status(http.StatusInternalServerError)
 		return
 	}
 
-	whepsession := NewWhepSession(streamid, s.config.WriteChanSize, pc, s.lalServer)
+	whepsession := NewWhepSession(streamid, s.config.WriteChanSize, pc, s.lalServer, newSessionInfo(c.Request, auth.ProtocolWhep))
 	if whepsession == nil {
 		c.Status(http.StatusInternalServerError)
 		return
 	}
 
+	if err = whepsession.Check(); err != nil {
+		pc.Close()
+		c.Status(http.StatusForbidden)
+		return
+	}
+
 	c.Header("Location", fmt.Sprintf("whep/%s", whepsession.subscriberId))
 
 	userAgent := c.Request.UserAgent()
@@ -209,18 +307,24 @@ func (s *RtcServer) HandleWHEP(c *gin.Context) {
 }
 
 func (s *RtcServer) handleWHEP(w http.ResponseWriter, r *http.Request, streamid, body string) {
-	pc, err := newPeerConnection(s.config.ICEHostNATToIPs, s.udpMux, s.tcpMux)
+	pc, err := s.newPeerConnection(false)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	whepsession := NewWhepSession(streamid, s.config.WriteChanSize, pc, s.lalServer)
+	whepsession := NewWhepSession(streamid, s.config.WriteChanSize, pc, s.lalServer, newSessionInfo(r, auth.ProtocolWhep))
 	if whepsession == nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	if err = whepsession.Check(); err != nil {
+		pc.Close()
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
 	sdp := whepsession.GetAnswerSDP(string(body))
 	if sdp == "" {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -10,6 +10,7 @@ import (
 	"github.com/pion/webrtc/v3"
 	"github.com/q191201771/lal/pkg/base"
 	"github.com/q191201771/lal/pkg/logic"
+	"github.com/q191201771/lalmax/metrics"
 	"github.com/q191201771/naza/pkg/nazalog"
 )
 
@@ -25,9 +26,10 @@ type whepSession struct {
 	msgChan      *chanx.UnboundedChan[base.RtmpMsg]
 	closeChan    chan bool
 	remoteSafari bool
+	info         hook.SessionInfo
 }
 
-func NewWhepSession(streamid string, writeChanSize int, pc *peerConnection, lalServer logic.ILalServer) *whepSession {
+func NewWhepSession(streamid string, writeChanSize int, pc *peerConnection, lalServer logic.ILalServer, info hook.SessionInfo) *whepSession {
 	ok, session := hook.GetHookSessionManagerInstance().GetHookSession(streamid)
 	if !ok {
 		nazalog.Error("not found streamid:", streamid)
@@ -42,9 +44,15 @@ func NewWhepSession(streamid string, writeChanSize int, pc *peerConnection, lalS
 		subscriberId: u.String(),
 		msgChan:      chanx.NewUnboundedChan[base.RtmpMsg](context.Background(), writeChanSize),
 		closeChan:    make(chan bool, 2),
+		info:         info,
 	}
 }
 
+// Check on_sub_start同步回调，需要在应答sdp之前调用
+func (conn *whepSession) Check() error {
+	return conn.hooks.CheckConsumer(conn.subscriberId, conn.info)
+}
+
 func (conn *whepSession) SetRemoteSafari(val bool) {
 	conn.remoteSafari = val
 }
@@ -158,10 +166,12 @@ func (conn *whepSession) GetAnswerSDP(offer string) (sdp string) {
 }
 
 func (conn *whepSession) Run() {
-	conn.hooks.AddConsumer(conn.subscriberId, conn)
+	conn.hooks.AddCheckedConsumer(conn.subscriberId, conn, conn.info)
 
+	rtcState := metrics.NewRtcConnState("whep")
 	conn.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		nazalog.Info("peer connection state: ", state.String())
+		rtcState.Set(state.String())
 
 		switch state {
 		case webrtc.PeerConnectionStateConnected:
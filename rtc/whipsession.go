@@ -4,15 +4,16 @@ import (
 	"github.com/gofrs/uuid"
 	"github.com/pion/webrtc/v3"
 	"github.com/q191201771/lal/pkg/base"
-	"github.com/q191201771/lal/pkg/logic"
+	"github.com/q191201771/lalmax/hook"
+	"github.com/q191201771/lalmax/metrics"
 	"github.com/q191201771/naza/pkg/nazalog"
 )
 
 type whipSession struct {
 	streamid      string
 	pc            *peerConnection
-	lalServer     logic.ILalServer
-	lalSession    logic.ICustomizePubSessionContext
+	pubManager    *hook.PubSessionManager
+	lalSession    *hook.PubSession
 	videoUnpacker *UnPacker
 	audioUnpacker *UnPacker
 	pktChan       chan base.AvPacket
@@ -20,8 +21,19 @@ type whipSession struct {
 	subscriberId  string
 }
 
-func NewWhipSession(streamid string, pc *peerConnection, lalServer logic.ILalServer) *whipSession {
-	session, err := lalServer.AddCustomizePubSession(streamid)
+func NewWhipSession(streamid string, pc *peerConnection, pubManager *hook.PubSessionManager, info hook.SessionInfo) *whipSession {
+	u, _ := uuid.NewV4()
+
+	conn := &whipSession{
+		streamid:     streamid,
+		pc:           pc,
+		pubManager:   pubManager,
+		pktChan:      make(chan base.AvPacket, 100),
+		closeChan:    make(chan bool, 2),
+		subscriberId: u.String(),
+	}
+
+	session, err := pubManager.AddPubSession(streamid, conn, info)
 	if err != nil {
 		nazalog.Error(err)
 		return nil
@@ -31,16 +43,15 @@ func NewWhipSession(streamid string, pc *peerConnection, lalServer logic.ILalSer
 		option.VideoFormat = base.AvPacketStreamVideoFormatAnnexb
 	})
 
-	u, _ := uuid.NewV4()
+	conn.lalSession = session
+	return conn
+}
 
-	return &whipSession{
-		streamid:     streamid,
-		pc:           pc,
-		lalServer:    lalServer,
-		lalSession:   session,
-		pktChan:      make(chan base.AvPacket, 100),
-		closeChan:    make(chan bool, 2),
-		subscriberId: u.String(),
+// Kick 被踢掉或者被新的推流接管时断开连接
+func (conn *whipSession) Kick() {
+	select {
+	case conn.closeChan <- true:
+	default:
 	}
 }
 
@@ -72,8 +83,10 @@ func (conn *whipSession) GetAnswerSDP(offer string) (sdp string) {
 
 func (conn *whipSession) Run() {
 
+	rtcState := metrics.NewRtcConnState("whip")
 	conn.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		nazalog.Info("peer connection state: ", state.String())
+		rtcState.Set(state.String())
 
 		switch state {
 		case webrtc.PeerConnectionStateConnected:
@@ -124,7 +137,8 @@ func (conn *whipSession) Run() {
 		select {
 		case <-conn.closeChan:
 			nazalog.Info("whip connect close, streamid:", conn.streamid)
-			conn.lalServer.DelCustomizePubSession(conn.lalSession)
+			conn.pubManager.DelPubSession(conn.lalSession)
+			conn.pc.Close()
 			return
 		case pkt := <-conn.pktChan:
 			conn.lalSession.FeedAvPacket(pkt)
@@ -9,15 +9,19 @@
 package server
 
 import (
+	"encoding/json"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/q191201771/lalmax/fmp4/hls"
+	"github.com/q191201771/lalmax/gb28181"
 	"github.com/q191201771/lalmax/hook"
 
 	config "github.com/q191201771/lalmax/conf"
 
 	"github.com/q191201771/lal/pkg/base"
-	"github.com/q191201771/naza/pkg/nazahttp"
 	"github.com/q191201771/naza/pkg/nazalog"
 )
 
@@ -36,38 +40,67 @@ type PostTask struct {
 }
 
 type HttpNotify struct {
-	cfg config.HttpNotifyConfig
+	cfg    config.HttpNotifyConfig
+	urlCfg atomic.Pointer[config.HttpNotifyConfig] // 回调地址，可以热更新
 
 	serverId string
 
-	taskQueue         chan PostTask
 	notifyUpdateQueue chan PostTask
 	client            *http.Client
+
+	hlssvr *hls.HlsServer
+
+	// on_update以外的事件按回调地址分队列发送，失败重试，可选落盘
+	workerMutex sync.Mutex
+	workers     map[string]*notifyWorker
+	workerWg    sync.WaitGroup
+	disposed    bool
+	disposeChan chan struct{}
+	spoolSeq    uint64
+
+	// 同步回调
+	syncEvents        map[string]bool
+	syncClient        *http.Client
+	rejectedRtmpConns sync.Map // session id -> 过期时间
 }
 
 func NewHttpNotify(cfg config.HttpNotifyConfig, serverId string) *HttpNotify {
 	httpNotify := &HttpNotify{
 		cfg:               cfg,
 		serverId:          serverId,
-		taskQueue:         make(chan PostTask, maxTaskLen),
 		notifyUpdateQueue: make(chan PostTask, maxTaskLen),
 		client: &http.Client{
 			Timeout: time.Duration(notifyTimeoutSec) * time.Second,
 		},
 	}
-	go httpNotify.RunLoop()
+	httpNotify.urlCfg.Store(&cfg)
+	if cfg.Enable {
+		httpNotify.initDelivery()
+	}
 	go httpNotify.NotifyUpdateRunLoop()
 
 	return httpNotify
 }
 
-// TODO(chef): Dispose
+// UpdateUrls 热更新回调地址，其他配置修改后需要重启
+func (h *HttpNotify) UpdateUrls(cfg config.HttpNotifyConfig) {
+	h.urlCfg.Store(&cfg)
+}
+
+func (h *HttpNotify) urls() *config.HttpNotifyConfig {
+	return h.urlCfg.Load()
+}
+
+// SetHlsServer on_update中补充hls观看者的信息
+func (h *HttpNotify) SetHlsServer(hlssvr *hls.HlsServer) {
+	h.hlssvr = hlssvr
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
 func (h *HttpNotify) NotifyServerStart(info base.LalInfo) {
 	info.ServerId = h.serverId
-	h.asyncPost(h.cfg.OnServerStart, info)
+	h.asyncPost(h.urls().OnServerStart, info)
 }
 
 func (h *HttpNotify) NotifyUpdate(info base.UpdateInfo) {
@@ -77,48 +110,56 @@ func (h *HttpNotify) NotifyUpdate(info base.UpdateInfo) {
 		if exist {
 			info.Groups[i].StatSubs = append(info.Groups[i].StatSubs, session.GetAllConsumer()...)
 		}
+		if h.hlssvr != nil {
+			info.Groups[i].StatSubs = append(info.Groups[i].StatSubs, h.hlssvr.GetAllViewers(v.StreamName)...)
+		}
 	}
-	h.notifyUpdateAsyncPost(h.cfg.OnUpdate, info)
+	h.notifyUpdateAsyncPost(h.urls().OnUpdate, info)
 }
 
 func (h *HttpNotify) NotifyPubStart(info base.PubStartInfo) {
 	info.ServerId = h.serverId
-	h.asyncPost(h.cfg.OnPubStart, info)
+	h.asyncPost(h.urls().OnPubStart, info)
 }
 
 func (h *HttpNotify) NotifyPubStop(info base.PubStopInfo) {
 	info.ServerId = h.serverId
-	h.asyncPost(h.cfg.OnPubStop, info)
+	h.asyncPost(h.urls().OnPubStop, info)
 }
 
 func (h *HttpNotify) NotifySubStart(info base.SubStartInfo) {
 	info.ServerId = h.serverId
-	h.asyncPost(h.cfg.OnSubStart, info)
+	h.asyncPost(h.urls().OnSubStart, info)
 }
 
 func (h *HttpNotify) NotifySubStop(info base.SubStopInfo) {
 	info.ServerId = h.serverId
-	h.asyncPost(h.cfg.OnSubStop, info)
+	h.asyncPost(h.urls().OnSubStop, info)
 }
 
 func (h *HttpNotify) NotifyPullStart(info base.PullStartInfo) {
 	info.ServerId = h.serverId
-	h.asyncPost(h.cfg.OnRelayPullStart, info)
+	h.asyncPost(h.urls().OnRelayPullStart, info)
 }
 
 func (h *HttpNotify) NotifyPullStop(info base.PullStopInfo) {
 	info.ServerId = h.serverId
-	h.asyncPost(h.cfg.OnRelayPullStop, info)
+	h.asyncPost(h.urls().OnRelayPullStop, info)
 }
 
 func (h *HttpNotify) NotifyRtmpConnect(info base.RtmpConnectInfo) {
 	info.ServerId = h.serverId
-	h.asyncPost(h.cfg.OnRtmpConnect, info)
+	h.asyncPost(h.urls().OnRtmpConnect, info)
 }
 
 func (h *HttpNotify) NotifyOnHlsMakeTs(info base.HlsMakeTsInfo) {
 	info.ServerId = h.serverId
-	h.asyncPost(h.cfg.OnHlsMakeTs, info)
+	h.asyncPost(h.urls().OnHlsMakeTs, info)
+}
+
+func (h *HttpNotify) NotifyGbAlarm(info gb28181.AlarmInfo) {
+	info.ServerId = h.serverId
+	h.asyncPost(h.urls().OnGbAlarm, info)
 }
 
 // ----- implement INotifyHandler interface ----------------------------------------------------------------------------
@@ -132,7 +173,10 @@ func (h *HttpNotify) OnUpdate(info base.UpdateInfo) {
 }
 
 func (h *HttpNotify) OnPubStart(info base.PubStartInfo) {
-	h.NotifyPubStart(info)
+	// 同步模式下已经在鉴权时回调过
+	if !h.isSync(SyncEventOnPubStart) {
+		h.NotifyPubStart(info)
+	}
 }
 
 func (h *HttpNotify) OnPubStop(info base.PubStopInfo) {
@@ -140,7 +184,9 @@ func (h *HttpNotify) OnPubStop(info base.PubStopInfo) {
 }
 
 func (h *HttpNotify) OnSubStart(info base.SubStartInfo) {
-	h.NotifySubStart(info)
+	if !h.isSync(SyncEventOnSubStart) {
+		h.NotifySubStart(info)
+	}
 }
 
 func (h *HttpNotify) OnSubStop(info base.SubStopInfo) {
@@ -156,6 +202,11 @@ func (h *HttpNotify) OnRelayPullStop(info base.PullStopInfo) {
 }
 
 func (h *HttpNotify) OnRtmpConnect(info base.RtmpConnectInfo) {
+	if h.isSync(SyncEventOnRtmpConnect) {
+		info.ServerId = h.serverId
+		h.onRtmpConnectSync(info)
+		return
+	}
 	h.NotifyRtmpConnect(info)
 }
 
@@ -165,15 +216,6 @@ func (h *HttpNotify) OnHlsMakeTs(info base.HlsMakeTsInfo) {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-func (h *HttpNotify) RunLoop() {
-	for {
-		select {
-		case t := <-h.taskQueue:
-			h.post(t.url, t.info)
-		}
-	}
-}
-
 func (h *HttpNotify) NotifyUpdateRunLoop() {
 	for {
 		select {
@@ -203,16 +245,16 @@ func (h *HttpNotify) asyncPost(url string, info interface{}) {
 		return
 	}
 
-	select {
-	case h.taskQueue <- PostTask{url: url, info: info}:
-		// noop
-	default:
-		Log.Error("http notify queue full.")
-	}
+	h.submit(url, info)
 }
 
+// post on_update是定时发送的全量信息，失败后不重试
 func (h *HttpNotify) post(url string, info interface{}) {
-	if _, err := nazahttp.PostJson(url, info, h.client); err != nil {
+	body, err := json.Marshal(info)
+	if err == nil {
+		err = h.send(url, body)
+	}
+	if err != nil {
 		Log.Errorf("http notify post error. err=%+v, url=%s, info=%+v", err, url, info)
 	}
 }
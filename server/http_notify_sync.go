@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/q191201771/lal/pkg/base"
+	"github.com/q191201771/lal/pkg/logic"
+	"github.com/q191201771/lalmax/gb28181"
+	"github.com/q191201771/lalmax/metrics"
+)
+
+// 可以配置为同步回调的事件
+const (
+	SyncEventOnPubStart    = "on_pub_start"
+	SyncEventOnSubStart    = "on_sub_start"
+	SyncEventOnRtmpConnect = "on_rtmp_connect"
+)
+
+const (
+	SyncFailPolicyOpen   = "open"   // 回调失败或者超时时允许，默认策略
+	SyncFailPolicyClosed = "closed" // 回调失败或者超时时拒绝
+
+	// on_rtmp_connect被拒绝的rtmp连接，在这段时间内的推拉流都会被拒绝
+	rtmpConnectRejectDuration = time.Minute
+)
+
+var ErrSyncNotifyReject = errors.New("lalmax: rejected by http notify")
+
+// syncNotifyResp 同步回调的返回，allow为false时拒绝，没有返回allow字段时允许
+type syncNotifyResp struct {
+	Allow *bool `json:"allow"`
+}
+
+// initSync 开启同步回调时，返回给lal的鉴权回调，没有开启时返回nil，使用lal默认的simple_auth
+func (h *HttpNotify) initSync(lalConfigPath string) logic.IAuthentication {
+	if !h.cfg.Enable || len(h.cfg.SyncEvents) == 0 {
+		return nil
+	}
+
+	h.syncEvents = make(map[string]bool)
+	for _, event := range h.cfg.SyncEvents {
+		switch event {
+		case SyncEventOnPubStart, SyncEventOnSubStart, SyncEventOnRtmpConnect:
+			h.syncEvents[event] = true
+		default:
+			Log.Warnf("http notify invalid sync event:%s", event)
+		}
+	}
+	h.syncClient = &http.Client{
+		Timeout: time.Duration(h.cfg.SyncTimeoutMs) * time.Millisecond,
+	}
+
+	Log.Infof("http notify sync events:%v, fail policy:%s", h.cfg.SyncEvents, h.cfg.SyncFailPolicy)
+	return &syncNotifyAuth{
+		simple: logic.NewSimpleAuthCtx(loadLalSimpleAuthConfig(lalConfigPath)),
+		notify: h,
+	}
+}
+
+func (h *HttpNotify) isSync(event string) bool {
+	return h.syncEvents[event]
+}
+
+// syncPost 同步回调，返回nil表示允许
+func (h *HttpNotify) syncPost(url string, info interface{}) error {
+	if url == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	h.sign(req, body)
+
+	resp, err := h.syncClient.Do(req)
+	if err != nil {
+		metrics.WebhookFailures.WithLabelValues(url).Inc()
+		if h.cfg.SyncFailPolicy == SyncFailPolicyOpen {
+			Log.Warnf("http notify sync post error, allow. err=%+v, url=%s", err, url)
+			return nil
+		}
+		Log.Warnf("http notify sync post error, reject. err=%+v, url=%s", err, url)
+		return ErrSyncNotifyReject
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		Log.Infof("http notify sync reject, statusCode=%d, url=%s, info=%s", resp.StatusCode, url, string(body))
+		return ErrSyncNotifyReject
+	}
+	var out syncNotifyResp
+	respBody, _ := io.ReadAll(resp.Body)
+	if json.Unmarshal(respBody, &out) == nil && out.Allow != nil && !*out.Allow {
+		Log.Infof("http notify sync reject, url=%s, info=%s", url, string(body))
+		return ErrSyncNotifyReject
+	}
+	return nil
+}
+
+// onRtmpConnectSync lal的on_rtmp_connect不能返回错误，被拒绝的连接记录下来，在推拉流时拒绝
+func (h *HttpNotify) onRtmpConnectSync(info base.RtmpConnectInfo) {
+	if err := h.syncPost(h.urls().OnRtmpConnect, info); err != nil {
+		h.rejectedRtmpConns.Store(info.SessionId, time.Now().Add(rtmpConnectRejectDuration))
+	}
+
+	now := time.Now()
+	h.rejectedRtmpConns.Range(func(k, v interface{}) bool {
+		if now.After(v.(time.Time)) {
+			h.rejectedRtmpConns.Delete(k)
+		}
+		return true
+	})
+}
+
+func (h *HttpNotify) isRtmpConnRejected(sessionId string) bool {
+	v, ok := h.rejectedRtmpConns.Load(sessionId)
+	return ok && time.Now().Before(v.(time.Time))
+}
+
+// syncNotifyAuth 实现lal的IAuthentication，先做lal本身的simple_auth鉴权，再同步回调
+//
+// 注意lal调用时持有全局锁，回调耗时会影响所有的推拉流，sync_timeout_ms不宜设置过大
+type syncNotifyAuth struct {
+	simple logic.IAuthentication
+	notify *HttpNotify
+}
+
+func (a *syncNotifyAuth) OnPubStart(info base.PubStartInfo) error {
+	if err := a.simple.OnPubStart(info); err != nil {
+		return err
+	}
+	if a.notify.isRtmpConnRejected(info.SessionId) {
+		return ErrSyncNotifyReject
+	}
+	if !a.notify.isSync(SyncEventOnPubStart) {
+		return nil
+	}
+	info.ServerId = a.notify.serverId
+	return a.notify.syncPost(a.notify.urls().OnPubStart, info)
+}
+
+func (a *syncNotifyAuth) OnSubStart(info base.SubStartInfo) error {
+	if err := a.simple.OnSubStart(info); err != nil {
+		return err
+	}
+	if a.notify.isRtmpConnRejected(info.SessionId) {
+		return ErrSyncNotifyReject
+	}
+	if !a.notify.isSync(SyncEventOnSubStart) {
+		return nil
+	}
+	info.ServerId = a.notify.serverId
+	return a.notify.syncPost(a.notify.urls().OnSubStart, info)
+}
+
+func (a *syncNotifyAuth) OnHls(streamName, urlParam string) error {
+	return a.simple.OnHls(streamName, urlParam)
+}
+
+// loadLalSimpleAuthConfig 设置了IAuthentication之后lal不再创建simple_auth，这里从lal的配置文件中读取
+func loadLalSimpleAuthConfig(path string) logic.SimpleAuthConfig {
+	var conf struct {
+		SimpleAuthConfig logic.SimpleAuthConfig `json:"simple_auth"`
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &conf)
+	}
+	if err != nil {
+		Log.Warnf("load lal simple auth config failed. err=%+v, path=%s", err, path)
+	}
+	return conf.SimpleAuthConfig
+}
+
+// nativeNotify lalmax自己接入的推拉流的通知，不经过lal的鉴权流程，由hook层和hls在会话开始前调用 CheckPubStart/CheckSubStart
+//
+// 和lal一样，同步回调过的事件不再异步发送，推流的同步回调发生在创建会话之前，没有session_id
+type nativeNotify struct {
+	h *HttpNotify
+}
+
+func (n nativeNotify) OnPubStop(info base.PubStopInfo)  { n.h.NotifyPubStop(info) }
+func (n nativeNotify) OnSubStop(info base.SubStopInfo)  { n.h.NotifySubStop(info) }
+func (n nativeNotify) OnGbAlarm(info gb28181.AlarmInfo) { n.h.NotifyGbAlarm(info) }
+
+func (n nativeNotify) OnPubStart(info base.PubStartInfo) {
+	// 同步模式下已经在 CheckPubStart 时回调过
+	if !n.h.isSync(SyncEventOnPubStart) {
+		n.h.NotifyPubStart(info)
+	}
+}
+
+func (n nativeNotify) OnSubStart(info base.SubStartInfo) {
+	// 同步模式下已经在 CheckSubStart 时回调过
+	if !n.h.isSync(SyncEventOnSubStart) {
+		n.h.NotifySubStart(info)
+	}
+}
+
+func (n nativeNotify) CheckPubStart(info base.PubStartInfo) error {
+	if !n.h.isSync(SyncEventOnPubStart) {
+		return nil
+	}
+	info.ServerId = n.h.serverId
+	return n.h.syncPost(n.h.urls().OnPubStart, info)
+}
+
+func (n nativeNotify) CheckSubStart(info base.SubStartInfo) error {
+	if !n.h.isSync(SyncEventOnSubStart) {
+		return nil
+	}
+	info.ServerId = n.h.serverId
+	return n.h.syncPost(n.h.urls().OnSubStart, info)
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/q191201771/lalmax/metrics"
+)
+
+const (
+	maxNotifyRetryInterval = 30 * time.Second
+
+	notifySpoolSuffix = ".json"
+
+	NotifyHeaderTimestamp = "X-Lalmax-Timestamp"
+	NotifyHeaderSignature = "X-Lalmax-Signature"
+)
+
+// notifyTask 一次回调，body提前序列化好，用于签名和落盘
+//
+// 开启落盘时入队前就写入落盘目录，发送成功或者放弃后删除，进程异常退出时队列中的事件也不会丢失
+type notifyTask struct {
+	Url  string          `json:"url"`
+	Body json.RawMessage `json:"body"`
+
+	spoolFile string
+}
+
+// notifyWorker 每个回调地址一个队列，并发数为1时同一个地址的事件按顺序发送
+type notifyWorker struct {
+	queue chan *notifyTask
+}
+
+func (h *HttpNotify) initDelivery() {
+	h.workers = make(map[string]*notifyWorker)
+	h.disposeChan = make(chan struct{})
+
+	if h.cfg.SpoolDir != "" {
+		if err := os.MkdirAll(h.cfg.SpoolDir, 0755); err != nil {
+			Log.Errorf("http notify create spool dir failed, disable spool. dir=%s, err=%+v", h.cfg.SpoolDir, err)
+			h.cfg.SpoolDir = ""
+			return
+		}
+		h.loadSpool()
+	}
+}
+
+// loadSpool 重启后重新发送上次没有发送成功的事件
+func (h *HttpNotify) loadSpool() {
+	matches, err := filepath.Glob(filepath.Join(h.cfg.SpoolDir, "*"+notifySpoolSuffix))
+	if err != nil || len(matches) == 0 {
+		return
+	}
+	// 文件名是纳秒时间戳加序号，按名字排序就是事件产生的顺序
+	sort.Strings(matches)
+
+	Log.Infof("http notify load spool. count=%d", len(matches))
+	for _, file := range matches {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var t notifyTask
+		if err = json.Unmarshal(data, &t); err != nil || t.Url == "" {
+			Log.Warnf("http notify invalid spool file, remove it. file=%s, err=%+v", file, err)
+			os.Remove(file)
+			continue
+		}
+		t.spoolFile = file
+		h.enqueue(&t)
+	}
+}
+
+func (h *HttpNotify) submit(url string, info interface{}) {
+	body, err := json.Marshal(info)
+	if err != nil {
+		Log.Errorf("http notify marshal failed. err=%+v, url=%s", err, url)
+		return
+	}
+
+	t := &notifyTask{Url: url, Body: body}
+	h.spool(t)
+	h.enqueue(t)
+}
+
+// spool 没有开启落盘或者已经落盘时不做处理
+func (h *HttpNotify) spool(t *notifyTask) {
+	if h.cfg.SpoolDir == "" || t.spoolFile != "" {
+		return
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return
+	}
+	name := fmt.Sprintf("%020d_%010d%s", time.Now().UnixNano(), atomic.AddUint64(&h.spoolSeq, 1), notifySpoolSuffix)
+	file := filepath.Join(h.cfg.SpoolDir, name)
+	if err = os.WriteFile(file, data, 0644); err != nil {
+		Log.Errorf("http notify write spool failed. err=%+v, file=%s", err, file)
+		return
+	}
+	t.spoolFile = file
+}
+
+func (h *HttpNotify) enqueue(t *notifyTask) {
+	h.workerMutex.Lock()
+	defer h.workerMutex.Unlock()
+
+	if h.disposed {
+		if t.spoolFile != "" {
+			Log.Warnf("http notify disposed, event kept in spool until restart. url=%s", t.Url)
+		} else {
+			Log.Warnf("http notify disposed, drop event. url=%s", t.Url)
+		}
+		return
+	}
+
+	w, ok := h.workers[t.Url]
+	if !ok {
+		w = &notifyWorker{queue: make(chan *notifyTask, maxTaskLen)}
+		h.workers[t.Url] = w
+		for i := 0; i < h.cfg.ConcurrencyPerUrl; i++ {
+			h.workerWg.Add(1)
+			go h.runWorker(w)
+		}
+	}
+
+	select {
+	case w.queue <- t:
+		// noop
+	default:
+		metrics.WebhookDropped.WithLabelValues(t.Url).Inc()
+		if t.spoolFile != "" {
+			Log.Errorf("http notify queue full, event kept in spool until restart. url=%s", t.Url)
+		} else {
+			Log.Errorf("http notify queue full, drop event. url=%s", t.Url)
+		}
+	}
+}
+
+func (h *HttpNotify) runWorker(w *notifyWorker) {
+	defer h.workerWg.Done()
+	for t := range w.queue {
+		h.deliver(t)
+	}
+}
+
+// deliver 失败后按照指数退避重试，重试次数用完后丢弃
+func (h *HttpNotify) deliver(t *notifyTask) {
+	if h.isAborted() {
+		h.abort(t)
+		return
+	}
+
+	interval := time.Duration(h.cfg.RetryIntervalMs) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := h.send(t.Url, t.Body)
+		if err == nil {
+			break
+		}
+		if attempt >= h.cfg.MaxRetries {
+			metrics.WebhookDropped.WithLabelValues(t.Url).Inc()
+			Log.Errorf("http notify post error, give up. err=%+v, url=%s, body=%s", err, t.Url, string(t.Body))
+			break
+		}
+		Log.Warnf("http notify post error, retry after %v. err=%+v, url=%s", interval, err, t.Url)
+
+		select {
+		case <-time.After(interval):
+		case <-h.disposeChan:
+			h.abort(t)
+			return
+		}
+		if interval *= 2; interval > maxNotifyRetryInterval {
+			interval = maxNotifyRetryInterval
+		}
+	}
+
+	if t.spoolFile != "" {
+		os.Remove(t.spoolFile)
+	}
+}
+
+func (h *HttpNotify) isAborted() bool {
+	select {
+	case <-h.disposeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// abort 退出时等待超时，不再发送，开启落盘时保留落盘文件下次启动再发送，否则丢弃
+func (h *HttpNotify) abort(t *notifyTask) {
+	h.spool(t)
+	if t.spoolFile == "" {
+		metrics.WebhookDropped.WithLabelValues(t.Url).Inc()
+		Log.Warnf("http notify disposed, drop event. url=%s", t.Url)
+	}
+}
+
+func (h *HttpNotify) send(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	h.sign(req, body)
+
+	resp, err := h.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		metrics.WebhookFailures.WithLabelValues(url).Inc()
+	}
+	return err
+}
+
+// sign 签名为 hex(hmac_sha256(sign_secret, "{timestamp}.{body}"))
+func (h *HttpNotify) sign(req *http.Request, body []byte) {
+	if h.cfg.SignSecret == "" {
+		return
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(h.cfg.SignSecret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	req.Header.Set(NotifyHeaderTimestamp, ts)
+	req.Header.Set(NotifyHeaderSignature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Dispose 停止接收新的事件，等待队列中的事件发送完成
+//
+// ctx超时后不再等待正在发送的请求，队列中剩余的事件同步写入落盘目录，没有开启落盘时丢弃
+func (h *HttpNotify) Dispose(ctx context.Context) {
+	if !h.cfg.Enable {
+		return
+	}
+
+	h.workerMutex.Lock()
+	if h.disposed {
+		h.workerMutex.Unlock()
+		return
+	}
+	h.disposed = true
+	workers := make([]*notifyWorker, 0, len(h.workers))
+	for _, w := range h.workers {
+		close(w.queue)
+		workers = append(workers, w)
+	}
+	h.workerMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.workerWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+		Log.Warn("http notify flush timeout")
+	}
+	close(h.disposeChan)
+
+	for _, w := range workers {
+		for t := range w.queue {
+			h.abort(t)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/q191201771/lal/pkg/base"
+	config "github.com/q191201771/lalmax/conf"
+)
+
+// failingServer 前failTimes次请求返回500，之后返回200，记录收到的body
+type failingServer struct {
+	*httptest.Server
+
+	failTimes int32
+	attempts  int32
+
+	mutex  sync.Mutex
+	bodies []string
+}
+
+func newFailingServer(failTimes int32) *failingServer {
+	s := &failingServer{failTimes: failTimes}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&s.attempts, 1) <= s.failTimes {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		s.mutex.Lock()
+		s.bodies = append(s.bodies, string(body))
+		s.mutex.Unlock()
+	}))
+	return s
+}
+
+func (s *failingServer) received() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+// newTestNotify 和启动流程一样先填充默认值再创建
+func newTestNotify(cfg config.HttpNotifyConfig) *HttpNotify {
+	c := config.Config{HttpNotifyConfig: cfg}
+	c.SetDefaults()
+	return NewHttpNotify(c.HttpNotifyConfig, "1")
+}
+
+func TestNotifySign(t *testing.T) {
+	body := []byte(`{"stream_name":"test110"}`)
+
+	testCases := []struct {
+		name   string
+		secret string
+	}{
+		{"no secret", ""},
+		{"with secret", "lalmaxnotifysecret"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestNotify(config.HttpNotifyConfig{SignSecret: tc.secret})
+			req := httptest.NewRequest(http.MethodPost, "/on_pub_start", nil)
+			h.sign(req, body)
+
+			ts := req.Header.Get(NotifyHeaderTimestamp)
+			signature := req.Header.Get(NotifyHeaderSignature)
+			if tc.secret == "" {
+				if ts != "" || signature != "" {
+					t.Fatalf("expect no signature, got ts:%s, signature:%s", ts, signature)
+				}
+				return
+			}
+
+			mac := hmac.New(sha256.New, []byte(tc.secret))
+			mac.Write([]byte(ts + "." + string(body)))
+			if expect := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != expect {
+				t.Fatalf("expect signature:%s, got:%s", expect, signature)
+			}
+		})
+	}
+}
+
+func TestNotifyDeliver(t *testing.T) {
+	testCases := []struct {
+		name           string
+		failTimes      int32
+		maxRetries     int
+		expectAttempts int32
+		expectReceived int
+	}{
+		{"success", 0, 3, 1, 1},
+		{"retry then success", 2, 3, 3, 1},
+		{"retry exhausted", 5, 2, 3, 0},
+		{"no retry", 1, -1, 1, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			svr := newFailingServer(tc.failTimes)
+			defer svr.Close()
+
+			spoolDir := t.TempDir()
+			h := newTestNotify(config.HttpNotifyConfig{
+				Enable:          true,
+				MaxRetries:      tc.maxRetries,
+				RetryIntervalMs: 1,
+				SpoolDir:        spoolDir,
+			})
+			h.deliver(&notifyTask{Url: svr.URL, Body: json.RawMessage(`{}`)})
+
+			if attempts := atomic.LoadInt32(&svr.attempts); attempts != tc.expectAttempts {
+				t.Fatalf("expect attempts:%d, got:%d", tc.expectAttempts, attempts)
+			}
+			if received := len(svr.received()); received != tc.expectReceived {
+				t.Fatalf("expect received:%d, got:%d", tc.expectReceived, received)
+			}
+			// 成功或者放弃之后都要删除落盘文件
+			if files, _ := filepath.Glob(filepath.Join(spoolDir, "*"+notifySpoolSuffix)); len(files) != 0 {
+				t.Fatalf("expect spool empty, got:%v", files)
+			}
+		})
+	}
+}
+
+func TestNotifySpoolReplay(t *testing.T) {
+	spoolDir := t.TempDir()
+	svr := newFailingServer(0)
+	defer svr.Close()
+
+	// 退出时没有发送成功的事件写入落盘目录
+	h := newTestNotify(config.HttpNotifyConfig{Enable: true, SpoolDir: spoolDir})
+	close(h.disposeChan)
+	for _, body := range []string{`{"seq":1}`, `{"seq":2}`, `{"seq":3}`} {
+		h.deliver(&notifyTask{Url: svr.URL, Body: json.RawMessage(body)})
+	}
+	files, _ := filepath.Glob(filepath.Join(spoolDir, "*"+notifySpoolSuffix))
+	if len(files) != 3 {
+		t.Fatalf("expect 3 spool files, got:%v", files)
+	}
+	if n := atomic.LoadInt32(&svr.attempts); n != 0 {
+		t.Fatalf("expect no attempt after dispose, got:%d", n)
+	}
+
+	// 重启后按顺序重新发送
+	h = newTestNotify(config.HttpNotifyConfig{Enable: true, SpoolDir: spoolDir})
+	h.Dispose(context.Background())
+
+	expect := []string{`{"seq":1}`, `{"seq":2}`, `{"seq":3}`}
+	received := svr.received()
+	if len(received) != len(expect) {
+		t.Fatalf("expect %v, got:%v", expect, received)
+	}
+	for i := range expect {
+		if received[i] != expect[i] {
+			t.Fatalf("expect %v, got:%v", expect, received)
+		}
+	}
+	if files, _ = filepath.Glob(filepath.Join(spoolDir, "*"+notifySpoolSuffix)); len(files) != 0 {
+		t.Fatalf("expect spool empty, got:%v", files)
+	}
+}
+
+func TestNotifyPerUrlOrder(t *testing.T) {
+	svr := newFailingServer(1)
+	defer svr.Close()
+
+	h := newTestNotify(config.HttpNotifyConfig{Enable: true, RetryIntervalMs: 1})
+	var expect []string
+	for i := 0; i < 20; i++ {
+		body, _ := json.Marshal(map[string]int{"seq": i})
+		expect = append(expect, string(body))
+		h.submit(svr.URL, map[string]int{"seq": i})
+	}
+	h.Dispose(context.Background())
+
+	received := svr.received()
+	if len(received) != len(expect) {
+		t.Fatalf("expect %d events, got:%d", len(expect), len(received))
+	}
+	for i := range expect {
+		if received[i] != expect[i] {
+			t.Fatalf("expect %v, got:%v", expect, received)
+		}
+	}
+}
+
+func TestNotifyAbortWithoutSpool(t *testing.T) {
+	// 一直失败并且没有落盘时，退出后不再重试
+	svr := newFailingServer(1 << 30)
+	defer svr.Close()
+
+	h := newTestNotify(config.HttpNotifyConfig{Enable: true, MaxRetries: 1000, RetryIntervalMs: 1000})
+	done := make(chan struct{})
+	go func() {
+		h.deliver(&notifyTask{Url: svr.URL, Body: json.RawMessage(`{}`)})
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(h.disposeChan)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("deliver not return after dispose")
+	}
+}
+
+func TestNotifyDisposeSpool(t *testing.T) {
+	// 回调地址一直无法访问
+	svr := newFailingServer(0)
+	url := svr.URL
+	svr.Close()
+
+	spoolDir := t.TempDir()
+	h := newTestNotify(config.HttpNotifyConfig{Enable: true, MaxRetries: 1000, RetryIntervalMs: 1000, SpoolDir: spoolDir})
+	for i := 0; i < 3; i++ {
+		h.submit(url, map[string]int{"seq": i})
+	}
+	// 入队时就已经落盘，进程异常退出也不会丢失
+	if files, _ := filepath.Glob(filepath.Join(spoolDir, "*"+notifySpoolSuffix)); len(files) != 3 {
+		t.Fatalf("expect 3 spool files after submit, got:%v", files)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	h.Dispose(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dispose not return after ctx done, elapsed:%v", elapsed)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(spoolDir, "*"+notifySpoolSuffix))
+	if len(files) != 3 {
+		t.Fatalf("expect 3 spool files after dispose, got:%v", files)
+	}
+	for i, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var task notifyTask
+		if err = json.Unmarshal(data, &task); err != nil || task.Url != url || string(task.Body) != fmt.Sprintf(`{"seq":%d}`, i) {
+			t.Fatalf("unexpected spool file:%s, err:%v", string(data), err)
+		}
+	}
+}
+
+func TestNativeNotifySyncPubStart(t *testing.T) {
+	svr := newFailingServer(0)
+	defer svr.Close()
+
+	h := newTestNotify(config.HttpNotifyConfig{
+		Enable:     true,
+		OnPubStart: svr.URL,
+		SyncEvents: []string{SyncEventOnPubStart},
+	})
+	h.initSync("")
+	n := nativeNotify{h}
+
+	var info base.PubStartInfo
+	info.StreamName = "test110"
+	if err := n.CheckPubStart(info); err != nil {
+		t.Fatal(err)
+	}
+	// 会话创建之后不再异步发送
+	n.OnPubStart(info)
+	h.Dispose(context.Background())
+
+	if received := svr.received(); len(received) != 1 {
+		t.Fatalf("expect 1 on_pub_start, got:%v", received)
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/q191201771/lalmax/hook"
+	"github.com/q191201771/lalmax/metrics"
+)
+
+var (
+	streamsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "streams"),
+		"Number of streams.", nil, nil)
+	publishersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "publishers"),
+		"Number of publishers by protocol.", []string{"protocol"}, nil)
+	subscribersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "subscribers"),
+		"Number of subscribers by protocol.", []string{"protocol"}, nil)
+	streamRecvBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "stream", "recv_bytes"),
+		"Bytes received by the current publisher or relay pull of the stream, resets when the publisher reconnects.", []string{"stream_name"}, nil)
+	streamSentBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "stream", "sent_bytes"),
+		"Bytes sent to the current subscribers of the stream, drops when a subscriber leaves.", []string{"stream_name"}, nil)
+	gopCacheGopsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "stream", "gop_cache_gops"),
+		"Number of GOPs in the gop cache.", []string{"stream_name"}, nil)
+	gopCacheFramesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "stream", "gop_cache_frames"),
+		"Number of frames in the gop cache.", []string{"stream_name"}, nil)
+	gbDevicesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "gb28181", "devices"),
+		"Number of GB28181 devices by status.", []string{"status"}, nil)
+	gbChannelsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "gb28181", "channels"),
+		"Number of GB28181 channels by status.", []string{"status"}, nil)
+)
+
+// statCollector 流、会话、gop缓存、国标设备等状态类的指标，在每次采集时统计
+type statCollector struct {
+	s *LalMaxServer
+}
+
+func (c statCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- streamsDesc
+	ch <- publishersDesc
+	ch <- subscribersDesc
+	ch <- streamRecvBytesDesc
+	ch <- streamSentBytesDesc
+	ch <- gopCacheGopsDesc
+	ch <- gopCacheFramesDesc
+	ch <- gbDevicesDesc
+	ch <- gbChannelsDesc
+}
+
+func (c statCollector) Collect(ch chan<- prometheus.Metric) {
+	groups := c.s.statAllGroup()
+	ch <- prometheus.MustNewConstMetric(streamsDesc, prometheus.GaugeValue, float64(len(groups)))
+
+	pubs := make(map[string]int)
+	subs := make(map[string]int)
+	for _, group := range groups {
+		var recv, sent uint64
+		if group.StatPub.SessionId != "" {
+			pubs[group.StatPub.Protocol]++
+			recv += group.StatPub.ReadBytesSum
+		}
+		if group.StatPull.SessionId != "" {
+			recv += group.StatPull.ReadBytesSum
+		}
+		for _, sub := range group.StatSubs {
+			subs[sub.Protocol]++
+			sent += sub.WroteBytesSum
+		}
+		// 只统计当前的会话，会话结束后会变小，所以是gauge而不是counter
+		ch <- prometheus.MustNewConstMetric(streamRecvBytesDesc, prometheus.GaugeValue, float64(recv), group.StreamName)
+		ch <- prometheus.MustNewConstMetric(streamSentBytesDesc, prometheus.GaugeValue, float64(sent), group.StreamName)
+
+		if exist, session := hook.GetHookSessionManagerInstance().GetHookSession(group.StreamName); exist {
+			gopNum, frameNum := session.GopCacheStat()
+			ch <- prometheus.MustNewConstMetric(gopCacheGopsDesc, prometheus.GaugeValue, float64(gopNum), group.StreamName)
+			ch <- prometheus.MustNewConstMetric(gopCacheFramesDesc, prometheus.GaugeValue, float64(frameNum), group.StreamName)
+		}
+	}
+	for protocol, n := range pubs {
+		ch <- prometheus.MustNewConstMetric(publishersDesc, prometheus.GaugeValue, float64(n), protocol)
+	}
+	for protocol, n := range subs {
+		ch <- prometheus.MustNewConstMetric(subscribersDesc, prometheus.GaugeValue, float64(n), protocol)
+	}
+
+	if c.s.gbsbr != nil {
+		devices, channels := c.s.gbsbr.StatStatus()
+		for status, n := range devices {
+			ch <- prometheus.MustNewConstMetric(gbDevicesDesc, prometheus.GaugeValue, float64(n), status)
+		}
+		for status, n := range channels {
+			ch <- prometheus.MustNewConstMetric(gbChannelsDesc, prometheus.GaugeValue, float64(n), status)
+		}
+	}
+}
+
+// metricsHandler 默认registry中是各个模块累加的事件指标以及go运行时指标，状态类的指标单独注册，避免创建多个server时重复注册
+func (s *LalMaxServer) metricsHandler() gin.HandlerFunc {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(statCollector{s: s})
+	handler := promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, registry}, promhttp.HandlerOpts{})
+	return gin.WrapH(handler)
+}
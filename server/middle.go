@@ -32,15 +32,17 @@ func (s *LalMaxServer) Cors() gin.HandlerFunc {
 	}
 }
 
+// unauthorizedResp 鉴权失败的响应，http status 为200，error_code 为401
+var unauthorizedResp = base.ApiRespBasic{
+	ErrorCode: http.StatusUnauthorized,
+	Desp:      http.StatusText(http.StatusUnauthorized),
+}
+
 // Authentication 接口鉴权
 func Authentication(secrets, ips []string) gin.HandlerFunc {
-	out := base.ApiRespBasic{
-		ErrorCode: http.StatusUnauthorized,
-		Desp:      http.StatusText(http.StatusUnauthorized),
-	}
 	return func(c *gin.Context) {
 		if !authentication(c.Query("token"), c.ClientIP(), secrets, ips) {
-			c.JSON(200, out)
+			c.AbortWithStatusJSON(http.StatusOK, unauthorizedResp)
 			return
 		}
 		c.Next()
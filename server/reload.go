@@ -0,0 +1,123 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/q191201771/lal/pkg/base"
+	config "github.com/q191201771/lalmax/conf"
+)
+
+// Reload 重新加载配置文件，可以热更新的配置项:
+//
+//	http_config.ctrl_auth_whitelist
+//	http_notify 中的回调地址
+//	hls_config 中的 segment_count、segment_duration、part_duration、viewer_timeout_sec、idle_timeout_sec
+//	hook_config 中的 gop_cache_num、single_gop_max_frame_num
+//
+// 其他配置项修改后需要重启才能生效；配置文件不合法时返回错误，继续使用原来的配置
+func (s *LalMaxServer) Reload() error {
+	newConf, err := config.Reload()
+	if err != nil {
+		Log.Errorf("reload config failed. err=%+v", err)
+		return err
+	}
+	s.applyConfig(newConf)
+	return nil
+}
+
+func (s *LalMaxServer) applyConfig(newConf *config.Config) {
+	s.confMutex.Lock()
+	s.conf.HttpConfig.CtrlAuthWhitelist = newConf.HttpConfig.CtrlAuthWhitelist
+
+	notify := &s.conf.HttpNotifyConfig
+	notify.OnServerStart = newConf.HttpNotifyConfig.OnServerStart
+	notify.OnUpdate = newConf.HttpNotifyConfig.OnUpdate
+	notify.OnPubStart = newConf.HttpNotifyConfig.OnPubStart
+	notify.OnPubStop = newConf.HttpNotifyConfig.OnPubStop
+	notify.OnSubStart = newConf.HttpNotifyConfig.OnSubStart
+	notify.OnSubStop = newConf.HttpNotifyConfig.OnSubStop
+	notify.OnRelayPullStart = newConf.HttpNotifyConfig.OnRelayPullStart
+	notify.OnRelayPullStop = newConf.HttpNotifyConfig.OnRelayPullStop
+	notify.OnRtmpConnect = newConf.HttpNotifyConfig.OnRtmpConnect
+	notify.OnHlsMakeTs = newConf.HttpNotifyConfig.OnHlsMakeTs
+	notify.OnGbAlarm = newConf.HttpNotifyConfig.OnGbAlarm
+
+	hls := &s.conf.HlsConfig
+	hls.SegmentCount = newConf.HlsConfig.SegmentCount
+	hls.SegmentDuration = newConf.HlsConfig.SegmentDuration
+	hls.PartDuration = newConf.HlsConfig.PartDuration
+	hls.ViewerTimeoutSec = newConf.HlsConfig.ViewerTimeoutSec
+	hls.IdleTimeoutSec = newConf.HlsConfig.IdleTimeoutSec
+
+	s.conf.HookConfig.GopCacheNum = newConf.HookConfig.GopCacheNum
+	s.conf.HookConfig.SingleGopMaxFrameNum = newConf.HookConfig.SingleGopMaxFrameNum
+
+	changed := changedFields(*s.conf, *newConf)
+	notifyConf := *notify
+	hlsConf := *hls
+	s.confMutex.Unlock()
+
+	s.notifyHandler.UpdateUrls(notifyConf)
+	if s.hlssvr != nil {
+		s.hlssvr.UpdateConfig(hlsConf)
+	}
+
+	if len(changed) > 0 {
+		Log.Warnf("reload config, these fields changed but need restart to take effect: %s", strings.Join(changed, ", "))
+	}
+	Log.Info("reload config succ")
+}
+
+// changedFields 返回值不同的配置项的json名字，只比较到第二层
+func changedFields(a, b config.Config) (out []string) {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	t := va.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		fa, fb := va.Field(i), vb.Field(i)
+		if reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			continue
+		}
+		if fa.Kind() != reflect.Struct {
+			out = append(out, name)
+			continue
+		}
+		ft := fa.Type()
+		for j := 0; j < ft.NumField(); j++ {
+			if !reflect.DeepEqual(fa.Field(j).Interface(), fb.Field(j).Interface()) {
+				out = append(out, name+"."+strings.Split(ft.Field(j).Tag.Get("json"), ",")[0])
+			}
+		}
+	}
+	return
+}
+
+// ctrlAuthentication 控制类接口的鉴权，白名单可以热更新
+func (s *LalMaxServer) ctrlAuthentication() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s.confMutex.RLock()
+		whitelist := s.conf.HttpConfig.CtrlAuthWhitelist
+		s.confMutex.RUnlock()
+		if !authentication(c.Query("token"), c.ClientIP(), whitelist.Secrets, whitelist.IPs) {
+			c.AbortWithStatusJSON(http.StatusOK, unauthorizedResp)
+			return
+		}
+		c.Next()
+	}
+}
+
+func (s *LalMaxServer) ctrlReloadConfigHandler(c *gin.Context) {
+	var v base.ApiRespBasic
+	if err := s.Reload(); err != nil {
+		v.ErrorCode = ErrorCodeReloadConfig
+		v.Desp = DespReloadConfig + ": " + err.Error()
+		c.JSON(http.StatusOK, v)
+		return
+	}
+	v.ErrorCode = base.ErrorCodeSucc
+	v.Desp = base.DespSucc
+	c.JSON(http.StatusOK, v)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	config "github.com/q191201771/lalmax/conf"
+)
+
+func TestChangedFields(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(c *config.Config)
+		expect []string
+	}{
+		{"no change", func(c *config.Config) {}, nil},
+		{"top level field", func(c *config.Config) { c.ServerId = "2" }, []string{"server_id"}},
+		{"nested field", func(c *config.Config) { c.SrtConfig.Addr = ":6002" }, []string{"srt_config.addr"}},
+		{"multiple fields", func(c *config.Config) {
+			c.HttpConfig.ListenAddr = ":8080"
+			c.HttpConfig.TrustedProxies = []string{"127.0.0.1"}
+			c.RtcConfig.WriteChanSize = 2048
+		}, []string{"rtc_config.write_chan_size", "http_config.http_listen_addr", "http_config.trusted_proxies"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var a config.Config
+			a.SetDefaults()
+			b := a
+			tc.modify(&b)
+			if out := changedFields(a, b); !reflect.DeepEqual(out, tc.expect) {
+				t.Fatalf("expect %v, got:%v", tc.expect, out)
+			}
+		})
+	}
+}
+
+func TestReloadConfigAuthentication(t *testing.T) {
+	setCtrlSecrets(t, "ctrl-token")
+	expectUnauthorized(t, "POST", "/api/ctrl/reload_config", "")
+	expectUnauthorized(t, "POST", "/api/ctrl/reload_config?token=wrong", "")
+}
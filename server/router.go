@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"time"
+
+	"github.com/q191201771/lalmax/auth"
 
 	"github.com/q191201771/lalmax/hook"
 
@@ -41,6 +44,8 @@ func (s *LalMaxServer) InitRouter(router *gin.Engine) {
 
 	// hls-fmp4/llhls
 	router.GET("/live/hls/:streamid/:type", s.HandleHls)
+	// hls-ts
+	router.GET("/live/hls-ts/:streamid/:type", s.HandleHlsTs)
 
 	// onvif
 	router.POST("/api/ctrl/onvif/pull", s.HandleOnvifPull)
@@ -51,6 +56,21 @@ func (s *LalMaxServer) InitRouter(router *gin.Engine) {
 	gb.GET("/device_infos", gbLogic.GetDeviceInfos)
 	gb.POST("/start_play", gbLogic.StartPlay)
 	gb.POST("/stop_play", gbLogic.StopPlay)
+	gb.POST("/record_info", gbLogic.RecordInfo)
+	gb.POST("/start_playback", gbLogic.StartPlayback)
+	gb.POST("/playback_pause", gbLogic.PlaybackPause)
+	gb.POST("/playback_resume", gbLogic.PlaybackResume)
+	gb.POST("/playback_seek", gbLogic.PlaybackSeek)
+	gb.POST("/playback_speed", gbLogic.PlaybackSpeed)
+	gb.GET("/cascades", gbLogic.Cascades)
+	gb.GET("/alarms", gbLogic.Alarms)
+	gb.GET("/alarm_subscriptions", gbLogic.AlarmSubscriptions)
+	gb.POST("/alarm_subscribe", gbLogic.AlarmSubscribe)
+	gb.GET("/subscriptions", gbLogic.Subscriptions)
+	gb.POST("/catalog_subscribe", gbLogic.CatalogSubscribe)
+	gb.POST("/position_subscribe", gbLogic.PositionSubscribe)
+	gb.GET("/positions", gbLogic.Positions)
+	gb.GET("/position_history", gbLogic.PositionHistory)
 	gb.POST("/update_all_notify", gbLogic.UpdateAllNotify)
 	gb.POST("/update_notify", gbLogic.UpdateNotify)
 	gb.POST("/ptz_direction", gbLogic.PtzDirection)
@@ -59,19 +79,40 @@ func (s *LalMaxServer) InitRouter(router *gin.Engine) {
 	gb.POST("/ptz_preset", gbLogic.PtzPreset)
 	gb.POST("/ptz_stop", gbLogic.PtzStop)
 
-	auth := Authentication(s.conf.HttpConfig.CtrlAuthWhitelist.Secrets, s.conf.HttpConfig.CtrlAuthWhitelist.IPs)
+	auth := s.ctrlAuthentication()
+	// gb 管理类接口，和 /api/ctrl 一样需要鉴权
+	gbCtrl := router.Group("/api/gb", auth)
+	gbCtrl.POST("/start_download", gbLogic.StartDownload)
+	gbCtrl.POST("/stop_download", gbLogic.StopDownload)
+	gbCtrl.GET("/download_jobs", gbLogic.DownloadJobs)
+	gbCtrl.POST("/start_broadcast", gbLogic.StartBroadcast)
+	gbCtrl.POST("/stop_broadcast", gbLogic.StopBroadcast)
+	gbCtrl.GET("/broadcasts", gbLogic.Broadcasts)
+	gbCtrl.GET("/register_bans", gbLogic.RegisterBans)
+	gbCtrl.POST("/clear_register_ban", gbLogic.ClearRegisterBan)
+	gbCtrl.POST("/alarm_reset", gbLogic.AlarmReset)
+
 	// stat
 	stat := router.Group("/api/stat", auth)
 	stat.GET("/group", s.statGroupHandler)
 	stat.GET("/all_group", s.statAllGroupHandler)
 	stat.GET("/lal_info", s.statLalInfoHandler)
 
+	// prometheus
+	if s.conf.MetricsConfig.Enable {
+		router.GET("/metrics", auth, s.metricsHandler())
+	}
+
 	// ctrl
 	ctrl := router.Group("/api/ctrl", auth)
 	ctrl.POST("/start_relay_pull", s.ctrlStartRelayPullHandler)
 	ctrl.POST("/stop_relay_pull", s.ctrlStopRelayPullHandler)
 	ctrl.POST("/kick_session", s.ctrlKickSessionHandler)
 	ctrl.POST("/start_rtp_pub", s.ctrlStartRtpPubHandler)
+	ctrl.POST("/set_hls_abr_group", s.ctrlSetHlsAbrGroupHandler)
+	ctrl.POST("/del_hls_abr_group", s.ctrlDelHlsAbrGroupHandler)
+	ctrl.POST("/sign_play_url", s.ctrlSignPlayUrlHandler)
+	ctrl.POST("/reload_config", s.ctrlReloadConfigHandler)
 }
 
 func (s *LalMaxServer) HandleWHIP(c *gin.Context) {
@@ -119,6 +160,15 @@ func (s *LalMaxServer) HandleHls(c *gin.Context) {
 	}
 }
 
+func (s *LalMaxServer) HandleHlsTs(c *gin.Context) {
+	if s.hlssvr != nil {
+		s.hlssvr.HandleTsRequest(c)
+	} else {
+		nazalog.Error("hls is disable")
+		c.Status(http.StatusNotFound)
+	}
+}
+
 func (s *LalMaxServer) HandleHttpFmp4(c *gin.Context) {
 	if s.httpfmp4svr != nil {
 		s.httpfmp4svr.HandleRequest(c)
@@ -154,6 +204,9 @@ func (s *LalMaxServer) statGroupHandler(c *gin.Context) {
 	if exist {
 		v.Data.StatSubs = append(v.Data.StatSubs, session.GetAllConsumer()...)
 	}
+	if s.hlssvr != nil {
+		v.Data.StatSubs = append(v.Data.StatSubs, s.hlssvr.GetAllViewers(streamName)...)
+	}
 	v.ErrorCode = base.ErrorCodeSucc
 	v.Desp = base.DespSucc
 	c.JSON(http.StatusOK, v)
@@ -163,15 +216,23 @@ func (s *LalMaxServer) statAllGroupHandler(c *gin.Context) {
 	var out base.ApiStatAllGroupResp
 	out.ErrorCode = base.ErrorCodeSucc
 	out.Desp = base.DespSucc
+	out.Data.Groups = s.statAllGroup()
+	c.JSON(http.StatusOK, out)
+}
+
+// statAllGroup lal的流信息，加上lalmax自己接入的拉流
+func (s *LalMaxServer) statAllGroup() []base.StatGroup {
 	groups := s.lalsvr.StatAllGroup()
 	for i, group := range groups {
 		exist, session := hook.GetHookSessionManagerInstance().GetHookSession(group.StreamName)
 		if exist {
 			groups[i].StatSubs = append(groups[i].StatSubs, session.GetAllConsumer()...)
 		}
+		if s.hlssvr != nil {
+			groups[i].StatSubs = append(groups[i].StatSubs, s.hlssvr.GetAllViewers(group.StreamName)...)
+		}
 	}
-	out.Data.Groups = groups
-	c.JSON(http.StatusOK, out)
+	return groups
 }
 
 func (s *LalMaxServer) statLalInfoHandler(c *gin.Context) {
@@ -272,6 +333,78 @@ func (s *LalMaxServer) ctrlStartRtpPubHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
+const (
+	ErrorCodeHlsDisable = 2003
+	DespHlsDisable      = "hls is disable"
+
+	ErrorCodeSignDisable = 2004
+	DespSignDisable      = "sign secret is not configured"
+
+	ErrorCodeReloadConfig = 2005
+	DespReloadConfig      = "reload config failed"
+)
+
+type ApiCtrlHlsAbrGroupReq struct {
+	GroupName   string   `json:"group_name"`
+	StreamNames []string `json:"stream_names"`
+}
+
+func (s *LalMaxServer) ctrlSetHlsAbrGroupHandler(c *gin.Context) {
+	var v base.ApiRespBasic
+	var info ApiCtrlHlsAbrGroupReq
+
+	_, err := unmarshalRequestJSONBody(c.Request, &info, "group_name", "stream_names")
+	if err != nil || info.GroupName == "" || len(info.StreamNames) == 0 {
+		Log.Warnf("http api set hls abr group error. err=%+v", err)
+		v.ErrorCode = base.ErrorCodeParamMissing
+		v.Desp = base.DespParamMissing
+		c.JSON(http.StatusOK, v)
+		return
+	}
+
+	if s.hlssvr == nil {
+		v.ErrorCode = ErrorCodeHlsDisable
+		v.Desp = DespHlsDisable
+		c.JSON(http.StatusOK, v)
+		return
+	}
+
+	Log.Infof("http api set hls abr group. req info=%+v", info)
+
+	s.hlssvr.SetAbrGroup(info.GroupName, info.StreamNames)
+	v.ErrorCode = base.ErrorCodeSucc
+	v.Desp = base.DespSucc
+	c.JSON(http.StatusOK, v)
+}
+
+func (s *LalMaxServer) ctrlDelHlsAbrGroupHandler(c *gin.Context) {
+	var v base.ApiRespBasic
+	var info ApiCtrlHlsAbrGroupReq
+
+	_, err := unmarshalRequestJSONBody(c.Request, &info, "group_name")
+	if err != nil {
+		Log.Warnf("http api del hls abr group error. err=%+v", err)
+		v.ErrorCode = base.ErrorCodeParamMissing
+		v.Desp = base.DespParamMissing
+		c.JSON(http.StatusOK, v)
+		return
+	}
+
+	if s.hlssvr == nil {
+		v.ErrorCode = ErrorCodeHlsDisable
+		v.Desp = DespHlsDisable
+		c.JSON(http.StatusOK, v)
+		return
+	}
+
+	Log.Infof("http api del hls abr group. req info=%+v", info)
+
+	s.hlssvr.DelAbrGroup(info.GroupName)
+	v.ErrorCode = base.ErrorCodeSucc
+	v.Desp = base.DespSucc
+	c.JSON(http.StatusOK, v)
+}
+
 func unmarshalRequestJSONBody(r *http.Request, info interface{}, keyFieldList ...string) (nazajson.Json, error) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -290,3 +423,52 @@ func unmarshalRequestJSONBody(r *http.Request, info interface{}, keyFieldList ..
 
 	return j, json.Unmarshal(body, info)
 }
+
+type ApiCtrlSignPlayUrlReq struct {
+	StreamName string `json:"stream_name"`
+	ExpireSec  int64  `json:"expire_sec"`
+	ClientIp   string `json:"client_ip"`
+	Action     string `json:"action"` // sub或者pub，默认sub
+}
+
+type ApiCtrlSignPlayUrlResp struct {
+	base.ApiRespBasic
+	Data struct {
+		Expire int64  `json:"expire"`
+		Sign   string `json:"sign"`
+		Query  string `json:"query"`
+	} `json:"data"`
+}
+
+func (s *LalMaxServer) ctrlSignPlayUrlHandler(c *gin.Context) {
+	var v ApiCtrlSignPlayUrlResp
+	var info ApiCtrlSignPlayUrlReq
+
+	_, err := unmarshalRequestJSONBody(c.Request, &info, "stream_name", "expire_sec")
+	if info.Action == "" {
+		info.Action = auth.ActionSub
+	}
+	if err != nil || info.StreamName == "" || info.ExpireSec <= 0 ||
+		(info.Action != auth.ActionSub && info.Action != auth.ActionPub) {
+		Log.Warnf("http api sign play url error. err=%+v", err)
+		v.ErrorCode = base.ErrorCodeParamMissing
+		v.Desp = base.DespParamMissing
+		c.JSON(http.StatusOK, v)
+		return
+	}
+
+	secret := s.conf.AuthConfig.SignSecret
+	if secret == "" {
+		v.ErrorCode = ErrorCodeSignDisable
+		v.Desp = DespSignDisable
+		c.JSON(http.StatusOK, v)
+		return
+	}
+
+	v.Data.Expire = time.Now().Unix() + info.ExpireSec
+	v.Data.Sign = auth.Sign(secret, info.Action, info.StreamName, v.Data.Expire, info.ClientIp)
+	v.Data.Query = auth.SignQuery(secret, info.Action, info.StreamName, v.Data.Expire, info.ClientIp).Encode()
+	v.ErrorCode = base.ErrorCodeSucc
+	v.Desp = base.DespSucc
+	c.JSON(http.StatusOK, v)
+}
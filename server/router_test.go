@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -24,6 +25,7 @@ func TestMain(m *testing.M) {
 	var err error
 	max, err = NewLalMaxServer(&config.Config{
 		HttpFmp4Config:   config.HttpFmp4Config{Enable: true},
+		MetricsConfig:    config.MetricsConfig{Enable: true},
 		LalSvrConfigPath: "../conf/lalserver.conf.json",
 		HttpConfig: config.HttpConfig{
 			ListenAddr: ":52349",
@@ -68,7 +70,7 @@ func TestAllGroup(t *testing.T) {
 
 	t.Run("has consumer", func(t *testing.T) {
 		ss := hook.NewHookSession("test", "test", max.hlssvr, 1, 0)
-		ss.AddConsumer("consumer1", nil)
+		ss.AddConsumer("consumer1", nil, hook.SessionInfo{})
 		hook.GetHookSessionManagerInstance().SetHookSession("test", ss)
 
 		r := httptest.NewRecorder()
@@ -101,7 +103,7 @@ func TestNotifyUpdate(t *testing.T) {
 		t.Fatal(err)
 	}
 	ss := hook.NewHookSession("test", "test", max.hlssvr, 1, 0)
-	ss.AddConsumer("consumer1", nil)
+	ss.AddConsumer("consumer1", nil, hook.SessionInfo{})
 	hook.GetHookSessionManagerInstance().SetHookSession("test", ss)
 
 	http.HandleFunc("/on_update", func(w http.ResponseWriter, r *http.Request) {
@@ -156,3 +158,90 @@ func TestAuthentication(t *testing.T) {
 		}
 	})
 }
+
+// setCtrlSecrets 设置控制类接口的鉴权秘钥，测试结束后恢复
+func setCtrlSecrets(t *testing.T, secrets ...string) {
+	max.confMutex.Lock()
+	old := max.conf.HttpConfig.CtrlAuthWhitelist
+	max.conf.HttpConfig.CtrlAuthWhitelist = config.CtrlAuthWhitelist{Secrets: secrets}
+	max.confMutex.Unlock()
+	t.Cleanup(func() {
+		max.confMutex.Lock()
+		max.conf.HttpConfig.CtrlAuthWhitelist = old
+		max.confMutex.Unlock()
+	})
+}
+
+// expectUnauthorized 请求未通过鉴权时只能返回401，不能再执行后面的handler
+func expectUnauthorized(t *testing.T, method, url, body string) {
+	r := httptest.NewRecorder()
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	max.router.ServeHTTP(r, req)
+	var out base.ApiRespBasic
+	if err := json.Unmarshal(r.Body.Bytes(), &out); err != nil {
+		t.Fatalf("expect only 401 response, got:%s", r.Body.String())
+	}
+	if out.ErrorCode != http.StatusUnauthorized {
+		t.Fatalf("expect error_code 401, got:%s", r.Body.String())
+	}
+}
+
+func TestCtrlAuthentication(t *testing.T) {
+	setCtrlSecrets(t, "ctrl-token")
+
+	t.Run("sign_play_url", func(t *testing.T) {
+		expectUnauthorized(t, "POST", "/api/ctrl/sign_play_url", `{"stream_name":"test","expire_sec":60}`)
+		expectUnauthorized(t, "POST", "/api/ctrl/sign_play_url?token=wrong", `{"stream_name":"test","expire_sec":60}`)
+	})
+
+	t.Run("token ok", func(t *testing.T) {
+		r := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/api/stat/all_group?token=ctrl-token", nil)
+		max.router.ServeHTTP(r, req)
+		var out base.ApiStatAllGroupResp
+		if err := json.Unmarshal(r.Body.Bytes(), &out); err != nil || out.ErrorCode != base.ErrorCodeSucc {
+			t.Fatalf("expect succ, got:%s", r.Body.String())
+		}
+	})
+}
+
+func TestMetricsAuthentication(t *testing.T) {
+	setCtrlSecrets(t, "ctrl-token")
+	expectUnauthorized(t, "GET", "/metrics", "")
+
+	r := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics?token=ctrl-token", nil)
+	max.router.ServeHTTP(r, req)
+	if r.Code != http.StatusOK || !strings.Contains(r.Body.String(), "lalmax_streams") {
+		t.Fatalf("expect metrics, got:%d %s", r.Code, r.Body.String())
+	}
+}
+
+func TestHlsAbrGroupAuthentication(t *testing.T) {
+	setCtrlSecrets(t, "ctrl-token")
+	expectUnauthorized(t, "POST", "/api/ctrl/set_hls_abr_group", `{"group_name":"cam1","stream_names":["cam1_1080","cam1_720"]}`)
+	expectUnauthorized(t, "POST", "/api/ctrl/del_hls_abr_group", `{"group_name":"cam1"}`)
+}
+
+func TestGbCtrlAuthentication(t *testing.T) {
+	setCtrlSecrets(t, "ctrl-token")
+	testCases := []struct {
+		method string
+		url    string
+	}{
+		{"GET", "/api/gb/register_bans"},
+		{"POST", "/api/gb/clear_register_ban"},
+		{"POST", "/api/gb/start_download"},
+		{"POST", "/api/gb/stop_download"},
+		{"GET", "/api/gb/download_jobs"},
+		{"POST", "/api/gb/start_broadcast"},
+		{"POST", "/api/gb/stop_broadcast"},
+		{"GET", "/api/gb/broadcasts"},
+		{"POST", "/api/gb/alarm_reset"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.url, func(t *testing.T) {
+			expectUnauthorized(t, tc.method, tc.url, `{"device_id":"34020000001320000001"}`)
+		})
+	}
+}
@@ -3,7 +3,10 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"github.com/q191201771/lalmax/auth"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/q191201771/lalmax/srt"
 
@@ -40,45 +43,77 @@ type LalMaxServer struct {
 	gbsbr       *gb28181.GB28181Server
 	onvifsvr    *onvif.OnvifServer
 	roomsvr     *room.RoomServer
+
+	notifyHandler *HttpNotify
+	httpSrv       *http.Server
+	httpsSrv      *http.Server
+	cancel        context.CancelFunc
+	disposeOnce   sync.Once
+
+	confMutex sync.RWMutex // 保护可以热更新的配置项
 }
 
 func NewLalMaxServer(conf *config.Config) (*LalMaxServer, error) {
+	conf.SetDefaults()
+	notifyHandler := NewHttpNotify(conf.HttpNotifyConfig, conf.ServerId)
+	syncAuth := notifyHandler.initSync(conf.LalSvrConfigPath)
 	lalsvr := logic.NewLalServer(func(option *logic.Option) {
 		option.ConfFilename = conf.LalSvrConfigPath
-		option.NotifyHandler = NewHttpNotify(conf.HttpNotifyConfig, conf.ServerId)
+		option.NotifyHandler = notifyHandler
+		if syncAuth != nil {
+			option.Authentication = syncAuth
+		}
 	})
 
+	// lalmax自己接入的推拉流不经过lal，由hook层发送通知
+	hook.GetHookSessionManagerInstance().SetNotifyHandler(nativeNotify{notifyHandler})
+	pubManager := hook.NewPubSessionManager(lalsvr, conf.HookConfig.RepublishPolicy)
+	authenticator := auth.NewAuthenticator(conf.AuthConfig)
+
 	maxsvr := &LalMaxServer{
-		lalsvr: lalsvr,
-		conf:   conf,
+		lalsvr:        lalsvr,
+		conf:          conf,
+		notifyHandler: notifyHandler,
 	}
 
 	if conf.SrtConfig.Enable {
-		maxsvr.srtsvr = srt.NewSrtServer(conf.SrtConfig.Addr, lalsvr, func(option *srt.SrtOption) {
-			option.Latency = 300
-			option.PeerLatency = 300
+		maxsvr.srtsvr = srt.NewSrtServer(conf.SrtConfig.Addr, lalsvr, pubManager, func(option *srt.SrtOption) {
+			option.Latency = conf.SrtConfig.Latency
+			option.RecvLatency = conf.SrtConfig.RecvLatency
+			option.PeerLatency = conf.SrtConfig.PeerLatency
 		})
+		maxsvr.srtsvr.SetAuthenticator(authenticator)
 	}
 
 	if conf.RtcConfig.Enable {
 		var err error
-		maxsvr.rtcsvr, err = rtc.NewRtcServer(conf.RtcConfig, lalsvr)
+		maxsvr.rtcsvr, err = rtc.NewRtcServer(conf.RtcConfig, lalsvr, pubManager)
 		if err != nil {
 			nazalog.Error("create rtc svr failed, err:", err)
 			return nil, err
 		}
+		maxsvr.rtcsvr.SetAuthenticator(authenticator)
 	}
 
 	if conf.HttpFmp4Config.Enable {
 		maxsvr.httpfmp4svr = httpfmp4.NewHttpFmp4Server()
+		maxsvr.httpfmp4svr.SetAuthenticator(authenticator)
 	}
 
 	if conf.HlsConfig.Enable {
 		maxsvr.hlssvr = hls.NewHlsServer(conf.HlsConfig)
+		maxsvr.hlssvr.SetNotifyHandler(nativeNotify{notifyHandler})
+		maxsvr.hlssvr.SetStreamSource(hlsStreamSource{})
+		maxsvr.hlssvr.SetAuthenticator(authenticator)
+		if conf.AuthConfig.SubMethod == auth.MethodSign {
+			maxsvr.hlssvr.SetSignSecret(conf.AuthConfig.SignSecret)
+		}
+		notifyHandler.SetHlsServer(maxsvr.hlssvr)
 	}
 
 	if conf.GB28181Config.Enable {
 		maxsvr.gbsbr = gb28181.NewGB28181Server(conf.GB28181Config, lalsvr)
+		maxsvr.gbsbr.SetNotifyHandler(nativeNotify{notifyHandler})
 	}
 
 	if conf.OnvifConfig.Enable {
@@ -90,9 +125,16 @@ func NewLalMaxServer(conf *config.Config) (*LalMaxServer, error) {
 	}
 
 	maxsvr.router = gin.Default()
+	// 签名url绑定ip和控制接口白名单都依赖客户端ip，只信任配置的代理发送的X-Forwarded-For
+	if err := maxsvr.router.SetTrustedProxies(conf.HttpConfig.TrustedProxies); err != nil {
+		return nil, err
+	}
 	maxsvr.InitRouter(maxsvr.router)
 	if conf.HttpConfig.EnableHttps {
 		maxsvr.routerTls = gin.Default()
+		if err := maxsvr.routerTls.SetTrustedProxies(conf.HttpConfig.TrustedProxies); err != nil {
+			return nil, err
+		}
 		maxsvr.InitRouter(maxsvr.routerTls)
 	}
 
@@ -102,28 +144,33 @@ func NewLalMaxServer(conf *config.Config) (*LalMaxServer, error) {
 func (s *LalMaxServer) Run() (err error) {
 	s.lalsvr.WithOnHookSession(func(uniqueKey string, streamName string) logic.ICustomizeHookSessionContext {
 		// 有新的流了，创建业务层的对象，用于hook这个流
-		return hook.NewHookSession(uniqueKey, streamName, s.hlssvr, s.conf.HookConfig.GopCacheNum, s.conf.HookConfig.SingleGopMaxFrameNum)
+		s.confMutex.RLock()
+		hookConf := s.conf.HookConfig
+		s.confMutex.RUnlock()
+		return hook.NewHookSession(uniqueKey, streamName, s.hlssvr, hookConf.GopCacheNum, hookConf.SingleGopMaxFrameNum)
 	})
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	s.cancel = cancel
 
 	if s.srtsvr != nil {
 		go s.srtsvr.Run(ctx)
 	}
 
+	s.httpSrv = &http.Server{Addr: s.conf.HttpConfig.ListenAddr, Handler: s.router}
 	go func() {
 		nazalog.Infof("lalmax http listen. addr=%s", s.conf.HttpConfig.ListenAddr)
-		if err = s.router.Run(s.conf.HttpConfig.ListenAddr); err != nil {
+		if err := s.httpSrv.ListenAndServe(); err != nil {
 			nazalog.Infof("lalmax http stop. addr=%s", s.conf.HttpConfig.ListenAddr)
 		}
 	}()
 
 	if s.conf.HttpConfig.EnableHttps {
-		server := &http.Server{Addr: s.conf.HttpConfig.HttpsListenAddr, Handler: s.routerTls, TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){}}
+		s.httpsSrv = &http.Server{Addr: s.conf.HttpConfig.HttpsListenAddr, Handler: s.routerTls, TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){}}
 		go func() {
 			nazalog.Infof("lalmax https listen. addr=%s", s.conf.HttpConfig.HttpsListenAddr)
-			if err = server.ListenAndServeTLS(s.conf.HttpConfig.HttpsCertFile, s.conf.HttpConfig.HttpsKeyFile); err != nil {
+			if err := s.httpsSrv.ListenAndServeTLS(s.conf.HttpConfig.HttpsCertFile, s.conf.HttpConfig.HttpsKeyFile); err != nil {
 				nazalog.Infof("lalmax https stop. addr=%s", s.conf.HttpConfig.ListenAddr)
 			}
 		}()
@@ -139,3 +186,93 @@ func (s *LalMaxServer) Run() (err error) {
 
 	return s.lalsvr.RunLoop()
 }
+
+// Dispose 优雅退出，停止接收新的请求，关闭所有推拉流，让 Run 返回，最后发送完剩余的通知
+//
+// 各个模块在 shutdown_timeout_sec 内没有关闭完成时不再等待，可以在 Run 返回后再次调用，等待退出流程结束
+func (s *LalMaxServer) Dispose() {
+	s.disposeOnce.Do(func() {
+		timeout := time.Duration(s.conf.ShutdownTimeoutSec) * time.Second
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		done := make(chan struct{})
+		go func() {
+			s.dispose(ctx)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			nazalog.Warnf("lalmax dispose timeout. timeout=%v", timeout)
+		}
+		s.lalsvr.Dispose()
+
+		// 包括上面关闭推拉流产生的on_pub_stop/on_sub_stop，和上面共用同一个超时时间，超时后剩余的事件写入落盘目录
+		s.notifyHandler.Dispose(ctx)
+		nazalog.Info("lalmax dispose done")
+	})
+}
+
+func (s *LalMaxServer) dispose(ctx context.Context) {
+	// 先停止接收新的http请求，已经建立的长连接(http-fmp4等)在关闭流时断开
+	var wg sync.WaitGroup
+	for _, srv := range []*http.Server{s.httpSrv, s.httpsSrv} {
+		if srv == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				nazalog.Warnf("lalmax http shutdown failed. addr=%s, err=%+v", srv.Addr, err)
+			}
+		}(srv)
+	}
+
+	if s.srtsvr != nil {
+		s.srtsvr.Dispose()
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	if s.rtcsvr != nil {
+		s.rtcsvr.Dispose()
+	}
+
+	// 给正在播放的国标通道发送BYE
+	if s.gbsbr != nil {
+		s.gbsbr.Dispose()
+	}
+
+	if s.roomsvr != nil {
+		s.roomsvr.Stop()
+	}
+
+	wg.Wait()
+}
+
+// hlsStreamSource 按需模式下hls muxer从hook session订阅数据，订阅时会先下发gop缓存
+type hlsStreamSource struct{}
+
+func (hlsStreamSource) AddConsumer(streamName, consumerId string, subscriber hls.IStreamSubscriber) bool {
+	ok, session := hook.GetHookSessionManagerInstance().GetHookSession(streamName)
+	if !ok {
+		return false
+	}
+	session.AddInnerConsumer(consumerId, subscriber)
+	return true
+}
+
+func (hlsStreamSource) StreamNames() []string {
+	return hook.GetHookSessionManagerInstance().StreamNames()
+}
+
+func (hlsStreamSource) RemoveConsumer(streamName, consumerId string) {
+	ok, session := hook.GetHookSessionManagerInstance().GetHookSession(streamName)
+	if ok {
+		session.RemoveConsumer(consumerId)
+	}
+}
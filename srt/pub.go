@@ -1,109 +1,293 @@
 package srt
 
 import (
-	"bufio"
 	"context"
+
 	srt "github.com/datarhei/gosrt"
 	"github.com/q191201771/lal/pkg/aac"
 	"github.com/q191201771/lal/pkg/base"
-	"github.com/q191201771/lal/pkg/logic"
+	"github.com/q191201771/lal/pkg/rtmp"
+	"github.com/q191201771/lalmax/hook"
 	"github.com/q191201771/naza/pkg/nazalog"
 	codec "github.com/yapingcat/gomedia/go-codec"
 	ts "github.com/yapingcat/gomedia/go-mpeg2"
 )
 
 type Publisher struct {
-	ctx         context.Context
-	srv         *SrtServer
-	ss          logic.ICustomizePubSessionContext
-	streamName  string
-	demuxer     *ts.TSDemuxer
-	conn        srt.Conn
-	subscribers []*Subscriber
+	ctx           context.Context
+	srv           *SrtServer
+	ss            *hook.PubSession
+	streamName    string
+	programNumber uint16
+	demuxer       *ts.TSDemuxer
+	conn          srt.Conn
+	subscribers   []*Subscriber
+
+	timestamp  timestampFixer
+	foundAudio bool
 }
 
-func NewPublisher(ctx context.Context, conn srt.Conn, streamName string, srv *SrtServer) *Publisher {
+func NewPublisher(ctx context.Context, conn srt.Conn, streamName string, programNumber uint16, srv *SrtServer) *Publisher {
 	pub := &Publisher{
-		ctx:        ctx,
-		srv:        srv,
-		streamName: streamName,
-		conn:       conn,
-		demuxer:    ts.NewTSDemuxer(),
+		ctx:           ctx,
+		srv:           srv,
+		streamName:    streamName,
+		programNumber: programNumber,
+		conn:          conn,
+		demuxer:       ts.NewTSDemuxer(),
 	}
 
-	nazalog.Infof("create srt publisher, streamName:%s", streamName)
+	nazalog.Infof("create srt publisher, streamName:%s, programNumber:%d", streamName, programNumber)
 	return pub
 }
 
-func (p *Publisher) SetSession(session logic.ICustomizePubSessionContext) {
+func (p *Publisher) SetSession(session *hook.PubSession) {
 	p.ss = session
 }
 
+// Kick 被踢掉或者被新的推流接管时断开连接
+func (p *Publisher) Kick() {
+	p.conn.Close()
+}
+
 func (p *Publisher) Run() {
 	defer func() {
 		p.conn.Close()
-		p.srv.Remove(p.streamName, p.ss)
+		p.srv.Remove(p.ss)
 	}()
-	audioSampleRate := uint32(0)
-	var foundAudio bool
-	p.demuxer.OnFrame = func(cid ts.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64) {
-		var pkt base.AvPacket
-		if cid == ts.TS_STREAM_AAC {
-			if !foundAudio {
-				if asc, err := codec.ConvertADTSToASC(frame); err != nil {
-					return
-				} else {
-					p.ss.FeedAudioSpecificConfig(asc.Encode())
-					audioSampleRate = uint32(codec.AACSampleIdxToSample(int(asc.Sample_freq_index)))
-				}
-
-				foundAudio = true
-			}
 
-			var preAudioDts uint64
-			ctx := aac.AdtsHeaderContext{}
-			for len(frame) > aac.AdtsHeaderLength {
-				ctx.Unpack(frame[:])
-				if preAudioDts == 0 {
-					preAudioDts = dts
-				} else {
-					preAudioDts += uint64(1024 * 1000 / audioSampleRate)
-				}
-
-				aacPacket := base.AvPacket{
-					Timestamp:   int64(preAudioDts),
-					PayloadType: base.AvPacketPtAac,
-					Pts:         int64(preAudioDts),
-				}
-				if len(frame) >= int(ctx.AdtsLength) {
-					Payload := frame[aac.AdtsHeaderLength:ctx.AdtsLength]
-					if len(frame) > int(ctx.AdtsLength) {
-						frame = frame[ctx.AdtsLength:]
-					} else {
-						frame = frame[0:0]
-					}
-					aacPacket.Payload = Payload
-					p.ss.FeedAvPacket(aacPacket)
-				}
+	selector := newTsProgramSelector(p.conn, p.programNumber)
+	selector.onPrivateFrame = p.onFrame
+	p.demuxer.OnFrame = p.onFrame
+
+	err := p.demuxer.Input(selector)
+	if err != nil {
+		nazalog.Infof("stream [%s] disconnected", p.streamName)
+	}
+}
+
+func (p *Publisher) onFrame(cid ts.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64) {
+	fixedPts, fixedDts := p.timestamp.fix(pts, dts)
+
+	switch cid {
+	case ts.TS_STREAM_H264:
+		p.feedVideo(base.AvPacketPtAvc, frame, fixedPts, fixedDts)
+	case ts.TS_STREAM_H265:
+		p.feedVideo(base.AvPacketPtHevc, frame, fixedPts, fixedDts)
+	case ts.TS_STREAM_AAC:
+		p.feedAac(frame, fixedDts)
+	case ts.TS_STREAM_AUDIO_MPEG1, ts.TS_STREAM_AUDIO_MPEG2:
+		p.feedMp3(frame, fixedDts)
+	case tsStreamOpus:
+		p.feedOpus(frame, fixedDts)
+	case tsStreamG711A:
+		p.feedAudio(base.AvPacketPtG711A, frame, fixedDts)
+	case tsStreamG711U:
+		p.feedAudio(base.AvPacketPtG711U, frame, fixedDts)
+	}
+}
+
+func (p *Publisher) feedVideo(payloadType base.AvPacketPt, frame []byte, pts, dts int64) {
+	p.ss.FeedAvPacket(base.AvPacket{
+		PayloadType: payloadType,
+		Timestamp:   dts,
+		Pts:         pts,
+		Payload:     frame,
+	})
+}
+
+func (p *Publisher) feedAudio(payloadType base.AvPacketPt, frame []byte, dts int64) {
+	p.ss.FeedAvPacket(base.AvPacket{
+		PayloadType: payloadType,
+		Timestamp:   dts,
+		Pts:         dts,
+		Payload:     append([]byte(nil), frame...),
+	})
+}
+
+// feedAac 一个PES中可能包含多个ADTS帧，每个ADTS帧也可能包含多个raw data block，
+// 按照实际的采样数计算每一帧的时间戳
+func (p *Publisher) feedAac(frame []byte, dts int64) {
+	if !p.foundAudio {
+		asc, err := codec.ConvertADTSToASC(frame)
+		if err != nil {
+			return
+		}
+		p.ss.FeedAudioSpecificConfig(asc.Encode())
+		p.foundAudio = true
+	}
+
+	var samples uint64
+	var ctx aac.AdtsHeaderContext
+	for len(frame) >= aac.AdtsHeaderLength {
+		if err := ctx.Unpack(frame); err != nil {
+			return
+		}
+
+		frameLength := int(ctx.AdtsLength)
+		headerLength := aac.AdtsHeaderLength
+		if frame[1]&0x01 == 0 {
+			// protection_absent为0时带2字节CRC
+			headerLength += 2
+		}
+		if frameLength <= headerLength || frameLength > len(frame) {
+			nazalog.Warnf("invalid adts frame, streamName:%s, adtsLength:%d, remain:%d", p.streamName, frameLength, len(frame))
+			return
+		}
+
+		sampleRate, err := ctx.AscCtx.GetSamplingFrequency()
+		if err != nil || sampleRate == 0 {
+			return
+		}
+		timestamp := dts + int64(samples*1000/uint64(sampleRate))
+		p.ss.FeedAvPacket(base.AvPacket{
+			PayloadType: base.AvPacketPtAac,
+			Timestamp:   timestamp,
+			Pts:         timestamp,
+			Payload:     frame[headerLength:frameLength],
+		})
+
+		rawDataBlocks := uint64(frame[6]&0x03) + 1
+		samples += rawDataBlocks * 1024
+		frame = frame[frameLength:]
+	}
+}
+
+// feedOpus 解析ETSI TS 102 366附录中定义的opus_control_header，一个PES中可能有多个opus包
+func (p *Publisher) feedOpus(frame []byte, dts int64) {
+	var duration int64
+	for len(frame) > 2 {
+		if frame[0] != 0x7f || frame[1]&0xe0 != 0xe0 {
+			nazalog.Warnf("invalid opus control header, streamName:%s", p.streamName)
+			return
+		}
+		startTrim := frame[1]&0x10 != 0
+		endTrim := frame[1]&0x08 != 0
+		controlExtension := frame[1]&0x04 != 0
 
+		pos := 2
+		size := 0
+		for pos < len(frame) {
+			b := frame[pos]
+			pos++
+			size += int(b)
+			if b != 0xff {
+				break
+			}
+		}
+		if startTrim {
+			pos += 2
+		}
+		if endTrim {
+			pos += 2
+		}
+		if controlExtension {
+			if pos >= len(frame) {
+				return
 			}
-		} else if cid == ts.TS_STREAM_H264 {
-			pkt.Payload = frame
-			pkt.PayloadType = base.AvPacketPtAvc
-			pkt.Pts = int64(pts)
-			pkt.Timestamp = int64(dts)
-			p.ss.FeedAvPacket(pkt)
-		} else if cid == ts.TS_STREAM_H265 {
-			pkt.Payload = frame
-			pkt.PayloadType = base.AvPacketPtHevc
-			pkt.Pts = int64(pts)
-			pkt.Timestamp = int64(dts)
-			p.ss.FeedAvPacket(pkt)
+			pos += 1 + int(frame[pos])
 		}
+		if size == 0 || pos+size > len(frame) {
+			return
+		}
+
+		packet := frame[pos : pos+size]
+		p.feedAudio(base.AvPacketPtOpus, packet, dts+duration)
+		duration += opusPacketDurationMs(packet)
+		frame = frame[pos+size:]
 	}
-	err := p.demuxer.Input(bufio.NewReader(p.conn))
-	if err != nil {
-		nazalog.Infof("stream [%s] disconnected", p.streamName)
+}
+
+// opusPacketDurationMs 根据TOC计算一个opus包的时长
+func opusPacketDurationMs(packet []byte) int64 {
+	if len(packet) == 0 {
+		return 0
+	}
+	toc := packet[0]
+	config := toc >> 3
+
+	// 以48kHz下的采样数表示单帧时长
+	var frameSamples int64
+	switch {
+	case config < 12:
+		// SILK: 10, 20, 40, 60ms
+		frameSamples = []int64{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		// Hybrid: 10, 20ms
+		frameSamples = []int64{480, 960}[config%2]
+	default:
+		// CELT: 2.5, 5, 10, 20ms
+		frameSamples = []int64{120, 240, 480, 960}[config%4]
+	}
+
+	var frameCount int64
+	switch toc & 0x03 {
+	case 0:
+		frameCount = 1
+	case 1, 2:
+		frameCount = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		frameCount = int64(packet[1] & 0x3f)
+	}
+
+	return frameSamples * frameCount / 48
+}
+
+// feedMp3 lal的AvPacket不支持mp3，直接以rtmp消息的方式输入
+func (p *Publisher) feedMp3(frame []byte, dts int64) {
+	soundHeader, ok := rtmpMp3SoundHeader(frame)
+	if !ok {
+		nazalog.Warnf("invalid mp3 frame header, streamName:%s", p.streamName)
+		return
+	}
+	payload := make([]byte, len(frame)+1)
+	payload[0] = soundHeader
+	copy(payload[1:], frame)
+
+	var msg base.RtmpMsg
+	msg.Header.Csid = rtmp.CsidAudio
+	msg.Header.MsgStreamId = rtmp.Msid1
+	msg.Header.MsgTypeId = base.RtmpTypeIdAudio
+	msg.Header.MsgLen = uint32(len(payload))
+	msg.Header.TimestampAbs = uint32(dts)
+	msg.Payload = payload
+	if err := p.ss.FeedRtmpMsg(msg); err != nil {
+		nazalog.Warnf("feed mp3 failed, streamName:%s, err:%+v", p.streamName, err)
+	}
+}
+
+// rtmpMp3SoundHeader 根据MPEG音频帧头生成rtmp的音频头，固定16bits，
+// rtmp只能表示5.5/11/22/44kHz，按MPEG版本对应到相近的采样率
+func rtmpMp3SoundHeader(frame []byte) (byte, bool) {
+	if len(frame) < 4 || frame[0] != 0xff || frame[1]&0xe0 != 0xe0 {
+		return 0, false
+	}
+	version := (frame[1] >> 3) & 0x03
+	layer := (frame[1] >> 1) & 0x03
+	sampleRateIndex := (frame[2] >> 2) & 0x03
+	if version == 0x01 || layer == 0x00 || sampleRateIndex == 0x03 {
+		return 0, false
+	}
+
+	var rate byte
+	switch version {
+	case 0x03:
+		// MPEG-1: 44.1/48/32kHz
+		rate = 3
+	case 0x02:
+		// MPEG-2: 22.05/24/16kHz
+		rate = 2
+	default:
+		// MPEG-2.5: 11.025/12/8kHz
+		rate = 1
+	}
+
+	var stereo byte = 1
+	if frame[3]>>6 == 0x03 {
+		stereo = 0
 	}
-	return
+	return 2<<4 | rate<<2 | 1<<1 | stereo, true
 }
@@ -0,0 +1,52 @@
+package srt
+
+import "testing"
+
+func TestRtmpMp3SoundHeader(t *testing.T) {
+	testCases := []struct {
+		name   string
+		frame  []byte
+		expect byte
+		ok     bool
+	}{
+		// MPEG-1 Layer3 44.1kHz 立体声
+		{"mpeg1 stereo", []byte{0xff, 0xfb, 0x90, 0x00}, 0x2f, true},
+		// MPEG-1 Layer3 48kHz 单声道
+		{"mpeg1 mono", []byte{0xff, 0xfb, 0x94, 0xc0}, 0x2e, true},
+		// MPEG-2 Layer3 22.05kHz 联合立体声
+		{"mpeg2 joint stereo", []byte{0xff, 0xf3, 0x90, 0x40}, 0x2b, true},
+		// MPEG-2.5 Layer3 8kHz 单声道
+		{"mpeg2.5 mono", []byte{0xff, 0xe3, 0x18, 0xc0}, 0x26, true},
+		{"reserved version", []byte{0xff, 0xeb, 0x90, 0x00}, 0, false},
+		{"reserved sample rate", []byte{0xff, 0xfb, 0x9c, 0x00}, 0, false},
+		{"no sync", []byte{0x00, 0xfb, 0x90, 0x00}, 0, false},
+		{"short", []byte{0xff, 0xfb}, 0, false},
+	}
+	for _, tc := range testCases {
+		header, ok := rtmpMp3SoundHeader(tc.frame)
+		if ok != tc.ok || header != tc.expect {
+			t.Fatalf("%s: expect:0x%x %v, got:0x%x %v", tc.name, tc.expect, tc.ok, header, ok)
+		}
+	}
+}
+
+func TestOpusPacketDurationMs(t *testing.T) {
+	testCases := []struct {
+		packet []byte
+		expect int64
+	}{
+		// SILK 20ms 单帧
+		{[]byte{0x08}, 20},
+		// CELT 20ms 两帧
+		{[]byte{0xf9}, 40},
+		// CELT 2.5ms code 3 共8帧
+		{[]byte{0x83, 0x08}, 20},
+		{[]byte{0x03}, 0},
+		{nil, 0},
+	}
+	for _, tc := range testCases {
+		if out := opusPacketDurationMs(tc.packet); out != tc.expect {
+			t.Fatalf("packet:%x, expect:%d, got:%d", tc.packet, tc.expect, out)
+		}
+	}
+}
@@ -2,19 +2,31 @@ package srt
 
 import (
 	"context"
+	"net"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	srt "github.com/datarhei/gosrt"
 	"github.com/q191201771/lal/pkg/base"
 	"github.com/q191201771/lal/pkg/logic"
+	"github.com/q191201771/lalmax/auth"
+	"github.com/q191201771/lalmax/hook"
 	"github.com/q191201771/naza/pkg/nazalog"
 )
 
 type SrtServer struct {
-	addr      string
-	lalServer logic.ILalServer
-	srtOpt    SrtOption
+	addr       string
+	lalServer  logic.ILalServer
+	pubManager *hook.PubSessionManager
+	srtOpt     SrtOption
+	auth       auth.IAuthenticator
+
+	listenerMutex sync.Mutex
+	listener      srt.Listener
+	disposed      bool
 }
 type SrtOption struct {
 	Latency           int
@@ -40,21 +52,26 @@ var defaultSrtOption = SrtOption{
 
 type ModSrtOption func(option *SrtOption)
 
-func NewSrtServer(addr string, lal logic.ILalServer, modOptions ...ModSrtOption) *SrtServer {
+func NewSrtServer(addr string, lal logic.ILalServer, pubManager *hook.PubSessionManager, modOptions ...ModSrtOption) *SrtServer {
 	opt := defaultSrtOption
 	for _, fn := range modOptions {
 		fn(&opt)
 	}
 	svr := &SrtServer{
-		addr:      addr,
-		lalServer: lal,
-		srtOpt:    opt,
+		addr:       addr,
+		lalServer:  lal,
+		pubManager: pubManager,
+		srtOpt:     opt,
 	}
 
 	nazalog.Info("create srt server")
 	return svr
 }
 
+func (s *SrtServer) SetAuthenticator(authenticator auth.IAuthenticator) {
+	s.auth = authenticator
+}
+
 func (s *SrtServer) Run(ctx context.Context) {
 	conf := srt.DefaultConfig()
 	conf.Latency = time.Millisecond * time.Duration(s.srtOpt.Latency)
@@ -70,7 +87,15 @@ func (s *SrtServer) Run(ctx context.Context) {
 		panic(err)
 	}
 
-	defer srtlistener.Close()
+	s.listenerMutex.Lock()
+	if s.disposed {
+		s.listenerMutex.Unlock()
+		srtlistener.Close()
+		return
+	}
+	s.listener = srtlistener
+	s.listenerMutex.Unlock()
+	defer s.Dispose()
 
 	nazalog.Info("srt server listen addr:", s.addr)
 
@@ -82,12 +107,16 @@ func (s *SrtServer) Run(ctx context.Context) {
 
 		}
 
+		// Accept的回调是同步执行的，鉴权(可能是http回调)放到每个连接自己的协程中，避免阻塞其他连接的握手
 		var info StreamInfo
 		conn, mode, err := srtlistener.Accept(func(req srt.ConnRequest) srt.ConnType {
 			info = getStreamInfo(req.StreamId())
 			return info.Mode
 		})
 
+		if err == srt.ErrListenerClosed {
+			return
+		}
 		if err != nil {
 			// rejected connection, ignore
 			continue
@@ -98,27 +127,54 @@ func (s *SrtServer) Run(ctx context.Context) {
 			continue
 		}
 
-		if info.Mode == srt.PUBLISH {
-			go s.handlePublish(ctx, conn, info.StreamName)
-		} else {
-			go s.handleSubcribe(ctx, conn, info.StreamName)
-		}
+		go s.handleConn(ctx, conn, info)
 	}
 }
 
-func (s *SrtServer) handlePublish(ctx context.Context, conn srt.Conn, streamid string) {
-	publisher := NewPublisher(ctx, conn, streamid, s)
-	session, err := s.lalServer.AddCustomizePubSession(streamid)
-	if err != nil {
-		nazalog.Error(err)
+func (s *SrtServer) handleConn(ctx context.Context, conn srt.Conn, info StreamInfo) {
+	if !s.authenticate(info, conn.RemoteAddr()) {
+		conn.Close()
+		return
 	}
 
-	if session != nil {
-		session.WithOption(func(option *base.AvPacketStreamOption) {
-			option.VideoFormat = base.AvPacketStreamVideoFormatAnnexb
-		})
+	if info.Mode == srt.PUBLISH {
+		s.handlePublish(ctx, conn, info)
+	} else {
+		s.handleSubcribe(ctx, conn, info.StreamName)
+	}
+}
+
+// Dispose 关闭监听，已经建立的连接通过Run的ctx关闭
+func (s *SrtServer) Dispose() {
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+	if s.disposed {
+		return
+	}
+	s.disposed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+func (s *SrtServer) handlePublish(ctx context.Context, conn srt.Conn, info StreamInfo) {
+	publisher := NewPublisher(ctx, conn, info.StreamName, info.ProgramNumber, s)
+	session, err := s.pubManager.AddPubSession(info.StreamName, publisher, hook.SessionInfo{
+		Protocol:   auth.ProtocolSrt,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Url:        conn.StreamId(),
+		RawQuery:   info.Query.Encode(),
+	})
+	if err != nil {
+		nazalog.Errorf("srt publish failed, streamName:%s, err:%+v", info.StreamName, err)
+		conn.Close()
+		return
 	}
 
+	session.WithOption(func(option *base.AvPacketStreamOption) {
+		option.VideoFormat = base.AvPacketStreamVideoFormatAnnexb
+	})
+
 	publisher.SetSession(session)
 	publisher.Run()
 }
@@ -128,24 +184,51 @@ func (s *SrtServer) handleSubcribe(ctx context.Context, conn srt.Conn, streamid
 	subscriber.Run()
 }
 
-func (s *SrtServer) Remove(host string, ss logic.ICustomizePubSessionContext) {
-	s.lalServer.DelCustomizePubSession(ss)
+func (s *SrtServer) authenticate(info StreamInfo, remoteAddr net.Addr) bool {
+	if s.auth == nil {
+		return true
+	}
+
+	authInfo := auth.AuthInfo{
+		Protocol:   auth.ProtocolSrt,
+		Action:     auth.ActionSub,
+		StreamName: info.StreamName,
+		RemoteAddr: remoteAddr.String(),
+		Query:      info.Query,
+	}
+	if info.Mode == srt.PUBLISH {
+		authInfo.Action = auth.ActionPub
+	}
+	if host, _, err := net.SplitHostPort(authInfo.RemoteAddr); err == nil {
+		authInfo.ClientIp = host
+	}
+	return s.auth.Authenticate(authInfo) == nil
+}
+
+func (s *SrtServer) Remove(ss *hook.PubSession) {
+	s.pubManager.DelPubSession(ss)
 }
 
 type StreamInfo struct {
-	StreamName string
-	Mode    srt.ConnType
+	StreamName    string
+	Mode          srt.ConnType
+	ProgramNumber uint16     // 多节目TS流中选择的节目号，对应PMT中的program_number，0表示第一个节目
+	Query         url.Values // 其他参数，用于鉴权，例如 #!::h=test110,m=publish,token=xxx
 }
 
 func getStreamInfo(streamid string) StreamInfo {
 	info := StreamInfo{
-		Mode: srt.REJECT,
+		Mode:  srt.REJECT,
+		Query: url.Values{},
 	}
 
 	s := strings.TrimLeft(streamid, "#!::")
 	values := strings.Split(s, ",")
 	for _, v := range values {
 		ss := strings.Split(v, "=")
+		if len(ss) != 2 {
+			continue
+		}
 		name := ss[0]
 		switch name {
 		case "h":
@@ -157,6 +240,12 @@ func getStreamInfo(streamid string) StreamInfo {
 			case "request":
 				info.Mode = srt.SUBSCRIBE
 			}
+		case "pn":
+			if pn, err := strconv.ParseUint(ss[1], 10, 16); err == nil {
+				info.ProgramNumber = uint16(pn)
+			}
+		default:
+			info.Query.Set(name, ss[1])
 		}
 	}
 
@@ -3,6 +3,7 @@ package srt
 import (
 	"context"
 
+	"github.com/q191201771/lalmax/auth"
 	"github.com/q191201771/lalmax/hook"
 
 	srt "github.com/datarhei/gosrt"
@@ -51,7 +52,15 @@ func (s *Subscriber) Run() {
 	if ok {
 		var err error
 		sendBuf := make([]byte, 0, s.maxSendPacketSize*ts.TS_PAKCET_SIZE)
-		session.AddConsumer(s.subscriberId, s)
+		err = session.AddConsumer(s.subscriberId, s, hook.SessionInfo{
+			Protocol:   auth.ProtocolSrt,
+			RemoteAddr: s.conn.RemoteAddr().String(),
+			Url:        s.conn.StreamId(),
+		})
+		if err != nil {
+			s.conn.Close()
+			return
+		}
 		s.muxer.OnPacket = func(tsPacket []byte) {
 			defer func() {
 				if err != nil {
@@ -0,0 +1,68 @@
+package srt
+
+const (
+	// tsWrapMs 33位的PTS/DTS(90kHz)换算成毫秒后的回绕周期，约26.5小时
+	tsWrapMs = int64((1 << 33) / 90)
+
+	// tsDiscontinuityMs 相邻两帧时间戳跳变超过该值时认为出现了断流/编码器重启
+	tsDiscontinuityMs = int64(10000)
+)
+
+// timestampFixer 将TS中的毫秒级PTS/DTS转换成从0开始、单调连续的时间戳
+//
+// 同一个节目的音视频共用一个 timestampFixer，保证回绕和跳变修正后音视频依然同步
+type timestampFixer struct {
+	inited     bool
+	wrapOffset int64 // 回绕累计的偏移
+	jumpOffset int64 // 跳变累计的偏移
+	lastDts    int64 // 上一次展开回绕后的dts
+	lastOutDts int64 // 上一次输出的dts
+}
+
+func (f *timestampFixer) fix(pts, dts uint64) (int64, int64) {
+	rawDts := int64(dts)
+	rawPts := int64(pts)
+
+	if !f.inited {
+		f.inited = true
+		f.lastDts = rawDts
+		f.jumpOffset = -rawDts
+		f.lastOutDts = 0
+		return rawPts - rawDts, 0
+	}
+
+	unwrappedDts := f.unwrap(rawDts)
+
+	// pts与dts相差不会超过回绕周期的一半，按dts对齐
+	unwrappedPts := rawPts + f.wrapOffset
+	if unwrappedPts-unwrappedDts > tsWrapMs/2 {
+		unwrappedPts -= tsWrapMs
+	} else if unwrappedDts-unwrappedPts > tsWrapMs/2 {
+		unwrappedPts += tsWrapMs
+	}
+
+	diff := unwrappedDts - f.lastDts
+	if diff > tsDiscontinuityMs || diff < -tsDiscontinuityMs {
+		// 时间戳跳变，从上一次的输出时间继续
+		f.jumpOffset = f.lastOutDts - unwrappedDts
+	}
+	f.lastDts = unwrappedDts
+
+	outDts := unwrappedDts + f.jumpOffset
+	outPts := unwrappedPts + f.jumpOffset
+	f.lastOutDts = outDts
+	return outPts, outDts
+}
+
+func (f *timestampFixer) unwrap(raw int64) int64 {
+	v := raw + f.wrapOffset
+	if v-f.lastDts < -tsWrapMs/2 {
+		// 时间戳回绕
+		f.wrapOffset += tsWrapMs
+		v += tsWrapMs
+	} else if v-f.lastDts > tsWrapMs/2 {
+		// 回绕之前的迟到数据
+		v -= tsWrapMs
+	}
+	return v
+}
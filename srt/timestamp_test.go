@@ -0,0 +1,36 @@
+package srt
+
+import "testing"
+
+func TestTimestampFixer(t *testing.T) {
+	t.Run("wrap", func(t *testing.T) {
+		var f timestampFixer
+		start := uint64(tsWrapMs - 100)
+		if _, dts := f.fix(start, start); dts != 0 {
+			t.Fatalf("first dts expect 0, got %d", dts)
+		}
+		// 音频先回绕
+		if _, dts := f.fix(20, 20); dts != 120 {
+			t.Fatalf("wrapped dts expect 120, got %d", dts)
+		}
+		// 回绕之前的迟到视频帧
+		if _, dts := f.fix(start+40, start+40); dts != 40 {
+			t.Fatalf("late dts expect 40, got %d", dts)
+		}
+		if pts, dts := f.fix(100, 60); dts != 160 || pts != 200 {
+			t.Fatalf("expect pts 200 dts 160, got pts %d dts %d", pts, dts)
+		}
+	})
+
+	t.Run("discontinuity", func(t *testing.T) {
+		var f timestampFixer
+		f.fix(1000, 1000)
+		f.fix(1040, 1040)
+		if _, dts := f.fix(500000, 500000); dts != 40 {
+			t.Fatalf("jump dts expect 40, got %d", dts)
+		}
+		if _, dts := f.fix(500040, 500040); dts != 80 {
+			t.Fatalf("dts after jump expect 80, got %d", dts)
+		}
+	})
+}
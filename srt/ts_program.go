@@ -0,0 +1,292 @@
+package srt
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/q191201771/naza/pkg/nazalog"
+	codec "github.com/yapingcat/gomedia/go-codec"
+	ts "github.com/yapingcat/gomedia/go-mpeg2"
+)
+
+// gomedia不支持的私有音频流类型
+const (
+	tsStreamPrivate ts.TS_STREAM_TYPE = 0x06  // PES私有数据，配合registration descriptor "Opus"使用
+	tsStreamOpus    ts.TS_STREAM_TYPE = 0x106 // 非标准值，仅用于内部区分带Opus描述符的私有流
+	tsStreamG711A   ts.TS_STREAM_TYPE = 0x90
+	tsStreamG711U   ts.TS_STREAM_TYPE = 0x91
+)
+
+const (
+	tsPidPat            = 0x0000
+	tsDescRegistration  = 0x05
+	tsPesMaxPayloadSize = 64 * 1024
+)
+
+type tsPrivateStream struct {
+	cid ts.TS_STREAM_TYPE
+	pes *ts.PesPacket
+	buf []byte
+	pts uint64
+	dts uint64
+}
+
+// tsProgramSelector 解析PAT/PMT，只把选中节目的TS包交给gomedia的TSDemuxer，
+// 多节目的TS流中其余节目的数据会被丢弃。
+//
+// gomedia不处理的私有音频流(opus、g711)在这里自行组PES，通过 onPrivateFrame 回调出去，
+// 回调的时间戳单位与gomedia一致，都是毫秒
+type tsProgramSelector struct {
+	r             *bufio.Reader
+	programNumber uint16 // 为0时选择PAT中的第一个节目
+	pmtPid        int
+	pmtVersion    int
+
+	demuxPids      map[uint16]bool
+	privateStreams map[uint16]*tsPrivateStream
+
+	onPrivateFrame func(cid ts.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64)
+
+	pending []byte
+}
+
+func newTsProgramSelector(r io.Reader, programNumber uint16) *tsProgramSelector {
+	return &tsProgramSelector{
+		r:              bufio.NewReader(r),
+		programNumber:  programNumber,
+		pmtPid:         -1,
+		pmtVersion:     -1,
+		demuxPids:      make(map[uint16]bool),
+		privateStreams: make(map[uint16]*tsPrivateStream),
+	}
+}
+
+// Read 实现io.Reader，输出的都是以0x47开头的完整TS包
+func (s *tsProgramSelector) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		pkt, err := s.readPacket()
+		if err != nil {
+			s.flush()
+			return 0, err
+		}
+		if s.filter(pkt) {
+			s.pending = pkt
+		}
+	}
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *tsProgramSelector) readPacket() ([]byte, error) {
+	for {
+		b, err := s.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == 0x47 {
+			break
+		}
+		// 丢弃到下一个同步字节
+		_, _ = s.r.Discard(1)
+	}
+
+	pkt := make([]byte, ts.TS_PAKCET_SIZE)
+	if _, err := io.ReadFull(s.r, pkt); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// filter 返回true表示该TS包需要交给gomedia处理
+func (s *tsProgramSelector) filter(pkt []byte) bool {
+	pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+	pusi := pkt[1]&0x40 != 0
+	payload := tsPacketPayload(pkt)
+
+	switch {
+	case pid == tsPidPat:
+		if pusi && payload != nil {
+			s.parsePat(payload)
+		}
+		return true
+	case int(pid) == s.pmtPid:
+		if pusi && payload != nil {
+			s.parsePmt(payload)
+		}
+		return true
+	case s.demuxPids[pid]:
+		return true
+	}
+
+	if stream, ok := s.privateStreams[pid]; ok && payload != nil {
+		s.feedPrivate(stream, payload, pusi)
+	}
+	return false
+}
+
+func tsPacketPayload(pkt []byte) []byte {
+	afc := (pkt[3] >> 4) & 0x03
+	switch afc {
+	case 0x01:
+		return pkt[4:]
+	case 0x03:
+		start := 5 + int(pkt[4])
+		if start >= len(pkt) {
+			return nil
+		}
+		return pkt[start:]
+	}
+	return nil
+}
+
+// tsSection 跳过pointer field，返回section数据(去掉CRC)
+func tsSection(payload []byte) []byte {
+	if len(payload) < 1 {
+		return nil
+	}
+	start := 1 + int(payload[0])
+	if start+3 > len(payload) {
+		return nil
+	}
+	section := payload[start:]
+	sectionLength := int(section[1]&0x0f)<<8 | int(section[2])
+	if 3+sectionLength > len(section) || sectionLength < 9 {
+		return nil
+	}
+	return section[:3+sectionLength-4]
+}
+
+func (s *tsProgramSelector) parsePat(payload []byte) {
+	section := tsSection(payload)
+	if section == nil || section[0] != 0x00 {
+		return
+	}
+
+	for i := 8; i+4 <= len(section); i += 4 {
+		programNumber := uint16(section[i])<<8 | uint16(section[i+1])
+		pid := int(section[i+2]&0x1f)<<8 | int(section[i+3])
+		if programNumber == 0 {
+			// network PID
+			continue
+		}
+		if s.programNumber == 0 || s.programNumber == programNumber {
+			if s.pmtPid != pid {
+				nazalog.Infof("srt select ts program, programNumber:%d, pmtPid:%d", programNumber, pid)
+				s.programNumber = programNumber
+				s.pmtPid = pid
+				s.pmtVersion = -1
+			}
+			return
+		}
+	}
+
+	if s.pmtPid == -1 {
+		nazalog.Warnf("srt ts program not found in pat, programNumber:%d", s.programNumber)
+	}
+}
+
+func (s *tsProgramSelector) parsePmt(payload []byte) {
+	section := tsSection(payload)
+	if section == nil || section[0] != 0x02 {
+		return
+	}
+	programNumber := uint16(section[3])<<8 | uint16(section[4])
+	version := int(section[5]>>1) & 0x1f
+	if programNumber != s.programNumber || version == s.pmtVersion {
+		return
+	}
+	s.pmtVersion = version
+
+	programInfoLength := int(section[10]&0x0f)<<8 | int(section[11])
+	demuxPids := make(map[uint16]bool)
+	privateStreams := make(map[uint16]*tsPrivateStream)
+	for i := 12 + programInfoLength; i+5 <= len(section); {
+		streamType := ts.TS_STREAM_TYPE(section[i])
+		pid := uint16(section[i+1]&0x1f)<<8 | uint16(section[i+2])
+		esInfoLength := int(section[i+3]&0x0f)<<8 | int(section[i+4])
+		end := i + 5 + esInfoLength
+		if end > len(section) {
+			break
+		}
+		descriptors := section[i+5 : end]
+		i = end
+
+		switch streamType {
+		case ts.TS_STREAM_AAC, ts.TS_STREAM_AUDIO_MPEG1, ts.TS_STREAM_AUDIO_MPEG2, ts.TS_STREAM_H264, ts.TS_STREAM_H265:
+			demuxPids[pid] = true
+		case tsStreamPrivate:
+			if isOpusDescriptor(descriptors) {
+				privateStreams[pid] = s.privateStream(pid, tsStreamOpus)
+			}
+		case tsStreamG711A, tsStreamG711U:
+			privateStreams[pid] = s.privateStream(pid, streamType)
+		default:
+			nazalog.Warnf("srt unsupported ts stream type:0x%x, pid:%d", int(streamType), pid)
+		}
+	}
+
+	s.demuxPids = demuxPids
+	s.privateStreams = privateStreams
+}
+
+func (s *tsProgramSelector) privateStream(pid uint16, cid ts.TS_STREAM_TYPE) *tsPrivateStream {
+	if stream, ok := s.privateStreams[pid]; ok && stream.cid == cid {
+		return stream
+	}
+	return &tsPrivateStream{cid: cid, pes: ts.NewPesPacket()}
+}
+
+func isOpusDescriptor(descriptors []byte) bool {
+	for i := 0; i+2 <= len(descriptors); {
+		tag := descriptors[i]
+		length := int(descriptors[i+1])
+		if i+2+length > len(descriptors) {
+			return false
+		}
+		if tag == tsDescRegistration && length >= 4 && string(descriptors[i+2:i+6]) == "Opus" {
+			return true
+		}
+		i += 2 + length
+	}
+	return false
+}
+
+func (s *tsProgramSelector) feedPrivate(stream *tsPrivateStream, payload []byte, pusi bool) {
+	if pusi {
+		s.emitPrivate(stream)
+
+		// PES跨多个TS包时Decode会返回需要更多数据的错误，此时payload已经可用
+		stream.pes.Pes_payload = nil
+		if err := stream.pes.Decode(codec.NewBitStream(payload)); err != nil && stream.pes.Pes_payload == nil {
+			stream.buf = stream.buf[:0]
+			return
+		}
+		stream.pts = stream.pes.Pts
+		stream.dts = stream.pes.Dts
+		stream.buf = append(stream.buf[:0], stream.pes.Pes_payload...)
+		return
+	}
+
+	if len(stream.buf) == 0 || len(stream.buf)+len(payload) > tsPesMaxPayloadSize {
+		return
+	}
+	stream.buf = append(stream.buf, payload...)
+}
+
+func (s *tsProgramSelector) emitPrivate(stream *tsPrivateStream) {
+	if len(stream.buf) == 0 {
+		return
+	}
+	if s.onPrivateFrame != nil {
+		s.onPrivateFrame(stream.cid, stream.buf, stream.pts/90, stream.dts/90)
+	}
+	stream.buf = stream.buf[:0]
+}
+
+func (s *tsProgramSelector) flush() {
+	for _, stream := range s.privateStreams {
+		s.emitPrivate(stream)
+	}
+}
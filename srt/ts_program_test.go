@@ -0,0 +1,155 @@
+package srt
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	ts "github.com/yapingcat/gomedia/go-mpeg2"
+)
+
+// tsTestPacket 不足184字节的payload用adaptation field填充
+func tsTestPacket(pid uint16, pusi bool, payload []byte) []byte {
+	pkt := make([]byte, 0, ts.TS_PAKCET_SIZE)
+	b1 := byte(pid>>8) & 0x1f
+	if pusi {
+		b1 |= 0x40
+	}
+	pkt = append(pkt, 0x47, b1, byte(pid))
+	if len(payload) >= 184 {
+		pkt = append(pkt, 0x10)
+		return append(pkt, payload[:184]...)
+	}
+	afl := 183 - len(payload)
+	pkt = append(pkt, 0x30, byte(afl))
+	if afl > 0 {
+		pkt = append(pkt, 0x00)
+		pkt = append(pkt, bytes.Repeat([]byte{0xff}, afl-1)...)
+	}
+	return append(pkt, payload...)
+}
+
+// tsTestSection 加上pointer field和section_length，CRC不校验，填0
+func tsTestSection(tableId byte, body []byte) []byte {
+	length := len(body) + 4
+	section := []byte{0x00, tableId, 0xb0 | byte(length>>8), byte(length)}
+	section = append(section, body...)
+	return append(section, 0, 0, 0, 0)
+}
+
+func tsTestPat(programs map[uint16]uint16, order []uint16) []byte {
+	body := []byte{0x00, 0x01, 0xc1, 0x00, 0x00}
+	for _, programNumber := range order {
+		pid := programs[programNumber]
+		body = append(body, byte(programNumber>>8), byte(programNumber), 0xe0|byte(pid>>8), byte(pid))
+	}
+	return tsTestSection(0x00, body)
+}
+
+type tsTestEs struct {
+	streamType  byte
+	pid         uint16
+	descriptors []byte
+}
+
+func tsTestPmt(programNumber uint16, streams []tsTestEs) []byte {
+	body := []byte{byte(programNumber >> 8), byte(programNumber), 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00}
+	for _, es := range streams {
+		body = append(body, es.streamType, 0xe0|byte(es.pid>>8), byte(es.pid), 0xf0, byte(len(es.descriptors)))
+		body = append(body, es.descriptors...)
+	}
+	return tsTestSection(0x02, body)
+}
+
+func tsTestPes(streamId byte, pts uint64, payload []byte) []byte {
+	pes := []byte{0x00, 0x00, 0x01, streamId, 0, 0, 0x80, 0x80, 0x05,
+		0x21 | byte(pts>>29)&0x0e, byte(pts >> 22), 0x01 | byte(pts>>14)&0xfe, byte(pts >> 7), 0x01 | byte(pts<<1)}
+	length := len(pes) - 6 + len(payload)
+	pes[4], pes[5] = byte(length>>8), byte(length)
+	return append(pes, payload...)
+}
+
+type tsTestFrame struct {
+	cid     ts.TS_STREAM_TYPE
+	payload string
+	pts     uint64
+}
+
+func TestTsProgramSelector(t *testing.T) {
+	opusDesc := []byte{tsDescRegistration, 0x04, 'O', 'p', 'u', 's'}
+	pat := tsTestPat(map[uint16]uint16{1: 0x1000, 2: 0x1001}, []uint16{1, 2})
+	pmt1 := tsTestPmt(1, []tsTestEs{{byte(ts.TS_STREAM_H264), 0x100, nil}, {byte(tsStreamG711U), 0x101, nil}})
+	pmt2 := tsTestPmt(2, []tsTestEs{
+		{byte(ts.TS_STREAM_H264), 0x200, nil},
+		{byte(tsStreamG711A), 0x201, nil},
+		{byte(tsStreamPrivate), 0x202, opusDesc},
+		// 没有Opus描述符的私有流不处理
+		{byte(tsStreamPrivate), 0x203, nil},
+	})
+
+	var stream []byte
+	for _, pkt := range [][]byte{
+		tsTestPacket(tsPidPat, true, pat),
+		tsTestPacket(0x1000, true, pmt1),
+		tsTestPacket(0x1001, true, pmt2),
+		tsTestPacket(0x100, true, tsTestPes(0xe0, 90000, []byte("video1"))),
+		tsTestPacket(0x101, true, tsTestPes(0xc0, 90000, []byte("g711u"))),
+		tsTestPacket(0x200, true, tsTestPes(0xe0, 90000, []byte("video2"))),
+		tsTestPacket(0x201, true, tsTestPes(0xc0, 90000, []byte("g711a"))),
+		tsTestPacket(0x202, true, tsTestPes(0xbd, 180000, []byte{0x7f, 0xe0, 0x04, 'o', 'p', 'u', 's'})),
+		tsTestPacket(0x203, true, tsTestPes(0xbd, 180000, []byte("private"))),
+	} {
+		stream = append(stream, pkt...)
+	}
+
+	testCases := []struct {
+		name          string
+		programNumber uint16
+		demuxPids     []uint16
+		frames        []tsTestFrame
+	}{
+		// 默认选择PAT中的第一个节目
+		{"first program", 0, []uint16{tsPidPat, 0x1000, 0x100}, []tsTestFrame{{tsStreamG711U, "g711u", 1000}}},
+		{"second program", 2, []uint16{tsPidPat, 0x1001, 0x200}, []tsTestFrame{{tsStreamG711A, "g711a", 1000}, {tsStreamOpus, "\x7f\xe0\x04opus", 2000}}},
+	}
+	for _, tc := range testCases {
+		s := newTsProgramSelector(bytes.NewReader(stream), tc.programNumber)
+		var frames []tsTestFrame
+		s.onPrivateFrame = func(cid ts.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64) {
+			frames = append(frames, tsTestFrame{cid, string(frame), pts})
+		}
+
+		out, err := io.ReadAll(s)
+		if err != nil {
+			t.Fatalf("%s: %+v", tc.name, err)
+		}
+		var pids []uint16
+		for i := 0; i+ts.TS_PAKCET_SIZE <= len(out); i += ts.TS_PAKCET_SIZE {
+			pids = append(pids, uint16(out[i+1]&0x1f)<<8|uint16(out[i+2]))
+		}
+		if len(pids) != len(tc.demuxPids) {
+			t.Fatalf("%s: expect pids:%v, got:%v", tc.name, tc.demuxPids, pids)
+		}
+		for i := range pids {
+			if pids[i] != tc.demuxPids[i] {
+				t.Fatalf("%s: expect pids:%v, got:%v", tc.name, tc.demuxPids, pids)
+			}
+		}
+
+		// 私有流的帧在下一个PES开始或者结束时输出，顺序不固定
+		if len(frames) != len(tc.frames) {
+			t.Fatalf("%s: expect frames:%v, got:%v", tc.name, tc.frames, frames)
+		}
+		for _, expect := range tc.frames {
+			found := false
+			for _, f := range frames {
+				if f == expect {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("%s: expect frame:%v in %v", tc.name, expect, frames)
+			}
+		}
+	}
+}